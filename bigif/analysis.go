@@ -0,0 +1,663 @@
+package bigif
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// Analysis is a report of structural problems found in a compiled StoryGraph.
+type Analysis struct {
+	DeadEnds           []DeadEnd    `json:"deadEnds"`
+	ShortestPaths      []EndingPath `json:"shortestPaths"`
+	UnreachableEndings []string     `json:"unreachableEndings"` // END knots never realized as nodes
+
+	// OneSidedConditions lists conditions that evaluated the same way on every
+	// reachable node: always false means the content or choice is never
+	// available, always true means the condition is redundant.
+	OneSidedConditions []ConditionCoverage `json:"oneSidedConditions"`
+
+	Scenes []SceneMetrics `json:"scenes"` // Pacing metrics per scene, ordered by scene name
+
+	Words WordMetrics `json:"words"`
+
+	// TrappedNodes lists, in order, the nodes from which no END node can be
+	// reached. TrapEntries are the edges that lead into that region from a
+	// node that could still reach an ending: the choices that doom the player.
+	TrappedNodes []string    `json:"trappedNodes"`
+	TrapEntries  []TrapEntry `json:"trapEntries"`
+
+	// NoteCounts counts the script's notes by kind, with every kind
+	// present, so a release build can require NoteCounts["FIXME"] == 0.
+	NoteCounts map[string]int `json:"noteCounts"`
+}
+
+// TrapEntry is a choice that leads from a node that can still reach an
+// ending into one that cannot.
+type TrapEntry struct {
+	SourceNodeID string `json:"sourceNodeId"`
+	Choice       string `json:"choice"`
+	TargetNodeID string `json:"targetNodeId"`
+}
+
+// WordMetrics summarizes the length of a story in words.
+type WordMetrics struct {
+	// Distinct is the word count of every distinct node content, so text
+	// shown in several states is counted once.
+	Distinct int `json:"distinct"`
+
+	// MinPath is the fewest words read on any path from the start node to
+	// an END node, counting every node on the path. Zero if no END node is
+	// reachable.
+	MinPath int `json:"minPath"`
+
+	// MaxPath is the most words read on a path to an END node. It is exact
+	// when the graph has no loops (MaxPathExact); otherwise it is the
+	// largest seen over the sampled playthroughs.
+	MaxPath      int  `json:"maxPath"`
+	MaxPathExact bool `json:"maxPathExact"`
+
+	// AvgPath is the average words read over Samples seeded random
+	// playthroughs (see Simulate) that reached an END node.
+	AvgPath float64 `json:"avgPath"`
+	Samples int     `json:"samples"`
+}
+
+// wordSamples is the number of simulated playthroughs used for AvgPath.
+const wordSamples = 1000
+
+// wordSampleSteps caps the choices of one sampled playthrough, so sampling
+// a large graph with loops costs at most wordSamples*wordSampleSteps steps.
+const wordSampleSteps = 2000
+
+// SceneMetrics describes the shape of the part of a graph in one scene.
+// Nodes without a scene are grouped under the empty scene name.
+type SceneMetrics struct {
+	Scene string `json:"scene"`
+	Nodes int    `json:"nodes"`
+
+	// LongestPath is the number of choices on the longest path that stays
+	// inside the scene. Loops are collapsed first: a path may pass through
+	// each node of a loop once, so for loops this is an upper bound.
+	LongestPath int `json:"longestPath"`
+
+	MinChoices int     `json:"minChoices"` // Fewest edges leaving a node of the scene
+	AvgChoices float64 `json:"avgChoices"`
+	MaxChoices int     `json:"maxChoices"`
+
+	EntryEdges int `json:"entryEdges"` // Edges from other scenes into this one
+	ExitEdges  int `json:"exitEdges"`  // Edges from this scene into other scenes
+}
+
+// ConditionCoverage describes a choice or text block condition that only
+// ever took one outcome.
+type ConditionCoverage struct {
+	KnotName  string `json:"knotName"`
+	Line      int    `json:"line"`
+	Choice    string `json:"choice,omitempty"` // Choice text, empty for a text block
+	Block     int    `json:"block,omitempty"`  // 1-based text block number, zero for a choice
+	Condition string `json:"condition"`
+	Visits    int    `json:"visits"`  // Reachable nodes on which the condition was evaluated
+	Outcome   bool   `json:"outcome"` // The only outcome observed
+}
+
+// String describes the finding, e.g. "cellar: choice 'Use the rope'
+// condition was false in all 12 visits".
+func (c ConditionCoverage) String() string {
+	subject := fmt.Sprintf("choice '%s'", c.Choice)
+	if c.Choice == "" {
+		subject = fmt.Sprintf("text block %d", c.Block)
+	}
+	msg := fmt.Sprintf("%s: %s condition was %t in all %d visits", c.KnotName, subject, c.Outcome, c.Visits)
+	if c.Outcome {
+		msg += " (condition is redundant)"
+	}
+	return msg
+}
+
+// DeadEnd describes a reachable node that is not an ending but offers no choices.
+type DeadEnd struct {
+	NodeID        string          `json:"nodeId"`
+	KnotName      string          `json:"knotName"`
+	State         map[string]bool `json:"state"`
+	HiddenChoices []HiddenChoice  `json:"hiddenChoices,omitempty"`
+}
+
+// HiddenChoice is a choice that was filtered out at a node because its condition failed.
+type HiddenChoice struct {
+	Text      string `json:"text"`
+	Condition string `json:"condition"`
+}
+
+// EndingPath is the shortest route from the start node to one ending node.
+type EndingPath struct {
+	NodeID     string     `json:"nodeId"`
+	KnotName   string     `json:"knotName"`
+	EndingName string     `json:"endingName,omitempty"`
+	Length     int        `json:"length"` // Number of choices taken
+	Path       []PathStep `json:"path"`
+}
+
+// PathStep is one node on a path and the choice taken to leave it. The final
+// step of a path has an empty Choice.
+type PathStep struct {
+	NodeID string `json:"nodeId"`
+	Choice string `json:"choice,omitempty"`
+}
+
+// Analyze inspects a compiled graph and reports its dead ends and the shortest
+// route to every ending. For each dead end it lists the choices whose
+// conditions failed in that state, which is usually the fastest way to see why
+// the player got stuck.
+func Analyze(graph *StoryGraph) *Analysis {
+	analysis := &Analysis{
+		DeadEnds:           findDeadEnds(graph),
+		ShortestPaths:      ShortestPaths(graph),
+		UnreachableEndings: unreachableEndings(graph),
+		OneSidedConditions: oneSidedConditions(graph),
+		Scenes:             sceneMetrics(graph),
+		Words:              wordMetrics(graph),
+	}
+	if graph.script != nil {
+		analysis.NoteCounts = noteCounts(graph.script.Notes)
+	}
+	analysis.TrappedNodes, analysis.TrapEntries = findTraps(graph)
+	return analysis
+}
+
+// findTraps walks the graph backwards from every END node. Nodes it never
+// reaches cannot lead to an ending.
+func findTraps(graph *StoryGraph) ([]string, []TrapEntry) {
+	predecessors := make(map[string][]string)
+	var queue []string
+	canEnd := make(map[string]bool)
+	for _, nodeID := range sortedNodeIDs(graph) {
+		node := graph.Graph[nodeID]
+		for _, edge := range node.Edges {
+			predecessors[edge.TargetNodeID] = append(predecessors[edge.TargetNodeID], nodeID)
+		}
+		if node.IsEnd {
+			canEnd[nodeID] = true
+			queue = append(queue, nodeID)
+		}
+	}
+	for len(queue) > 0 {
+		nodeID := queue[0]
+		queue = queue[1:]
+		for _, prev := range predecessors[nodeID] {
+			if !canEnd[prev] {
+				canEnd[prev] = true
+				queue = append(queue, prev)
+			}
+		}
+	}
+
+	var trapped []string
+	var entries []TrapEntry
+	for _, nodeID := range sortedNodeIDs(graph) {
+		if !canEnd[nodeID] {
+			trapped = append(trapped, nodeID)
+			continue
+		}
+		for _, edge := range graph.Graph[nodeID].Edges {
+			if !canEnd[edge.TargetNodeID] {
+				entries = append(entries, TrapEntry{SourceNodeID: nodeID, Choice: edge.Text, TargetNodeID: edge.TargetNodeID})
+			}
+		}
+	}
+	return trapped, entries
+}
+
+// sampleWords plays through graph like Simulate with the same seed, picking
+// the same edges, but only adds up the words read, without building a
+// transcript. ok reports whether the run reached an END node.
+func sampleWords(graph *StoryGraph, seed int64, maxSteps int) (words int, ok bool) {
+	rng := rand.New(rand.NewSource(seed))
+	node, found := graph.Graph[graph.StartNodeID]
+	for steps := 0; found; steps++ {
+		words += node.WordCount
+		if node.IsEnd {
+			return words, true
+		}
+		if len(node.Edges) == 0 || steps >= maxSteps {
+			break
+		}
+		node, found = graph.Graph[node.Edges[rng.Intn(len(node.Edges))].TargetNodeID]
+	}
+	return words, false
+}
+
+// wordMetrics computes the word counts reported in WordMetrics.
+func wordMetrics(graph *StoryGraph) WordMetrics {
+	var m WordMetrics
+	seen := make(map[string]bool)
+	for _, nodeID := range sortedNodeIDs(graph) {
+		node := graph.Graph[nodeID]
+		if !seen[node.Content] {
+			seen[node.Content] = true
+			m.Distinct += node.WordCount
+		}
+	}
+	start, ok := graph.Graph[graph.StartNodeID]
+	if !ok {
+		return m
+	}
+
+	// Fewest words: Dijkstra's algorithm, where entering a node costs its words.
+	m.MinPath = -1
+	dist := map[string]int{graph.StartNodeID: start.WordCount}
+	queue := &wordQueue{{nodeID: graph.StartNodeID, words: start.WordCount}}
+	for queue.Len() > 0 {
+		item := heap.Pop(queue).(wordItem)
+		if item.words > dist[item.nodeID] {
+			continue
+		}
+		node := graph.Graph[item.nodeID]
+		if node.IsEnd {
+			m.MinPath = item.words
+			break
+		}
+		for _, edge := range node.Edges {
+			target, ok := graph.Graph[edge.TargetNodeID]
+			if !ok {
+				continue
+			}
+			words := item.words + target.WordCount
+			if d, seen := dist[edge.TargetNodeID]; !seen || words < d {
+				dist[edge.TargetNodeID] = words
+				heap.Push(queue, wordItem{nodeID: edge.TargetNodeID, words: words})
+			}
+		}
+	}
+	if m.MinPath < 0 {
+		m.MinPath = 0
+		return m
+	}
+
+	m.MaxPath, m.MaxPathExact = maxWordsAcyclic(graph)
+
+	maxSteps := 10 * len(graph.Graph)
+	if maxSteps > wordSampleSteps {
+		maxSteps = wordSampleSteps
+	}
+	total, ended := 0, 0
+	for seed := int64(0); seed < wordSamples; seed++ {
+		words, ok := sampleWords(graph, seed, maxSteps)
+		if !ok {
+			continue
+		}
+		total += words
+		ended++
+		if !m.MaxPathExact && words > m.MaxPath {
+			m.MaxPath = words
+		}
+	}
+	m.Samples = ended
+	if ended > 0 {
+		m.AvgPath = float64(total) / float64(ended)
+	}
+	return m
+}
+
+// wordItem is a node waiting in wordQueue with the words read to reach it.
+type wordItem struct {
+	nodeID string
+	words  int
+}
+
+// wordQueue is a min-heap of wordItems for Dijkstra's algorithm.
+type wordQueue []wordItem
+
+func (q wordQueue) Len() int            { return len(q) }
+func (q wordQueue) Less(i, j int) bool  { return q[i].words < q[j].words }
+func (q wordQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *wordQueue) Push(x interface{}) { *q = append(*q, x.(wordItem)) }
+func (q *wordQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// maxWordsAcyclic returns the most words on a path from the start node to an
+// END node, or false if a loop is reachable and the maximum is unbounded or
+// too costly to compute.
+func maxWordsAcyclic(graph *StoryGraph) (int, bool) {
+	const (
+		unvisited = iota
+		inProgress
+		finished
+	)
+	status := make(map[string]int)
+	best := make(map[string]int) // most words from a node to an END node, -1 if none
+	acyclic := true
+	var visit func(nodeID string) int
+	visit = func(nodeID string) int {
+		switch status[nodeID] {
+		case inProgress:
+			acyclic = false
+			return -1
+		case finished:
+			return best[nodeID]
+		}
+		status[nodeID] = inProgress
+		node := graph.Graph[nodeID]
+		result := -1
+		if node.IsEnd {
+			result = node.WordCount
+		}
+		for _, edge := range node.Edges {
+			if _, ok := graph.Graph[edge.TargetNodeID]; !ok {
+				continue
+			}
+			if rest := visit(edge.TargetNodeID); rest >= 0 && node.WordCount+rest > result {
+				result = node.WordCount + rest
+			}
+		}
+		status[nodeID] = finished
+		best[nodeID] = result
+		return result
+	}
+	result := visit(graph.StartNodeID)
+	if !acyclic || result < 0 {
+		return 0, false
+	}
+	return result, true
+}
+
+// sceneMetrics groups nodes by scene and measures each group.
+func sceneMetrics(graph *StoryGraph) []SceneMetrics {
+	byScene := make(map[string][]string)
+	for _, nodeID := range sortedNodeIDs(graph) {
+		scene := graph.Graph[nodeID].Scene
+		byScene[scene] = append(byScene[scene], nodeID)
+	}
+	scenes := make([]string, 0, len(byScene))
+	for scene := range byScene {
+		scenes = append(scenes, scene)
+	}
+	sort.Strings(scenes)
+
+	metrics := make([]SceneMetrics, 0, len(scenes))
+	for _, scene := range scenes {
+		nodeIDs := byScene[scene]
+		m := SceneMetrics{Scene: scene, Nodes: len(nodeIDs), MinChoices: -1}
+		total := 0
+		for _, nodeID := range nodeIDs {
+			edges := graph.Graph[nodeID].Edges
+			total += len(edges)
+			if m.MinChoices < 0 || len(edges) < m.MinChoices {
+				m.MinChoices = len(edges)
+			}
+			if len(edges) > m.MaxChoices {
+				m.MaxChoices = len(edges)
+			}
+			for _, edge := range edges {
+				if target, ok := graph.Graph[edge.TargetNodeID]; ok && target.Scene != scene {
+					m.ExitEdges++
+				}
+			}
+		}
+		m.AvgChoices = float64(total) / float64(len(nodeIDs))
+		m.LongestPath = longestPathWithin(graph, nodeIDs, scene)
+		metrics = append(metrics, m)
+	}
+	for _, nodeID := range sortedNodeIDs(graph) {
+		node := graph.Graph[nodeID]
+		for _, edge := range node.Edges {
+			if target, ok := graph.Graph[edge.TargetNodeID]; ok && target.Scene != node.Scene {
+				i := sort.Search(len(metrics), func(i int) bool { return metrics[i].Scene >= target.Scene })
+				metrics[i].EntryEdges++
+			}
+		}
+	}
+	return metrics
+}
+
+// longestPathWithin returns the number of edges on the longest path through
+// the nodes of one scene. The subgraph is condensed into its strongly
+// connected components first; a component of n nodes contributes n-1 edges.
+func longestPathWithin(graph *StoryGraph, nodeIDs []string, scene string) int {
+	successors := func(nodeID string) []string {
+		var next []string
+		for _, edge := range graph.Graph[nodeID].Edges {
+			if target, ok := graph.Graph[edge.TargetNodeID]; ok && target.Scene == scene {
+				next = append(next, edge.TargetNodeID)
+			}
+		}
+		return next
+	}
+
+	// Tarjan's algorithm emits components in reverse topological order, so
+	// every component reachable from the current one is already measured.
+	index := make(map[string]int)
+	lowlink := make(map[string]int)
+	onStack := make(map[string]bool)
+	component := make(map[string]int)
+	var stack []string
+	var longest []int
+	var strongConnect func(nodeID string)
+	strongConnect = func(nodeID string) {
+		index[nodeID] = len(index)
+		lowlink[nodeID] = index[nodeID]
+		stack = append(stack, nodeID)
+		onStack[nodeID] = true
+		for _, next := range successors(nodeID) {
+			if _, seen := index[next]; !seen {
+				strongConnect(next)
+				if lowlink[next] < lowlink[nodeID] {
+					lowlink[nodeID] = lowlink[next]
+				}
+			} else if onStack[next] && index[next] < lowlink[nodeID] {
+				lowlink[nodeID] = index[next]
+			}
+		}
+		if lowlink[nodeID] != index[nodeID] {
+			return
+		}
+
+		c := len(longest)
+		var members []string
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component[top] = c
+			members = append(members, top)
+			if top == nodeID {
+				break
+			}
+		}
+		best := 0
+		for _, member := range members {
+			for _, next := range successors(member) {
+				if d := component[next]; d != c && longest[d]+1 > best {
+					best = longest[d] + 1
+				}
+			}
+		}
+		longest = append(longest, len(members)-1+best)
+	}
+	for _, nodeID := range nodeIDs {
+		if _, seen := index[nodeID]; !seen {
+			strongConnect(nodeID)
+		}
+	}
+
+	result := 0
+	for _, length := range longest {
+		if length > result {
+			result = length
+		}
+	}
+	return result
+}
+
+// oneSidedConditions evaluates every condition of each reachable node the way
+// compilation does: all choice conditions, and text block conditions in order
+// until one holds. Conditions seen with only one outcome are returned ordered
+// by knot name and line.
+func oneSidedConditions(graph *StoryGraph) []ConditionCoverage {
+	if graph.script == nil {
+		return nil
+	}
+	type outcomes struct{ visits, trues int }
+	seen := make(map[string][]outcomes) // knot name -> blocks then choices
+	for _, node := range graph.Graph {
+		knot := graph.script.Knots[node.KnotName]
+		if knot == nil {
+			continue
+		}
+		counts := seen[node.KnotName]
+		if counts == nil {
+			counts = make([]outcomes, len(knot.Body)+len(knot.Choices))
+			seen[node.KnotName] = counts
+		}
+		for i, block := range knot.Body {
+			if block.Condition == "" {
+				break
+			}
+			counts[i].visits++
+			if block.condition().holds(node.State) {
+				counts[i].trues++
+				break
+			}
+		}
+		for i, choice := range knot.Choices {
+			if choice.Condition == "" {
+				continue
+			}
+			counts[len(knot.Body)+i].visits++
+			if choice.condition().holds(node.State) {
+				counts[len(knot.Body)+i].trues++
+			}
+		}
+	}
+
+	var coverage []ConditionCoverage
+	for _, name := range sortedKnotNames(graph.script.Knots) {
+		counts, ok := seen[name]
+		if !ok {
+			continue
+		}
+		knot := graph.script.Knots[name]
+		var found []ConditionCoverage
+		for i, count := range counts {
+			if count.visits == 0 || (count.trues > 0 && count.trues < count.visits) {
+				continue
+			}
+			c := ConditionCoverage{KnotName: name, Visits: count.visits, Outcome: count.trues > 0}
+			if i < len(knot.Body) {
+				block := knot.Body[i]
+				c.Block, c.Line, c.Condition = i+1, block.Line, block.Condition
+			} else {
+				choice := knot.Choices[i-len(knot.Body)]
+				c.Choice, c.Line, c.Condition = choice.Text, choice.Line, choice.Condition
+			}
+			found = append(found, c)
+		}
+		sort.SliceStable(found, func(i, j int) bool { return found[i].Line < found[j].Line })
+		coverage = append(coverage, found...)
+	}
+	return coverage
+}
+
+// ShortestPaths runs a breadth-first search from the start node and returns,
+// for every reachable ending node, the minimum number of choices needed to
+// reach it along with one witness path. Edges are followed in choice order, so
+// the witness is deterministic. Results are ordered by node ID.
+func ShortestPaths(graph *StoryGraph) []EndingPath {
+	if _, ok := graph.Graph[graph.StartNodeID]; !ok {
+		return nil
+	}
+	type parentLink struct {
+		nodeID string
+		choice string
+	}
+	parents := map[string]parentLink{graph.StartNodeID: {}}
+	queue := []string{graph.StartNodeID}
+	var endings []string
+	for len(queue) > 0 {
+		nodeID := queue[0]
+		queue = queue[1:]
+		node := graph.Graph[nodeID]
+		if node.IsEnd {
+			endings = append(endings, nodeID)
+		}
+		for _, edge := range node.Edges {
+			if _, seen := parents[edge.TargetNodeID]; seen {
+				continue
+			}
+			if _, exists := graph.Graph[edge.TargetNodeID]; !exists {
+				continue
+			}
+			parents[edge.TargetNodeID] = parentLink{nodeID: nodeID, choice: edge.Text}
+			queue = append(queue, edge.TargetNodeID)
+		}
+	}
+
+	sort.Strings(endings)
+	paths := make([]EndingPath, 0, len(endings))
+	for _, nodeID := range endings {
+		path := []PathStep{{NodeID: nodeID}}
+		for current := nodeID; current != graph.StartNodeID; {
+			link := parents[current]
+			path = append(path, PathStep{NodeID: link.nodeID, Choice: link.choice})
+			current = link.nodeID
+		}
+		for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+			path[i], path[j] = path[j], path[i]
+		}
+		node := graph.Graph[nodeID]
+		paths = append(paths, EndingPath{
+			NodeID:     nodeID,
+			KnotName:   node.KnotName,
+			EndingName: node.EndingName,
+			Length:     len(path) - 1,
+			Path:       path,
+		})
+	}
+	return paths
+}
+
+// unreachableEndings lists, in name order, the END knots that produced no node.
+func unreachableEndings(graph *StoryGraph) []string {
+	if graph.script == nil {
+		return nil
+	}
+	reached := make(map[string]bool)
+	for _, node := range graph.Graph {
+		reached[node.KnotName] = true
+	}
+	var names []string
+	for _, name := range sortedKnotNames(graph.script.Knots) {
+		if graph.script.Knots[name].IsEnd && !reached[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// findDeadEnds returns the graph's dead ends ordered by node ID.
+func findDeadEnds(graph *StoryGraph) []DeadEnd {
+	var deadEnds []DeadEnd
+	for nodeID, node := range graph.Graph {
+		if len(node.Edges) > 0 || node.IsEnd || node.Missing {
+			continue
+		}
+		deadEnd := DeadEnd{NodeID: nodeID, KnotName: node.KnotName, State: node.State}
+		if graph.script != nil {
+			if knot, ok := graph.script.Knots[node.KnotName]; ok {
+				for _, choice := range knot.Choices {
+					if choice.Condition != "" && !choice.condition().holds(node.State) {
+						deadEnd.HiddenChoices = append(deadEnd.HiddenChoices, HiddenChoice{Text: choice.Text, Condition: choice.Condition})
+					}
+				}
+			}
+		}
+		deadEnds = append(deadEnds, deadEnd)
+	}
+	sort.Slice(deadEnds, func(i, j int) bool { return deadEnds[i].NodeID < deadEnds[j].NodeID })
+	return deadEnds
+}
@@ -0,0 +1,91 @@
+package bigif
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Asset is a media file attached to a knot by a "// image: file" or
+// "// audio: file" line, optionally conditional, as in
+// "// image {lamp_on == true}: cellar_lit.png".
+type Asset struct {
+	Kind      string // "image" or "audio"
+	Condition string // Raw condition text, empty if unconditional
+	Path      string
+	Line      int // Line of the directive, in the knot's file
+}
+
+// assetKinds lists the asset directives recognized inside knots.
+var assetKinds = []string{"image", "audio"}
+
+// parseAssetLine parses the text after "//" of a comment inside a knot. ok
+// is false when the comment is not an asset directive.
+func parseAssetLine(comment string) (asset Asset, ok bool, err error) {
+	comment = strings.TrimSpace(comment)
+	for _, kind := range assetKinds {
+		if !strings.HasPrefix(comment, kind) {
+			continue
+		}
+		rest := strings.TrimSpace(comment[len(kind):])
+		if !strings.HasPrefix(rest, "{") && !strings.HasPrefix(rest, ":") {
+			continue
+		}
+		asset.Kind = kind
+		if strings.HasPrefix(rest, "{") {
+			end := strings.Index(rest, "}")
+			if end == -1 {
+				return asset, true, fmt.Errorf("mismatched braces in %s condition", kind)
+			}
+			asset.Condition = strings.TrimSpace(rest[1:end])
+			rest = strings.TrimSpace(rest[end+1:])
+			if !strings.HasPrefix(rest, ":") {
+				return asset, true, fmt.Errorf("expected ':' after the %s condition", kind)
+			}
+		}
+		if asset.Path = strings.TrimSpace(rest[1:]); asset.Path == "" {
+			return asset, true, fmt.Errorf("%s directive has no file", kind)
+		}
+		return asset, true, nil
+	}
+	return Asset{}, false, nil
+}
+
+// knotAssets returns the assets of knot shown in state, keyed by kind. As
+// with text blocks, the first asset of a kind whose condition holds wins.
+func knotAssets(knot *Knot, state map[string]bool) map[string]string {
+	var assets map[string]string
+	for _, asset := range knot.Assets {
+		if _, ok := assets[asset.Kind]; ok {
+			continue
+		}
+		if asset.Condition != "" && !evaluateCondition(asset.Condition, state) {
+			continue
+		}
+		if assets == nil {
+			assets = make(map[string]string)
+		}
+		assets[asset.Kind] = asset.Path
+	}
+	return assets
+}
+
+// validateAssets passes every asset of ast to validate, returning the
+// failures as errors at the assets' lines.
+func validateAssets(ast *Script, validate func(kind, path string) error) error {
+	if validate == nil {
+		return nil
+	}
+	var errs []*Error
+	for _, name := range sortedKnotNames(ast.Knots) {
+		knot := ast.Knots[name]
+		for _, asset := range knot.Assets {
+			if err := validate(asset.Kind, asset.Path); err != nil {
+				errs = append(errs, newError(CodeAsset, knot.File, asset.Line, 0, fmt.Errorf("knot '%s': %s '%s': %w", knot.Name, asset.Kind, asset.Path, err)))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errorList(errs)
+	}
+	return nil
+}
@@ -3,24 +3,116 @@ package bigif
 // Script represents the entire parsed script as an Abstract Syntax Tree (AST).
 type Script struct {
 	Metadata     map[string]string
-	GlobalStates map[string]bool // True if a state is a FLAG-STATE
-	LocalStates  map[string]bool // True if a state is a LOCAL-STATE
+	Title        string // First-class metadata, matched case-insensitively
+	Author       string
+	Language     string
+	IFID         string                          // Interactive fiction identifier, if the script declares one
+	States       map[string]StateKind            // Every declared state and its kind
+	SceneStates  map[string]map[string]StateKind // Local states scoped to one scene, keyed by scene
+	Endings      []string                        // Ending labels declared by the ENDINGS header, in declaration order
+	Scenes       []string                        // Valid scene names declared by the SCENES header
+	DefaultScene string                          // Scene inherited by knots without a "// scene:" line
+	TrackVisits  []string                        // Knots named by the TRACK-VISITS header, as written
+	MaxTurns     int                             // Bound of the turn counter set by "// TURNS: max=N", zero without one
 	Knots        map[string]*Knot
+	Directives   map[string]string // Header values attached by Options.DirectiveHandler
+	Notes        []Note            // TODO, FIXME and NOTE comments, in source order
+	Warnings     []Diagnostic      // Non-fatal problems found while parsing
+
+	Strict            bool         // Set by "// STRICT: true"; unknown directives become errors
+	UnknownDirectives []Diagnostic // Header keys that look like mistyped directives
+
+	layout *stateLayout // Bit positions of the states, set by compileConditions
+}
+
+// stateKind returns the kind of a state as seen from a knot in scene. States
+// scoped to another scene are not visible.
+func (s *Script) stateKind(scene, state string) (StateKind, bool) {
+	if kind, ok := s.SceneStates[scene][state]; ok {
+		return kind, true
+	}
+	kind, ok := s.States[state]
+	return kind, ok
+}
+
+// StateKind describes how a declared state behaves during graph analysis.
+type StateKind int
+
+const (
+	StateNormal    StateKind = iota // Declared by STATES: freely settable, global
+	StateFlag                       // Declared by FLAG-STATES: can only go from false to true
+	StateLocal                      // Declared by LOCAL-STATES: reset when the scene changes
+	StateLocalFlag                  // Declared by LOCAL-FLAG-STATES: one-way within a scene, reset when the scene changes
+)
+
+// IsFlag reports whether assignments of false to the state are ignored.
+func (k StateKind) IsFlag() bool {
+	return k == StateFlag || k == StateLocalFlag
+}
+
+// IsLocal reports whether the state is reset when the scene changes.
+func (k StateKind) IsLocal() bool {
+	return k == StateLocal || k == StateLocalFlag
+}
+
+// String returns the header directive that declares states of this kind.
+func (k StateKind) String() string {
+	switch k {
+	case StateFlag:
+		return "FLAG-STATES"
+	case StateLocal:
+		return "LOCAL-STATES"
+	case StateLocalFlag:
+		return "LOCAL-FLAG-STATES"
+	default:
+		return "STATES"
+	}
 }
 
 // Knot represents a single content block, e.g., === knot_name ===
 type Knot struct {
-	Name    string
-	Scene   string
-	Body    []TextBlock
-	Choices []Choice
-	IsEnd   bool
+	Name       string // Fully qualified name, e.g. "act2.intro" in namespace "act2"
+	Namespace  string // Namespace declared by the knot's file, empty if none
+	Scene      string
+	Body       []TextBlock
+	Choices    []Choice
+	IsEnd      bool
+	EndingName string            // Label from "END: label", empty for an unnamed ending
+	Tags       map[string]string // Tags from "#key:value" tokens on the declaration line
+	Directives map[string]string // Values attached by Options.DirectiveHandler
+	Assets     []Asset           // Image and audio directives, in source order
+	File       string            // Source file of the knot, empty when compiled from a string
+	Line       int               // Line number of the knot declaration
 }
 
 // TextBlock represents a conditional block of text in a Knot's body.
 type TextBlock struct {
-	Condition string // Raw condition text, e.g., "has_key == true"
-	Content   string // The multi-line body text
+	Condition string     // Raw condition text, e.g., "has_key == true"
+	Content   string     // The multi-line body text
+	Visit     BlockVisit // Restricts the block to the first arrival or to revisits
+	Line      int        // Line where the block starts, in the knot's file
+
+	compiled *compiledCondition // Condition, set by compileConditions
+}
+
+// BlockVisit says on which arrivals at its knot a text block is shown.
+type BlockVisit int
+
+const (
+	AnyVisit   BlockVisit = iota // Every arrival, for a plain "-" block
+	FirstVisit                   // The first arrival only, for a "-1" block
+	Revisit                      // Every arrival but the first, for a "-+" block
+)
+
+// marker returns what follows the "-" of a block shown on these arrivals.
+func (v BlockVisit) marker() string {
+	switch v {
+	case FirstVisit:
+		return "1"
+	case Revisit:
+		return "+"
+	}
+	return ""
 }
 
 // Choice represents a single choice line, e.g., * Text {condition} ~ state_change -> target
@@ -30,5 +122,12 @@ type Choice struct {
 	StateChanges []string // e.g., ["has_key = false", "torch_lit = true"]
 	TargetKnot   string
 	Stitch       string // e.g., ".stitch_name"
-}
+	Line         int    // Line of the choice, in the knot's file
 
+	compiled *compiledCondition // Condition, set by compileConditions
+
+	// Condition and StateChanges as written, kept when prepareScript
+	// rewrites them, for Options.IncludeSourceLogic
+	writtenCondition    string
+	writtenStateChanges []string
+}
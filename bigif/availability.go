@@ -0,0 +1,134 @@
+package bigif
+
+import (
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// ChoiceMatrix shows which choices of a knot are offered in each reachable
+// state of that knot.
+type ChoiceMatrix struct {
+	KnotName string      `json:"knotName"`
+	Choices  []string    `json:"choices"` // every choice of the knot, in script order
+	Rows     []ChoiceRow `json:"rows"`    // one per node, ordered by node ID
+}
+
+// ChoiceRow is one reachable state of a knot and the choices offered in it.
+type ChoiceRow struct {
+	NodeID  string          `json:"nodeId"`
+	State   map[string]bool `json:"state"`
+	Visible []string        `json:"visible"`
+}
+
+// ChoiceAvailability returns the choice matrix for knotName. For a graph
+// loaded with LoadGraph the script is not available, so the columns are the
+// choices seen on at least one edge, in order of first appearance.
+func ChoiceAvailability(graph *StoryGraph, knotName string) (*ChoiceMatrix, error) {
+	var nodeIDs []string
+	for nodeID, node := range graph.Graph {
+		if node.KnotName == knotName && !node.Missing {
+			nodeIDs = append(nodeIDs, nodeID)
+		}
+	}
+	if len(nodeIDs) == 0 {
+		return nil, fmt.Errorf("knot '%s' has no reachable nodes", knotName)
+	}
+	sort.Strings(nodeIDs)
+
+	matrix := &ChoiceMatrix{KnotName: knotName}
+	var knot *Knot
+	if graph.script != nil {
+		knot = graph.script.Knots[knotName]
+	}
+	if knot != nil {
+		for _, choice := range knot.Choices {
+			matrix.Choices = append(matrix.Choices, choice.Text)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, text := range matrix.Choices {
+		seen[text] = true
+	}
+	for _, nodeID := range nodeIDs {
+		node := graph.Graph[nodeID]
+		row := ChoiceRow{NodeID: nodeID, State: node.State, Visible: []string{}}
+		if knot != nil {
+			for _, choice := range offeredChoices(knot, node.State, graph.script) {
+				row.Visible = append(row.Visible, choice.Text)
+			}
+		} else {
+			for _, edge := range node.Edges {
+				row.Visible = append(row.Visible, edge.Text)
+				if !seen[edge.Text] {
+					seen[edge.Text] = true
+					matrix.Choices = append(matrix.Choices, edge.Text)
+				}
+			}
+		}
+		matrix.Rows = append(matrix.Rows, row)
+	}
+	return matrix, nil
+}
+
+// table lays the matrix out as a header row followed by one row per node:
+// the state assignment, then "x" for each visible choice.
+func (m *ChoiceMatrix) table() [][]string {
+	header := append([]string{"state"}, m.Choices...)
+	records := [][]string{header}
+	for _, row := range m.Rows {
+		visible := make(map[string]bool)
+		for _, text := range row.Visible {
+			visible[text] = true
+		}
+		record := []string{stateAssignment(row.State)}
+		for _, text := range m.Choices {
+			mark := ""
+			if visible[text] {
+				mark = "x"
+			}
+			record = append(record, mark)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// String renders the matrix as an aligned text table.
+func (m *ChoiceMatrix) String() string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	for _, record := range m.table() {
+		fmt.Fprintln(w, strings.Join(record, "\t"))
+	}
+	w.Flush()
+	return b.String()
+}
+
+// CSV renders the matrix as comma-separated values.
+func (m *ChoiceMatrix) CSV() string {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.WriteAll(m.table())
+	return b.String()
+}
+
+// stateAssignment formats a state as "name=value" pairs in name order, or "-"
+// when the node tracks no states.
+func stateAssignment(state map[string]bool) string {
+	if len(state) == 0 {
+		return "-"
+	}
+	names := make([]string, 0, len(state))
+	for name := range state {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%t", name, state[name])
+	}
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,70 @@
+package bigif
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Catalog maps translation keys to text. ExtractCatalog gives the source
+// text of a script under its keys; a translator returns a copy with the
+// values replaced, which Options.Translations then compiles in.
+//
+// Keys name the position of a piece of text in its knot: "cellar/text/0" is
+// the first text block of knot cellar and "cellar/choice/2" its third
+// choice. They stay valid while the text is edited, but not when blocks or
+// choices are added, removed or reordered.
+type Catalog map[string]string
+
+// ExtractCatalog returns the translatable text of a script: the content of
+// every text block and the text of every choice.
+func ExtractCatalog(ast *Script) Catalog {
+	catalog := make(Catalog)
+	for name, knot := range ast.Knots {
+		for i, block := range knot.Body {
+			catalog[textKey(name, i)] = block.Content
+		}
+		for i, choice := range knot.Choices {
+			catalog[choiceKey(name, i)] = choice.Text
+		}
+	}
+	return catalog
+}
+
+func textKey(knot string, i int) string {
+	return fmt.Sprintf("%s/text/%d", knot, i)
+}
+
+func choiceKey(knot string, i int) string {
+	return fmt.Sprintf("%s/choice/%d", knot, i)
+}
+
+// translateScript replaces the text of ast's blocks and choices with their
+// translations in catalog, before the graph is built, so node content and
+// edge text come out translated while conditions, targets and node IDs stay
+// those of the source. Text with no translation keeps its source wording
+// and is reported in a single warning listing the missing keys.
+func translateScript(ast *Script, catalog Catalog) []Diagnostic {
+	var missing []string
+	for name, knot := range ast.Knots {
+		for i := range knot.Body {
+			if text, ok := catalog[textKey(name, i)]; ok {
+				knot.Body[i].Content = text
+			} else {
+				missing = append(missing, textKey(name, i))
+			}
+		}
+		for i := range knot.Choices {
+			if text, ok := catalog[choiceKey(name, i)]; ok {
+				knot.Choices[i].Text = text
+			} else {
+				missing = append(missing, choiceKey(name, i))
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return []Diagnostic{warningAt(position{}, CodeMissingTranslation, "text without a translation keeps its source wording: %s", strings.Join(missing, ", "))}
+}
@@ -0,0 +1,215 @@
+package bigif
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"reflect"
+	"sort"
+)
+
+// Compiler compiles successive versions of a script, reusing work from the
+// previous compile. It is meant for editors that recompile on every change.
+//
+// Each knot is fingerprinted twice: once over everything that shapes the
+// graph (conditions, choices, targets, scene, tags, ending) and once over its
+// prose. When only prose changed since the last compile, the explored graph
+// is reused and only nodes of the edited knots have their content recomputed.
+// Any structural change, header state change or change to Options triggers a
+// full rebuild, including changes made in place to the maps in Options.
+//
+// A Compiler is not safe for concurrent use.
+type Compiler struct {
+	// Options apply to every compile.
+	Options Options
+
+	source    string // script of the last successful compile
+	result    *CompileResult
+	opts      Options // options the cached graph was built with
+	structure [sha256.Size]byte
+	prose     map[string][sha256.Size]byte
+	graph     *StoryGraph // explored graph before finishGraph; results get copies
+	truncated bool
+	reused    bool // whether the last compile reused the explored graph
+}
+
+// NewCompiler returns a Compiler with default options and an empty cache.
+func NewCompiler() *Compiler {
+	return &Compiler{}
+}
+
+// Compile compiles scriptContent like CompileWithOptions with c.Options.
+// Compiling the same script twice in a row returns the same result, so it
+// must not be modified by the caller.
+func (c *Compiler) Compile(scriptContent string) (*CompileResult, error) {
+	sameOptions := reflect.DeepEqual(c.Options.withoutHooks(), c.opts.withoutHooks())
+	if c.result != nil && sameOptions && scriptContent == c.source {
+		c.reused = true
+		return c.result, nil
+	}
+	c.result = nil
+
+	ast, err := parseWithOptions(scriptContent, c.Options)
+	if err != nil {
+		return nil, fmt.Errorf("parsing error: %w", err)
+	}
+	if err := prepareScript(ast, c.Options); err != nil {
+		return nil, err
+	}
+
+	structure := scriptStructure(ast)
+	prose := make(map[string][sha256.Size]byte, len(ast.Knots))
+	for name, knot := range ast.Knots {
+		prose[name] = knotProse(knot)
+	}
+
+	c.reused = c.graph != nil && sameOptions && structure == c.structure
+	if c.reused {
+		for _, node := range c.graph.Graph {
+			if prose[node.KnotName] != c.prose[node.KnotName] {
+				node.Content = knotContent(ast.Knots[node.KnotName], node.State)
+				node.WordCount = countWords(node.Content)
+			}
+		}
+	} else {
+		c.graph = nil
+		explored, truncated, err := exploreGraph(context.Background(), ast, c.Options)
+		if err != nil {
+			return nil, fmt.Errorf("graph analysis error: %w", err)
+		}
+		c.graph, c.truncated = explored, truncated
+		c.opts, c.structure = c.Options.withCopiedMaps(), structure
+	}
+	c.prose = prose
+
+	graph, err := finishGraph(ast, cloneGraph(c.graph), c.Options, c.truncated)
+	if err != nil {
+		return nil, fmt.Errorf("graph analysis error: %w", err)
+	}
+	c.source, c.result = scriptContent, newCompileResult(ast, graph)
+	c.result.format = c.Options.Format
+	return c.result, nil
+}
+
+// cloneGraph copies the nodes and edges of an explored graph so finishGraph
+// can rewrite them. Node states are shared, since nothing modifies them.
+func cloneGraph(graph *StoryGraph) *StoryGraph {
+	clone := &StoryGraph{StartNodeID: graph.StartNodeID, Graph: make(map[string]*StoryNode, len(graph.Graph))}
+	for nodeID, node := range graph.Graph {
+		n := *node
+		n.Edges = make([]*StoryEdge, len(node.Edges))
+		for i, edge := range node.Edges {
+			e := *edge
+			n.Edges[i] = &e
+		}
+		clone.Graph[nodeID] = &n
+	}
+	return clone
+}
+
+// scriptStructure hashes everything in a script that can change the explored
+// graph: state declarations, scenes and the structure of every knot.
+func scriptStructure(ast *Script) [sha256.Size]byte {
+	h := sha256.New()
+	writeStates(h, ast.States)
+	scenes := make([]string, 0, len(ast.SceneStates))
+	for scene := range ast.SceneStates {
+		scenes = append(scenes, scene)
+	}
+	sort.Strings(scenes)
+	for _, scene := range scenes {
+		fmt.Fprintf(h, "scene %q\n", scene)
+		writeStates(h, ast.SceneStates[scene])
+	}
+	fmt.Fprintf(h, "%q %q %q\n", ast.Scenes, ast.DefaultScene, ast.Endings)
+	for _, name := range sortedKnotNames(ast.Knots) {
+		knot := ast.Knots[name]
+		fmt.Fprintf(h, "knot %q %q %q %t %q\n", knot.Name, knot.Namespace, knot.Scene, knot.IsEnd, knot.EndingName)
+		tags := make([]string, 0, len(knot.Tags))
+		for key := range knot.Tags {
+			tags = append(tags, key)
+		}
+		sort.Strings(tags)
+		for _, key := range tags {
+			fmt.Fprintf(h, "tag %q %q\n", key, knot.Tags[key])
+		}
+		directives := make([]string, 0, len(knot.Directives))
+		for key := range knot.Directives {
+			directives = append(directives, key)
+		}
+		sort.Strings(directives)
+		for _, key := range directives {
+			fmt.Fprintf(h, "directive %q %q\n", key, knot.Directives[key])
+		}
+		for _, block := range knot.Body {
+			fmt.Fprintf(h, "block %q\n", block.Condition)
+		}
+		for _, asset := range knot.Assets {
+			fmt.Fprintf(h, "asset %q %q %q\n", asset.Kind, asset.Condition, asset.Path)
+		}
+		for _, choice := range knot.Choices {
+			fmt.Fprintf(h, "choice %q %q %q %q %q\n", choice.Text, choice.Condition, choice.StateChanges, choice.TargetKnot, choice.Stitch)
+		}
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+func writeStates(h hash.Hash, states map[string]StateKind) {
+	names := make([]string, 0, len(states))
+	for name := range states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "state %q %d\n", name, states[name])
+	}
+}
+
+// knotProse hashes the text of a knot's blocks, which only affects node content.
+func knotProse(knot *Knot) [sha256.Size]byte {
+	h := sha256.New()
+	for _, block := range knot.Body {
+		fmt.Fprintf(h, "%q\n", block.Content)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// withCopiedMaps returns o with copies of its maps, so that options kept
+// for comparison do not change when the caller edits the maps in place.
+func (o Options) withCopiedMaps() Options {
+	o.InitialStates = copyBoolMap(o.InitialStates)
+	o.ExternalConditions = copyBoolMap(o.ExternalConditions)
+	if o.Translations != nil {
+		translations := make(Catalog, len(o.Translations))
+		for key, text := range o.Translations {
+			translations[key] = text
+		}
+		o.Translations = translations
+	}
+	return o
+}
+
+// copyBoolMap copies m, keeping nil as nil.
+func copyBoolMap(m map[string]bool) map[string]bool {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]bool, len(m))
+	for key, value := range m {
+		c[key] = value
+	}
+	return c
+}
+
+// withoutHooks clears the callbacks and logger in o, which reflect.DeepEqual
+// cannot compare reliably. None of them affect the graph except
+// DirectiveHandler, whose results are compared through scriptStructure.
+func (o Options) withoutHooks() Options {
+	o.OnProgress, o.Logger, o.DirectiveHandler, o.AssetValidator = nil, nil, nil, nil
+	return o
+}
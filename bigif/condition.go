@@ -0,0 +1,122 @@
+package bigif
+
+import "strings"
+
+// compiledCondition is a condition parsed once, so graph construction does
+// not split and trim the same text again for every node it expands. A
+// condition is a conjunction, so it holds when every term does.
+type compiledCondition struct {
+	terms []conditionTerm
+	never bool // A part compares nothing, as in "false", so the condition never holds
+}
+
+// conditionTerm is one "state == value" or "state != value" part of a
+// condition, with "!=" folded into the value the state must have.
+type conditionTerm struct {
+	state string
+	index int // Bit of the state in the script's stateLayout, -1 if it has none
+	want  bool
+}
+
+// compileCondition parses condition the way it has always been evaluated:
+// parts are joined by "&&", a part with "!=" is an inequality even if it
+// also contains "==", anything but "true" compares as false, and a part
+// with neither operator makes the whole condition false. States missing
+// from layout, which may be nil, compare as false.
+func compileCondition(condition string, layout *stateLayout) *compiledCondition {
+	c := &compiledCondition{}
+	for _, part := range strings.Split(condition, "&&") {
+		part = strings.TrimSpace(part)
+
+		op := "=="
+		if strings.Contains(part, "!=") {
+			op = "!="
+		} else if !strings.Contains(part, "==") {
+			c.never = true
+			continue
+		}
+		vals := strings.Split(part, op)
+		term := conditionTerm{state: strings.TrimSpace(vals[0]), index: -1, want: strings.TrimSpace(vals[1]) == "true"}
+		if op == "!=" {
+			term.want = !term.want
+		}
+		if layout != nil {
+			if i, ok := layout.index[term.state]; ok {
+				term.index = i
+			}
+		}
+		c.terms = append(c.terms, term)
+	}
+	return c
+}
+
+// holds evaluates the condition against the map form of a state.
+func (c *compiledCondition) holds(state map[string]bool) bool {
+	if c.never {
+		return false
+	}
+	for _, term := range c.terms {
+		if state[term.state] != term.want {
+			return false
+		}
+	}
+	return true
+}
+
+// holdsIn evaluates the condition against a state vector of layout, which
+// must be the layout it was compiled with.
+func (c *compiledCondition) holdsIn(layout *stateLayout, v stateVector) bool {
+	if c.never {
+		return false
+	}
+	for _, term := range c.terms {
+		value := term.index >= 0 && layout.get(v, term.index)
+		if value != term.want {
+			return false
+		}
+	}
+	return true
+}
+
+// compileConditions lays out the states of a prepared script and compiles
+// the condition of every text block and choice against that layout, once
+// per distinct condition text. It runs last in prepareScript, since the
+// earlier steps rewrite conditions and declare states.
+func compileConditions(ast *Script) {
+	ast.layout = newStateLayout(ast)
+	compiled := make(map[string]*compiledCondition)
+	compile := func(condition string) *compiledCondition {
+		c, ok := compiled[condition]
+		if !ok {
+			c = compileCondition(condition, ast.layout)
+			compiled[condition] = c
+		}
+		return c
+	}
+	for _, knot := range ast.Knots {
+		for i := range knot.Body {
+			knot.Body[i].compiled = compile(knot.Body[i].Condition)
+		}
+		for i := range knot.Choices {
+			knot.Choices[i].compiled = compile(knot.Choices[i].Condition)
+		}
+	}
+}
+
+// condition returns the compiled condition of the block, compiling it now
+// for a script that was parsed but not prepared.
+func (b *TextBlock) condition() *compiledCondition {
+	if b.compiled == nil {
+		return compileCondition(b.Condition, nil)
+	}
+	return b.compiled
+}
+
+// condition returns the compiled condition of the choice, compiling it now
+// for a script that was parsed but not prepared.
+func (c *Choice) condition() *compiledCondition {
+	if c.compiled == nil {
+		return compileCondition(c.Condition, nil)
+	}
+	return c.compiled
+}
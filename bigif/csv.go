@@ -0,0 +1,91 @@
+package bigif
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ExportCSV writes a graph as two CSV tables for spreadsheets. nodesW gets
+// one row per node with the columns id, knotName, scene, isEnd and content,
+// then one "state.<name>" column per state found in the graph, sorted by
+// name; a state the node does not track is left empty. edgesW gets one row
+// per edge with the columns source, text and target. Rows are in node ID
+// order, edges in the order of each node's choices, and both tables start
+// with a header row.
+//
+// Content is written on one line: backslashes are doubled and line breaks
+// become "\n". Commas, quotes and the like are quoted by encoding/csv.
+func ExportCSV(graph *StoryGraph, nodesW, edgesW io.Writer) error {
+	if graph == nil {
+		return fmt.Errorf("exporting CSV: graph is nil")
+	}
+	ids := make([]string, 0, len(graph.Graph))
+	stateSet := make(map[string]bool)
+	for id, node := range graph.Graph {
+		ids = append(ids, id)
+		for state := range node.State {
+			stateSet[state] = true
+		}
+	}
+	sort.Strings(ids)
+	states := make([]string, 0, len(stateSet))
+	for state := range stateSet {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+
+	nodes := csv.NewWriter(nodesW)
+	header := []string{"id", "knotName", "scene", "isEnd", "content"}
+	for _, state := range states {
+		header = append(header, "state."+state)
+	}
+	if err := nodes.Write(header); err != nil {
+		return fmt.Errorf("exporting CSV nodes: %w", err)
+	}
+	for _, id := range ids {
+		node := graph.Graph[id]
+		row := []string{id, node.KnotName, node.Scene, strconv.FormatBool(node.IsEnd), csvEscape(node.Content)}
+		for _, state := range states {
+			value, ok := node.State[state]
+			if ok {
+				row = append(row, strconv.FormatBool(value))
+			} else {
+				row = append(row, "")
+			}
+		}
+		if err := nodes.Write(row); err != nil {
+			return fmt.Errorf("exporting CSV nodes: %w", err)
+		}
+	}
+	nodes.Flush()
+	if err := nodes.Error(); err != nil {
+		return fmt.Errorf("exporting CSV nodes: %w", err)
+	}
+
+	edges := csv.NewWriter(edgesW)
+	if err := edges.Write([]string{"source", "text", "target"}); err != nil {
+		return fmt.Errorf("exporting CSV edges: %w", err)
+	}
+	for _, id := range ids {
+		for _, edge := range graph.Graph[id].Edges {
+			if err := edges.Write([]string{id, csvEscape(edge.Text), edge.TargetNodeID}); err != nil {
+				return fmt.Errorf("exporting CSV edges: %w", err)
+			}
+		}
+	}
+	edges.Flush()
+	if err := edges.Error(); err != nil {
+		return fmt.Errorf("exporting CSV edges: %w", err)
+	}
+	return nil
+}
+
+// csvEscape puts text on one line, doubling backslashes and writing line
+// breaks as "\n".
+func csvEscape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace(text)
+}
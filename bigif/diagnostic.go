@@ -0,0 +1,107 @@
+package bigif
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Severity says how serious a Diagnostic is.
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// More codes used by warnings; errors use the codes declared with Error.
+const (
+	CodeDuplicateMetadata  ErrorCode = "duplicate-metadata"  // A metadata key defined more than once
+	CodeRedeclared         ErrorCode = "redeclared"          // A state or DEFAULT-SCENE declared again
+	CodeUnusedState        ErrorCode = "unused-state"        // A state never read, or never read or written
+	CodeUnsetState         ErrorCode = "unset-state"         // A state read but never written
+	CodeIgnoredAssignment  ErrorCode = "ignored-assignment"  // An assignment that can never take effect
+	CodeFlagLikeState      ErrorCode = "flag-like-state"     // A state set to true and never back to false
+	CodeLocalOutOfScope    ErrorCode = "local-out-of-scope"  // A local state read where it is always false
+	CodeTruncated          ErrorCode = "truncated"           // The graph was cut off by Options.MaxDepth
+	CodeHiddenChoice       ErrorCode = "hidden-choice"       // A choice hidden by its condition at a dead end
+	CodeTrap               ErrorCode = "trap"                // A choice into a region that cannot reach an ending
+	CodeUndeclaredEnding   ErrorCode = "undeclared-ending"   // An ending label missing from the ENDINGS header
+	CodeUndeclaredState    ErrorCode = "undeclared-state"    // A condition or state change naming an undeclared state, from Validate
+	CodeUnsupportedMacro   ErrorCode = "unsupported-macro"   // Twine markup ImportTwee cannot convert
+	CodeRenamedPassage     ErrorCode = "renamed-passage"     // A Twine passage whose name is not a valid knot name
+	CodeMissingTranslation ErrorCode = "missing-translation" // Text with no entry in Options.Translations
+)
+
+// Diagnostic is one finding about a script: an error, or a warning that does
+// not stop compilation. Every analysis reports into this one shape, so tools
+// can sort, filter and underline findings without parsing messages.
+type Diagnostic struct {
+	Severity Severity  `json:"severity"`
+	Code     ErrorCode `json:"code"`
+	File     string    `json:"file,omitempty"`   // Empty for a script passed in as a string
+	Line     int       `json:"line,omitempty"`   // 1-based, 0 when the finding has no single position
+	Column   int       `json:"column,omitempty"` // 1-based, 0 when unknown
+	Message  string    `json:"message"`
+}
+
+// String formats the diagnostic the way warnings have always been written:
+// "line N: message", "file:N: message", or just the message.
+func (d Diagnostic) String() string {
+	if d.Line == 0 {
+		return d.Message
+	}
+	return location(d.File, d.Line) + ": " + d.Message
+}
+
+// Diagnostic converts the error into a Diagnostic with error severity.
+func (e *Error) Diagnostic() Diagnostic {
+	return Diagnostic{Severity: SeverityError, Code: e.Code, File: e.File, Line: e.Line, Column: e.Column, Message: e.Message}
+}
+
+// ErrorDiagnostics returns the errors behind a failed compile as
+// diagnostics, one per Error in an ErrorList, so tools can show every
+// problem with its position. An error that is not an Error becomes a
+// diagnostic without a position or code, and a nil error gives nil.
+func ErrorDiagnostics(err error) []Diagnostic {
+	if err == nil {
+		return nil
+	}
+	var list ErrorList
+	if errors.As(err, &list) {
+		diagnostics := make([]Diagnostic, len(list))
+		for i, e := range list {
+			diagnostics[i] = e.Diagnostic()
+		}
+		return diagnostics
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return []Diagnostic{e.Diagnostic()}
+	}
+	return []Diagnostic{{Severity: SeverityError, Message: err.Error()}}
+}
+
+// position locates a line in a script file.
+type position struct {
+	file string
+	line int
+}
+
+func (p position) String() string { return location(p.file, p.line) }
+
+// warningAt builds a warning at a position; use position{} for none.
+func warningAt(at position, code ErrorCode, format string, args ...interface{}) Diagnostic {
+	return Diagnostic{Severity: SeverityWarning, Code: code, File: at.file, Line: at.line, Message: fmt.Sprintf(format, args...)}
+}
+
+// diagnosticStrings renders diagnostics as plain messages.
+func diagnosticStrings(diagnostics []Diagnostic) []string {
+	if diagnostics == nil {
+		return nil
+	}
+	lines := make([]string, len(diagnostics))
+	for i, d := range diagnostics {
+		lines[i] = d.String()
+	}
+	return lines
+}
@@ -0,0 +1,233 @@
+package bigif
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// GraphDiff describes how one compiled graph differs from another.
+type GraphDiff struct {
+	AddedNodes   []string     // IDs of nodes only in the new graph
+	RemovedNodes []string     // IDs of nodes only in the old graph
+	RenamedNodes []NodeRename // Nodes matched by knot and state whose ID changed
+	ChangedNodes []NodeDiff   // Matched nodes whose content or edges changed
+}
+
+// NodeRename pairs a node of the old graph with the node of the new graph it
+// was matched to, when their IDs differ.
+type NodeRename struct {
+	From string
+	To   string
+}
+
+// NodeDiff lists the changes to one matched node. NodeID is its ID in the new graph.
+type NodeDiff struct {
+	NodeID          string
+	ContentChanged  bool
+	OldContent      string
+	NewContent      string
+	AddedEdges      []*StoryEdge
+	RemovedEdges    []*StoryEdge
+	RetargetedEdges []EdgeRetarget
+}
+
+// EdgeRetarget is a choice present in both graphs that now leads elsewhere.
+// OldTargetNodeID is translated to the new graph's IDs where the old target
+// was matched.
+type EdgeRetarget struct {
+	Text            string
+	OldTargetNodeID string
+	NewTargetNodeID string
+}
+
+// Empty reports whether the graphs are equivalent.
+func (d *GraphDiff) Empty() bool {
+	return len(d.AddedNodes) == 0 && len(d.RemovedNodes) == 0 && len(d.RenamedNodes) == 0 && len(d.ChangedNodes) == 0
+}
+
+// DiffGraphs compares graph a (old) with graph b (new). Nodes are matched by
+// ID first, then by knot name and identical state, and finally by knot name
+// and the values of the states both graphs track, so that renamed IDs (e.g.
+// after adding a state or switching to compact IDs) still pair up where the
+// match is unambiguous.
+func DiffGraphs(a, b *StoryGraph) *GraphDiff {
+	matched := make(map[string]string) // a ID -> b ID
+	taken := make(map[string]bool)     // matched b IDs
+	for id := range a.Graph {
+		if _, ok := b.Graph[id]; ok {
+			matched[id] = id
+			taken[id] = true
+		}
+	}
+
+	full := func(node *StoryNode) string {
+		return node.KnotName + "|" + stateSignature(node.State, nil)
+	}
+	matchBy(a, b, matched, taken, full, full)
+
+	common := make(map[string]bool)
+	aStates, bStates := graphStates(a), graphStates(b)
+	for state := range aStates {
+		if bStates[state] {
+			common[state] = true
+		}
+	}
+	partial := func(node *StoryNode) string {
+		return node.KnotName + "|" + stateSignature(node.State, common)
+	}
+	matchBy(a, b, matched, taken, partial, partial)
+
+	diff := &GraphDiff{}
+	for _, id := range sortedNodeIDs(a) {
+		to, ok := matched[id]
+		if !ok {
+			diff.RemovedNodes = append(diff.RemovedNodes, id)
+			continue
+		}
+		if to != id {
+			diff.RenamedNodes = append(diff.RenamedNodes, NodeRename{From: id, To: to})
+		}
+		if nodeDiff, changed := diffNode(a.Graph[id], b.Graph[to], to, matched); changed {
+			diff.ChangedNodes = append(diff.ChangedNodes, nodeDiff)
+		}
+	}
+	for _, id := range sortedNodeIDs(b) {
+		if !taken[id] {
+			diff.AddedNodes = append(diff.AddedNodes, id)
+		}
+	}
+	sort.Slice(diff.ChangedNodes, func(i, j int) bool { return diff.ChangedNodes[i].NodeID < diff.ChangedNodes[j].NodeID })
+	return diff
+}
+
+// matchBy pairs still-unmatched nodes whose keys are equal and unique on both sides.
+func matchBy(a, b *StoryGraph, matched map[string]string, taken map[string]bool, keyA, keyB func(*StoryNode) string) {
+	index := func(graph *StoryGraph, skip func(string) bool, key func(*StoryNode) string) map[string][]string {
+		byKey := make(map[string][]string)
+		for id, node := range graph.Graph {
+			if !skip(id) {
+				byKey[key(node)] = append(byKey[key(node)], id)
+			}
+		}
+		return byKey
+	}
+	fromA := index(a, func(id string) bool { _, ok := matched[id]; return ok }, keyA)
+	fromB := index(b, func(id string) bool { return taken[id] }, keyB)
+	for key, ids := range fromA {
+		if len(ids) == 1 && len(fromB[key]) == 1 {
+			matched[ids[0]] = fromB[key][0]
+			taken[fromB[key][0]] = true
+		}
+	}
+}
+
+// diffNode compares two matched nodes. Edges are paired by choice text, in order.
+func diffNode(old, new *StoryNode, nodeID string, matched map[string]string) (NodeDiff, bool) {
+	d := NodeDiff{NodeID: nodeID}
+	if old.Content != new.Content {
+		d.ContentChanged, d.OldContent, d.NewContent = true, old.Content, new.Content
+	}
+
+	remaining := make(map[string][]*StoryEdge)
+	for _, edge := range new.Edges {
+		remaining[edge.Text] = append(remaining[edge.Text], edge)
+	}
+	for _, edge := range old.Edges {
+		candidates := remaining[edge.Text]
+		if len(candidates) == 0 {
+			d.RemovedEdges = append(d.RemovedEdges, edge)
+			continue
+		}
+		counterpart := candidates[0]
+		remaining[edge.Text] = candidates[1:]
+		oldTarget := edge.TargetNodeID
+		if to, ok := matched[oldTarget]; ok {
+			oldTarget = to
+		}
+		if oldTarget != counterpart.TargetNodeID {
+			d.RetargetedEdges = append(d.RetargetedEdges, EdgeRetarget{Text: edge.Text, OldTargetNodeID: oldTarget, NewTargetNodeID: counterpart.TargetNodeID})
+		}
+	}
+	for _, edge := range new.Edges {
+		for _, left := range remaining[edge.Text] {
+			if left == edge {
+				d.AddedEdges = append(d.AddedEdges, edge)
+			}
+		}
+	}
+
+	changed := d.ContentChanged || len(d.AddedEdges) > 0 || len(d.RemovedEdges) > 0 || len(d.RetargetedEdges) > 0
+	return d, changed
+}
+
+// String renders the diff for people: one line per added (+), removed (-),
+// renamed (>) or changed (~) node, with indented details for changes.
+func (d *GraphDiff) String() string {
+	if d.Empty() {
+		return "graphs are identical\n"
+	}
+	var b strings.Builder
+	for _, id := range d.AddedNodes {
+		fmt.Fprintf(&b, "+ %s\n", id)
+	}
+	for _, id := range d.RemovedNodes {
+		fmt.Fprintf(&b, "- %s\n", id)
+	}
+	for _, rename := range d.RenamedNodes {
+		fmt.Fprintf(&b, "> %s -> %s\n", rename.From, rename.To)
+	}
+	for _, node := range d.ChangedNodes {
+		fmt.Fprintf(&b, "~ %s\n", node.NodeID)
+		if node.ContentChanged {
+			fmt.Fprintf(&b, "    content: %q -> %q\n", node.OldContent, node.NewContent)
+		}
+		for _, edge := range node.AddedEdges {
+			fmt.Fprintf(&b, "    + choice '%s' -> %s\n", edge.Text, edge.TargetNodeID)
+		}
+		for _, edge := range node.RemovedEdges {
+			fmt.Fprintf(&b, "    - choice '%s' -> %s\n", edge.Text, edge.TargetNodeID)
+		}
+		for _, edge := range node.RetargetedEdges {
+			fmt.Fprintf(&b, "    ~ choice '%s': %s -> %s\n", edge.Text, edge.OldTargetNodeID, edge.NewTargetNodeID)
+		}
+	}
+	return b.String()
+}
+
+// stateSignature renders a state canonically, keeping only the states in
+// keep when it is non-nil.
+func stateSignature(state map[string]bool, keep map[string]bool) string {
+	names := make([]string, 0, len(state))
+	for name := range state {
+		if keep == nil || keep[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%t", name, state[name])
+	}
+	return strings.Join(parts, ",")
+}
+
+// graphStates returns every state name that appears in any node of graph.
+func graphStates(graph *StoryGraph) map[string]bool {
+	states := make(map[string]bool)
+	for _, node := range graph.Graph {
+		for state := range node.State {
+			states[state] = true
+		}
+	}
+	return states
+}
+
+func sortedNodeIDs(graph *StoryGraph) []string {
+	ids := make([]string, 0, len(graph.Graph))
+	for id := range graph.Graph {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
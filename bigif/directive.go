@@ -0,0 +1,50 @@
+package bigif
+
+// DirectiveScope tells a DirectiveHandler where a directive was found.
+type DirectiveScope int
+
+const (
+	ScopeHeader DirectiveScope = iota // Before the first knot of a file
+	ScopeKnot                         // Inside a knot
+)
+
+// Pos locates a line in a script. File is empty for a script compiled from
+// a string.
+type Pos struct {
+	File string
+	Line int
+}
+
+// DirectiveHandler is called for each "// key: value" comment that is not a
+// built-in directive, in the header and inside knots, so pipelines can add
+// their own annotations such as "// art: cellar.png". A nil map means the
+// handler does not take the directive, which then behaves as without a
+// handler: header keys become metadata and knot comments are ignored. The
+// entries of a non-nil map are added to the knot's Directives, and from
+// there to each of its nodes, or for the header to the script's Directives;
+// a later entry replaces an earlier one with the same key. A returned error
+// fails the compile at the directive's line with code CodeDirective.
+type DirectiveHandler func(scope DirectiveScope, key, value string, pos Pos) (attach map[string]string, err error)
+
+// handleDirective offers a directive to the parser's handler and stores what
+// it attaches in into, which it allocates if needed. It reports whether the
+// handler took the directive.
+func (p *parser) handleDirective(scope DirectiveScope, key, value string, pos position, into *map[string]string) (bool, error) {
+	if p.directives == nil {
+		return false, nil
+	}
+	attach, err := p.directives(scope, key, value, Pos{File: pos.file, Line: pos.line})
+	if err != nil {
+		return false, errorf(CodeDirective, "directive '%s': %w", key, err)
+	}
+	if attach == nil {
+		return false, nil
+	}
+	if *into == nil {
+		*into = make(map[string]string, len(attach))
+	}
+	for k, v := range attach {
+		(*into)[k] = v
+	}
+	return true, nil
+}
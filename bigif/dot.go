@@ -0,0 +1,156 @@
+package bigif
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// DOTOptions controls the Graphviz output of ExportDOT. The zero value gives
+// top-to-bottom layout with content cut to 40 characters and no state.
+type DOTOptions struct {
+	// MaxLabelLength cuts node content to this many characters, marking the
+	// cut with "…". Zero means 40; a negative value leaves content out and
+	// labels nodes with their knot name only.
+	MaxLabelLength int
+
+	// ShowState adds the states that are true to each node label.
+	ShowState bool
+
+	// RankDir is the Graphviz rankdir: "TB", "LR", "BT" or "RL". Empty means "TB".
+	RankDir string
+}
+
+// ExportDOT renders a graph in the Graphviz DOT language. Nodes are labelled
+// with their knot name and the start of their content, END nodes are drawn
+// as double circles and stubs for missing knots dashed, edges are labelled
+// with the choice text, and the nodes of each scene are grouped into a
+// cluster subgraph. Output is sorted by scene and node ID, so it is stable.
+func ExportDOT(graph *StoryGraph, opts DOTOptions) ([]byte, error) {
+	if graph == nil {
+		return nil, fmt.Errorf("exporting DOT: graph is nil")
+	}
+	rankDir := opts.RankDir
+	switch rankDir {
+	case "":
+		rankDir = "TB"
+	case "TB", "LR", "BT", "RL":
+	default:
+		return nil, fmt.Errorf("exporting DOT: invalid rankdir '%s': want TB, LR, BT or RL", opts.RankDir)
+	}
+	maxLength := opts.MaxLabelLength
+	if maxLength == 0 {
+		maxLength = 40
+	}
+
+	ids := make([]string, 0, len(graph.Graph))
+	scenes := make(map[string][]string)
+	for id, node := range graph.Graph {
+		ids = append(ids, id)
+		scenes[node.Scene] = append(scenes[node.Scene], id)
+	}
+	sort.Strings(ids)
+	sceneNames := make([]string, 0, len(scenes))
+	for scene, members := range scenes {
+		sort.Strings(members)
+		if scene != "" {
+			sceneNames = append(sceneNames, scene)
+		}
+	}
+	sort.Strings(sceneNames)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "digraph story {\n  rankdir=%s;\n  node [shape=box];\n", rankDir)
+	writeNode := func(indent, id string) {
+		node := graph.Graph[id]
+		attrs := []string{"label=" + dotQuote(dotLabel(node, maxLength, opts.ShowState))}
+		switch {
+		case node.IsEnd:
+			attrs = append(attrs, "shape=doublecircle")
+		case node.Missing:
+			attrs = append(attrs, "style=dashed")
+		}
+		if id == graph.StartNodeID {
+			attrs = append(attrs, "penwidth=2")
+		}
+		fmt.Fprintf(&b, "%s%s [%s];\n", indent, dotQuote(id), strings.Join(attrs, ", "))
+	}
+	for i, scene := range sceneNames {
+		fmt.Fprintf(&b, "  subgraph %s {\n    label=%s;\n", dotQuote(fmt.Sprintf("cluster_%d", i)), dotQuote(scene))
+		for _, id := range scenes[scene] {
+			writeNode("    ", id)
+		}
+		b.WriteString("  }\n")
+	}
+	for _, id := range scenes[""] {
+		writeNode("  ", id)
+	}
+	for _, id := range ids {
+		for _, edge := range graph.Graph[id].Edges {
+			fmt.Fprintf(&b, "  %s -> %s [label=%s];\n", dotQuote(id), dotQuote(edge.TargetNodeID), dotQuote(edge.Text))
+		}
+	}
+	b.WriteString("}\n")
+	return b.Bytes(), nil
+}
+
+// dotLabel builds the text of a node label: knot name, content cut to
+// maxLength characters unless maxLength is negative, and optionally the
+// states that are true.
+func dotLabel(node *StoryNode, maxLength int, showState bool) string {
+	lines := []string{node.KnotName}
+	if node.Stitch != "" {
+		lines[0] += " " + node.Stitch
+	}
+	if maxLength > 0 && node.Content != "" {
+		lines = append(lines, truncateText(node.Content, maxLength))
+	}
+	if showState {
+		var set []string
+		for state, value := range node.State {
+			if value {
+				set = append(set, state)
+			}
+		}
+		sort.Strings(set)
+		if len(set) > 0 {
+			lines = append(lines, "["+strings.Join(set, ", ")+"]")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// truncateText collapses whitespace in text and cuts it to max characters,
+// ending a cut with "…".
+func truncateText(text string, max int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	runes := []rune(text)
+	return string(runes[:max-1]) + "…"
+}
+
+// dotQuote returns s as a DOT double-quoted string. Backslashes and quotes
+// are escaped so they are shown literally, and line breaks become "\n".
+func dotQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -1,57 +1,807 @@
 package bigif
 
 import (
+	"context"
+	"crypto/sha1"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
 // StoryGraph is the final, processed output of the engine. It contains only reachable states.
 type StoryGraph struct {
-	Metadata map[string]string      `json:"metadata"`
-	Graph    map[string]*StoryNode `json:"nodes"`
+	StartNodeID string                 `json:"startNodeId"`
+	Metadata    map[string]interface{} `json:"metadata"`
+	Graph       map[string]*StoryNode  `json:"nodes"`
+	Endings     []*Ending              `json:"endings"`
+
+	// SourceMap locates every node in the script by node ID. Only filled with
+	// Options.IncludeSourceMap.
+	SourceMap map[string]*NodeSource `json:"sourceMap,omitempty"`
+
+	warnings     []Diagnostic // collected during analysis and handed to CompileResult
+	script       *Script      // the AST the graph was built from, used by Analyze
+	info         storyInfo    // the top-level fields of the JSON document
+	dedupContent bool         // Options.DedupContent: write contents once, see outputNodes
+	omitStates   bool         // Options.OmitStates: write states as bits, see outputNodes
+}
+
+// storyInfo holds the top-level story fields of the JSON document that are
+// not part of the graph itself.
+type storyInfo struct {
+	title, author, language, ifid string
 }
 
 // StoryNode represents a single, unique, and reachable state in the narrative.
 type StoryNode struct {
-	KnotName string          `json:"knotName"`
-	Scene    string          `json:"scene"`
-	State    map[string]bool `json:"state"`
-	Content  string          `json:"content"`
-	Edges    []*StoryEdge    `json:"edges"`
-	IsEnd    bool            `json:"isEnd"`
-	Stitch   string          `json:"stitch,omitempty"`
+	KnotName   string            `json:"knotName" short:"k"`
+	Scene      string            `json:"scene" short:"sc"`
+	State      map[string]bool   `json:"state" short:"s"`
+	Content    string            `json:"content" short:"c"`
+	WordCount  int               `json:"wordCount" short:"w"` // Words in Content, split on Unicode whitespace
+	Edges      []*StoryEdge      `json:"edges" short:"e"`
+	IsEnd      bool              `json:"isEnd" short:"end"`
+	EndingName string            `json:"endingName,omitempty" short:"en"`
+	Stitch     string            `json:"stitch,omitempty" short:"st"`
+	Tags       map[string]string `json:"tags,omitempty" short:"tg"`
+	Directives map[string]string `json:"directives,omitempty" short:"dr"` // From Options.DirectiveHandler
+	Assets     map[string]string `json:"assets,omitempty" short:"as"`     // Image and audio shown in this state, by kind
+
+	ContentRef *int   `json:"contentRef,omitempty" short:"cr"` // Index into the document's contents, set only while reading or writing with Options.DedupContent
+	StateBits  string `json:"stateBits,omitempty" short:"sb"`  // State over the document's stateNames, set only while reading or writing with Options.OmitStates
+
+	IncomingEdges []*IncomingEdge `json:"incomingEdges,omitempty" short:"in"` // Only filled with Options.IncomingEdges
+
+	Src *SourcePos `json:"src,omitempty" short:"src"` // Omitted with Options.OmitSource
+
+	Missing bool `json:"missing,omitempty" short:"m"` // A stub for a knot that does not exist, see Options.AllowMissingTargets
+
+	MergedFrom []string `json:"mergedFrom,omitempty" short:"mf"` // IDs of the nodes merged into this one, see Options.MergeEquivalentNodes
+
+	Parent *IncomingEdge `json:"parent,omitempty" short:"p"` // Only filled with Options.ParentPointers
+
+	parent *IncomingEdge // the edge that first discovered the node, used by Explain
 }
 
 // StoryEdge represents a choice leading from one StoryNode to another.
 type StoryEdge struct {
-	Text         string `json:"text"`
-	TargetNodeID string `json:"targetNodeId"`
-	Stitch       string `json:"stitch,omitempty"`
+	Text         string `json:"text" short:"t"`
+	TargetNodeID string `json:"targetNodeId" short:"to"`
+	Stitch       string `json:"stitch,omitempty" short:"st"`
+
+	UntrackedStateChanges []string `json:"untrackedStateChanges,omitempty" short:"u"` // Assignments to states pruned by Options.PruneUnreadStates
+
+	// Only filled with Options.IncludeSourceLogic
+	Condition    string          `json:"condition,omitempty" short:"cd"`    // The choice's condition, as written
+	StateChanges []string        `json:"stateChanges,omitempty" short:"sx"` // The choice's state changes, as written
+	StateDelta   map[string]bool `json:"stateDelta,omitempty" short:"sd"`   // States whose value differs in the target node, with their new value
+
+	Src *SourcePos `json:"src,omitempty" short:"src"` // Omitted with Options.OmitSource
+}
+
+// SourcePos locates a node or edge in the script. File is empty when the
+// script was compiled from a string.
+type SourcePos struct {
+	File        string `json:"file,omitempty" short:"f"`
+	Line        int    `json:"line" short:"l"`                   // Knot declaration for a node, choice line for an edge
+	ContentLine int    `json:"contentLine,omitempty" short:"cl"` // Nodes only: first line of the text block that supplied Content
+}
+
+// IncomingEdge is a choice, seen from its target, that leads into a StoryNode.
+type IncomingEdge struct {
+	SourceNodeID string `json:"sourceNodeId" short:"from"`
+	Text         string `json:"text" short:"t"`
+}
+
+// Ending summarizes one reachable END node, so consumers can build an ending
+// screen without scanning the graph.
+type Ending struct {
+	NodeID   string          `json:"nodeId" short:"n"`
+	KnotName string          `json:"knotName" short:"k"`
+	Name     string          `json:"name,omitempty" short:"nm"` // Label from "END: label", empty for an unnamed ending
+	Scene    string          `json:"scene" short:"sc"`
+	State    map[string]bool `json:"state" short:"s"` // The state the ending is reached with
+}
+
+// NodeSource is the source map entry of a node: where its knot, content
+// and choices are in the script. File is empty when the script was compiled
+// from a string.
+type NodeSource struct {
+	File             string        `json:"file,omitempty" short:"f"`
+	KnotLine         int           `json:"knotLine" short:"k"`
+	ContentBlockLine int           `json:"contentBlockLine,omitempty" short:"c"` // First line of the text block that supplied the content
+	Edges            []*EdgeSource `json:"edges" short:"e"`                      // In the order of the node's edges
+}
+
+// EdgeSource is the source map entry of an edge.
+type EdgeSource struct {
+	ChoiceLine int `json:"choiceLine" short:"l"`
+}
+
+// Options controls optional compile behaviour. The zero value gives the
+// behaviour of Compile.
+type Options struct {
+	// Strict turns header keys that look like mistyped directives into errors
+	// instead of warnings. A script can also opt in with "// STRICT: true".
+	Strict bool
+
+	// StartKnot names the knot the analysis starts from. Defaults to "index".
+	StartKnot string
+
+	// InitialStates overrides the initial value of declared states, which
+	// otherwise all start false. Overriding an undeclared state is an error.
+	InitialStates map[string]bool
+
+	// UnreachableKnotsAsErrors fails the compile when a knot is never reached
+	// from the starting knot, instead of reporting it as a warning.
+	UnreachableKnotsAsErrors bool
+
+	// UnreachableEndingsAsErrors fails the compile when an END knot is never
+	// reached, e.g. because a condition guarding it can never hold. Without it
+	// such endings are reported as warnings naming the choices that lead to them.
+	UnreachableEndingsAsErrors bool
+
+	// DeadEndsAsErrors fails the compile when a reachable node has no
+	// available choices and is not marked END.
+	DeadEndsAsErrors bool
+
+	// MaxNodes stops the analysis with an error once the graph would grow
+	// beyond this many nodes. Zero means DefaultMaxNodes; a negative value
+	// disables the limit.
+	MaxNodes int
+
+	// MaxDepth stops expanding nodes this many choices away from the start
+	// node. Zero means no limit. Useful when debugging a runaway script.
+	MaxDepth int
+
+	// CompactIDs emits short node IDs made of the knot name and a hash of the
+	// state, e.g. "cellar#3f2a9c0d1b4e5f67", instead of the verbose
+	// "cellar|has_key=true,..." form. The full state stays in each node's State.
+	CompactIDs bool
+
+	// IncomingEdges fills StoryNode.IncomingEdges with each node's
+	// predecessors, so consumers can answer "how did the player get here?"
+	// without inverting the graph themselves.
+	IncomingEdges bool
+
+	// PruneUnreadStates leaves states that no condition ever reads out of
+	// node identity, so they no longer multiply the number of nodes. Their
+	// assignments are still reported on edges as UntrackedStateChanges.
+	PruneUnreadStates bool
+
+	// Concurrency is the number of goroutines used to expand the graph. Zero
+	// means runtime.GOMAXPROCS(0); 1 builds on the calling goroutine. The
+	// output is identical for every value.
+	Concurrency int
+
+	// OmitSource leaves the "src" source positions out of nodes and edges,
+	// for production builds where output size matters.
+	OmitSource bool
+
+	// AllowMissingTargets lets a draft compile when choices lead to knots
+	// that do not exist yet. Each missing knot becomes a stub node with the
+	// ID "name|", content "[missing knot: name]" and no edges, and is
+	// reported once as a warning listing every choice that refers to it.
+	AllowMissingTargets bool
+
+	// MergeEquivalentNodes merges nodes of the same knot that the player
+	// cannot tell apart: same content, and choices with the same text that
+	// lead to equivalent nodes. This catches states that matter elsewhere in
+	// the story but not from here on. The surviving node lists the IDs of the
+	// nodes merged into it in MergedFrom.
+	MergeEquivalentNodes bool
+
+	// ParentPointers includes in each node the edge through which the
+	// breadth-first search first discovered it. Following parents back to
+	// the start node gives a shortest path that explains why the node
+	// exists; Explain does this for you.
+	ParentPointers bool
+
+	// IncludeSourceLogic copies the condition and state changes of each
+	// edge's choice onto the edge, verbatim as written in the script, and
+	// adds the states that actually changed between its source and target
+	// nodes, for debugging overlays. The delta can differ from the written
+	// changes, since flags cannot be reset, local states reset on leaving a
+	// scene, and TURNS and TRACK-VISITS set states of their own.
+	IncludeSourceLogic bool
+
+	// DedupContent writes each distinct node content once, in a top-level
+	// "contents" array, and gives each node a "contentRef" index into it
+	// and an empty "content". Stories whose states mostly affect choices
+	// repeat the same prose in many nodes, so this can shrink the output
+	// considerably. Only the serialized document changes: the compiled
+	// graph keeps every node's Content, and LoadGraph resolves references
+	// back into Content. Since "content" changes meaning, the document is
+	// written with TableFormatVersion.
+	DedupContent bool
+
+	// OmitStates leaves the state map out of every node of the document,
+	// which with many states and nodes is most of its size. The document
+	// instead lists the state names once, in a top-level "stateNames"
+	// array, and gives each node a "stateBits" string with one character
+	// per name: '1' true, '0' false, and '-' for a scene-scoped state the
+	// node does not have. As with DedupContent, the compiled graph is
+	// unchanged and LoadGraph rebuilds the maps. Nodes then have a null
+	// "state", so the document is written with TableFormatVersion: a 1.x
+	// reader would see no states at all.
+	OmitStates bool
+
+	// IncludeSourceMap adds a top-level "sourceMap" to the output, mapping
+	// each node ID to the lines of its knot, content block and choices, for
+	// debuggers and coverage tools. It is independent of OmitSource.
+	IncludeSourceMap bool
+
+	// ExternalConditions gives the values of condition names written with
+	// an "ext:" prefix, as in "{ext:hard_mode == true}", for conditions that
+	// depend on the build rather than the story. They are constants: each
+	// is resolved before the graph is built and never appears in a node's
+	// state or ID. An external name with no value here is a compile error.
+	ExternalConditions map[string]bool
+
+	// AssetValidator, if set, is called with the kind ("image" or "audio")
+	// and path of every asset directive, so a build can check the files
+	// exist. An error fails the compile at the directive's line with code
+	// CodeAsset.
+	AssetValidator func(kind, path string) error
+
+	// DirectiveHandler, if set, is offered every "// key: value" comment
+	// that is not a built-in directive; see DirectiveHandler. A Compiler
+	// assumes it returns the same for the same script.
+	DirectiveHandler DirectiveHandler
+
+	// Translations, if set, replaces the text of blocks and choices with
+	// their entries in the catalog, keyed as by ExtractCatalog. Node IDs,
+	// structure and conditions are those of the source script. Text missing
+	// from the catalog keeps its source wording and is reported in one
+	// warning that lists the missing keys.
+	Translations Catalog
+
+	// OnProgress, if set, is called during the graph search with running
+	// counts, for progress bars on large stories. It runs synchronously on
+	// the goroutine that merges search results, between nodes, and receives
+	// a copy of the counts, so it cannot disturb the build; a slow callback
+	// only slows the build down. It is called every ProgressInterval nodes,
+	// and also whenever ProgressPeriod has passed since the last call, and
+	// once more with Done set when the search ends.
+	OnProgress func(ProgressInfo)
+
+	// ProgressInterval is the number of nodes expanded between OnProgress
+	// calls. Zero means 1000.
+	ProgressInterval int
+
+	// ProgressPeriod, if positive, also calls OnProgress when this much time
+	// has passed since the last call.
+	ProgressPeriod time.Duration
+
+	// Logger, if set, receives a debug trace of the graph search: choices
+	// skipped and why, assignments ignored, nodes created or already
+	// visited, and edges added. Events are written in search order from the
+	// merging goroutine, so the trace is the same for every Concurrency.
+	// Without a Logger none of this is computed.
+	Logger Logger
+
+	// Format is the serialization used by CompileResult.Encode. The default,
+	// FormatJSON, is the indented JSON of Compile.
+	Format OutputFormat
+}
+
+// Logger receives the debug trace enabled by Options.Logger.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+}
+
+// ProgressInfo reports how far a graph search has got.
+type ProgressInfo struct {
+	NodesCreated  int           // Nodes discovered so far
+	EdgesCreated  int           // Edges added so far
+	NodesExpanded int           // Nodes whose choices have been followed
+	QueueLen      int           // Nodes discovered but not yet expanded
+	Depth         int           // Choices from the start node of the level being expanded
+	CurrentKnot   string        // Knot of the node just expanded
+	Elapsed       time.Duration // Time since the search started
+	Done          bool          // Set on the final call, when the search has ended
+}
+
+// CompileResult is the in-memory result of a successful compile.
+type CompileResult struct {
+	Graph    *StoryGraph
+	Title    string
+	Author   string
+	Language string
+	IFID     string                 // Declared by the script, or generated from the title and author
+	Metadata map[string]interface{} // Header metadata with values converted to bools, numbers and lists where possible
+	Warnings []string               // Non-fatal problems, each prefixed with its source location where known
+
+	// Diagnostics holds the same warnings with their code and position as
+	// separate fields. Every analysis reports into it.
+	Diagnostics []Diagnostic
+
+	// Notes are the script's TODO, FIXME and NOTE comments, in source
+	// order. They are not part of the serialized graph.
+	Notes []Note
+
+	format OutputFormat
 }
 
 // Compile is the main public entry point for the BigIF engine.
 // It takes a script as a string and returns the fully processed StoryGraph as a JSON byte slice.
 func Compile(scriptContent string) ([]byte, error) {
-	// 1. Parse the script into an AST
+	graph, err := CompileToGraph(scriptContent)
+	if err != nil {
+		return nil, err
+	}
+	return JSONMarshaler{}.Marshal(graph, graphMetadata(graph))
+}
+
+// CompileToGraph compiles a script with default options and returns the
+// graph itself, for Go programs that want to walk it without decoding JSON.
+// Marshaling the graph produces the same document as Compile.
+func CompileToGraph(scriptContent string) (*StoryGraph, error) {
+	result, err := CompileWithOptions(scriptContent, Options{})
+	if err != nil {
+		return nil, err
+	}
+	return result.Graph, nil
+}
+
+// Parse parses a script into its AST without building the graph, for tools
+// that only need the knots, choices and declarations. Includes are not
+// followed, and the checks that run at compile time are not applied.
+func Parse(scriptContent string) (*Script, error) {
 	ast, err := parse(scriptContent)
 	if err != nil {
 		return nil, fmt.Errorf("parsing error: %w", err)
 	}
+	return ast, nil
+}
+
+// CompileWithOptions compiles a script string with the given options and
+// returns the result without serializing it.
+func CompileWithOptions(scriptContent string, opts Options) (*CompileResult, error) {
+	return CompileWithOptionsContext(context.Background(), scriptContent, opts)
+}
+
+// CompileContext is Compile with a context. The graph search stops soon
+// after ctx is done, returning an error with code CodeCanceled that wraps
+// ctx.Err() and says how many nodes had been expanded, so a server can bound
+// the time spent on a pathological script.
+func CompileContext(ctx context.Context, scriptContent string) ([]byte, error) {
+	result, err := CompileWithOptionsContext(ctx, scriptContent, Options{})
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(result.Graph, "", "  ")
+}
+
+// CompileWithOptionsContext is CompileWithOptions with a context; see CompileContext.
+func CompileWithOptionsContext(ctx context.Context, scriptContent string, opts Options) (*CompileResult, error) {
+	// 1. Parse the script into an AST
+	ast, err := parseWithOptions(scriptContent, opts)
+	if err != nil {
+		return nil, fmt.Errorf("parsing error: %w", err)
+	}
+
+	return compileScript(ctx, ast, opts)
+}
+
+// CompileReader compiles a script read from r with default options. The
+// script is parsed line by line as it is read, so large generated scripts do
+// not have to be loaded into a string first. INCLUDE directives are not
+// supported; use CompileFile for those.
+func CompileReader(r io.Reader) ([]byte, error) {
+	ast, err := parseReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("parsing error: %w", err)
+	}
+	return compileToJSON(ast)
+}
+
+// CompileFile compiles the script at path, following any "// INCLUDE: file"
+// header directives. Included paths are resolved relative to the including file.
+func CompileFile(path string) ([]byte, error) {
+	ast, err := ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return compileToJSON(ast)
+}
+
+// ParseFile parses the script at path into an AST without compiling it,
+// following INCLUDE directives like CompileFile.
+func ParseFile(path string) (*Script, error) {
+	ast, err := parseFile(path, func(from, include string) (string, []byte, error) {
+		name := include
+		if from != "" && !filepath.IsAbs(include) {
+			name = filepath.Join(filepath.Dir(from), filepath.FromSlash(include))
+		}
+		content, err := os.ReadFile(name)
+		return name, content, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("parsing error: %w", err)
+	}
+	return ast, nil
+}
+
+// CompileFS compiles every .biff file under root in fsys as a single story.
+// Files are parsed in lexical path order and their knots and header directives
+// are merged; knot name collisions are an error. This works with embed.FS and
+// os.DirFS alike.
+func CompileFS(fsys fs.FS, root string) ([]byte, error) {
+	ast, err := parseFS(fsys, root)
+	if err != nil {
+		return nil, fmt.Errorf("parsing error: %w", err)
+	}
+	return compileToJSON(ast)
+}
+
+// compileToJSON compiles a parsed script with default options and serializes it.
+func compileToJSON(ast *Script) ([]byte, error) {
+	result, err := compileScript(context.Background(), ast, Options{})
+	if err != nil {
+		return nil, err
+	}
+	return result.JSON()
+}
+
+// compileScript builds the graph for a parsed script.
+func compileScript(ctx context.Context, ast *Script, opts Options) (*CompileResult, error) {
+	if err := prepareScript(ast, opts); err != nil {
+		return nil, err
+	}
 
 	// 2. Analyze the AST to build the graph of reachable states
-	graph, err := buildGraph(ast)
+	graph, err := buildGraph(ctx, ast, opts)
 	if err != nil {
 		return nil, fmt.Errorf("graph analysis error: %w", err)
 	}
+	result := newCompileResult(ast, graph)
+	result.format = opts.Format
+	return result, nil
+}
+
+// prepareScript runs the static checks that need no graph. In strict mode,
+// header keys that look like mistyped directives are an error; otherwise
+// they are reported as warnings, along with problems in state usage and
+// assignments that can never take effect. It also resolves external
+// conditions, adds the states of TRACK-VISITS and TURNS, applies
+// Options.Translations and compiles the conditions for graph construction.
+func prepareScript(ast *Script, opts Options) error {
+	if err := resolveExternalConditions(ast, opts.ExternalConditions); err != nil {
+		return fmt.Errorf("parsing error: %w", err)
+	}
+	if err := validateAssets(ast, opts.AssetValidator); err != nil {
+		return fmt.Errorf("parsing error: %w", err)
+	}
+	if err := trackVisits(ast); err != nil {
+		return fmt.Errorf("parsing error: %w", err)
+	}
+	if err := countTurns(ast); err != nil {
+		return fmt.Errorf("parsing error: %w", err)
+	}
+	if len(ast.UnknownDirectives) > 0 {
+		if opts.Strict || ast.Strict {
+			return fmt.Errorf("parsing error: %w", errorf(CodeUnknownDirective, "%s", strings.Join(diagnosticStrings(ast.UnknownDirectives), "; ")))
+		}
+		ast.Warnings = append(ast.Warnings, ast.UnknownDirectives...)
+	}
+	ast.Warnings = append(ast.Warnings, stateUsageWarnings(ast, opts)...)
+	ast.Warnings = append(ast.Warnings, flagResetWarnings(ast)...)
+	ast.Warnings = append(ast.Warnings, stuckStateWarnings(ast)...)
+	ast.Warnings = append(ast.Warnings, localScopeWarnings(ast, opts)...)
+	if opts.Translations != nil {
+		ast.Warnings = append(ast.Warnings, translateScript(ast, opts.Translations)...)
+	}
+	compileConditions(ast)
+	return nil
+}
+
+// newCompileResult assembles the result for a script and its finished graph.
+func newCompileResult(ast *Script, graph *StoryGraph) *CompileResult {
+	ifid := ast.IFID
+	if ifid == "" {
+		ifid = generateIFID(ast.Title, ast.Author, graph)
+	}
+	graph.info = storyInfo{title: ast.Title, author: ast.Author, language: ast.Language, ifid: ifid}
+
+	return &CompileResult{
+		Graph:       graph,
+		Title:       ast.Title,
+		Author:      ast.Author,
+		Language:    ast.Language,
+		IFID:        ifid,
+		Metadata:    graph.Metadata,
+		Warnings:    diagnosticStrings(graph.warnings),
+		Diagnostics: graph.warnings,
+		Notes:       ast.Notes,
+	}
+}
+
+// JSON serializes the result to the JSON structure described in the specification.
+func (r *CompileResult) JSON() ([]byte, error) {
+	return JSONMarshaler{}.Marshal(r.Graph, r.metadata())
+}
+
+// MarshalJSON encodes the graph as the complete document described in the
+// specification, the same one Compile returns.
+func (g *StoryGraph) MarshalJSON() ([]byte, error) {
+	return json.Marshal(document(g, g.info, g.Metadata, diagnosticStrings(g.warnings)))
+}
+
+// UnmarshalJSON decodes a document produced by Compile or MarshalJSON.
+func (g *StoryGraph) UnmarshalJSON(data []byte) error {
+	var doc graphDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if err := checkFormatVersion(doc.FormatVersion); err != nil {
+		return err
+	}
+	if err := doc.resolveNodes(); err != nil {
+		return err
+	}
+	*g = *doc.storyGraph()
+	return nil
+}
 
-	// 3. Serialize the final graph to JSON with the correct nested structure.
+// graphDocument is the document written by Compile, in typed form for
+// decoding and for the compact and binary formats. Compile itself writes
+// the document as a map, so its keys come out in sorted order.
+type graphDocument struct {
+	FormatVersion string `json:"formatVersion" short:"v"`
+	Generator     string `json:"generator" short:"gen"`
+
+	Title    string                 `json:"title" short:"t"`
+	Author   string                 `json:"author" short:"a"`
+	Language string                 `json:"language" short:"l"`
+	IFID     string                 `json:"ifid" short:"i"`
+	Metadata map[string]interface{} `json:"metadata" short:"m"`
+	Graph    struct {
+		StartNodeID string                `json:"startNodeId" short:"s"`
+		Nodes       map[string]*StoryNode `json:"nodes" short:"n"`
+	} `json:"graph" short:"g"`
+	Endings   []*Ending              `json:"endings" short:"e"`
+	Warnings  []string               `json:"warnings,omitempty" short:"w"`
+	SourceMap map[string]*NodeSource `json:"sourceMap,omitempty" short:"sm"`
+
+	// Tables the nodes refer to, see outputNodes
+	Contents   []string `json:"contents,omitempty" short:"cs"`   // Node contents, with Options.DedupContent
+	StateNames []string `json:"stateNames,omitempty" short:"sn"` // Names of the node state bits, with Options.OmitStates
+}
+
+// newGraphDocument builds the document for a graph with the story fields
+// of meta.
+func newGraphDocument(g *StoryGraph, meta Metadata) *graphDocument {
+	doc := &graphDocument{
+		FormatVersion: g.formatVersion(), Generator: generator(),
+		Title: meta.Title, Author: meta.Author, Language: meta.Language, IFID: meta.IFID,
+		Metadata: meta.Values, Endings: g.Endings, Warnings: meta.Warnings, SourceMap: g.SourceMap,
+	}
+	doc.Graph.StartNodeID = g.StartNodeID
+	nodes, tables := outputNodes(g)
+	doc.Graph.Nodes, doc.Contents, doc.StateNames = nodes, tables.contents, tables.stateNames
+	return doc
+}
+
+// documentTables holds the tables the nodes of a document refer to.
+type documentTables struct {
+	contents   []string // With Options.DedupContent
+	stateNames []string // With Options.OmitStates
+}
+
+// outputNodes returns the nodes as a document lists them. With
+// Options.DedupContent, each node's content is replaced by a reference into
+// the returned contents, which hold each distinct content once, in sorted
+// order. With Options.OmitStates, each node's state is replaced by its
+// StateBits over the returned state names, every state present in some
+// node, in sorted order. The nodes are then copies; otherwise they are the
+// graph's own.
+func outputNodes(g *StoryGraph) (map[string]*StoryNode, documentTables) {
+	var tables documentTables
+	if !g.dedupContent && !g.omitStates {
+		return g.Graph, tables
+	}
+	refs := make(map[string]int)
+	index := make(map[string]int)
+	for _, node := range g.Graph {
+		refs[node.Content] = 0
+		for state := range node.State {
+			index[state] = 0
+		}
+	}
+	if g.dedupContent {
+		for content := range refs {
+			tables.contents = append(tables.contents, content)
+		}
+		sort.Strings(tables.contents)
+		for i, content := range tables.contents {
+			refs[content] = i
+		}
+	}
+	if g.omitStates {
+		tables.stateNames = make([]string, 0, len(index))
+		for state := range index {
+			tables.stateNames = append(tables.stateNames, state)
+		}
+		sort.Strings(tables.stateNames)
+		for i, state := range tables.stateNames {
+			index[state] = i
+		}
+	}
+
+	nodes := make(map[string]*StoryNode, len(g.Graph))
+	for id, node := range g.Graph {
+		written := *node
+		if g.dedupContent {
+			ref := refs[node.Content]
+			written.Content, written.ContentRef = "", &ref
+		}
+		if g.omitStates {
+			bits := []byte(strings.Repeat(string(stateAbsent), len(tables.stateNames)))
+			for state, value := range node.State {
+				bits[index[state]] = stateBit(value)
+			}
+			written.State, written.StateBits = nil, string(bits)
+		}
+		nodes[id] = &written
+	}
+	return nodes, tables
+}
+
+// The characters of StoryNode.StateBits.
+const (
+	stateFalse  = '0'
+	stateTrue   = '1'
+	stateAbsent = '-' // A scene-scoped state outside its scene
+)
+
+func stateBit(value bool) byte {
+	if value {
+		return stateTrue
+	}
+	return stateFalse
+}
+
+// resolveNodes puts back the content and state of every node written with
+// Options.DedupContent or Options.OmitStates, from the document's tables.
+func (doc *graphDocument) resolveNodes() error {
+	var errs []*Error
+	for _, id := range sortedNodeIDs(&StoryGraph{Graph: doc.Graph.Nodes}) {
+		node := doc.Graph.Nodes[id]
+		if node == nil {
+			continue
+		}
+		if node.ContentRef != nil {
+			if ref := *node.ContentRef; ref < 0 || ref >= len(doc.Contents) {
+				errs = append(errs, errorf(CodeMalformedGraph, "node '%s' refers to content %d, but the document has %d", id, ref, len(doc.Contents)))
+			} else {
+				node.Content, node.ContentRef = doc.Contents[ref], nil
+			}
+		}
+		if node.State == nil || node.StateBits != "" {
+			state, err := decodeStateBits(node.StateBits, doc.StateNames)
+			if err != nil {
+				errs = append(errs, errorf(CodeMalformedGraph, "node '%s': %v", id, err))
+				continue
+			}
+			node.State, node.StateBits = state, ""
+		}
+	}
+	if len(errs) > 0 {
+		return errorList(errs)
+	}
+	return nil
+}
+
+// decodeStateBits rebuilds a state map from its StateBits over names.
+func decodeStateBits(bits string, names []string) (map[string]bool, error) {
+	if len(bits) != len(names) {
+		return nil, fmt.Errorf("state bits '%s' do not match the %d state names", bits, len(names))
+	}
+	state := make(map[string]bool)
+	for i := 0; i < len(bits); i++ {
+		switch bits[i] {
+		case stateFalse, stateTrue:
+			state[names[i]] = bits[i] == stateTrue
+		case stateAbsent:
+		default:
+			return nil, fmt.Errorf("invalid character %q in state bits '%s'", bits[i], bits)
+		}
+	}
+	return state, nil
+}
+
+// storyGraph returns the graph a decoded document describes.
+func (doc *graphDocument) storyGraph() *StoryGraph {
+	// Warnings read back from a document have lost their structure; each
+	// becomes a diagnostic whose message is the whole line.
+	var warnings []Diagnostic
+	for _, warning := range doc.Warnings {
+		warnings = append(warnings, Diagnostic{Severity: SeverityWarning, Message: warning})
+	}
+	return &StoryGraph{
+		StartNodeID: doc.Graph.StartNodeID,
+		Metadata:    doc.Metadata,
+		Graph:       doc.Graph.Nodes,
+		Endings:     doc.Endings,
+		SourceMap:   doc.SourceMap,
+		warnings:    warnings,
+		info:        storyInfo{title: doc.Title, author: doc.Author, language: doc.Language, ifid: doc.IFID},
+	}
+}
+
+// document lays out the JSON output: the story fields at the top level and
+// the nodes nested under "graph".
+func document(graph *StoryGraph, info storyInfo, metadata map[string]interface{}, warnings []string) map[string]interface{} {
+	nodes, tables := outputNodes(graph)
 	output := map[string]interface{}{
-		"metadata": ast.Metadata,
+		"formatVersion": graph.formatVersion(),
+		"generator":     generator(),
+		"title":         info.title,
+		"author":        info.author,
+		"language":      info.language,
+		"ifid":          info.ifid,
+		"metadata":      metadata,
 		"graph": map[string]interface{}{
-			"nodes": graph.Graph,
+			"startNodeId": graph.StartNodeID,
+			"nodes":       nodes,
 		},
+		"endings": graph.Endings,
+	}
+	if len(warnings) > 0 {
+		output["warnings"] = warnings
+	}
+	if graph.SourceMap != nil {
+		output["sourceMap"] = graph.SourceMap
 	}
+	if tables.contents != nil {
+		output["contents"] = tables.contents
+	}
+	if tables.stateNames != nil {
+		output["stateNames"] = tables.stateNames
+	}
+	return output
+}
 
-	return json.MarshalIndent(output, "", "  ")
+// ifidNamespace is the UUID namespace for IFIDs generated by BigIF.
+var ifidNamespace = [16]byte{0xf8, 0x8c, 0x51, 0xd2, 0x6a, 0xdd, 0x42, 0xac, 0x85, 0x12, 0x48, 0x97, 0xa3, 0x3f, 0x69, 0xb0}
+
+// generateIFID derives a stable IFID (a name-based UUID, version 5) from the
+// story's title and author, so recompiling an edited script keeps its identity.
+// A story with neither is named by the knots of its graph instead, so that
+// untitled stories do not all share one IFID.
+func generateIFID(title, author string, graph *StoryGraph) string {
+	name := title + "\n" + author
+	if title == "" && author == "" {
+		name = strings.Join(graphKnotNames(graph), "\n")
+	}
+	h := sha1.New()
+	h.Write(ifidNamespace[:])
+	h.Write([]byte(name))
+	sum := h.Sum(nil)
+
+	sum[6] = (sum[6] & 0x0f) | 0x50 // version 5
+	sum[8] = (sum[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16]))
 }
 
+// graphKnotNames returns the names of the knots with nodes in graph, in
+// order, leaving out missing-knot stubs.
+func graphKnotNames(graph *StoryGraph) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, node := range graph.Graph {
+		if !node.Missing && !seen[node.KnotName] {
+			seen[node.KnotName] = true
+			names = append(names, node.KnotName)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
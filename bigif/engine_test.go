@@ -1,13 +1,39 @@
 package bigif
 
 import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/gob"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	goast "go/ast"
+	"go/format"
+	goparser "go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
 func TestSimpleCompilation(t *testing.T) {
 	script := `
 // title: My Story
@@ -68,12 +94,12 @@ You did the thing.
 
 	graphObj := result["graph"].(map[string]interface{})
 	nodes := graphObj["nodes"].(map[string]interface{})
-	
+
 	require.Contains(t, nodes, "next|major_event=true", "The 'next' node should exist in the graph")
 	nextNode := nodes["next|major_event=true"].(map[string]interface{})
 	edges := nextNode["edges"].([]interface{})
 	edge := edges[0].(map[string]interface{})
-	
+
 	assert.Equal(t, "index|major_event=true", edge["targetNodeId"])
 }
 
@@ -107,7 +133,7 @@ func TestLocalState(t *testing.T) {
 	require.Contains(t, nodes, "room1|global_quest_active=false,has_room_key=true")
 	node1 := nodes["room1|global_quest_active=false,has_room_key=true"].(map[string]interface{})
 	edgeToHallway := node1["edges"].([]interface{})[1].(map[string]interface{})
-	
+
 	expectedTargetID := "hallway|global_quest_active=false,has_room_key=false"
 	assert.Equal(t, expectedTargetID, edgeToHallway["targetNodeId"], "Local state should be purged when changing scenes")
 }
@@ -135,7 +161,7 @@ func TestConditionalText(t *testing.T) {
 	require.Contains(t, nodes, "index|power_on=false")
 	darkNode := nodes["index|power_on=false"].(map[string]interface{})
 	assert.Equal(t, "The room is dark.\nIt is very spooky.", darkNode["content"])
-	
+
 	require.Contains(t, nodes, "index|power_on=true")
 	lightNode := nodes["index|power_on=true"].(map[string]interface{})
 	assert.Equal(t, "The lights are on.", lightNode["content"])
@@ -162,7 +188,7 @@ END
 	var result map[string]interface{}
 	err = json.Unmarshal(outputJSON, &result)
 	require.NoError(t, err)
-	
+
 	graphObj := result["graph"].(map[string]interface{})
 	nodes := graphObj["nodes"].(map[string]interface{})
 
@@ -171,3 +197,5293 @@ END
 	assert.Len(t, nodes, 3, "Should only have 3 reachable nodes")
 }
 
+func TestDuplicateKnotDefinition(t *testing.T) {
+	script := `
+=== index ===
+* Go down. -> cellar
+
+=== cellar ===
+It is damp.
+
+=== cellar ===
+It is dry.
+`
+	_, err := Compile(script)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 8")
+	assert.Contains(t, err.Error(), "line 5")
+}
+
+func TestInvalidIdentifiers(t *testing.T) {
+	_, err := Compile("=== index ===\n* Go. -> a|b\n\n=== a|b ===\nEND\n")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 4")
+	assert.Contains(t, err.Error(), "invalid knot name 'a|b'")
+
+	_, err = Compile("// STATES: ok, has=key\n=== index ===\nEND\n")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 1")
+	assert.Contains(t, err.Error(), "invalid state name 'has=key'")
+}
+
+func TestNamedEndings(t *testing.T) {
+	script := `
+// ENDINGS: redemption, tragedy, neutral
+
+=== index ===
+* Forgive. -> forgive
+* Fight. -> fight
+
+=== forgive ===
+You lay down your sword.
+END: redemption
+
+=== fight ===
+Nobody wins.
+END: pyrrhic
+`
+	outputJSON, err := Compile(script)
+	require.NoError(t, err)
+
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(outputJSON, &result))
+
+	nodes := result["graph"].(map[string]interface{})["nodes"].(map[string]interface{})
+	forgive := nodes["forgive|"].(map[string]interface{})
+	assert.Equal(t, true, forgive["isEnd"])
+	assert.Equal(t, "redemption", forgive["endingName"])
+
+	endings := result["endings"].([]interface{})
+	require.Len(t, endings, 2)
+	first := endings[0].(map[string]interface{})
+	assert.Equal(t, "pyrrhic", first["name"])
+	assert.Equal(t, "fight|", first["nodeId"])
+	assert.Equal(t, "fight", first["knotName"])
+
+	warnings := result["warnings"].([]interface{})
+	require.Len(t, warnings, 3)
+	assert.Contains(t, warnings[0], "ending 'pyrrhic' in knot 'fight' is not declared")
+	assert.Contains(t, warnings[1], "declared ending 'tragedy' is never reached")
+	assert.Contains(t, warnings[2], "declared ending 'neutral' is never reached")
+}
+
+func TestEndingsSummary(t *testing.T) {
+	script := `// SCENES: road, home
+// STATES: tired
+
+=== index ===
+// scene: road
+* Rest. ~ tired = false -> index
+* Run. ~ tired = true -> home
+
+=== home ===
+// scene: home
+- {tired == true} You collapse into bed.
+END
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, []*Ending{
+		{NodeID: "home|tired=true", KnotName: "home", Scene: "home", State: map[string]bool{"tired": true}},
+	}, result.Graph.Endings)
+
+	compact, err := CompileWithOptions(script, Options{CompactIDs: true})
+	require.NoError(t, err)
+	require.Len(t, compact.Graph.Endings, 1)
+	assert.Contains(t, compact.Graph.Graph, compact.Graph.Endings[0].NodeID, "endings use the final node IDs")
+}
+
+func TestTrappedRegions(t *testing.T) {
+	script := `=== index ===
+* Go home. -> home
+* Enter the maze. -> maze_a
+
+=== home ===
+END
+
+=== maze_a ===
+The walls all look the same.
+* Turn left. -> maze_b
+
+=== maze_b ===
+The walls still look the same.
+* Turn right. -> maze_a
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"at index|, choice 'Enter the maze.' leads to maze_a|, from which no ending can be reached",
+	}, result.Warnings)
+
+	analysis := Analyze(result.Graph)
+	assert.Equal(t, []string{"maze_a|", "maze_b|"}, analysis.TrappedNodes)
+	assert.Equal(t, []TrapEntry{
+		{SourceNodeID: "index|", Choice: "Enter the maze.", TargetNodeID: "maze_a|"},
+	}, analysis.TrapEntries)
+}
+
+func TestChoiceAvailability(t *testing.T) {
+	script := `// STATES: key, lamp
+
+=== index ===
+* Take the key. ~ key = true -> hub
+* Take the lamp. ~ lamp = true -> hub
+
+=== hub ===
+A locked door.
+* {key == true} Unlock the door. -> index
+* {lamp == true} Light the lamp. -> index
+* {key == true && lamp == true} Unlock the door by lamplight. -> index
+* {key != true} Search for a key. ~ key = true -> hub
+* Wait. -> index
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+
+	matrix, err := ChoiceAvailability(result.Graph, "hub")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Unlock the door.", "Light the lamp.", "Unlock the door by lamplight.", "Search for a key.", "Wait."}, matrix.Choices)
+	require.Len(t, matrix.Rows, 3)
+	assert.Equal(t, "hub|key=false,lamp=true", matrix.Rows[0].NodeID)
+	assert.Equal(t, []string{"Light the lamp.", "Search for a key.", "Wait."}, matrix.Rows[0].Visible)
+	assert.Equal(t, []string{"Unlock the door.", "Wait."}, matrix.Rows[1].Visible)
+	assert.Equal(t, []string{"Unlock the door.", "Light the lamp.", "Unlock the door by lamplight.", "Wait."}, matrix.Rows[2].Visible)
+
+	assert.Equal(t, "state,Unlock the door.,Light the lamp.,Unlock the door by lamplight.,Search for a key.,Wait.\n"+
+		"key=false lamp=true,,x,,x,x\n"+
+		"key=true lamp=false,x,,,,x\n"+
+		"key=true lamp=true,x,x,x,,x\n", matrix.CSV())
+	lines := strings.Split(strings.TrimSuffix(matrix.String(), "\n"), "\n")
+	require.Len(t, lines, 4)
+	assert.True(t, strings.HasPrefix(lines[0], "state                Unlock the door.  Light the lamp."), lines[0])
+	assert.True(t, strings.HasPrefix(lines[3], "key=true lamp=true   x                 x"), lines[3])
+
+	output, err := result.JSON()
+	require.NoError(t, err)
+	loaded, err := LoadGraph(output)
+	require.NoError(t, err)
+	fromJSON, err := ChoiceAvailability(loaded, "hub")
+	require.NoError(t, err)
+	assert.Equal(t, matrix.Rows, fromJSON.Rows, "a loaded graph yields the same rows")
+
+	_, err = ChoiceAvailability(result.Graph, "cellar")
+	assert.EqualError(t, err, "knot 'cellar' has no reachable nodes")
+}
+
+func TestMergeEquivalentNodes(t *testing.T) {
+	script := `// STATES: lamp
+
+=== index ===
+- {lamp == true} The room is lit.
+- It is dark.
+* {lamp == false} Light the lamp. ~ lamp = true -> index
+* Leave. -> hall
+
+=== hall ===
+A long hall.
+* Wait. -> hall
+* Go on. -> cave
+
+=== cave ===
+END
+`
+	plain, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	assert.Len(t, plain.Graph.Graph, 6)
+
+	result, err := CompileWithOptions(script, Options{MergeEquivalentNodes: true})
+	require.NoError(t, err)
+	assert.Len(t, result.Graph.Graph, 4, "lamp is never read after the index knot")
+
+	hall := result.Graph.Graph["hall|lamp=false"]
+	require.NotNil(t, hall)
+	assert.Equal(t, []string{"hall|lamp=true"}, hall.MergedFrom)
+	assert.Equal(t, "hall|lamp=false", hall.Edges[0].TargetNodeID, "the loop points at the survivor")
+	assert.Equal(t, "cave|lamp=false", hall.Edges[1].TargetNodeID)
+	assert.Equal(t, []string{"cave|lamp=true"}, result.Graph.Graph["cave|lamp=false"].MergedFrom)
+	assert.Equal(t, "hall|lamp=false", result.Graph.Graph["index|lamp=true"].Edges[0].TargetNodeID)
+	assert.Nil(t, result.Graph.Graph["index|lamp=true"].MergedFrom, "different content is never merged")
+	require.Len(t, result.Graph.Endings, 1)
+
+	output, err := result.JSON()
+	require.NoError(t, err)
+	assert.Contains(t, string(output), `"mergedFrom": [`)
+
+	explanation, err := Explain(result.Graph, "cave|lamp=false")
+	require.NoError(t, err)
+	assert.Equal(t, "start at index\nchoose 'Leave.' -> hall\nchoose 'Go on.' -> cave\n", explanation)
+}
+
+func TestReachabilityQueries(t *testing.T) {
+	script := `// STATES: key
+
+=== index ===
+* Enter the hall. -> hall
+
+=== hall ===
+* Go back. -> index
+* {key == false} Take the key. ~ key = true -> hall
+* {key == true} Open the vault. -> vault
+
+=== vault ===
+END
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	graph := result.Graph
+
+	assert.True(t, graph.CanReach("index|key=false", "vault|key=true"))
+	assert.True(t, graph.CanReach("hall|key=true", "index|key=true"), "cycles are followed")
+	assert.False(t, graph.CanReach("hall|key=true", "hall|key=false"), "the key cannot be put back")
+	assert.True(t, graph.CanReach("hall|key=false", "hall|key=false"))
+	assert.False(t, graph.CanReach("index|key=false", "cellar|"))
+
+	path, ok := graph.WitnessPath("index|key=false", "vault|key=true")
+	require.True(t, ok)
+	assert.Equal(t, []PathStep{
+		{NodeID: "index|key=false", Choice: "Enter the hall."},
+		{NodeID: "hall|key=false", Choice: "Take the key."},
+		{NodeID: "hall|key=true", Choice: "Open the vault."},
+		{NodeID: "vault|key=true"},
+	}, path)
+
+	path, ok = graph.WitnessPathWithState("hall|key=false", "index", "key", true)
+	require.True(t, ok)
+	assert.Equal(t, []PathStep{
+		{NodeID: "hall|key=false", Choice: "Take the key."},
+		{NodeID: "hall|key=true", Choice: "Go back."},
+		{NodeID: "index|key=true"},
+	}, path)
+
+	_, ok = graph.WitnessPathWithState("hall|key=true", "index", "key", false)
+	assert.False(t, ok)
+
+	output, err := result.JSON()
+	require.NoError(t, err)
+	loaded, err := LoadGraph(output)
+	require.NoError(t, err)
+	loadedPath, ok := loaded.WitnessPath("index|key=false", "vault|key=true")
+	require.True(t, ok)
+	assert.Len(t, loadedPath, 4, "queries work on loaded graphs")
+}
+
+func TestExplain(t *testing.T) {
+	script := `// STATES: key, door_open
+
+=== index ===
+* Enter the hall. -> hall
+
+=== hall ===
+* {key == false} Take the key. ~ key = true -> hall
+* {key == true} Open the door. ~ door_open = true -> vault
+
+=== vault ===
+END
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	explanation, err := Explain(result.Graph, "vault|door_open=true,key=true")
+	require.NoError(t, err)
+	assert.Equal(t, "start at index\n"+
+		"choose 'Enter the hall.' -> hall\n"+
+		"choose 'Take the key.' ~ key = true -> hall\n"+
+		"choose 'Open the door.' ~ door_open = true -> vault\n", explanation)
+
+	explanation, err = Explain(result.Graph, result.Graph.StartNodeID)
+	require.NoError(t, err)
+	assert.Equal(t, "start at index\n", explanation)
+
+	_, err = Explain(result.Graph, "cellar|")
+	assert.EqualError(t, err, "node 'cellar|' does not exist")
+
+	output, err := result.JSON()
+	require.NoError(t, err)
+	assert.NotContains(t, string(output), `"parent"`, "parents are only emitted on request")
+
+	result, err = CompileWithOptions(script, Options{ParentPointers: true, CompactIDs: true})
+	require.NoError(t, err)
+	output, err = result.JSON()
+	require.NoError(t, err)
+	loaded, err := LoadGraph(output)
+	require.NoError(t, err)
+	var vaultID string
+	for nodeID, node := range loaded.Graph {
+		if node.KnotName == "vault" {
+			vaultID = nodeID
+		}
+	}
+	assert.Equal(t, "Open the door.", loaded.Graph[vaultID].Parent.Text)
+	fromJSON, err := Explain(loaded, vaultID)
+	require.NoError(t, err)
+	assert.Equal(t, explanation+"choose 'Enter the hall.' -> hall\n"+
+		"choose 'Take the key.' ~ key = true -> hall\n"+
+		"choose 'Open the door.' ~ door_open = true -> vault\n", fromJSON, "loaded graphs explain through their parent fields")
+}
+
+func TestCompileToGraph(t *testing.T) {
+	script, err := os.ReadFile(filepath.Join("testdata", "garden.biff"))
+	require.NoError(t, err)
+
+	output, err := Compile(string(script))
+	require.NoError(t, err)
+	graph, err := CompileToGraph(string(script))
+	require.NoError(t, err)
+	marshaled, err := json.MarshalIndent(graph, "", "  ")
+	require.NoError(t, err)
+	assert.Equal(t, string(output), string(marshaled))
+
+	assert.NotEmpty(t, graph.Metadata)
+	assert.Equal(t, graph.Metadata["title"], graph.info.title)
+	require.Contains(t, graph.Graph, graph.StartNodeID)
+
+	loaded, err := LoadGraph(output)
+	require.NoError(t, err)
+	roundTrip, err := json.MarshalIndent(loaded, "", "  ")
+	require.NoError(t, err)
+	assert.Equal(t, string(output), string(roundTrip), "a loaded graph marshals back to the same document")
+
+	ast, err := Parse(string(script))
+	require.NoError(t, err)
+	assert.Contains(t, ast.Knots, "index")
+	assert.Equal(t, graph.Graph[graph.StartNodeID].Content, knotContent(ast.Knots["index"], graph.Graph[graph.StartNodeID].State))
+
+	_, err = Parse("=== index ===\n=== index ===\n")
+	assert.Error(t, err)
+}
+
+func TestCompileReader(t *testing.T) {
+	prose := strings.Repeat("word ", 200*1024) + "end."
+	script := "=== index ===\r\n" + prose + "\r\n* Go on. -> finale\r\n\r\n=== finale ===\r\nEND"
+
+	output, err := CompileReader(strings.NewReader(script))
+	require.NoError(t, err)
+	graph, err := LoadGraph(output)
+	require.NoError(t, err)
+	start := graph.Graph[graph.StartNodeID]
+	assert.Equal(t, prose, start.Content, "a line over 1MB is read whole")
+	assert.Equal(t, 200*1024+1, start.WordCount)
+	require.Len(t, start.Edges, 1)
+	assert.Equal(t, "finale|", start.Edges[0].TargetNodeID)
+
+	fromString, err := Compile(script)
+	require.NoError(t, err)
+	assert.Equal(t, string(fromString), string(output))
+
+	_, err = CompileReader(io.MultiReader(strings.NewReader("=== index ===\nEND\n"), iotest.ErrReader(errors.New("disk on fire"))))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 3: reading script: disk on fire")
+}
+
+func TestStructuredErrors(t *testing.T) {
+	asError := func(t *testing.T, err error) *Error {
+		t.Helper()
+		require.Error(t, err)
+		var biffErr *Error
+		require.True(t, errors.As(err, &biffErr), "%v", err)
+		return biffErr
+	}
+
+	_, err := Compile("=== index ===\nHello.\n   * {lit == true Go. -> index\n")
+	e := asError(t, err)
+	assert.Equal(t, CodeSyntax, e.Code)
+	assert.Equal(t, 3, e.Line)
+	assert.Equal(t, 4, e.Column)
+	assert.Equal(t, "", e.File)
+	assert.Equal(t, "failed to parse choice '* {lit == true Go. -> index': mismatched braces in condition", e.Message)
+	assert.Equal(t, "parsing error: line 3: "+e.Message, err.Error())
+
+	_, err = Compile("=== index ===\n* Go. -> hall\n\n=== hall ===\n* Down. -> cellar\n")
+	e = asError(t, err)
+	assert.Equal(t, CodeMissingKnot, e.Code)
+	assert.Equal(t, 5, e.Line, "the line of the offending choice")
+	assert.Equal(t, "graph analysis error: line 5: choice leads to non-existent knot: 'cellar'", err.Error())
+
+	_, err = Compile("// STATES: ok, has-key\n=== index ===\nEND\n")
+	e = asError(t, err)
+	assert.Equal(t, CodeInvalidName, e.Code)
+	assert.Equal(t, 1, e.Line)
+
+	_, err = Compile("=== index === #a:1 #a:2\nEND\n")
+	assert.Equal(t, CodeDuplicate, asError(t, err).Code)
+
+	dir := writeFiles(t, map[string]string{
+		"main.biff": "// INCLUDE: two.biff\n=== index ===\n* Go. -> cellar\n",
+		"two.biff":  "=== cellar ===\nEND\n=== cellar ===\n",
+	})
+	_, err = CompileFile(filepath.Join(dir, "main.biff"))
+	e = asError(t, err)
+	assert.Equal(t, CodeDuplicate, e.Code)
+	assert.Equal(t, filepath.Join(dir, "two.biff"), e.File)
+	assert.Equal(t, 3, e.Line)
+
+	_, err = CompileFile(filepath.Join(dir, "missing.biff"))
+	e = asError(t, err)
+	assert.Equal(t, CodeRead, e.Code)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "the cause is kept")
+
+	_, err = CompileWithOptions("=== index ===\n* Loop. -> index\n", Options{DeadEndsAsErrors: true, StartKnot: "hall"})
+	e = asError(t, err)
+	assert.Equal(t, CodeStartKnot, e.Code)
+	assert.Equal(t, 0, e.Line)
+	assert.Equal(t, "starting knot 'hall' does not exist", e.Error())
+}
+
+func TestMultipleErrors(t *testing.T) {
+	script := `// STATES: lit, has-key
+
+=== index ===
+* {lit == true Go. -> hall
+* Wait. -> index
+
+=== bad name ===
+* {broken Ignored, the knot is skipped. -> index
+
+=== hall ===
+- {lit == true The light.
+END
+
+=== hall ===
+END
+`
+	_, err := Compile(script)
+	require.Error(t, err)
+	var list ErrorList
+	require.True(t, errors.As(err, &list), "%v", err)
+	lines := make([]int, len(list))
+	codes := make([]ErrorCode, len(list))
+	for i, e := range list.Errors() {
+		lines[i], codes[i] = e.Line, e.Code
+	}
+	assert.Equal(t, []int{1, 4, 7, 11, 14}, lines)
+	assert.Equal(t, []ErrorCode{CodeInvalidName, CodeSyntax, CodeInvalidName, CodeSyntax, CodeDuplicate}, codes)
+	assert.Contains(t, err.Error(), "line 4: failed to parse choice")
+	assert.Contains(t, err.Error(), "\nline 14: duplicate knot 'hall'")
+
+	var first *Error
+	require.True(t, errors.As(err, &first))
+	assert.Equal(t, 1, first.Line)
+
+	var flood strings.Builder
+	flood.WriteString("=== index ===\n")
+	for i := 0; i < 80; i++ {
+		flood.WriteString("* {x Broken. -> index\n")
+	}
+	_, err = Compile(flood.String())
+	require.True(t, errors.As(err, &list))
+	require.Len(t, list, maxErrors+1)
+	assert.Equal(t, CodeTooManyErrors, list[maxErrors].Code)
+
+	_, err = Compile(`=== index ===
+* Go down. -> cellar
+* Go up. -> hall
+
+=== hall ===
+* Climb. -> attic
+* Back. -> index
+`)
+	require.True(t, errors.As(err, &list), "%v", err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "line 2: choice leads to non-existent knot: 'cellar'", list[0].Error())
+	assert.Equal(t, "line 6: choice leads to non-existent knot: 'attic'", list[1].Error())
+}
+
+func TestDiagnostics(t *testing.T) {
+	script := `// STATES: lit, spare
+// FLAG-STATES: done
+
+=== index ===
+- {lit == true} Light.
+* Light it. ~ lit = true -> index
+* Finish. ~ done = false -> hall
+
+=== hall ===
+Nothing here.
+
+=== attic ===
+END
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	require.Len(t, result.Diagnostics, len(result.Warnings))
+	for i, d := range result.Diagnostics {
+		assert.Equal(t, SeverityWarning, d.Severity)
+		assert.Equal(t, result.Warnings[i], d.String())
+	}
+
+	byCode := make(map[ErrorCode]Diagnostic)
+	for _, d := range result.Diagnostics {
+		byCode[d.Code] = d
+	}
+	assert.Equal(t, Diagnostic{Severity: SeverityWarning, Code: CodeIgnoredAssignment, Line: 7,
+		Message: "knot 'index', choice 'Finish.': 'done = false' is ignored because 'done' is declared in FLAG-STATES and can only become true"}, byCode[CodeIgnoredAssignment])
+	assert.Equal(t, 9, byCode[CodeDeadEnd].Line)
+	assert.Equal(t, "state 'spare' is declared but never read or written", byCode[CodeUnusedState].Message)
+	assert.Equal(t, 0, byCode[CodeUnusedState].Line)
+	assert.Equal(t, 12, byCode[CodeUnreachable].Line)
+	assert.Contains(t, byCode, CodeFlagLikeState)
+
+	_, err = Compile("=== index ===\n* Go. ~ lamp -> x\n")
+	require.Error(t, err, "a state change without '=' must not reach the graph")
+	var changeErr *Error
+	require.True(t, errors.As(err, &changeErr))
+	assert.Equal(t, CodeSyntax, changeErr.Code)
+	assert.Equal(t, 2, changeErr.Line)
+	assert.Contains(t, changeErr.Message, "malformed state change 'lamp'")
+
+	_, err = Compile("=== index ===\n* {x Go. -> index\n")
+	var biffErr *Error
+	require.True(t, errors.As(err, &biffErr))
+	assert.Equal(t, Diagnostic{Severity: SeverityError, Code: CodeSyntax, Line: 2, Column: 1, Message: biffErr.Message}, biffErr.Diagnostic())
+}
+
+func TestValidate(t *testing.T) {
+	script := `// STATES: lit
+
+=== start ===
+- {lit = true} Light.
+* Light it. ~ lit = true -> hall
+* Wave. ~ hands -> start
+* {ghost == true} Follow. -> nowhere
+
+=== hall ===
+* Leave. -> start
+`
+	var got []string
+	for _, d := range Validate(script) {
+		got = append(got, fmt.Sprintf("%s %s %d", d.Severity, d.Code, d.Line))
+	}
+	assert.Equal(t, []string{
+		"error syntax 6",
+		"error start-knot 0",
+		"error syntax 4",
+		"warning undeclared-state 7",
+		"error missing-knot 7",
+		"warning flag-like-state 0",
+	}, got)
+
+	garden, err := os.ReadFile(filepath.Join("testdata", "garden.biff"))
+	require.NoError(t, err)
+	for _, d := range Validate(string(garden)) {
+		assert.NotEqual(t, SeverityError, d.Severity, d.String())
+	}
+
+	diagnostics := Validate("=== index\n* {x Go. -> index\n")
+	require.NotEmpty(t, diagnostics)
+	assert.Equal(t, CodeSyntax, diagnostics[0].Code)
+
+	for _, garbage := range []string{"", "*", "-", "//", "{", "===", "=== index ===\n* ~ = -> \n- {&&}", "\x00\xff\xfe=== \x01 ===", strings.Repeat("=== a ===\n* -> b\n", 100)} {
+		assert.NotPanics(t, func() { Validate(garbage) }, "%q", garbage)
+	}
+}
+
+func TestLintRequireScene(t *testing.T) {
+	script := `// SCENES: cellar
+
+=== index ===
+// scene: cellar
+* Go. -> hall
+
+=== hall ===
+END
+`
+	diagnostics, err := Lint(script, RequireScene{})
+	require.NoError(t, err)
+	assert.Equal(t, []Diagnostic{{Severity: SeverityWarning, Code: "require-scene", Line: 7, Message: "knot 'hall' does not declare a scene"}}, diagnostics)
+
+	diagnostics, err = Lint("// SCENES: cellar\n// DEFAULT-SCENE: cellar\n"+script, RequireScene{})
+	require.NoError(t, err)
+	assert.Empty(t, diagnostics)
+}
+
+func TestLintChoicePunctuation(t *testing.T) {
+	script := `=== index ===
+* Open the door. -> index
+* "Who's there?" -> index
+* Knock -> index
+* -> index
+`
+	diagnostics, err := Lint(script, ChoicePunctuation{})
+	require.NoError(t, err)
+	require.Len(t, diagnostics, 1)
+	assert.Equal(t, "choice-punctuation", string(diagnostics[0].Code))
+	assert.Equal(t, "line 4: knot 'index', choice 'Knock' does not end with punctuation", diagnostics[0].String())
+}
+
+func TestLintMaxChoices(t *testing.T) {
+	script := "=== index ===\n" + strings.Repeat("* Wait. -> index\n", 7) + "\n=== hall ===\n* Leave. -> index\n"
+	diagnostics, err := Lint(script, MaxChoices{Limit: 6})
+	require.NoError(t, err)
+	require.Len(t, diagnostics, 1)
+	assert.Equal(t, 1, diagnostics[0].Line)
+	assert.Equal(t, "knot 'index' has 7 choices, more than the limit of 6", diagnostics[0].Message)
+
+	diagnostics, err = Lint(script, MaxChoices{Limit: 7})
+	require.NoError(t, err)
+	assert.Empty(t, diagnostics)
+}
+
+// endingRule is a custom rule that leaves Severity and Code to Lint.
+type endingRule struct{}
+
+func (endingRule) Name() string { return "named-endings" }
+
+func (endingRule) Check(script *Script) []Diagnostic {
+	var diagnostics []Diagnostic
+	for _, knot := range script.Knots {
+		if knot.IsEnd && knot.EndingName == "" {
+			diagnostics = append(diagnostics, Diagnostic{Line: knot.Line, Message: "unnamed ending"})
+		}
+	}
+	return diagnostics
+}
+
+func TestLintRules(t *testing.T) {
+	script := "=== index ===\n* Go -> index\n* Stop. -> fin\n\n=== fin ===\nEND\n"
+	diagnostics, err := Lint(script)
+	require.NoError(t, err)
+	var codes []ErrorCode
+	for _, d := range diagnostics {
+		codes = append(codes, d.Code)
+	}
+	assert.Equal(t, []ErrorCode{"require-scene", "require-scene", "choice-punctuation"}, codes)
+
+	diagnostics, err = Lint(script, endingRule{})
+	require.NoError(t, err)
+	assert.Equal(t, []Diagnostic{{Severity: SeverityWarning, Code: "named-endings", Line: 5, Message: "unnamed ending"}}, diagnostics)
+
+	_, err = Lint("=== index\n")
+	assert.Error(t, err)
+}
+
+// normalizedScript parses a script and clears what WriteScript does not
+// keep: source positions and parse warnings.
+func normalizedScript(t *testing.T, script string) *Script {
+	t.Helper()
+	ast, err := Parse(script)
+	require.NoError(t, err, script)
+	ast.Warnings, ast.UnknownDirectives = nil, nil
+	for _, knot := range ast.Knots {
+		knot.Line = 0
+		for i := range knot.Body {
+			knot.Body[i].Line = 0
+		}
+		for i := range knot.Choices {
+			knot.Choices[i].Line = 0
+		}
+	}
+	return ast
+}
+
+func TestWriteScriptRoundTrip(t *testing.T) {
+	garden, err := os.ReadFile(filepath.Join("testdata", "garden.biff"))
+	require.NoError(t, err)
+	scripts := []string{string(garden), `// title: Cellar
+// Author: Someone
+// SCENES: house, yard
+// DEFAULT-SCENE: house
+// STATES: lit
+// FLAG-STATES: done
+// LOCAL-STATES(yard): dug
+// LOCAL-FLAG-STATES(yard): found
+// ENDINGS: escaped
+// STRICT: true
+
+=== index === #chapter:1 #opening
+The cellar is dark.
+
+It smells of earth.
+- {lit == true} A lamp burns.
+- Nothing else.
+* {lit == false} Light the lamp. ~ lit = true -> index
+* Go outside. -> yard
+* Look closer. -> .corner
+
+=== corner ===
+- {lit == true}
+  A trapdoor.
+* -> index
+
+=== yard ===
+// scene: yard
+* {dug == false} Dig. ~ dug = true ~ found = true -> yard
+* Leave. ~ done = true -> out
+
+=== out ===
+END: escaped
+`}
+	for _, script := range scripts {
+		written, err := WriteScript(normalizedScript(t, script))
+		require.NoError(t, err)
+		assert.Equal(t, normalizedScript(t, script), normalizedScript(t, written), written)
+
+		again, err := WriteScript(normalizedScript(t, written))
+		require.NoError(t, err)
+		assert.Equal(t, written, again, "WriteScript output is not canonical")
+	}
+}
+
+func TestWriteScriptFromStructs(t *testing.T) {
+	script := &Script{
+		Title:  "Built",
+		States: map[string]StateKind{"key": StateFlag},
+		Knots: map[string]*Knot{
+			"index": {Name: "index", Body: []TextBlock{{Content: "A door."}, {Condition: "key == true", Content: "It is unlocked."}},
+				Choices: []Choice{{Text: "Take the key.", StateChanges: []string{"key = true"}, TargetKnot: "index"}, {Text: "Leave.", TargetKnot: "end"}}},
+			"end": {Name: "end", IsEnd: true},
+		},
+	}
+	written, err := WriteScript(script)
+	require.NoError(t, err)
+	assert.Equal(t, `// title: Built
+// FLAG-STATES: key
+
+=== end ===
+END
+
+=== index ===
+A door.
+- {key == true} It is unlocked.
+* Take the key. ~ key = true -> index
+* Leave. -> end
+`, written)
+	_, err = Compile(written)
+	require.NoError(t, err)
+
+	script.Knots["index"].Choices[0].Text = "Go -> somewhere"
+	_, err = WriteScript(script)
+	assert.ErrorContains(t, err, "knot 'index': 'Go -> somewhere' cannot be written in a choice line")
+}
+
+func TestCompileContextCancels(t *testing.T) {
+	// Every state can be toggled independently, so the graph has 2^24 nodes.
+	var b strings.Builder
+	var states []string
+	for i := 0; i < 24; i++ {
+		states = append(states, fmt.Sprintf("s%d", i))
+	}
+	fmt.Fprintf(&b, "// STATES: %s\n\n=== index ===\n", strings.Join(states, ", "))
+	for _, state := range states {
+		fmt.Fprintf(&b, "* {%s == false} Set. ~ %s = true -> index\n* {%s == true} Clear. ~ %s = false -> index\n", state, state, state, state)
+	}
+	script := b.String()
+
+	goroutines := runtime.NumGoroutine()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := CompileWithOptionsContext(ctx, script, Options{MaxNodes: -1, Concurrency: 4})
+	assert.Less(t, time.Since(start), 5*time.Second)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	var biffErr *Error
+	require.True(t, errors.As(err, &biffErr))
+	assert.Equal(t, CodeCanceled, biffErr.Code)
+	assert.Contains(t, err.Error(), "graph analysis stopped after expanding")
+
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	_, err = CompileContext(canceled, script)
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	// Workers are joined before the compile returns, so none outlive it.
+	assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+
+	output, err := CompileContext(context.Background(), "=== index ===\nEND\n")
+	require.NoError(t, err)
+	expected, err := Compile("=== index ===\nEND\n")
+	require.NoError(t, err)
+	assert.Equal(t, expected, output)
+}
+
+func TestProgressCallback(t *testing.T) {
+	script := `// STATES: a, b, c, d
+
+=== index ===
+* Flip a. ~ a = true -> index
+* Flip b. ~ b = true -> index
+* Flip c. ~ c = true -> index
+* Flip d. ~ d = true -> hall
+
+=== hall ===
+A hall.
+* Back. ~ d = false -> index
+`
+	var calls []ProgressInfo
+	opts := Options{Concurrency: 2, ProgressInterval: 3, OnProgress: func(info ProgressInfo) { calls = append(calls, info) }}
+	result, err := CompileWithOptions(script, opts)
+	require.NoError(t, err)
+	require.True(t, len(calls) > 2)
+
+	for i := 1; i < len(calls); i++ {
+		prev, cur := calls[i-1], calls[i]
+		assert.GreaterOrEqual(t, cur.NodesCreated, prev.NodesCreated)
+		assert.GreaterOrEqual(t, cur.EdgesCreated, prev.EdgesCreated)
+		assert.GreaterOrEqual(t, cur.NodesExpanded, prev.NodesExpanded)
+		assert.GreaterOrEqual(t, cur.Elapsed, prev.Elapsed)
+	}
+	for _, info := range calls[:len(calls)-1] {
+		assert.False(t, info.Done)
+		assert.Equal(t, 0, info.NodesExpanded%3)
+		assert.NotEmpty(t, info.CurrentKnot)
+	}
+	last := calls[len(calls)-1]
+	assert.True(t, last.Done)
+	assert.Equal(t, len(result.Graph.Graph), last.NodesCreated)
+	assert.Equal(t, len(result.Graph.Graph), last.NodesExpanded)
+	assert.Equal(t, 0, last.QueueLen)
+	edges := 0
+	for _, node := range result.Graph.Graph {
+		edges += len(node.Edges)
+	}
+	assert.Equal(t, edges, last.EdgesCreated)
+
+	// The hook does not stop a Compiler from reusing its graph.
+	c := NewCompiler()
+	c.Options = opts
+	_, err = c.Compile(script)
+	require.NoError(t, err)
+	_, err = c.Compile(strings.Replace(script, "A hall.", "A long hall.", 1))
+	require.NoError(t, err)
+	assert.True(t, c.reused)
+}
+
+// traceRecorder is a Logger that keeps every event.
+type traceRecorder struct {
+	events []string
+}
+
+func (r *traceRecorder) Debugf(format string, args ...interface{}) {
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func TestLoggerTrace(t *testing.T) {
+	script := `// FLAG-STATES: has_key
+
+=== index ===
+* {has_key == true} Open the door. -> hall
+* Take the key. ~ has_key = true -> index
+* Drop the key. ~ has_key = false -> index
+
+=== hall ===
+END
+`
+	trace := &traceRecorder{}
+	_, err := CompileWithOptions(script, Options{Logger: trace, Concurrency: 3})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"node index|has_key=false created (start)",
+		"at node index|has_key=false, choice 'Open the door.' skipped (condition has_key == true failed)",
+		"at node index|has_key=false, choice 'Drop the key.': 'has_key = false' ignored ('has_key' is declared in FLAG-STATES and can only become true)",
+		"node index|has_key=true created",
+		"edge added index|has_key=false -> index|has_key=true ('Take the key.')",
+		"node index|has_key=false already visited",
+		"edge added index|has_key=false -> index|has_key=false ('Drop the key.')",
+	}, trace.events[:7])
+	assert.Contains(t, trace.events, "edge added index|has_key=true -> hall|has_key=true ('Open the door.')")
+
+	again := &traceRecorder{}
+	_, err = CompileWithOptions(script, Options{Logger: again, Concurrency: 1})
+	require.NoError(t, err)
+	assert.Equal(t, trace.events, again.events)
+}
+
+// assertDOTQuoting checks that every line of DOT output closes the quoted
+// strings it opens, so no label content leaks into the DOT syntax.
+func assertDOTQuoting(t *testing.T, dot string) {
+	t.Helper()
+	for _, line := range strings.Split(strings.TrimSuffix(dot, "\n"), "\n") {
+		quoted, escaped := false, false
+		for _, r := range line {
+			switch {
+			case escaped:
+				escaped = false
+			case quoted && r == '\\':
+				escaped = true
+			case r == '"':
+				quoted = !quoted
+			}
+		}
+		assert.False(t, quoted, "unterminated string in %q", line)
+	}
+}
+
+func TestExportDOT(t *testing.T) {
+	script := `// SCENES: hall, yard
+// STATES: lit
+
+=== index ===
+// scene: hall
+A "dark" hall \ with a backslash and {braces}.
+* Say "hi" \ ] -> index
+* Light up. ~ lit = true -> yard
+
+=== yard ===
+// scene: yard
+The yard is very long indeed, longer than any label should be.
+END
+`
+	graph, err := CompileToGraph(script)
+	require.NoError(t, err)
+	out, err := ExportDOT(graph, DOTOptions{MaxLabelLength: 20, ShowState: true, RankDir: "LR"})
+	require.NoError(t, err)
+	dot := string(out)
+	assertDOTQuoting(t, dot)
+	assert.True(t, strings.HasPrefix(dot, "digraph story {\n  rankdir=LR;\n"))
+	assert.Contains(t, dot, `  subgraph "cluster_0" {`+"\n"+`    label="hall";`)
+	assert.Contains(t, dot, `"index|lit=false" [label="index\nA \"dark\" hall \\ wit…", penwidth=2];`)
+	assert.Contains(t, dot, `"yard|lit=true" [label="yard\nThe yard is very lo…\n[lit]", shape=doublecircle];`)
+	assert.Contains(t, dot, `"index|lit=false" -> "index|lit=false" [label="Say \"hi\" \\ ]"];`)
+
+	// Hand-built graphs can hold anything, including line breaks.
+	hostile := &StoryGraph{StartNodeID: "a\"b", Graph: map[string]*StoryNode{
+		"a\"b": {KnotName: "a", Scene: "x\"}\n", Content: "line one\r\nline \"two\"", Edges: []*StoryEdge{{Text: "go\n\"now\"\\", TargetNodeID: "c\\"}}},
+		"c\\":  {KnotName: "c", IsEnd: true},
+	}}
+	out, err = ExportDOT(hostile, DOTOptions{MaxLabelLength: -1})
+	require.NoError(t, err)
+	assertDOTQuoting(t, string(out))
+	assert.Contains(t, string(out), `label="x\"}\n";`)
+	assert.Contains(t, string(out), `"a\"b" -> "c\\" [label="go\n\"now\"\\"];`)
+	assert.NotContains(t, string(out), "line one")
+
+	_, err = ExportDOT(graph, DOTOptions{RankDir: "up"})
+	assert.Error(t, err)
+}
+
+func TestExportGraphML(t *testing.T) {
+	script := `// STATES: lit, has_key
+
+=== index ===
+A <dark> & "quiet" hall.
+* Light up. ~ lit = true -> index
+* Leave. -> yard
+
+=== yard ===
+END
+`
+	graph, err := CompileToGraph(script)
+	require.NoError(t, err)
+	out, err := ExportGraphML(graph)
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(out, []byte(xml.Header)))
+
+	var doc struct {
+		XMLName xml.Name `xml:"http://graphml.graphdrawing.org/xmlns graphml"`
+		Keys    []struct {
+			ID   string `xml:"id,attr"`
+			For  string `xml:"for,attr"`
+			Name string `xml:"attr.name,attr"`
+			Type string `xml:"attr.type,attr"`
+		} `xml:"key"`
+		Graph struct {
+			EdgeDefault string `xml:"edgedefault,attr"`
+			Nodes       []struct {
+				ID   string `xml:"id,attr"`
+				Data []struct {
+					Key   string `xml:"key,attr"`
+					Value string `xml:",chardata"`
+				} `xml:"data"`
+			} `xml:"node"`
+			Edges []struct {
+				Source string `xml:"source,attr"`
+				Target string `xml:"target,attr"`
+				Data   []struct {
+					Key   string `xml:"key,attr"`
+					Value string `xml:",chardata"`
+				} `xml:"data"`
+			} `xml:"edge"`
+		} `xml:"graph"`
+	}
+	require.NoError(t, xml.Unmarshal(out, &doc))
+	assert.Equal(t, "directed", doc.Graph.EdgeDefault)
+
+	keys := make(map[string]string)
+	for _, key := range doc.Keys {
+		keys[key.ID] = key.For + " " + key.Name + " " + key.Type
+	}
+	assert.Equal(t, "node state.has_key boolean", keys["s0"])
+	assert.Equal(t, "node state.lit boolean", keys["s1"])
+	assert.Equal(t, "node isEnd boolean", keys["isEnd"])
+	assert.Equal(t, "edge text string", keys["text"])
+
+	require.Len(t, doc.Graph.Nodes, len(graph.Graph))
+	nodes := make(map[string]map[string]string)
+	numbers := make(map[string]string)
+	for _, node := range doc.Graph.Nodes {
+		data := make(map[string]string)
+		for _, d := range node.Data {
+			_, declared := keys[d.Key]
+			assert.True(t, declared, d.Key)
+			data[d.Key] = d.Value
+		}
+		nodes[data["nodeId"]] = data
+		numbers[node.ID] = data["nodeId"]
+	}
+	start := nodes["index|has_key=false,lit=false"]
+	assert.Equal(t, "index", start["knotName"])
+	assert.Equal(t, `A <dark> & "quiet" hall.`, start["content"])
+	assert.Equal(t, "false", start["s1"])
+	assert.Equal(t, "true", nodes["yard|has_key=false,lit=false"]["isEnd"])
+
+	edges := 0
+	for _, node := range graph.Graph {
+		edges += len(node.Edges)
+	}
+	require.Len(t, doc.Graph.Edges, edges)
+	for _, edge := range doc.Graph.Edges {
+		assert.Contains(t, graph.Graph, numbers[edge.Source])
+		assert.Contains(t, graph.Graph, numbers[edge.Target])
+	}
+	assert.Equal(t, "Light up.", doc.Graph.Edges[0].Data[0].Value)
+	assert.Equal(t, "index|has_key=false,lit=true", numbers[doc.Graph.Edges[0].Target])
+}
+
+// tweeStory is a Twee 3 file reduced to what a Twine import relies on.
+type tweeStory struct {
+	data     map[string]string   // StoryData
+	tags     map[string][]string // passage name -> tags
+	links    map[string][]string // passage name -> link targets
+	contents map[string]string   // passage name -> text before the links
+}
+
+// parseTwee is a small Twee 3 validator: it fails on duplicate or malformed
+// passage headers, bad StoryData and links to passages that do not exist.
+func parseTwee(t *testing.T, twee string) tweeStory {
+	t.Helper()
+	story := tweeStory{tags: map[string][]string{}, links: map[string][]string{}, contents: map[string]string{}}
+	header := regexp.MustCompile(`^:: ((?:[^\\\[\]{}]|\\.)+?)(?: \[((?:[^\\\]]|\\.)*)\])?$`)
+	link := regexp.MustCompile(`\[\[(.*?)\]\]`)
+	unescape := regexp.MustCompile(`\\(.)`)
+	var name string
+	bodies := map[string][]string{}
+	for _, line := range strings.Split(twee, "\n") {
+		if strings.HasPrefix(line, "::") {
+			m := header.FindStringSubmatch(line)
+			require.NotNil(t, m, "malformed passage header %q", line)
+			name = unescape.ReplaceAllString(m[1], "$1")
+			_, dup := bodies[name]
+			require.False(t, dup, "duplicate passage %q", name)
+			bodies[name] = nil
+			if m[2] != "" {
+				story.tags[name] = strings.Fields(unescape.ReplaceAllString(m[2], "$1"))
+			}
+			continue
+		}
+		require.NotEmpty(t, name, "text before the first passage")
+		bodies[name] = append(bodies[name], line)
+	}
+	require.NoError(t, json.Unmarshal([]byte(strings.Join(bodies["StoryData"], "\n")), &story.data))
+	for passage, lines := range bodies {
+		if passage == "StoryTitle" || passage == "StoryData" {
+			continue
+		}
+		var text []string
+		for _, line := range lines {
+			if m := link.FindAllStringSubmatch(line, -1); m != nil {
+				for _, l := range m {
+					target := l[1]
+					if i := strings.LastIndex(target, "->"); i != -1 {
+						target = target[i+2:]
+					}
+					require.NotContains(t, target, "|")
+					_, exists := bodies[target]
+					require.True(t, exists, "link from %q to missing passage %q", passage, target)
+					story.links[passage] = append(story.links[passage], target)
+				}
+				continue
+			}
+			text = append(text, line)
+		}
+		story.contents[passage] = strings.TrimSpace(strings.Join(text, "\n"))
+	}
+	_, exists := bodies[story.data["start"]]
+	require.True(t, exists, "start passage %q does not exist", story.data["start"])
+	return story
+}
+
+func TestExportTwee(t *testing.T) {
+	script := `// title: The Cellar
+// SCENES: house
+// STATES: lit
+
+=== index ===
+// scene: house
+A dark cellar.
+:: Not a passage.
+* Light the [[lamp]] | now <- here. ~ lit = true -> index
+* Leave. -> out
+
+=== out ===
+END: escaped
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	out, err := ExportTwee(result.Graph)
+	require.NoError(t, err)
+	twee := string(out)
+	assert.True(t, strings.HasPrefix(twee, ":: StoryTitle\nThe Cellar\n\n:: StoryData\n"))
+
+	story := parseTwee(t, twee)
+	assert.Equal(t, result.IFID, story.data["ifid"])
+	assert.Equal(t, "index (lit=false)", story.data["start"])
+	assert.Equal(t, []string{"index (lit=true)", "out (lit=false)"}, story.links["index (lit=false)"])
+	assert.Equal(t, "A dark cellar.\n\\:: Not a passage.", story.contents["index (lit=false)"])
+	assert.Equal(t, []string{"scene:house"}, story.tags["index (lit=false)"])
+	assert.Equal(t, []string{"end"}, story.tags["out (lit=true)"])
+	assert.Contains(t, twee, "[[Light the [ [lamp] ] / now < - here.->index (lit=true)]]\n")
+
+	compact, err := CompileWithOptions(script, Options{CompactIDs: true})
+	require.NoError(t, err)
+	out, err = ExportTwee(compact.Graph)
+	require.NoError(t, err)
+	story = parseTwee(t, string(out))
+	assert.Equal(t, compact.Graph.StartNodeID, story.data["start"])
+}
+
+func TestImportTwee(t *testing.T) {
+	twee := `:: StoryTitle
+The [Cellar]
+
+:: StoryData
+{"ifid": "D674C58C-DEFA-4F70-B7A2-27742230C0FC", "start": "Front Door"}
+
+:: Front Door [house]
+You stand at a door. (set: $knocked to true)
+[[Knock twice->The Cellar: "Down" {1}]]
+[[Café]]
+[[Front Door<-back]]
+
+:: The Cellar: "Down" \{1\} [scene:cellar end] {"position":"100,100"}
+It is dark.
+\:: Still dark.
+
+:: Café
+<<set $coffee to true>>Nice. [[Leave|The Cellar: "Down" {1}]]
+
+:: UserScript [script]
+window.x = 1;
+`
+	ast, err := ImportTwee(twee)
+	require.NoError(t, err)
+	assert.Equal(t, "The [Cellar]", ast.Title)
+	assert.Equal(t, "D674C58C-DEFA-4F70-B7A2-27742230C0FC", ast.IFID)
+
+	index := ast.Knots["index"]
+	require.NotNil(t, index)
+	assert.Equal(t, "house", index.Scene)
+	assert.False(t, index.IsEnd)
+	assert.Equal(t, []Choice{
+		{Text: "Knock twice", TargetKnot: "The_Cellar_Down_1", Line: 9},
+		{Text: "Café", TargetKnot: "Caf", Line: 10},
+		{Text: "back", TargetKnot: "index", Line: 11},
+	}, index.Choices)
+	assert.Equal(t, "You stand at a door.\nKnock twice\nCafé\nback", index.Body[0].Content)
+
+	cellar := ast.Knots["The_Cellar_Down_1"]
+	require.NotNil(t, cellar)
+	assert.Equal(t, "cellar", cellar.Scene)
+	assert.True(t, cellar.IsEnd)
+	assert.Equal(t, "It is dark.\n:: Still dark.", cellar.Body[0].Content)
+	assert.Equal(t, "Nice. Leave", ast.Knots["Caf"].Body[0].Content)
+	assert.NotContains(t, ast.Knots, "UserScript")
+
+	var warnings []string
+	for _, w := range ast.Warnings {
+		warnings = append(warnings, string(w.Code)+" "+w.String())
+	}
+	assert.ElementsMatch(t, []string{
+		"unsupported-macro line 20: passage 'UserScript' is a script or stylesheet and was skipped",
+		"unsupported-macro line 8: passage 'Front Door': unsupported macro '(set: $knocked to true)' ignored",
+		"renamed-passage line 7: passage 'Front Door' imported as knot 'index'",
+		"renamed-passage line 13: passage 'The Cellar: \"Down\" {1}' imported as knot 'The_Cellar_Down_1'",
+		"renamed-passage line 17: passage 'Café' imported as knot 'Caf'",
+		"unsupported-macro line 18: passage 'Café': unsupported macro '<<set $coffee to true>>' ignored",
+	}, warnings)
+
+	// The imported script compiles as it is, and through .biff source.
+	result, err := compileScript(context.Background(), ast, Options{})
+	require.NoError(t, err)
+	assert.Len(t, result.Graph.Endings, 1)
+	source, err := WriteScript(ast)
+	require.NoError(t, err)
+	_, err = Compile(source)
+	require.NoError(t, err)
+
+	// ExportTwee output imports back.
+	out, err := ExportTwee(result.Graph)
+	require.NoError(t, err)
+	reimported, err := ImportTwee(string(out))
+	require.NoError(t, err)
+	assert.Len(t, reimported.Knots, len(result.Graph.Graph))
+	_, err = compileScript(context.Background(), reimported, Options{})
+	require.NoError(t, err)
+
+	_, err = ImportTwee(":: Intro\nHello.\n")
+	var biffErr *Error
+	require.True(t, errors.As(err, &biffErr))
+	assert.Equal(t, CodeStartKnot, biffErr.Code)
+	assert.EqualError(t, err, "importing Twee: start passage 'Start' does not exist")
+
+	_, err = ImportTwee(":: Start\n[[a]]\n:: Start\n")
+	assert.EqualError(t, err, "importing Twee: line 3: duplicate passage 'Start' (first defined on line 1)")
+
+	_, err = ImportTwee("just text\n")
+	assert.EqualError(t, err, "importing Twee: no passages found")
+}
+
+func TestOutputFormats(t *testing.T) {
+	garden, err := os.ReadFile(filepath.Join("testdata", "garden.biff"))
+	require.NoError(t, err)
+	script := "// LAYOUT: [1, 2.5, \"wide\"]\n// RATING: 4\n" + string(garden)
+	expected, err := Compile(script)
+	require.NoError(t, err)
+
+	sizes := make(map[OutputFormat]int)
+	for _, format := range []OutputFormat{FormatJSON, FormatCompactJSON, FormatBinary} {
+		t.Run(format.String(), func(t *testing.T) {
+			result, err := CompileWithOptions(script, Options{Format: format})
+			require.NoError(t, err)
+			encoded, err := result.Encode()
+			require.NoError(t, err)
+			sizes[format] = len(encoded)
+
+			loaded, err := LoadGraph(encoded)
+			require.NoError(t, err)
+			output, err := json.MarshalIndent(loaded, "", "  ")
+			require.NoError(t, err)
+			assert.JSONEq(t, string(expected), string(output))
+
+			if format != FormatBinary { // gob writes maps in random order
+				direct, err := EncodeGraph(result.Graph, format)
+				require.NoError(t, err)
+				assert.Equal(t, encoded, direct)
+			}
+		})
+	}
+	assert.Less(t, sizes[FormatCompactJSON], sizes[FormatJSON])
+	assert.Less(t, sizes[FormatBinary], sizes[FormatJSON])
+
+	t.Run("compact keys", func(t *testing.T) {
+		result, err := CompileWithOptions("=== index ===\nHello.\n* Bye. -> end\n=== end ===\nEND\n", Options{})
+		require.NoError(t, err)
+		encoded, err := EncodeGraph(result.Graph, FormatCompactJSON)
+		require.NoError(t, err)
+		assert.NotContains(t, string(encoded), "\n")
+		var doc map[string]interface{}
+		require.NoError(t, json.Unmarshal(encoded, &doc))
+		assert.Contains(t, doc, "g")
+		assert.NotContains(t, doc, "graph")
+		node := doc["g"].(map[string]interface{})["n"].(map[string]interface{})["index|"].(map[string]interface{})
+		assert.Equal(t, "index", node["k"])
+		assert.Equal(t, "Bye.", node["e"].([]interface{})[0].(map[string]interface{})["t"])
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		_, err := EncodeGraph(&StoryGraph{}, OutputFormat(9))
+		assert.Error(t, err)
+	})
+
+	t.Run("corrupt binary", func(t *testing.T) {
+		encoded, err := EncodeGraph(&StoryGraph{StartNodeID: "index|"}, FormatBinary)
+		require.NoError(t, err)
+		_, err = LoadGraph(encoded[:len(encoded)-3])
+		assert.Error(t, err)
+	})
+}
+
+// TestShortTags checks that every field of the output document has a short
+// name and that no two fields of a struct share one.
+func TestShortTags(t *testing.T) {
+	seen := make(map[reflect.Type]bool)
+	var check func(reflect.Type)
+	check = func(typ reflect.Type) {
+		switch typ.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map:
+			check(typ.Elem())
+			return
+		case reflect.Struct:
+		default:
+			return
+		}
+		if seen[typ] {
+			return
+		}
+		seen[typ] = true
+		names := make(map[string]string)
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			long, _ := fieldNames(field)
+			if long == "" {
+				continue
+			}
+			short := field.Tag.Get("short")
+			if assert.NotEmpty(t, short, "%s.%s has no short tag", typ.Name(), field.Name) {
+				assert.NotContains(t, names, short, "%s.%s reuses short name %q", typ.Name(), field.Name, short)
+				names[short] = field.Name
+			}
+			check(field.Type)
+		}
+	}
+	check(reflect.TypeOf(graphDocument{}))
+	assert.True(t, seen[reflect.TypeOf(StoryEdge{})])
+}
+
+func TestValidateOutput(t *testing.T) {
+	garden, err := os.ReadFile(filepath.Join("testdata", "garden.biff"))
+	require.NoError(t, err)
+	script := "// LAYOUT: [1, 2.5, \"wide\"]\n" + string(garden)
+
+	t.Run("compiled output", func(t *testing.T) {
+		output, err := Compile(script)
+		require.NoError(t, err)
+		assert.NoError(t, ValidateOutput(output))
+
+		result, err := CompileWithOptions(script, Options{IncomingEdges: true, ParentPointers: true, MergeEquivalentNodes: true, PruneUnreadStates: true})
+		require.NoError(t, err)
+		output, err = result.JSON()
+		require.NoError(t, err)
+		assert.NoError(t, ValidateOutput(output))
+
+		compact, err := EncodeGraph(result.Graph, FormatCompactJSON)
+		require.NoError(t, err)
+		assert.NoError(t, ValidateOutput(compact))
+	})
+
+	t.Run("optional fields", func(t *testing.T) {
+		result, err := CompileWithOptions(`=== index === #mood:calm
+Hi.
+* Go on. -> .top
+* Leave. -> nowhere
+`, Options{AllowMissingTargets: true})
+		require.NoError(t, err)
+		output, err := result.JSON()
+		require.NoError(t, err)
+		assert.Contains(t, string(output), `"missing": true`)
+		assert.Contains(t, string(output), `"tags"`)
+		assert.NoError(t, ValidateOutput(output))
+	})
+
+	tests := []struct {
+		name, doc, want string
+	}{
+		{"not JSON", `{"title":`, "invalid output: unexpected EOF"},
+		{"not an object", `[]`, "/: expected object, got array"},
+		{"missing properties", `{"formatVersion": "1.0.0", "generator": "test", "title": "", "author": "", "language": "", "ifid": "", "metadata": {}, "endings": []}`, "/: missing required property 'graph'"},
+		{"wrong type", `{"formatVersion": "1.0.0", "generator": "test", "title": 1, "author": "", "language": "", "ifid": "", "metadata": {}, "endings": [], "graph": {"startNodeId": "a", "nodes": {}}}`, "/title: expected string, got number"},
+		{"unknown property", `{"formatVersion": "1.0.0", "generator": "test", "title": "", "author": "", "language": "", "ifid": "", "metadata": {}, "endings": [], "graph": {"startNodeId": "a", "nodes": {}, "extra": true}}`, "/graph/extra: unexpected property"},
+		{"bad node", `{"formatVersion": "1.0.0", "generator": "test", "title": "", "author": "", "language": "", "ifid": "", "metadata": {}, "endings": [], "graph": {"startNodeId": "a/b", "nodes": {"a/b": {"knotName": "a", "scene": "", "state": {"lit": "yes"}, "content": "", "wordCount": -1, "edges": [{"text": "x"}], "isEnd": false}}}}`,
+			"/graph/nodes/a~1b/edges/0: missing required property 'targetNodeId'; /graph/nodes/a~1b/state/lit: expected boolean, got string; /graph/nodes/a~1b/wordCount: -1 is less than the minimum 0"},
+		{"long key in compact document", `{"v": "1.0.0", "gen": "test", "t": "", "a": "", "l": "", "i": "", "m": {}, "e": [], "g": {"s": "a", "nodes": {}}}`, "/g: missing required property 'n'; /g/nodes: unexpected property"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateOutput([]byte(tt.doc))
+			require.Error(t, err)
+			assert.Equal(t, "invalid output: "+strings.TrimPrefix(tt.want, "invalid output: "), err.Error())
+		})
+	}
+
+	t.Run("problems are capped", func(t *testing.T) {
+		err := ValidateOutput([]byte(`{"x0": 0, "x1": 0, "x2": 0, "x3": 0, "x4": 0}`))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "and 4 more")
+	})
+}
+
+// TestOutputSchemaInSync checks output.schema.json against the Go types of
+// the output document: every JSON field is a property, with the short tag as
+// its x-shortName, the fields without omitempty are required, and the schema
+// has no properties the types lack.
+func TestOutputSchemaInSync(t *testing.T) {
+	var root jsonSchema
+	require.NoError(t, json.Unmarshal(OutputSchema(), &root))
+	resolve := func(s *jsonSchema) *jsonSchema {
+		if s != nil && s.Ref != "" {
+			def, ok := root.Defs[strings.TrimPrefix(s.Ref, "#/$defs/")]
+			require.True(t, ok, "unknown reference %s", s.Ref)
+			return def
+		}
+		return s
+	}
+
+	var check func(typ reflect.Type, s *jsonSchema, path string)
+	check = func(typ reflect.Type, s *jsonSchema, path string) {
+		s = resolve(s)
+		if !assert.NotNil(t, s, "%s has no schema", path) {
+			return
+		}
+		switch typ.Kind() {
+		case reflect.Ptr:
+			check(typ.Elem(), s, path)
+		case reflect.Slice:
+			assert.Contains(t, s.Type, "array", path)
+			if typ.Elem().Kind() != reflect.Interface {
+				check(typ.Elem(), s.Items, path+"[]")
+			}
+		case reflect.Map:
+			assert.Contains(t, s.Type, "object", path)
+			if typ.Elem().Kind() != reflect.Interface && assert.NotNil(t, s.AdditionalProperties, path) {
+				check(typ.Elem(), s.AdditionalProperties.schema, path+"{}")
+			}
+		case reflect.String:
+			assert.Equal(t, schemaTypes{"string"}, s.Type, path)
+		case reflect.Bool:
+			assert.Equal(t, schemaTypes{"boolean"}, s.Type, path)
+		case reflect.Int:
+			assert.Equal(t, schemaTypes{"integer"}, s.Type, path)
+		case reflect.Struct:
+			assert.Equal(t, schemaTypes{"object"}, s.Type, path)
+			if assert.NotNil(t, s.AdditionalProperties, path) {
+				assert.True(t, s.AdditionalProperties.forbidden, "%s allows additional properties", path)
+			}
+			fields := make(map[string]bool)
+			var required []string
+			for i := 0; i < typ.NumField(); i++ {
+				field := typ.Field(i)
+				long, _ := fieldNames(field)
+				if long == "" {
+					continue
+				}
+				fields[long] = true
+				if !strings.Contains(field.Tag.Get("json"), ",omitempty") {
+					required = append(required, long)
+				}
+				property, ok := s.Properties[long]
+				if !assert.True(t, ok, "%s.%s is missing from the schema", path, long) {
+					continue
+				}
+				assert.Equal(t, field.Tag.Get("short"), property.ShortName, "x-shortName of %s.%s", path, long)
+				check(field.Type, property, path+"."+long)
+			}
+			for name := range s.Properties {
+				assert.True(t, fields[name], "schema property %s.%s has no Go field", path, name)
+			}
+			assert.ElementsMatch(t, required, s.Required, "required properties of %s", path)
+		default:
+			t.Errorf("%s: no schema check for %s", path, typ)
+		}
+	}
+	check(reflect.TypeOf(graphDocument{}), &root, "document")
+
+	// The published schema must also be valid JSON for other tools.
+	var generic map[string]interface{}
+	require.NoError(t, json.Unmarshal(OutputSchema(), &generic))
+	assert.Equal(t, "https://json-schema.org/draft/2020-12/schema", generic["$schema"])
+}
+
+func TestFormatVersion(t *testing.T) {
+	script := "=== index ===\nHi.\n* Bye. -> end\n=== end ===\nEND\n"
+	output, err := Compile(script)
+	require.NoError(t, err)
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal(output, &doc))
+	assert.Equal(t, FormatVersion, doc["formatVersion"])
+	assert.Equal(t, "bigif "+Version, doc["generator"])
+
+	withVersion := func(version string) []byte {
+		edited := make(map[string]interface{}, len(doc))
+		for key, value := range doc {
+			edited[key] = value
+		}
+		delete(edited, "generator")
+		if version == "" {
+			delete(edited, "formatVersion")
+		} else {
+			edited["formatVersion"] = version
+		}
+		data, err := json.Marshal(edited)
+		require.NoError(t, err)
+		return data
+	}
+
+	t.Run("legacy, newer minor and table versions load", func(t *testing.T) {
+		for _, version := range []string{"", "1.0.0", "1.4.2", TableFormatVersion, "2.1.0"} {
+			graph, err := LoadGraph(withVersion(version))
+			if assert.NoError(t, err, version) {
+				assert.Len(t, graph.Graph, 2)
+			}
+		}
+	})
+
+	t.Run("other major versions are rejected", func(t *testing.T) {
+		_, err := LoadGraph(withVersion("3.0.0"))
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrIncompatibleVersion))
+		assert.Equal(t, "loading graph: format version 3.0.0, this version of bigif reads 1.x and 2.x: incompatible format version", err.Error())
+
+		compact, err := json.Marshal(map[string]interface{}{"v": "3.1.0", "g": map[string]interface{}{"s": "index|", "n": map[string]interface{}{}}})
+		require.NoError(t, err)
+		_, err = LoadGraph(compact)
+		assert.True(t, errors.Is(err, ErrIncompatibleVersion))
+
+		var b bytes.Buffer
+		b.Write(binaryMagic)
+		require.NoError(t, gob.NewEncoder(&b).Encode(graphDocument{FormatVersion: "0.9.0"}))
+		_, err = LoadGraph(b.Bytes())
+		assert.True(t, errors.Is(err, ErrIncompatibleVersion))
+	})
+
+	t.Run("malformed version", func(t *testing.T) {
+		_, err := LoadGraph(withVersion("one"))
+		require.Error(t, err)
+		assert.False(t, errors.Is(err, ErrIncompatibleVersion))
+		assert.Contains(t, err.Error(), "invalid format version 'one'")
+	})
+}
+
+func TestSourceMap(t *testing.T) {
+	script := `// STATES: lit
+
+=== index ===
+- {lit == true} The hall is bright.
+- The hall is dark.
+* {lit == false} Light the lamp. ~ lit = true -> index
+* Leave. -> outside
+
+=== outside ===
+It is raining.
+END
+`
+	compile := func(script string, opts Options) *StoryGraph {
+		opts.IncludeSourceMap = true
+		result, err := CompileWithOptions(script, opts)
+		require.NoError(t, err)
+		return result.Graph
+	}
+	graph := compile(script, Options{})
+	assert.Equal(t, map[string]*NodeSource{
+		"index|lit=false":   {KnotLine: 3, ContentBlockLine: 5, Edges: []*EdgeSource{{ChoiceLine: 6}, {ChoiceLine: 7}}},
+		"index|lit=true":    {KnotLine: 3, ContentBlockLine: 4, Edges: []*EdgeSource{{ChoiceLine: 7}}},
+		"outside|lit=false": {KnotLine: 9, ContentBlockLine: 10, Edges: []*EdgeSource{}},
+		"outside|lit=true":  {KnotLine: 9, ContentBlockLine: 10, Edges: []*EdgeSource{}},
+	}, graph.SourceMap)
+
+	t.Run("inserted lines shift the map", func(t *testing.T) {
+		shifted := compile("// AUTHOR: someone\n"+script, Options{})
+		require.Equal(t, len(graph.SourceMap), len(shifted.SourceMap))
+		for id, source := range graph.SourceMap {
+			moved := shifted.SourceMap[id]
+			require.NotNil(t, moved, id)
+			assert.Equal(t, source.KnotLine+1, moved.KnotLine, id)
+			assert.Equal(t, source.ContentBlockLine+1, moved.ContentBlockLine, id)
+			require.Len(t, moved.Edges, len(source.Edges), id)
+			for i := range source.Edges {
+				assert.Equal(t, source.Edges[i].ChoiceLine+1, moved.Edges[i].ChoiceLine, id)
+			}
+		}
+
+		// A line added inside index moves only what follows it.
+		edited := compile(strings.Replace(script, "* Leave.", "* Wait. -> index\n* Leave.", 1), Options{})
+		assert.Equal(t, 3, edited.SourceMap["index|lit=false"].KnotLine)
+		assert.Equal(t, []*EdgeSource{{ChoiceLine: 6}, {ChoiceLine: 7}, {ChoiceLine: 8}}, edited.SourceMap["index|lit=false"].Edges)
+		assert.Equal(t, 10, edited.SourceMap["outside|lit=true"].KnotLine)
+		assert.Equal(t, 11, edited.SourceMap["outside|lit=true"].ContentBlockLine)
+	})
+
+	t.Run("output", func(t *testing.T) {
+		output, err := Compile(script)
+		require.NoError(t, err)
+		assert.NotContains(t, string(output), "sourceMap")
+
+		result, err := CompileWithOptions(script, Options{IncludeSourceMap: true, OmitSource: true, CompactIDs: true})
+		require.NoError(t, err)
+		output, err = result.JSON()
+		require.NoError(t, err)
+		assert.NotContains(t, string(output), `"src"`)
+		assert.NoError(t, ValidateOutput(output))
+		var doc struct {
+			SourceMap map[string]*NodeSource `json:"sourceMap"`
+		}
+		require.NoError(t, json.Unmarshal(output, &doc))
+		require.Len(t, doc.SourceMap, 4)
+		for id := range result.Graph.Graph {
+			assert.Contains(t, doc.SourceMap, id)
+		}
+
+		for _, format := range []OutputFormat{FormatCompactJSON, FormatBinary} {
+			encoded, err := EncodeGraph(result.Graph, format)
+			require.NoError(t, err)
+			loaded, err := LoadGraph(encoded)
+			require.NoError(t, err)
+			assert.Equal(t, result.Graph.SourceMap, loaded.SourceMap, format.String())
+		}
+	})
+}
+
+func TestExportCSV(t *testing.T) {
+	script := `// STATES: lit, has_key
+
+=== index ===
+A "quiet" hall, dark and cold.
+Dust \\ cobwebs.
+* Light up, please. ~ lit = true -> index
+* Leave. -> yard
+* Dig. -> cellar
+
+=== yard ===
+END
+`
+	result, err := CompileWithOptions(script, Options{AllowMissingTargets: true})
+	require.NoError(t, err)
+	graph := result.Graph
+	var nodesOut, edgesOut bytes.Buffer
+	require.NoError(t, ExportCSV(graph, &nodesOut, &edgesOut))
+
+	nodes, err := csv.NewReader(&nodesOut).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, nodes, len(graph.Graph)+1)
+	assert.Equal(t, []string{"id", "knotName", "scene", "isEnd", "content", "state.has_key", "state.lit"}, nodes[0])
+	ids := make(map[string]bool)
+	for i, row := range nodes[1:] {
+		if i > 0 {
+			assert.Less(t, nodes[i][0], row[0], "rows are sorted by ID")
+		}
+		node := graph.Graph[row[0]]
+		require.NotNil(t, node, row[0])
+		ids[row[0]] = true
+		assert.Equal(t, node.KnotName, row[1])
+		assert.Equal(t, fmt.Sprint(node.IsEnd), row[3])
+		assert.NotContains(t, row[4], "\n")
+		assert.Equal(t, node.Content, strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(row[4]))
+	}
+	assert.Equal(t, []string{"cellar|", "cellar", "", "false", "[missing knot: cellar]", "", ""}, nodes[1])
+	assert.Equal(t, []string{"index|has_key=false,lit=false", "index", "", "false", `A "quiet" hall, dark and cold.\nDust \\\\ cobwebs.`, "false", "false"}, nodes[2])
+
+	edges, err := csv.NewReader(&edgesOut).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"source", "text", "target"}, edges[0])
+	count := 0
+	for _, node := range graph.Graph {
+		count += len(node.Edges)
+	}
+	require.Len(t, edges, count+1)
+	for _, row := range edges[1:] {
+		assert.True(t, ids[row[0]], row[0])
+		assert.True(t, ids[row[2]], row[2])
+	}
+	assert.Equal(t, []string{"index|has_key=false,lit=false", "Light up, please.", "index|has_key=false,lit=true"}, edges[1])
+
+	assert.Error(t, ExportCSV(nil, io.Discard, io.Discard))
+}
+
+func TestLoadGraphWithMetadata(t *testing.T) {
+	script := "// TITLE: Rain\n// AUTHOR: Someone\n// MOOD: grey\n\n=== index ===\nHi.\n* Bye. -> end\n=== end ===\nEND\n"
+	result, err := CompileWithOptions(script, Options{IncomingEdges: true, ParentPointers: true})
+	require.NoError(t, err)
+	output, err := result.JSON()
+	require.NoError(t, err)
+
+	graph, meta, err := LoadGraphWithMetadata(output)
+	require.NoError(t, err)
+	assert.Equal(t, result.Graph.StartNodeID, graph.StartNodeID)
+	assert.True(t, DiffGraphs(result.Graph, graph).Empty())
+	assert.Equal(t, &Metadata{
+		FormatVersion: FormatVersion,
+		Generator:     "bigif " + Version,
+		Title:         "Rain",
+		Author:        "Someone",
+		IFID:          result.IFID,
+		Values:        result.Metadata,
+		Warnings:      result.Warnings,
+	}, meta)
+
+	binary, err := EncodeGraph(result.Graph, FormatBinary)
+	require.NoError(t, err)
+	_, meta, err = LoadGraphWithMetadata(binary)
+	require.NoError(t, err)
+	assert.Equal(t, "Rain", meta.Title)
+
+	var legacy map[string]interface{}
+	require.NoError(t, json.Unmarshal(output, &legacy))
+	delete(legacy, "formatVersion")
+	delete(legacy, "generator")
+	data, err := json.Marshal(legacy)
+	require.NoError(t, err)
+	_, meta, err = LoadGraphWithMetadata(data)
+	require.NoError(t, err)
+	assert.Equal(t, "1.0.0", meta.FormatVersion)
+	assert.Empty(t, meta.Generator)
+
+	broken := func(edit func(doc map[string]interface{})) error {
+		var doc map[string]interface{}
+		require.NoError(t, json.Unmarshal(output, &doc))
+		edit(doc)
+		data, err := json.Marshal(doc)
+		require.NoError(t, err)
+		_, _, err = LoadGraphWithMetadata(data)
+		return err
+	}
+	nodes := func(doc map[string]interface{}) map[string]interface{} {
+		return doc["graph"].(map[string]interface{})["nodes"].(map[string]interface{})
+	}
+
+	tests := []struct {
+		name string
+		edit func(doc map[string]interface{})
+		code ErrorCode
+		want string
+	}{
+		{"nodes at the top of graph", func(doc map[string]interface{}) {
+			doc["graph"] = nodes(doc)
+		}, CodeMalformedGraph, `loading graph: no "graph" object with nodes`},
+		{"wrong type", func(doc map[string]interface{}) {
+			doc["graph"].(map[string]interface{})["nodes"] = []interface{}{}
+		}, CodeMalformedGraph, "loading graph: json: cannot unmarshal array"},
+		{"null node", func(doc map[string]interface{}) {
+			nodes(doc)["end|"] = nil
+		}, CodeMalformedGraph, "loading graph: node 'end|' is null"},
+		{"dangling references", func(doc map[string]interface{}) {
+			delete(nodes(doc), "end|")
+			doc["graph"].(map[string]interface{})["startNodeId"] = "start|"
+		}, CodeDanglingReference, `loading graph: start node 'start|' does not exist
+node 'index|': edge 'Bye.' leads to unknown node 'end|'
+ending '' refers to unknown node 'end|'`},
+		{"dangling parent", func(doc map[string]interface{}) {
+			nodes(doc)["end|"].(map[string]interface{})["parent"] = map[string]interface{}{"sourceNodeId": "gone|", "text": "x"}
+		}, CodeDanglingReference, "loading graph: node 'end|': parent 'gone|' does not exist"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := broken(tt.edit)
+			require.Error(t, err)
+			assert.True(t, strings.HasPrefix(err.Error(), tt.want), err.Error())
+			var loadErr *Error
+			require.True(t, errors.As(err, &loadErr))
+			assert.Equal(t, tt.code, loadErr.Code)
+		})
+	}
+
+	_, _, err = LoadGraphWithMetadata([]byte("not json"))
+	var loadErr *Error
+	require.True(t, errors.As(err, &loadErr))
+	assert.Equal(t, CodeMalformedGraph, loadErr.Code)
+}
+
+// choiceIndex returns the index of the session choice leading to target.
+func choiceIndex(t *testing.T, session *Session, target string) int {
+	t.Helper()
+	for i, edge := range session.Choices() {
+		if edge.TargetNodeID == target {
+			return i
+		}
+	}
+	t.Fatalf("no choice at '%s' leads to '%s'", session.NodeID(), target)
+	return -1
+}
+
+func TestSession(t *testing.T) {
+	garden, err := os.ReadFile(filepath.Join("testdata", "garden.biff"))
+	require.NoError(t, err)
+	graph, err := CompileToGraph(string(garden))
+	require.NoError(t, err)
+
+	t.Run("replays simulated runs", func(t *testing.T) {
+		for seed := int64(0); seed < 20; seed++ {
+			transcript := Simulate(graph, seed, 200)
+			session := NewSession(graph)
+			assert.Equal(t, transcript.NodeIDs[0], session.NodeID())
+			for i, next := range transcript.NodeIDs[1:] {
+				index := choiceIndex(t, session, next)
+				assert.Equal(t, transcript.Choices[i], session.Choices()[index].Text)
+				require.NoError(t, session.Choose(index))
+				assert.Equal(t, next, session.NodeID())
+				assert.Same(t, graph.Graph[next], session.Current())
+			}
+			assert.Equal(t, transcript.Ended, session.Done(), "seed %d", seed)
+		}
+	})
+
+	t.Run("reaches every ending", func(t *testing.T) {
+		require.NotEmpty(t, graph.Endings)
+		for _, ending := range graph.Endings {
+			path, ok := graph.WitnessPath(graph.StartNodeID, ending.NodeID)
+			require.True(t, ok, ending.NodeID)
+			session := NewSession(graph)
+			for _, step := range path[1:] {
+				assert.False(t, session.Done())
+				require.NoError(t, session.Choose(choiceIndex(t, session, step.NodeID)))
+			}
+			assert.True(t, session.Done())
+			assert.True(t, session.Current().IsEnd)
+			assert.Empty(t, session.Choices())
+
+			err := session.Choose(0)
+			assert.True(t, errors.Is(err, ErrStoryEnded), "%v", err)
+			assert.Equal(t, ending.NodeID, session.NodeID())
+		}
+	})
+
+	t.Run("invalid choices", func(t *testing.T) {
+		session := NewSession(graph)
+		for _, index := range []int{-1, len(session.Choices())} {
+			err := session.Choose(index)
+			assert.True(t, errors.Is(err, ErrChoiceOutOfRange), "%v", err)
+			assert.Equal(t, graph.StartNodeID, session.NodeID())
+		}
+
+		broken := &StoryGraph{StartNodeID: "a", Graph: map[string]*StoryNode{
+			"a": {KnotName: "a", Edges: []*StoryEdge{{Text: "Go.", TargetNodeID: "b"}}},
+		}}
+		session = NewSession(broken)
+		assert.EqualError(t, session.Choose(0), "choosing 0 at node 'a': target node 'b' does not exist")
+		assert.Equal(t, "a", session.NodeID())
+
+		empty := NewSession(&StoryGraph{StartNodeID: "a"})
+		assert.Nil(t, empty.Current())
+		assert.True(t, empty.Done())
+	})
+}
+
+func TestSessionSaveRestore(t *testing.T) {
+	script := `// STATES: has_key
+
+=== index ===
+A locked door.
+* {has_key == false} Find the key. ~ has_key = true -> index
+* {has_key == true} Open the door. -> hall
+
+=== hall ===
+A long hall.
+* Walk on. -> garden
+
+=== garden ===
+Sunlight.
+END
+`
+	graph, err := CompileToGraph(script)
+	require.NoError(t, err)
+	session := NewSession(graph)
+	require.NoError(t, session.Choose(0))
+	require.NoError(t, session.Choose(0))
+	saved, err := session.Save()
+	require.NoError(t, err)
+
+	var payload map[string]interface{}
+	require.NoError(t, json.Unmarshal(saved, &payload))
+	assert.Equal(t, float64(2), payload["version"])
+	assert.Equal(t, "hall|has_key=true", payload["nodeId"])
+	assert.Equal(t, GraphHash(graph), payload["graphHash"])
+
+	t.Run("restore and continue", func(t *testing.T) {
+		recompiled, err := CompileToGraph(script)
+		require.NoError(t, err)
+		restored, err := RestoreSession(recompiled, saved)
+		require.NoError(t, err)
+		assert.Equal(t, session.NodeID(), restored.NodeID())
+		assert.Equal(t, []string{"index|has_key=false", "index|has_key=true", "hall|has_key=true"}, restored.Visited())
+		require.NoError(t, restored.Choose(0))
+		assert.True(t, restored.Done())
+		assert.Equal(t, "garden", restored.Current().KnotName)
+	})
+
+	t.Run("translated graph", func(t *testing.T) {
+		ast, err := Parse(script)
+		require.NoError(t, err)
+		catalog := ExtractCatalog(ast)
+		for key, text := range catalog {
+			catalog[key] = "[fr] " + text
+		}
+		french, err := CompileWithOptions(script, Options{Translations: catalog})
+		require.NoError(t, err)
+		assert.Equal(t, GraphHash(graph), GraphHash(french.Graph))
+		restored, err := RestoreSession(french.Graph, saved)
+		require.NoError(t, err)
+		assert.Equal(t, "[fr] A long hall.", restored.Current().Content)
+
+		catalog["hall/text/0"] = "[de] A long hall."
+		german, err := CompileWithOptions(script, Options{Translations: catalog})
+		require.NoError(t, err)
+		again, err := restored.Save()
+		require.NoError(t, err)
+		restored, err = RestoreSession(german.Graph, again)
+		require.NoError(t, err)
+		assert.Equal(t, "[de] A long hall.", restored.Current().Content)
+	})
+
+	t.Run("changed graph", func(t *testing.T) {
+		edited, err := CompileToGraph(strings.Replace(script, "A long hall.", "A short hall.\n* Go back. -> index", 1))
+		require.NoError(t, err)
+		assert.NotEqual(t, GraphHash(graph), GraphHash(edited))
+		_, err = RestoreSession(edited, saved)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrGraphMismatch))
+		assert.Equal(t, "restoring session at node 'hall|has_key=true': save does not match the graph", err.Error())
+
+		forced, err := RestoreSessionWithOptions(edited, saved, RestoreOptions{Force: true})
+		require.NoError(t, err)
+		assert.Equal(t, "A short hall.", forced.Current().Content)
+		assert.Equal(t, []string{"hall|has_key=true"}, forced.Visited())
+
+		renamed, err := CompileToGraph(strings.NewReplacer("=== hall ===", "=== corridor ===", "-> hall", "-> corridor").Replace(script))
+		require.NoError(t, err)
+		_, err = RestoreSessionWithOptions(renamed, saved, RestoreOptions{Force: true})
+		assert.True(t, errors.Is(err, ErrGraphMismatch))
+	})
+
+	t.Run("bad payloads", func(t *testing.T) {
+		for _, data := range []string{
+			`not json`,
+			`{"version": 3}`,
+			`{"version": 1, "graphHash": "` + GraphHash(graph) + `", "nodeId": "hall|has_key=true", "history": ["index|has_key=false"]}`,
+			`{"version": 1, "graphHash": "` + GraphHash(graph) + `", "nodeId": "hall|has_key=true", "history": ["nowhere|", "hall|has_key=true"]}`,
+		} {
+			_, err := RestoreSession(graph, []byte(data))
+			assert.Error(t, err, data)
+			assert.False(t, errors.Is(err, ErrGraphMismatch), data)
+		}
+	})
+
+	t.Run("version 1 saves", func(t *testing.T) {
+		old := `{"version": 1, "graphHash": "` + GraphHash(graph) + `", "nodeId": "hall|has_key=true", "history": ["index|has_key=false", "index|has_key=true", "hall|has_key=true"]}`
+		restored, err := RestoreSession(graph, []byte(old))
+		require.NoError(t, err)
+		assert.Equal(t, session.History(), restored.History())
+		require.NoError(t, restored.Back())
+		assert.Equal(t, "index|has_key=true", restored.NodeID())
+	})
+}
+
+func TestSessionBack(t *testing.T) {
+	graph, err := CompileToGraph(playScript)
+	require.NoError(t, err)
+	session := NewSession(graph)
+	err = session.Back()
+	assert.True(t, errors.Is(err, ErrAtStart), "%v", err)
+
+	require.NoError(t, session.Choose(0))
+	require.NoError(t, session.Choose(0))
+	require.True(t, session.Done())
+	assert.Equal(t, []Step{
+		{NodeID: "index|has_key=false", Choice: 0, Text: "Find the key.", TargetNodeID: "index|has_key=true"},
+		{NodeID: "index|has_key=true", Choice: 0, Text: "Open the door.", TargetNodeID: "garden|has_key=true"},
+	}, session.History())
+
+	// Back after the end, and again to the start.
+	require.NoError(t, session.Back())
+	assert.False(t, session.Done())
+	assert.Equal(t, "index|has_key=true", session.NodeID())
+	saved, err := session.Save()
+	require.NoError(t, err)
+	require.NoError(t, session.Back())
+	assert.Equal(t, graph.StartNodeID, session.NodeID())
+	assert.Empty(t, session.History())
+	assert.Equal(t, []string{graph.StartNodeID}, session.Visited())
+	assert.True(t, errors.Is(session.Back(), ErrAtStart))
+	assert.True(t, errors.Is(session.Back(), ErrAtStart))
+	assert.Equal(t, graph.StartNodeID, session.NodeID())
+
+	// The history is saved, so a restored session can go back too.
+	restored, err := RestoreSession(graph, saved)
+	require.NoError(t, err)
+	assert.Len(t, restored.History(), 1)
+	require.NoError(t, restored.Back())
+	assert.Equal(t, graph.StartNodeID, restored.NodeID())
+
+	tampered := strings.Replace(string(saved), `"choice":0`, `"choice":1`, 1)
+	_, err = RestoreSession(graph, []byte(tampered))
+	assert.Error(t, err)
+
+	var out bytes.Buffer
+	transcript, err := Play(context.Background(), NewSession(graph), strings.NewReader("back\n1\nback\n1\n1\n"), &out)
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), "> You are at the start.\n")
+	assert.Equal(t, 2, strings.Count(out.String(), "  1. Find the key."))
+	assert.Equal(t, 2, strings.Count(out.String(), "  1. Open the door."))
+	assert.True(t, transcript.Ended)
+	assert.Equal(t, []string{"Find the key.", "Open the door."}, transcript.Choices)
+	assert.Equal(t, "A locked door.\n\nA locked door.\n\nSunlight.", transcript.Content)
+}
+
+const playScript = `// STATES: has_key
+
+=== index ===
+A locked door.
+* {has_key == false} Find the key. ~ has_key = true -> index
+* {has_key == true} Open the door. -> garden
+
+=== garden ===
+Sunlight.
+END: freedom
+`
+
+func TestPlay(t *testing.T) {
+	graph, err := CompileToGraph(playScript)
+	require.NoError(t, err)
+
+	t.Run("to the end", func(t *testing.T) {
+		var out bytes.Buffer
+		transcript, err := Play(context.Background(), NewSessionSeeded(graph, 7), strings.NewReader("3\nkey\n1\n1\n"), &out)
+		require.NoError(t, err)
+		assert.Equal(t, `A locked door.
+
+  1. Find the key.
+> Choose a number from 1 to 1, back or quit.
+> Choose a number from 1 to 1, back or quit.
+> 
+A locked door.
+
+  1. Open the door.
+> 
+Sunlight.
+
+*** The End: freedom ***
+`, out.String())
+		assert.Equal(t, Transcript{
+			Seed:    7,
+			NodeIDs: []string{"index|has_key=false", "index|has_key=true", "garden|has_key=true"},
+			Choices: []string{"Find the key.", "Open the door."},
+			Content: "A locked door.\n\nA locked door.\n\nSunlight.",
+			Ended:   true,
+			Ending:  "freedom",
+		}, transcript)
+	})
+
+	t.Run("end of input and quit", func(t *testing.T) {
+		for _, input := range []string{"1\n", "1\nquit\n2\n"} {
+			var out bytes.Buffer
+			transcript, err := Play(context.Background(), NewSession(graph), strings.NewReader(input), &out)
+			require.NoError(t, err)
+			assert.False(t, transcript.Ended)
+			assert.Equal(t, []string{"index|has_key=false", "index|has_key=true"}, transcript.NodeIDs)
+		}
+	})
+
+	t.Run("interrupted", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		in, w := io.Pipe()
+		defer w.Close()
+		done := make(chan error)
+		go func() {
+			_, err := Play(ctx, NewSession(graph), in, io.Discard)
+			done <- err
+		}()
+		_, err := io.WriteString(w, "1\n")
+		require.NoError(t, err)
+		cancel()
+		select {
+		case err := <-done:
+			assert.True(t, errors.Is(err, context.Canceled))
+		case <-time.After(5 * time.Second):
+			t.Fatal("Play did not stop")
+		}
+	})
+
+	t.Run("start node", func(t *testing.T) {
+		id, err := NodeForKnot(graph, "index")
+		require.NoError(t, err)
+		assert.Equal(t, "index|has_key=false", id)
+		_, err = NodeForKnot(graph, "garden")
+		assert.EqualError(t, err, "knot 'garden' is never reached with every state false; reachable nodes: garden|has_key=true")
+		_, err = NodeForKnot(graph, "cellar")
+		assert.EqualError(t, err, "knot 'cellar' has no reachable node")
+
+		twice := &StoryGraph{StartNodeID: "hall|b=false", Graph: map[string]*StoryNode{
+			"hall|b=false": {KnotName: "hall", State: map[string]bool{"b": false}},
+			"hall|a=false": {KnotName: "hall", State: map[string]bool{"a": false}},
+			"hall|a=true":  {KnotName: "hall", State: map[string]bool{"a": true}},
+		}}
+		for i := 0; i < 20; i++ {
+			id, err := NodeForKnot(twice, "hall")
+			require.NoError(t, err)
+			require.Equal(t, "hall|a=false", id, "the smallest matching ID, whatever the map order")
+		}
+
+		session, err := NewSessionAt(graph, "index|has_key=true")
+		require.NoError(t, err)
+		transcript, err := Play(context.Background(), session, strings.NewReader("1\n"), io.Discard)
+		require.NoError(t, err)
+		assert.True(t, transcript.Ended)
+		_, err = NewSessionAt(graph, "cellar|")
+		assert.Error(t, err)
+	})
+}
+
+func TestSessionHooks(t *testing.T) {
+	graph, err := CompileToGraph(playScript)
+	require.NoError(t, err)
+	session := NewSession(graph)
+	var events []string
+	session.OnEnterNode(func(node *StoryNode) { events = append(events, "enter "+session.NodeID()) })
+	session.OnChoice(func(edge *StoryEdge) { events = append(events, "choice "+edge.Text) })
+	session.OnEnd(func(node *StoryNode) { events = append(events, "end "+node.KnotName) })
+	assert.Equal(t, []string{"enter index|has_key=false"}, events, "the start node is entered once")
+
+	require.NoError(t, session.Choose(0))
+	require.NoError(t, session.Choose(0))
+	assert.Equal(t, []string{
+		"enter index|has_key=false",
+		"choice Find the key.",
+		"enter index|has_key=true",
+		"choice Open the door.",
+		"enter garden|has_key=true",
+		"end garden",
+	}, events)
+
+	// Back does not fire hooks, and neither does a late registration.
+	require.NoError(t, session.Back())
+	session.OnEnterNode(func(node *StoryNode) { events = append(events, "late "+node.KnotName) })
+	assert.Len(t, events, 6)
+
+	t.Run("panicking hooks", func(t *testing.T) {
+		session := NewSession(graph)
+		session.OnChoice(func(edge *StoryEdge) { panic("boom") })
+		err := session.Choose(0)
+		assert.True(t, errors.Is(err, ErrHookPanic), "%v", err)
+		assert.Contains(t, err.Error(), "boom")
+		assert.Equal(t, graph.StartNodeID, session.NodeID())
+		assert.Empty(t, session.History())
+
+		session = NewSession(graph)
+		entered := 0
+		session.OnEnterNode(func(node *StoryNode) {
+			if entered++; entered == 2 {
+				panic("boom")
+			}
+		})
+		err = session.Choose(0)
+		assert.True(t, errors.Is(err, ErrHookPanic), "%v", err)
+		assert.Equal(t, "index|has_key=true", session.NodeID())
+		assert.Equal(t, []string{graph.StartNodeID, "index|has_key=true"}, session.Visited())
+		require.NoError(t, session.Choose(0))
+		assert.True(t, session.Done())
+	})
+}
+
+func TestSessionSeed(t *testing.T) {
+	graph, err := CompileToGraph(`=== index ===
+You wake up.
+* Go left. -> left
+* Go right. -> right
+* Wait. -> index
+
+=== left ===
+A cliff.
+END: fall
+
+=== right ===
+A road home.
+END: home
+`)
+	require.NoError(t, err)
+	walk := func(session *Session) []string {
+		for steps := 0; !session.Done() && steps < 50; steps++ {
+			_, err := session.ChooseRandom()
+			require.NoError(t, err)
+		}
+		return session.Visited()
+	}
+
+	paths := make(map[string]bool)
+	for seed := int64(0); seed < 20; seed++ {
+		session := NewSessionSeeded(graph, seed)
+		assert.Equal(t, seed, session.Seed())
+		path := walk(session)
+		assert.Equal(t, path, walk(NewSessionSeeded(graph, seed)), "seed %d", seed)
+		assert.Equal(t, Simulate(graph, seed, 50).NodeIDs, path, "seed %d", seed)
+		paths[strings.Join(path, " ")] = true
+	}
+	assert.Greater(t, len(paths), 1, "different seeds should take different choices")
+
+	session := NewSessionSeeded(graph, 1)
+	walk(session)
+	_, err = session.ChooseRandom()
+	assert.True(t, errors.Is(err, ErrStoryEnded), "%v", err)
+
+	// Sessions not given a seed still report the one they use.
+	session = NewSession(graph)
+	assert.Equal(t, walk(session), walk(NewSessionSeeded(graph, session.Seed())))
+}
+
+func TestSessionGotoNode(t *testing.T) {
+	graph, err := CompileToGraph(`// STATES: has_sword
+
+=== index ===
+The square.
+* Take the side street. -> street
+* Take the avenue. -> avenue
+* Visit the armoury. -> armoury
+* Leave town. -> road
+
+=== street ===
+A narrow street.
+* Walk on. -> blacksmith
+
+=== avenue ===
+A wide avenue.
+* Walk on. -> blacksmith
+
+=== armoury ===
+Racks of blades.
+* {has_sword == false} Take a sword. ~ has_sword = true -> index
+* Go back. -> index
+
+=== blacksmith ===
+The blacksmith looks up.
+* Go back. -> index
+
+=== road ===
+The open road.
+END: gone
+`)
+	require.NoError(t, err)
+	visitedAfter := func(session *Session, n int) []string {
+		visited := session.Visited()
+		return visited[len(visited)-n:]
+	}
+
+	session := NewSession(graph)
+	var entered []string
+	session.OnEnterNode(func(*StoryNode) { entered = append(entered, session.NodeID()) })
+
+	// Two paths of the same length: the avenue wins on node ID, though the
+	// street is the first choice.
+	require.NoError(t, session.GotoNode("blacksmith|has_sword=false"))
+	assert.Equal(t, []string{"index|has_sword=false", "avenue|has_sword=false", "blacksmith|has_sword=false"}, session.Visited())
+	assert.Equal(t, session.Visited(), entered, "hooks fire for every step")
+
+	// Around the loop, through the armoury.
+	require.NoError(t, session.GotoNode("blacksmith|has_sword=true"))
+	assert.Equal(t, []string{
+		"blacksmith|has_sword=false",
+		"index|has_sword=false",
+		"armoury|has_sword=false",
+		"index|has_sword=true",
+		"avenue|has_sword=true",
+		"blacksmith|has_sword=true",
+	}, visitedAfter(session, 6))
+	assert.Len(t, session.History(), 7)
+	require.NoError(t, session.GotoNode("blacksmith|has_sword=true"))
+	assert.Len(t, session.History(), 7, "going to the current node is a no-op")
+
+	// Nothing leads on from an END node, so the path starts over at the root.
+	require.NoError(t, session.GotoNode("road|has_sword=true"))
+	require.True(t, session.Done())
+	require.NoError(t, session.GotoNode("armoury|has_sword=false"))
+	assert.Equal(t, []string{"index|has_sword=false", "armoury|has_sword=false"}, session.Visited())
+
+	err = session.GotoNode("forge|has_sword=false")
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrUnreachable))
+
+	ended, err := NewSessionAt(graph, "road|has_sword=false")
+	require.NoError(t, err)
+	err = ended.GotoNode("index|has_sword=false")
+	assert.True(t, errors.Is(err, ErrUnreachable), "%v", err)
+	assert.Equal(t, "road|has_sword=false", ended.NodeID())
+
+	t.Run("skipping hooks", func(t *testing.T) {
+		hooked, quiet := NewSession(graph), NewSession(graph)
+		calls := 0
+		quiet.OnEnterNode(func(*StoryNode) { calls++ })
+		quiet.OnChoice(func(*StoryEdge) { calls++ })
+		require.NoError(t, hooked.GotoNode("blacksmith|has_sword=true"))
+		require.NoError(t, quiet.GotoNodeWithOptions("blacksmith|has_sword=true", GotoOptions{SkipHooks: true}))
+		assert.Equal(t, 1, calls, "only the start node, at registration")
+		assert.Equal(t, hooked.History(), quiet.History())
+	})
+}
+
+func TestSessionVisits(t *testing.T) {
+	script := `=== index === #area:town
+The square.
+* Visit the tavern. -> tavern
+* Leave. -> road
+
+=== tavern === #area:town #mood:loud
+A noisy tavern.
+* Go back out. -> index
+
+=== road ===
+The road.
+END: gone
+`
+	graph, err := CompileToGraph(script)
+	require.NoError(t, err)
+	session := NewSession(graph)
+	assert.Equal(t, 1, session.VisitCount("index"))
+	for i := 0; i < 5; i++ {
+		require.NoError(t, session.Choose(0))
+	}
+	assert.Equal(t, 3, session.VisitCount("tavern"))
+	assert.Equal(t, 3, session.VisitCount("index"))
+	assert.Equal(t, 0, session.VisitCount("road"))
+	assert.Len(t, session.VisitedNodes(), 2)
+	assert.Equal(t, map[string]int{"area:town": 6, "mood:loud": 3}, session.CollectedTags())
+
+	// Back takes the visit away again.
+	require.NoError(t, session.Back())
+	assert.Equal(t, 2, session.VisitCount("tavern"))
+	assert.Equal(t, map[string]int{"area:town": 5, "mood:loud": 2}, session.CollectedTags())
+
+	saved, err := session.Save()
+	require.NoError(t, err)
+	assert.Contains(t, string(saved), `"collectedTags":{"area:town":5,"mood:loud":2}`)
+	restored, err := RestoreSession(graph, saved)
+	require.NoError(t, err)
+	assert.Equal(t, session.VisitedNodes(), restored.VisitedNodes())
+	assert.Equal(t, 3, restored.VisitCount("index"))
+	assert.Equal(t, session.CollectedTags(), restored.CollectedTags())
+
+	// A forced restore drops the history but keeps the counts.
+	edited, err := CompileToGraph(strings.Replace(script, "The road.\nEND: gone", "The road.\n* Turn back. -> index", 1))
+	require.NoError(t, err)
+	forced, err := RestoreSessionWithOptions(edited, saved, RestoreOptions{Force: true})
+	require.NoError(t, err)
+	assert.Empty(t, forced.History())
+	assert.Equal(t, 3, forced.VisitCount("index"))
+	assert.Equal(t, 2, forced.VisitCount("tavern"))
+	require.NoError(t, forced.Choose(0))
+	assert.Equal(t, 3, forced.VisitCount("tavern"))
+	assert.Equal(t, map[string]int{"area:town": 6, "mood:loud": 3}, forced.CollectedTags())
+
+	transcript, err := Play(context.Background(), NewSession(graph), strings.NewReader("1\n1\n2\n"), io.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"area:town": 3, "mood:loud": 1}, transcript.Tags)
+	simulated := Simulate(graph, 1, 50)
+	require.True(t, simulated.Ended)
+	assert.Equal(t, len(simulated.NodeIDs)-1, simulated.Tags["area:town"], "every node but the road is in town")
+}
+
+func TestExportHTML(t *testing.T) {
+	script := `// title: The <Cellar>
+// STATES: lit
+
+=== index ===
+A dark cellar. </script><script>alert(1)</script>
+* Light the lamp & look. ~ lit = true -> index
+* Leave. -> out
+
+=== out ===
+END: escaped
+`
+	graph, err := CompileToGraph(script)
+	require.NoError(t, err)
+	out, err := ExportHTML(graph, HTMLOptions{})
+	require.NoError(t, err)
+	page := string(out)
+	assert.Contains(t, page, "<title>The &lt;Cellar&gt;</title>")
+	assert.NotContains(t, page, `id="debug"`)
+	assert.Equal(t, 2, strings.Count(page, "</script>"), "content must not end a script element")
+
+	// The embedded document loads back as the same graph.
+	const open = `<script type="application/json" id="story">`
+	start := strings.Index(page, open)
+	require.GreaterOrEqual(t, start, 0)
+	payload := page[start+len(open):]
+	payload = payload[:strings.Index(payload, "</script>")]
+	loaded, err := LoadGraph([]byte(payload))
+	require.NoError(t, err)
+	want, err := EncodeGraph(graph, FormatJSON)
+	require.NoError(t, err)
+	got, err := EncodeGraph(loaded, FormatJSON)
+	require.NoError(t, err)
+	assert.Equal(t, string(want), string(got))
+
+	out, err = ExportHTML(graph, HTMLOptions{Title: "Beta", CSS: "body { color: red; } </style>", Debug: true})
+	require.NoError(t, err)
+	page = string(out)
+	assert.Contains(t, page, "<title>Beta</title>")
+	assert.Contains(t, page, "body { color: red; } <\\/style>")
+	assert.Contains(t, page, `<div id="debug"></div>`)
+
+	_, err = ExportHTML(nil, HTMLOptions{})
+	assert.Error(t, err)
+}
+
+func TestExportGamebook(t *testing.T) {
+	graph, err := CompileToGraph(`// title: The Cellar
+// STATES: lit
+
+=== index ===
+A dark cellar.
+* {lit == false} Light the lamp. ~ lit = true -> index
+* Leave. -> out
+
+=== out ===
+Daylight.
+END: escaped
+`)
+	require.NoError(t, err)
+	out, err := ExportGamebook(graph, GamebookOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, `# The Cellar
+
+## 1
+
+A dark cellar.
+
+- If you light the lamp, turn to 2.
+- If you leave, turn to 3.
+
+## 2
+
+A dark cellar.
+
+- If you leave, turn to 4.
+
+## 3
+
+Daylight.
+
+**The End: escaped**
+
+## 4
+
+Daylight.
+
+**The End: escaped**
+`, string(out))
+
+	_, err = ExportGamebook(graph, GamebookOptions{MaxNodes: 3})
+	assert.Error(t, err)
+	_, err = ExportGamebook(graph, GamebookOptions{MaxNodes: -1})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "open the door", gamebookChoice("Open the door."))
+	assert.Equal(t, "I run", gamebookChoice("I run!"))
+	assert.Equal(t, "NASA calls", gamebookChoice("NASA calls"))
+}
+
+func TestGamebookCrossReferences(t *testing.T) {
+	graph, err := CompileToGraph(largeScript(3, 6))
+	require.NoError(t, err)
+
+	type section struct {
+		content string
+		refs    []int
+	}
+	parse := func(book string) map[int]section {
+		sections := make(map[int]section)
+		number := 0
+		for _, line := range strings.Split(book, "\n") {
+			var n int
+			if _, err := fmt.Sscanf(line, "## %d", &n); err == nil {
+				_, dup := sections[n]
+				require.False(t, dup, "section %d appears twice", n)
+				number = n
+				sections[n] = section{}
+				continue
+			}
+			if number == 0 {
+				continue
+			}
+			current := sections[number]
+			if i := strings.LastIndex(line, ", turn to "); strings.HasPrefix(line, "- If you ") && i >= 0 {
+				var n int
+				_, err := fmt.Sscanf(line[i:], ", turn to %d.", &n)
+				require.NoError(t, err, line)
+				current.refs = append(current.refs, n)
+			} else {
+				current.content += line
+			}
+			sections[number] = current
+		}
+		return sections
+	}
+	// walk reads the book breadth-first from section 1, the way the
+	// exporter numbers it.
+	walk := func(sections map[int]section) []string {
+		var contents []string
+		seen := map[int]bool{1: true}
+		for queue := []int{1}; len(queue) > 0; queue = queue[1:] {
+			contents = append(contents, sections[queue[0]].content)
+			for _, ref := range sections[queue[0]].refs {
+				if !seen[ref] {
+					seen[ref] = true
+					queue = append(queue, ref)
+				}
+			}
+		}
+		return contents
+	}
+
+	plain, err := ExportGamebook(graph, GamebookOptions{})
+	require.NoError(t, err)
+	var walks [][]string
+	for _, opts := range []GamebookOptions{{}, {Shuffle: true, Seed: 1}, {Shuffle: true, Seed: 2}} {
+		out, err := ExportGamebook(graph, opts)
+		require.NoError(t, err)
+		again, err := ExportGamebook(graph, opts)
+		require.NoError(t, err)
+		assert.Equal(t, string(out), string(again), "%+v", opts)
+
+		sections := parse(string(out))
+		require.Len(t, sections, len(graph.Graph))
+		for n, s := range sections {
+			assert.True(t, n >= 1 && n <= len(graph.Graph), "section %d out of range", n)
+			for _, ref := range s.refs {
+				_, ok := sections[ref]
+				assert.True(t, ok, "section %d refers to missing section %d", n, ref)
+			}
+		}
+		if opts.Shuffle {
+			assert.NotEqual(t, string(plain), string(out), "%+v", opts)
+		}
+		walks = append(walks, walk(sections))
+	}
+	assert.Equal(t, walks[0], walks[1], "shuffling must not change where choices lead")
+	assert.Equal(t, walks[0], walks[2])
+}
+
+func TestGenerateGoConstants(t *testing.T) {
+	script := `// STATES: has_key
+// SCENES: house, garden
+// ENDINGS: freedom
+
+=== index ===
+// scene: house
+A locked door.
+* {has_key == false} Find the key. ~ has_key = true -> index
+* {has_key == true} Open the door. -> garden_gate
+
+=== garden_gate ===
+// scene: garden
+Sunlight.
+END: freedom
+
+=== cellar ===
+Dark.
+END
+`
+	ast, err := Parse(script)
+	require.NoError(t, err)
+	out, err := GenerateGoConstants(ast, "story")
+	require.NoError(t, err)
+	assert.Equal(t, "// Code generated by "+generator()+`; DO NOT EDIT.
+
+package story
+
+// Knot is the name of a knot in the story.
+type Knot string
+
+const KnotCellar Knot = "cellar"
+const KnotGardenGate Knot = "garden_gate"
+const KnotIndex Knot = "index"
+
+// AllKnots lists every knot, sorted by name.
+var AllKnots = []Knot{
+	KnotCellar,
+	KnotGardenGate,
+	KnotIndex,
+}
+
+// State is the name of a declared state in the story.
+type State string
+
+const StateHasKey State = "has_key"
+
+// AllStates lists every state, sorted by name.
+var AllStates = []State{
+	StateHasKey,
+}
+
+// Scene is the name of a scene in the story.
+type Scene string
+
+const SceneGarden Scene = "garden"
+const SceneHouse Scene = "house"
+
+// AllScenes lists every scene, sorted by name.
+var AllScenes = []Scene{
+	SceneGarden,
+	SceneHouse,
+}
+
+// Ending is the name of an ending label in the story.
+type Ending string
+
+const EndingCellar Ending = "cellar"
+const EndingFreedom Ending = "freedom"
+
+// AllEndings lists every ending, sorted by name.
+var AllEndings = []Ending{
+	EndingCellar,
+	EndingFreedom,
+}
+`, string(out))
+
+	formatted, err := format.Source(out)
+	require.NoError(t, err)
+	assert.Equal(t, string(formatted), string(out), "output must be gofmt-clean")
+	fset := token.NewFileSet()
+	file, err := goparser.ParseFile(fset, "story.go", out, 0)
+	require.NoError(t, err)
+	_, err = (&types.Config{}).Check("story", fset, []*goast.File{file}, nil)
+	require.NoError(t, err, "output must type-check")
+
+	// A new knot only adds lines.
+	longer, err := Parse(script + "\n=== a_much_longer_knot_name ===\nHi.\n-> index\n")
+	require.NoError(t, err)
+	regenerated, err := GenerateGoConstants(longer, "story")
+	require.NoError(t, err)
+	oldLines := strings.Split(string(out), "\n")
+	newLines := strings.Split(string(regenerated), "\n")
+	assert.Len(t, newLines, len(oldLines)+2)
+	i := 0
+	for _, line := range newLines {
+		if i < len(oldLines) && line == oldLines[i] {
+			i++
+		}
+	}
+	assert.Equal(t, len(oldLines), i, "every old line must survive, in order")
+
+	again, err := GenerateGoConstants(longer, "story")
+	require.NoError(t, err)
+	assert.Equal(t, string(regenerated), string(again))
+
+	_, err = GenerateGoConstants(ast, "my-story")
+	assert.Error(t, err)
+	assert.Equal(t, "Act2Intro", goIdentifier("act2.intro"))
+	assert.Equal(t, "Unnamed", goIdentifier("..."))
+}
+
+// nodeCountMarshaler is a third-party style Marshaler for TestMarshaler.
+type nodeCountMarshaler struct{ err error }
+
+func (m nodeCountMarshaler) Marshal(graph *StoryGraph, meta Metadata) ([]byte, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return []byte(fmt.Sprintf("%s: %d nodes, %d warnings", meta.Title, len(graph.Graph), len(meta.Warnings))), nil
+}
+
+func TestMarshaler(t *testing.T) {
+	script, err := os.ReadFile(filepath.Join("testdata", "garden.biff"))
+	require.NoError(t, err)
+	golden, err := os.ReadFile(filepath.Join("testdata", "garden.golden.json"))
+	require.NoError(t, err)
+
+	// The built-in JSON marshaler is what Compile has always written.
+	output, err := CompileWith(string(script), JSONMarshaler{})
+	require.NoError(t, err)
+	assert.Equal(t, string(golden), string(output))
+
+	result, err := CompileWithOptions(string(script), Options{})
+	require.NoError(t, err)
+	for _, format := range []OutputFormat{FormatJSON, FormatCompactJSON, FormatBinary} {
+		m, err := format.marshaler()
+		require.NoError(t, err)
+		viaMarshaler, err := CompileWith(string(script), m)
+		require.NoError(t, err)
+		encoded, err := EncodeGraph(result.Graph, format)
+		require.NoError(t, err)
+		if format != FormatBinary { // gob writes maps in random order
+			assert.Equal(t, string(encoded), string(viaMarshaler), format.String())
+		}
+		loaded, err := LoadGraph(viaMarshaler)
+		require.NoError(t, err, format.String())
+		assert.Len(t, loaded.Graph, len(result.Graph.Graph), format.String())
+	}
+	_, err = EncodeGraph(result.Graph, OutputFormat(99))
+	assert.Error(t, err)
+
+	output, err = CompileWith(string(script), nodeCountMarshaler{})
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%s: %d nodes, %d warnings", result.Title, len(result.Graph.Graph), len(result.Warnings)), string(output))
+	_, err = CompileWith(string(script), nodeCountMarshaler{err: errors.New("disk full")})
+	assert.EqualError(t, err, "disk full")
+	_, err = CompileWith("=== index ===\n* Go. -> nowhere\n", nodeCountMarshaler{})
+	assert.Error(t, err)
+}
+
+func TestTranslations(t *testing.T) {
+	ast, err := Parse(playScript)
+	require.NoError(t, err)
+	catalog := ExtractCatalog(ast)
+	assert.Equal(t, Catalog{
+		"index/text/0":   "A locked door.",
+		"index/choice/0": "Find the key.",
+		"index/choice/1": "Open the door.",
+		"garden/text/0":  "Sunlight.",
+	}, catalog)
+
+	source, err := CompileWithOptions(playScript, Options{})
+	require.NoError(t, err)
+	translated, err := CompileWithOptions(playScript, Options{Translations: Catalog{
+		"index/text/0":   "Une porte verrouillée.",
+		"index/choice/0": "Trouver la clé.",
+		"index/choice/1": "Ouvrir la porte.",
+	}})
+	require.NoError(t, err)
+
+	require.Equal(t, len(source.Graph.Graph), len(translated.Graph.Graph))
+	var changed []string
+	for id, node := range source.Graph.Graph {
+		other, ok := translated.Graph.Graph[id]
+		require.True(t, ok, "node IDs are those of the source: %s", id)
+		assert.Equal(t, node.State, other.State)
+		require.Len(t, other.Edges, len(node.Edges))
+		for i, edge := range node.Edges {
+			assert.Equal(t, edge.TargetNodeID, other.Edges[i].TargetNodeID)
+		}
+		if node.Content != other.Content {
+			changed = append(changed, id)
+		}
+	}
+	sort.Strings(changed)
+	assert.Equal(t, []string{"index|has_key=false", "index|has_key=true"}, changed)
+
+	door := translated.Graph.Graph["index|has_key=true"]
+	assert.Equal(t, "Une porte verrouillée.", door.Content)
+	assert.Equal(t, 3, door.WordCount)
+	assert.Equal(t, "Ouvrir la porte.", door.Edges[0].Text)
+	assert.Equal(t, "Sunlight.", translated.Graph.Graph["garden|has_key=true"].Content, "missing translations fall back to the source")
+
+	var missing []Diagnostic
+	for _, d := range translated.Diagnostics {
+		if d.Code == CodeMissingTranslation {
+			missing = append(missing, d)
+		}
+	}
+	require.Len(t, missing, 1)
+	assert.Contains(t, missing[0].Message, ": garden/text/0")
+	assert.Len(t, translated.Diagnostics, len(source.Diagnostics)+1)
+}
+
+const renameScript = `// title: Keys
+// STATES: has_key, door_open
+// LOCAL-STATES(cellar): lamp
+
+=== index === #mood:calm
+- {has_key == true} You hold the key. The cellar is below.
+- A locked door.
+* {has_key == false} Look for has_key. ~ has_key = true -> index
+* {has_key == true && door_open == false} Unlock the hall. ~ door_open = true ~ has_key = false -> hall
+* Go down to the cellar.   ->   .cellar
+
+=== hall ===
+The hall.
+END: inside
+
+=== cellar ===
+// scene: cellar
+// The cellar knot is dark until the lamp is lit.
+- {lamp == true} Light.
+Dark.
+* Light the lamp. ~ lamp = true -> cellar
+* {lamp == true} Up. -> index
+`
+
+func TestRenameKnot(t *testing.T) {
+	renamed, err := RenameKnot(renameScript, "cellar", "basement")
+	require.NoError(t, err)
+	want := strings.NewReplacer(
+		"->   .cellar", "->   .basement",
+		"=== cellar ===", "=== basement ===",
+		"-> cellar", "-> basement",
+	).Replace(renameScript)
+	assert.Equal(t, want, renamed, "only the declaration and diverts change, not prose, comments, scenes or spacing")
+
+	renamed, err = RenameKnot(renameScript, "hall", "corridor")
+	require.NoError(t, err)
+	assert.Equal(t, strings.NewReplacer("-> hall", "-> corridor", "=== hall ===", "=== corridor ===").Replace(renameScript), renamed)
+	graph, err := CompileToGraph(renamed)
+	require.NoError(t, err)
+	assert.Contains(t, graph.Graph, "corridor|door_open=true,has_key=false")
+
+	_, err = RenameKnot(renameScript, "hall", "index")
+	assert.ErrorContains(t, err, "already exists")
+	_, err = RenameKnot(renameScript, "attic", "loft")
+	assert.ErrorContains(t, err, "no knot named 'attic'")
+	_, err = RenameKnot(renameScript, "hall", "the hall")
+	assert.ErrorContains(t, err, "invalid knot name")
+
+	t.Run("namespace", func(t *testing.T) {
+		script := "// NAMESPACE: act2\n\n=== index ===\nStart.\n* On. -> intro\n* Stitch. -> .intro\n* Full. -> act2.intro\n\n=== intro ===\nEND\n"
+		renamed, err := RenameKnot(script, "act2.intro", "act2.opening")
+		require.NoError(t, err)
+		assert.Equal(t, "// NAMESPACE: act2\n\n=== index ===\nStart.\n* On. -> opening\n* Stitch. -> .opening\n* Full. -> act2.opening\n\n=== opening ===\nEND\n", renamed)
+		_, err = RenameKnot(script, "act2.intro", "opening")
+		assert.ErrorContains(t, err, "namespace 'act2'")
+	})
+
+	t.Run("visit tracking", func(t *testing.T) {
+		script := "// TRACK-VISITS: index, tavern\n\n=== index ===\n- {visited_tavern == true} You know the way.\nA square.\n* Enter. -> tavern\n* {visited_tavern == true} Leave. ~ visited_tavern_door = true -> road\n\n=== tavern ===\nLoud.\n* Out. -> index\n\n=== road ===\nEND\n"
+		renamed, err := RenameKnot(script, "tavern", "inn")
+		require.NoError(t, err)
+		assert.Equal(t, "// TRACK-VISITS: index, inn\n\n=== index ===\n- {visited_inn == true} You know the way.\nA square.\n* Enter. -> inn\n* {visited_inn == true} Leave. ~ visited_tavern_door = true -> road\n\n=== inn ===\nLoud.\n* Out. -> index\n\n=== road ===\nEND\n", renamed)
+		before, err := CompileToGraph(script)
+		require.NoError(t, err)
+		after, err := CompileToGraph(renamed)
+		require.NoError(t, err)
+		assert.Len(t, after.Graph, len(before.Graph))
+
+		_, err = RenameKnot("// FLAG-STATES: visited_inn\n"+script, "tavern", "inn")
+		assert.ErrorContains(t, err, "broke the script", "the new visit state is already declared")
+	})
+}
+
+func TestRenameState(t *testing.T) {
+	renamed, err := RenameState(renameScript, "has_key", "holding_key")
+	require.NoError(t, err)
+	want := strings.NewReplacer(
+		"// STATES: has_key,", "// STATES: holding_key,",
+		"{has_key ==", "{holding_key ==",
+		"~ has_key =", "~ holding_key =",
+	).Replace(renameScript)
+	assert.Equal(t, want, renamed, "conditions, state changes and the header change, choice text does not")
+	assert.Contains(t, renamed, "Look for has_key.")
+
+	renamed, err = RenameState(renameScript, "lamp", "lantern")
+	require.NoError(t, err)
+	want = strings.NewReplacer(
+		"// LOCAL-STATES(cellar): lamp", "// LOCAL-STATES(cellar): lantern",
+		"{lamp ==", "{lantern ==",
+		"~ lamp =", "~ lantern =",
+	).Replace(renameScript)
+	assert.Equal(t, want, renamed, "scene-scoped declarations are renamed, prose mentioning the lamp is not")
+
+	// Whole identifiers only: renaming "door" must not touch "door_open".
+	_, err = RenameState(renameScript, "door", "gate")
+	assert.ErrorContains(t, err, "no state named 'door'")
+	_, err = RenameState(renameScript, "lamp", "has_key")
+	assert.ErrorContains(t, err, "already exists")
+	_, err = RenameState("=== index ===\n* {broken -> index\n", "a", "b")
+	assert.Error(t, err)
+
+	// External conditions are not states, even when they share a name.
+	ext := "// STATES: hard\n\n=== index ===\n- {ext:hard == true} A hard road.\n* {hard == false && ext:hard == true} Harden. ~ hard = true -> index\n* {hard == true} Go. -> end\n\n=== end ===\nEND\n"
+	renamed, err = RenameState(ext, "hard", "difficult")
+	require.NoError(t, err)
+	assert.Equal(t, "// STATES: difficult\n\n=== index ===\n- {ext:hard == true} A hard road.\n* {difficult == false && ext:hard == true} Harden. ~ difficult = true -> index\n* {difficult == true} Go. -> end\n\n=== end ===\nEND\n", renamed)
+}
+
+func TestStripUnreachable(t *testing.T) {
+	script := "// STATES: lit, cursed\n\n=== index ===\n- {cursed == true} A curse hangs here.\n  It never lifts.\n\n- {lit == true} Light.\n- Dark.\n* {cursed == true} Follow the curse. -> crypt\n* Light a match. ~ lit = true -> index\n* Leave. -> outside\n\n=== crypt ===\n// Cut from the release.\nBones.\n* Back. -> index\n\n=== outside ===\nFresh air.\nEND\n"
+	stripped, report, err := StripUnreachable(script)
+	require.NoError(t, err)
+	assert.Equal(t, "// STATES: lit, cursed\n\n=== index ===\n\n- {lit == true} Light.\n- Dark.\n* Light a match. ~ lit = true -> index\n* Leave. -> outside\n\n\n=== outside ===\nFresh air.\nEND\n", stripped)
+	assert.Equal(t, []StrippedSection{
+		{KnotName: "index", Block: 1, Condition: "cursed == true", StartLine: 4, EndLine: 5},
+		{KnotName: "index", Choice: 1, Target: "crypt", Condition: "cursed == true", StartLine: 9, EndLine: 9},
+		{KnotName: "crypt", StartLine: 13, EndLine: 16},
+	}, report.Removed)
+	assert.Equal(t, "line 9: index choice 1, leads to unreachable knot 'crypt'", report.Removed[1].String())
+	assert.Equal(t, "lines 13-16: unreachable knot 'crypt'", report.Removed[2].String())
+	for _, d := range Validate(stripped) {
+		assert.NotEqual(t, SeverityError, d.Severity, "%s", d)
+	}
+
+	before, err := CompileToGraph(script)
+	require.NoError(t, err)
+	after, err := CompileToGraph(stripped)
+	require.NoError(t, err)
+	assert.Equal(t, len(before.Graph), len(after.Graph), "stripping dead content does not change the story")
+	for id, node := range before.Graph {
+		require.Contains(t, after.Graph, id)
+		assert.Equal(t, node.Content, after.Graph[id].Content)
+	}
+
+	clean := "=== index ===\nHello.\nEND\n"
+	stripped, report, err = StripUnreachable(clean)
+	require.NoError(t, err)
+	assert.Equal(t, clean, stripped)
+	assert.Empty(t, report.Removed)
+}
+
+func TestMergeScripts(t *testing.T) {
+	shared := "=== credits ===\nMade by many hands.\nEND: credits\n"
+	alice := NamedScript{Name: "alice.biff", Source: "// title: The House\n// STATES: has_key\n\n=== index ===\nA house.\n* {has_key == false} Search. ~ has_key = true -> index\n* Enter. -> hall\n\n" + shared}
+	bob := NamedScript{Name: "bob.biff", Source: "// title: The House\n// STATES: has_key, lit\n\n=== hall ===\n- {lit == true} Bright.\nDim.\n* Light. ~ lit = true -> hall\n* Leave. -> credits\n\n" + shared}
+
+	merged, diagnostics, err := MergeScripts(alice, bob)
+	require.NoError(t, err)
+	assert.Empty(t, diagnostics, "identical knots and metadata merge silently")
+	result, err := CompileWithOptions(merged, Options{})
+	require.NoError(t, err, merged)
+	assert.Equal(t, "The House", result.Title)
+	assert.Contains(t, result.Graph.Graph, "credits|has_key=false,lit=false")
+	assert.Equal(t, 1, strings.Count(merged, "=== credits ==="))
+
+	carol := NamedScript{Name: "carol.biff", Source: "// title: A House\n// FLAG-STATES: lit\n\n=== hall ===\nAnother hall.\nEND\n"}
+	merged, diagnostics, err = MergeScripts(alice, bob, carol)
+	require.Error(t, err)
+	assert.Empty(t, merged)
+	var list ErrorList
+	require.True(t, errors.As(err, &list))
+	require.Len(t, list, 2)
+	assert.Equal(t, CodeDuplicate, list[0].Code)
+	assert.Equal(t, "carol.biff", list[0].File)
+	assert.Equal(t, 4, list[0].Line)
+	assert.Contains(t, list[0].Message, "bob.biff:4")
+	assert.Equal(t, CodeDeclaration, list[1].Code)
+	assert.Contains(t, list[1].Message, "state 'lit' is declared with FLAG-STATES in carol.biff, but with STATES in bob.biff")
+
+	require.Len(t, diagnostics, 3)
+	assert.Equal(t, SeverityWarning, diagnostics[2].Severity)
+	assert.Equal(t, CodeDuplicateMetadata, diagnostics[2].Code)
+	assert.Equal(t, "carol.biff", diagnostics[2].File)
+	assert.Contains(t, diagnostics[2].Message, "keeping 'The House'")
+
+	_, _, err = MergeScripts(alice, NamedScript{Name: "broken.biff", Source: "=== index ===\n* {oops -> index\n"})
+	assert.ErrorContains(t, err, "broken.biff")
+}
+
+// recordingVisitor records the nodes it visits and stops or skips at the
+// nodes named in stop and skip.
+type recordingVisitor struct {
+	visited    []string
+	stop, skip string
+}
+
+func (v *recordingVisitor) action(name string) WalkAction {
+	v.visited = append(v.visited, name)
+	switch name {
+	case v.stop:
+		return Stop
+	case v.skip:
+		return SkipChildren
+	}
+	return Continue
+}
+
+func (v *recordingVisitor) VisitKnot(knot *Knot) WalkAction {
+	return v.action(knot.Name)
+}
+
+func (v *recordingVisitor) VisitTextBlock(block *TextBlock) WalkAction {
+	return v.action(fmt.Sprintf("text:%d", block.Line))
+}
+
+func (v *recordingVisitor) VisitChoice(choice *Choice) WalkAction {
+	return v.action(fmt.Sprintf("choice:%d", choice.Line))
+}
+
+func TestWalk(t *testing.T) {
+	ast, err := Parse("// STATES: lit\n\n=== index ===\n- {lit == true} Light.\n- Dark.\n* Light. ~ lit = true -> index\n* Go. -> hall\n\n=== hall ===\n* Back. -> index\nAfterthought.\nEND\n\n=== attic ===\nDust.\nEND\n")
+	require.NoError(t, err)
+
+	v := &recordingVisitor{}
+	Walk(ast, v)
+	assert.Equal(t, []string{"index", "text:4", "text:5", "choice:6", "choice:7", "hall", "choice:10", "text:11", "attic", "text:15"}, v.visited,
+		"knots, blocks and choices come in source order")
+
+	v = &recordingVisitor{skip: "hall"}
+	Walk(ast, v)
+	assert.Equal(t, []string{"index", "text:4", "text:5", "choice:6", "choice:7", "hall", "attic", "text:15"}, v.visited)
+
+	v = &recordingVisitor{stop: "choice:6"}
+	Walk(ast, v)
+	assert.Equal(t, []string{"index", "text:4", "text:5", "choice:6"}, v.visited)
+
+	v = &recordingVisitor{stop: "hall"}
+	Walk(ast, v)
+	assert.Equal(t, []string{"index", "text:4", "text:5", "choice:6", "choice:7", "hall"}, v.visited)
+
+	var targets []string
+	Inspect(ast, func(node interface{}) bool {
+		switch n := node.(type) {
+		case *Knot:
+			return n.Name != "index"
+		case *Choice:
+			targets = append(targets, n.TargetKnot)
+		}
+		return true
+	})
+	assert.Equal(t, []string{"index"}, targets, "returning false for a knot skips its choices")
+
+	Inspect(ast, func(node interface{}) bool {
+		if block, ok := node.(*TextBlock); ok {
+			block.Content = strings.ToUpper(block.Content)
+		}
+		return true
+	})
+	assert.Equal(t, "DUST.", ast.Knots["attic"].Body[0].Content, "visitors see the script's own nodes")
+}
+
+func TestDirectiveHandler(t *testing.T) {
+	script := "// title: Cellar\n// art-style: ink\n\n=== index ===\n// art: hall.png\n// voice: narrator_2\n// just a comment\nA hall.\n* Down. -> cellar\n\n=== cellar ===\n// scene: below\n// art: cellar.png\nDark.\nEND\n"
+	var calls []string
+	handler := func(scope DirectiveScope, key, value string, pos Pos) (map[string]string, error) {
+		calls = append(calls, fmt.Sprintf("%d %s=%s @%d", scope, key, value, pos.Line))
+		switch key {
+		case "art", "art-style":
+			return map[string]string{key: value}, nil
+		case "voice":
+			if value == "" {
+				return nil, errors.New("voice needs a name")
+			}
+			return map[string]string{"voice": value}, nil
+		}
+		return nil, nil
+	}
+
+	result, err := CompileWithOptions(script, Options{DirectiveHandler: handler})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"0 title=Cellar @1", "0 art-style=ink @2",
+		"1 art=hall.png @5", "1 voice=narrator_2 @6",
+		"1 art=cellar.png @13",
+	}, calls, "built-in directives and plain comments are not offered")
+	assert.Equal(t, "Cellar", result.Title, "an unhandled header key is still metadata")
+	assert.Equal(t, map[string]string{"art": "hall.png", "voice": "narrator_2"}, result.Graph.Graph["index|"].Directives)
+	assert.Equal(t, map[string]string{"art": "cellar.png"}, result.Graph.Graph["cellar|"].Directives)
+	assert.Equal(t, "below", result.Graph.Graph["cellar|"].Scene)
+
+	data, err := result.JSON()
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"directives": {`)
+	assert.NotContains(t, string(data), "art-style", "header directives stay on the script")
+	ast, err := parseWithOptions(script, Options{DirectiveHandler: handler})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"art-style": "ink"}, ast.Directives)
+	assert.NotContains(t, ast.Metadata, "art-style")
+
+	plain, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	assert.Nil(t, plain.Graph.Graph["index|"].Directives, "without a handler directives are ignored as before")
+
+	_, err = CompileWithOptions(strings.Replace(script, "narrator_2", "", 1), Options{DirectiveHandler: handler})
+	var compileErr *Error
+	require.True(t, errors.As(err, &compileErr), "%v", err)
+	assert.Equal(t, CodeDirective, compileErr.Code)
+	assert.Equal(t, 6, compileErr.Line)
+	assert.Contains(t, compileErr.Message, "voice needs a name")
+
+	t.Run("compiler", func(t *testing.T) {
+		c := NewCompiler()
+		c.Options.DirectiveHandler = handler
+		_, err := c.Compile(script)
+		require.NoError(t, err)
+		result, err := c.Compile(strings.Replace(script, "cellar.png", "cellar_dark.png", 1))
+		require.NoError(t, err)
+		assert.Equal(t, "cellar_dark.png", result.Graph.Graph["cellar|"].Directives["art"])
+	})
+}
+
+func TestExternalConditions(t *testing.T) {
+	script := "// STATES: armed\n\n=== index ===\n- {ext:hard == true && armed == false} A guard blocks the way.\n- The way is clear.\n* {ext:hard == true} Fight the guard. ~ armed = true -> index\n* {ext:hard != true} Walk on. -> gate\n* {ext:hard == true && armed == true} Slip past. -> gate\n\n=== gate ===\nEND\n"
+
+	hard, err := CompileWithOptions(script, Options{ExternalConditions: map[string]bool{"hard": true}})
+	require.NoError(t, err)
+	easy, err := CompileWithOptions(script, Options{ExternalConditions: map[string]bool{"hard": false}})
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, []string{"index|armed=false", "index|armed=true", "gate|armed=true"}, sortedNodeIDs(hard.Graph))
+	assert.ElementsMatch(t, []string{"index|armed=false", "gate|armed=false"}, sortedNodeIDs(easy.Graph))
+	assert.Equal(t, "A guard blocks the way.", hard.Graph.Graph["index|armed=false"].Content)
+	assert.Equal(t, "The way is clear.", easy.Graph.Graph["index|armed=false"].Content)
+	for _, result := range []*CompileResult{hard, easy} {
+		for id, node := range result.Graph.Graph {
+			assert.NotContains(t, id, "ext")
+			assert.NotContains(t, node.State, "ext:hard")
+		}
+		for _, d := range result.Diagnostics {
+			assert.NotContains(t, d.Message, "ext:hard", "external names are not states")
+		}
+	}
+
+	_, err = CompileWithOptions(script, Options{})
+	var list ErrorList
+	require.True(t, errors.As(err, &list), "%v", err)
+	require.Len(t, list, 4)
+	assert.Equal(t, CodeExternalCondition, list[0].Code)
+	assert.Equal(t, 4, list[0].Line)
+	assert.Contains(t, list[0].Message, "'ext:hard'")
+
+	assert.Empty(t, validationErrors(script), "external conditions are valid without their values")
+	var found []string
+	for _, d := range validationErrors(strings.Replace(script, "{ext:hard == true}", "{ext:hard = true}", 1)) {
+		found = append(found, d.String())
+	}
+	assert.Equal(t, []string{"line 6: malformed condition 'ext:hard = true': expected 'state == true|false' or 'state != true|false'"}, found)
+}
+
+func TestAssets(t *testing.T) {
+	script := "// STATES: lamp_on\n\n=== index ===\n// image {lamp_on == true}: cellar_lit.png\n// image: cellar_dark.png\n// audio: drips.ogg\nA cellar.\n* {lamp_on == false} Light the lamp. ~ lamp_on = true -> index\n* Leave. -> outside\n\n=== outside ===\nEND\n"
+	result, err := CompileWithOptions(script, Options{PruneUnreadStates: true})
+	require.NoError(t, err)
+	assert.Equal(t, []Asset{
+		{Kind: "image", Condition: "lamp_on == true", Path: "cellar_lit.png", Line: 4},
+		{Kind: "image", Path: "cellar_dark.png", Line: 5},
+		{Kind: "audio", Path: "drips.ogg", Line: 6},
+	}, result.Graph.script.Knots["index"].Assets)
+	assert.Equal(t, map[string]string{"image": "cellar_dark.png", "audio": "drips.ogg"}, result.Graph.Graph["index|lamp_on=false"].Assets)
+	assert.Equal(t, map[string]string{"image": "cellar_lit.png", "audio": "drips.ogg"}, result.Graph.Graph["index|lamp_on=true"].Assets,
+		"a state read only by an asset condition is not pruned")
+	assert.Nil(t, result.Graph.Graph["outside|lamp_on=false"].Assets)
+	data, err := result.JSON()
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"image": "cellar_lit.png"`)
+
+	ast, err := Parse(script)
+	require.NoError(t, err)
+	written, err := WriteScript(ast)
+	require.NoError(t, err)
+	assert.Contains(t, written, "// image {lamp_on == true}: cellar_lit.png\n")
+
+	var checked []string
+	_, err = CompileWithOptions(script, Options{AssetValidator: func(kind, path string) error {
+		checked = append(checked, kind+" "+path)
+		if path == "drips.ogg" {
+			return os.ErrNotExist
+		}
+		return nil
+	}})
+	assert.Equal(t, []string{"image cellar_lit.png", "image cellar_dark.png", "audio drips.ogg"}, checked)
+	var compileErr *Error
+	require.True(t, errors.As(err, &compileErr), "%v", err)
+	assert.Equal(t, CodeAsset, compileErr.Code)
+	assert.Equal(t, 6, compileErr.Line)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	_, err = CompileWithOptions(strings.Replace(script, "{lamp_on == true}:", "{lamp_on == true", 1), Options{})
+	assert.ErrorContains(t, err, "line 4")
+
+	renamed, err := RenameState(script, "lamp_on", "lit")
+	require.NoError(t, err)
+	assert.Equal(t, strings.ReplaceAll(script, "lamp_on", "lit"), renamed, "asset conditions are renamed too")
+
+	var found []string
+	for _, d := range Validate(strings.Replace(script, "{lamp_on == true}", "{lamp_onn == true}", 1)) {
+		found = append(found, d.String())
+	}
+	assert.Contains(t, found, "line 4: knot 'index' uses undeclared state 'lamp_onn', which is always false")
+	found = nil
+	for _, d := range Validate(strings.Replace(script, "{lamp_on == true}", "{lamp_on = true}", 1)) {
+		found = append(found, d.String())
+	}
+	assert.Contains(t, found, "line 4: malformed condition 'lamp_on = true': expected 'state == true|false' or 'state != true|false'")
+}
+
+func TestNotes(t *testing.T) {
+	script := "// title: Notes\n// TODO: pick a better title\n\n=== index ===\n// FIXME: the door was red in chapter 1\nA green door.\n// NOTE: check continuity with ch.2\nIt creaks.\n* Open it. -> hall\n\n=== hall ===\n// TODO: punch up this description\nA hall.\nEND\n"
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, []Note{
+		{Kind: "TODO", Text: "pick a better title", Line: 2},
+		{Kind: "FIXME", Text: "the door was red in chapter 1", Knot: "index", Line: 5},
+		{Kind: "NOTE", Text: "check continuity with ch.2", Knot: "index", Line: 7},
+		{Kind: "TODO", Text: "punch up this description", Knot: "hall", Line: 12},
+	}, result.Notes)
+	assert.NotContains(t, result.Metadata, "TODO", "a header TODO is a note, not metadata")
+	assert.Equal(t, "A green door.", result.Graph.Graph["index|"].Content, "a note still ends a text block")
+
+	data, err := result.JSON()
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "punch up")
+
+	assert.Equal(t, map[string]int{"TODO": 2, "FIXME": 1, "NOTE": 1}, Analyze(result.Graph).NoteCounts)
+	clean, err := CompileToGraph("=== index ===\n// todo: lower case is a plain comment\nEND\n")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"TODO": 0, "FIXME": 0, "NOTE": 0}, Analyze(clean).NoteCounts)
+}
+
+func TestTrackVisits(t *testing.T) {
+	script := "// TRACK-VISITS: tavern\n\n=== index ===\nThe village square.\n* Enter the tavern. -> tavern\n* Wander the square. -> square\n\n=== square ===\nStalls and pigeons.\n* Back. -> index\n\n=== tavern ===\n- {visited_tavern == false} The tavern is loud and strange.\n- {visited_tavern == true} The barkeep nods; she remembers you.\n* Step out. -> index\n* Leave town. -> road\n\n=== road ===\nEND\n"
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"index|visited_tavern=false", "index|visited_tavern=true",
+		"road|visited_tavern=true",
+		"square|visited_tavern=false", "square|visited_tavern=true",
+		"tavern|visited_tavern=false", "tavern|visited_tavern=true",
+	}, sortedNodeIDs(result.Graph))
+	assert.Equal(t, "The tavern is loud and strange.", result.Graph.Graph["tavern|visited_tavern=false"].Content)
+	assert.Equal(t, "The barkeep nods; she remembers you.", result.Graph.Graph["tavern|visited_tavern=true"].Content)
+	for _, d := range result.Diagnostics {
+		assert.NotContains(t, d.Message, "visited_tavern")
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		for _, tc := range []struct {
+			script string
+			code   ErrorCode
+		}{
+			{"// TRACK-VISITS: attic\n\n=== index ===\nEND\n", CodeMissingKnot},
+			{"// TRACK-VISITS: index\n// FLAG-STATES: visited_index\n\n=== index ===\nEND\n", CodeDeclaration},
+			{"// TRACK-VISITS: in dex\n\n=== index ===\nEND\n", CodeInvalidName},
+		} {
+			_, err := CompileWithOptions(tc.script, Options{})
+			var e *Error
+			require.True(t, errors.As(err, &e), "%v", err)
+			assert.Equal(t, tc.code, e.Code, "%v", err)
+		}
+	})
+}
+
+func TestVisitBlocks(t *testing.T) {
+	script := "// STATES: paid\n\n=== index ===\n-1 The tavern is loud and strange.\n-+ {paid == true} Your ale is waiting.\n-+ The barkeep nods at you.\nSmoke hangs under the beams.\n* {paid == false} Pay for an ale. ~ paid = true -> index\n* Step out. -> yard\n\n=== yard ===\n- A muddy yard.\n-10 pigs -- no marker here.\n* Go back in. -> index\n* Leave. -> road\n\n=== road ===\nEND\n"
+	ast, err := parse(script)
+	require.NoError(t, err)
+	body := ast.Knots["index"].Body
+	require.Len(t, body, 3)
+	assert.Equal(t, TextBlock{Content: "The tavern is loud and strange.", Visit: FirstVisit, Line: 4}, body[0])
+	assert.Equal(t, TextBlock{Condition: "paid == true", Content: "Your ale is waiting.", Visit: Revisit, Line: 5}, body[1])
+	assert.Equal(t, TextBlock{Content: "The barkeep nods at you.\nSmoke hangs under the beams.", Visit: Revisit, Line: 6}, body[2])
+	assert.Equal(t, AnyVisit, ast.Knots["yard"].Body[1].Visit)
+	assert.Equal(t, "10 pigs -- no marker here.", ast.Knots["yard"].Body[1].Content)
+
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"index|paid=false,visited_index=false",
+		"index|paid=false,visited_index=true",
+		"index|paid=true,visited_index=true",
+		"road|paid=false,visited_index=true",
+		"road|paid=true,visited_index=true",
+		"yard|paid=false,visited_index=true",
+		"yard|paid=true,visited_index=true",
+	}, sortedNodeIDs(result.Graph))
+	assert.Equal(t, "The tavern is loud and strange.", result.Graph.Graph["index|paid=false,visited_index=false"].Content)
+	assert.Equal(t, "The barkeep nods at you.\nSmoke hangs under the beams.", result.Graph.Graph["index|paid=false,visited_index=true"].Content)
+	assert.Equal(t, "Your ale is waiting.", result.Graph.Graph["index|paid=true,visited_index=true"].Content)
+
+	written, err := WriteScript(ast)
+	require.NoError(t, err)
+	assert.Contains(t, written, "-1 The tavern is loud and strange.\n-+ {paid == true} Your ale is waiting.\n-+ The barkeep nods at you.\n")
+	again, err := parse(written)
+	require.NoError(t, err)
+	assert.Equal(t, withoutPositions(ast.Knots["index"]), withoutPositions(again.Knots["index"]))
+
+	t.Run("with TRACK-VISITS", func(t *testing.T) {
+		tracked, err := CompileWithOptions("// TRACK-VISITS: index\n"+script, Options{})
+		require.NoError(t, err)
+		assert.Equal(t, sortedNodeIDs(result.Graph), sortedNodeIDs(tracked.Graph))
+	})
+}
+
+func TestTurns(t *testing.T) {
+	script := "// TURNS: max=12\n\n=== index ===\n- {turns >= 10} The ticking is deafening now.\n- {turns == 0} A bomb ticks under the table.\n- The bomb ticks.\n* {turns < 12} Wait. -> index\n* {turns >= 12} The bomb goes off. -> boom\n\n=== boom ===\nEND: boom\n"
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+
+	states := make([]string, 12)
+	for i := range states {
+		states[i] = fmt.Sprintf("turns_%02d", i+1)
+	}
+	turnID := func(knot string, turns int) string {
+		parts := make([]string, len(states))
+		for i, state := range states {
+			parts[i] = fmt.Sprintf("%s=%t", state, i < turns)
+		}
+		return knot + "|" + strings.Join(parts, ",")
+	}
+	require.Len(t, result.Graph.Graph, 14)
+	assert.Equal(t, turnID("index", 0), result.Graph.StartNodeID)
+	for turns := 0; turns <= 12; turns++ {
+		node := result.Graph.Graph[turnID("index", turns)]
+		require.NotNil(t, node, "turn %d", turns)
+		switch {
+		case turns == 0:
+			assert.Equal(t, "A bomb ticks under the table.", node.Content)
+		case turns < 10:
+			assert.Equal(t, "The bomb ticks.", node.Content, "turn %d", turns)
+		default:
+			assert.Equal(t, "The ticking is deafening now.", node.Content, "turn %d", turns)
+		}
+		require.Len(t, node.Edges, 1, "turn %d", turns)
+		if turns < 12 {
+			assert.Equal(t, "Wait.", node.Edges[0].Text)
+			assert.Equal(t, turnID("index", turns+1), node.Edges[0].TargetNodeID)
+		} else {
+			assert.Equal(t, "The bomb goes off.", node.Edges[0].Text)
+			assert.Equal(t, turnID("boom", 12), node.Edges[0].TargetNodeID, "the counter saturates at its bound")
+		}
+	}
+	for _, d := range result.Diagnostics {
+		assert.NotContains(t, d.Message, "turns_", "the counter's states are not the author's")
+	}
+	assert.Empty(t, Validate(script))
+
+	pruned, err := CompileWithOptions(script, Options{PruneUnreadStates: true})
+	require.NoError(t, err)
+	assert.Len(t, pruned.Graph.Graph, 14, "unread turn states are still counted")
+
+	_, err = CompileWithOptions(script, Options{MaxNodes: 5})
+	var e *Error
+	require.True(t, errors.As(err, &e), "%v", err)
+	assert.Equal(t, CodeNodeLimit, e.Code)
+	assert.Contains(t, e.Message, "TURNS: max=12")
+
+	ast, err := parse(script)
+	require.NoError(t, err)
+	written, err := WriteScript(ast)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(written, "// TURNS: max=12\n"), written)
+
+	t.Run("rewriting", func(t *testing.T) {
+		ast := &Script{MaxTurns: 3}
+		for _, tc := range []struct{ condition, want string }{
+			{"turns >= 2", "turns_2 == true"},
+			{"turns > 2", "turns_3 == true"},
+			{"turns < 2 && lamp == true", "turns_2 == false && lamp == true"},
+			{"turns <= 2", "turns_3 == false"},
+			{"turns == 1", "turns_1 == true && turns_2 == false"},
+			{"turns == 3", "turns_3 == true"},
+			{"turns != 0", "turns_1 == true"},
+			{"turns >= 0", ""},
+			{"turns > 3", "false"},
+			{"turns_left == true", "turns_left == true"},
+		} {
+			got, err := rewriteTurns(tc.condition, ast)
+			require.NoError(t, err, tc.condition)
+			assert.Equal(t, tc.want, got, tc.condition)
+		}
+		for _, condition := range []string{"turns != 2", "turns >= many", "turns == true"} {
+			_, err := rewriteTurns(condition, ast)
+			assert.Error(t, err, condition)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, header := range []string{"// TURNS: 15\n", "// TURNS: max=0\n", "// TURNS: max=15\n// STATES: turns\n", "// TURNS: max=3\n// FLAG-STATES: turns_2\n"} {
+			_, err := CompileWithOptions(header+"\n=== index ===\nEND\n", Options{})
+			var e *Error
+			require.True(t, errors.As(err, &e), "%q: %v", header, err)
+			assert.Equal(t, CodeDeclaration, e.Code, "%q: %v", header, err)
+		}
+	})
+}
+
+func TestIncludeSourceLogic(t *testing.T) {
+	script := "// STATES: door_open\n// FLAG-STATES: has_key\n\n=== index ===\nA locked door.\n* {has_key == false} Take the key. ~ has_key = true -> index\n* {has_key == true && door_open == false} Unlock the door. ~ door_open = true -> hall\n\n=== hall ===\nA hall.\n* Drop the key and close the door. ~ has_key = false ~ door_open = false -> index\n"
+	plain, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	for _, node := range plain.Graph.Graph {
+		for _, edge := range node.Edges {
+			assert.Empty(t, edge.Condition)
+			assert.Nil(t, edge.StateChanges)
+			assert.Nil(t, edge.StateDelta)
+		}
+	}
+
+	result, err := CompileWithOptions(script, Options{IncludeSourceLogic: true})
+	require.NoError(t, err)
+	unlock := result.Graph.Graph["index|door_open=false,has_key=true"].Edges[0]
+	assert.Equal(t, "Unlock the door.", unlock.Text)
+	assert.Equal(t, "has_key == true && door_open == false", unlock.Condition)
+	assert.Equal(t, []string{"door_open = true"}, unlock.StateChanges)
+	assert.Equal(t, map[string]bool{"door_open": true}, unlock.StateDelta)
+
+	back := result.Graph.Graph["hall|door_open=true,has_key=true"].Edges[0]
+	assert.Equal(t, []string{"has_key = false", "door_open = false"}, back.StateChanges)
+	assert.Equal(t, map[string]bool{"door_open": false}, back.StateDelta, "the flag cannot be reset, so only the door changes")
+
+	take := result.Graph.Graph["index|door_open=false,has_key=false"].Edges[0]
+	assert.Equal(t, map[string]bool{"has_key": true}, take.StateDelta)
+
+	data, err := result.JSON()
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"stateDelta": {`)
+	loaded, err := LoadGraph(data)
+	require.NoError(t, err)
+	assert.Equal(t, unlock, loaded.Graph["index|door_open=false,has_key=true"].Edges[0])
+
+	t.Run("as written", func(t *testing.T) {
+		script := "// TURNS: max=3\n// TRACK-VISITS: index\n\n=== index ===\nA path.\n* {turns < 3 && ext:hard == true} Walk on. -> index\n* Stop. -> done\n\n=== done ===\nEND\n"
+		result, err := CompileWithOptions(script, Options{IncludeSourceLogic: true, ExternalConditions: map[string]bool{"hard": true}})
+		require.NoError(t, err)
+		walk := result.Graph.Graph[result.Graph.StartNodeID].Edges[0]
+		assert.Equal(t, "Walk on.", walk.Text)
+		assert.Equal(t, "turns < 3 && ext:hard == true", walk.Condition)
+		assert.Nil(t, walk.StateChanges, "the synthesized visit state is not listed")
+		assert.Equal(t, map[string]bool{"turns_1": true, "visited_index": true}, walk.StateDelta, "it shows in the delta")
+	})
+}
+
+func TestDedupContent(t *testing.T) {
+	// Eight states that only decide which choices are offered give 256
+	// nodes of one knot, all with the same long text.
+	var b strings.Builder
+	names := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	fmt.Fprintf(&b, "// STATES: %s\n\n=== index ===\n", strings.Join(names, ", "))
+	b.WriteString(strings.Repeat("The vault hums behind a wall of switches, each one stiff with age. ", 40) + "\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "* {%s == false} Throw switch %s. ~ %s = true -> index\n", name, name, name)
+	}
+	b.WriteString("* Leave. -> out\n\n=== out ===\nYou walk away.\nEND\n")
+
+	plain, err := CompileWithOptions(b.String(), Options{OmitSource: true})
+	require.NoError(t, err)
+	deduped, err := CompileWithOptions(b.String(), Options{OmitSource: true, DedupContent: true})
+	require.NoError(t, err)
+	require.Len(t, deduped.Graph.Graph, 512)
+	for id, node := range deduped.Graph.Graph {
+		assert.Equal(t, plain.Graph.Graph[id].Content, node.Content, "the compiled graph keeps its content")
+		assert.Nil(t, node.ContentRef)
+	}
+
+	plainJSON, err := plain.JSON()
+	require.NoError(t, err)
+	dedupedJSON, err := deduped.JSON()
+	require.NoError(t, err)
+	reduction := 100 - 100*len(dedupedJSON)/len(plainJSON)
+	t.Logf("JSON output: %d bytes, %d bytes with DedupContent (%d%% smaller)", len(plainJSON), len(dedupedJSON), reduction)
+	assert.Greater(t, reduction, 50)
+
+	var doc struct {
+		FormatVersion string   `json:"formatVersion"`
+		Contents      []string `json:"contents"`
+		Graph         struct {
+			Nodes map[string]struct {
+				Content    *string `json:"content"`
+				ContentRef *int    `json:"contentRef"`
+			} `json:"nodes"`
+		} `json:"graph"`
+	}
+	require.NoError(t, json.Unmarshal(dedupedJSON, &doc))
+	assert.Equal(t, TableFormatVersion, doc.FormatVersion, "content changes meaning, so 1.x readers must reject the document")
+	require.Len(t, doc.Contents, 2)
+	for id, node := range doc.Graph.Nodes {
+		require.NotNil(t, node.ContentRef, id)
+		assert.Equal(t, "", *node.Content, id)
+		assert.Equal(t, plain.Graph.Graph[id].Content, doc.Contents[*node.ContentRef], id)
+	}
+	assert.NotContains(t, string(plainJSON), `"contents"`)
+
+	for _, format := range []OutputFormat{FormatJSON, FormatCompactJSON, FormatBinary} {
+		data, err := EncodeGraph(deduped.Graph, format)
+		require.NoError(t, err, format)
+		loaded, meta, err := LoadGraphWithMetadata(data)
+		require.NoError(t, err, format)
+		assert.Equal(t, TableFormatVersion, meta.FormatVersion, format)
+		require.Len(t, loaded.Graph, len(plain.Graph.Graph))
+		for id, node := range loaded.Graph {
+			want := *plain.Graph.Graph[id]
+			want.parent = nil
+			require.Equal(t, want, *node, "%s %s", format, id)
+		}
+	}
+	var unmarshaled StoryGraph
+	require.NoError(t, json.Unmarshal(dedupedJSON, &unmarshaled))
+	for id, node := range unmarshaled.Graph {
+		require.Equal(t, plain.Graph.Graph[id].Content, node.Content, id)
+		require.Nil(t, node.ContentRef, id)
+	}
+
+	broken := strings.Replace(string(dedupedJSON), `"contentRef": 1`, `"contentRef": 7`, 1)
+	_, err = LoadGraph([]byte(broken))
+	var e *Error
+	require.True(t, errors.As(err, &e), "%v", err)
+	assert.Equal(t, CodeMalformedGraph, e.Code)
+}
+
+func TestOmitStates(t *testing.T) {
+	script, err := os.ReadFile(filepath.Join("testdata", "garden.biff"))
+	require.NoError(t, err)
+	full, err := CompileWithOptions(string(script), Options{})
+	require.NoError(t, err)
+	omitted, err := CompileWithOptions(string(script), Options{OmitStates: true})
+	require.NoError(t, err)
+	assert.Equal(t, full.Graph.Graph, omitted.Graph.Graph, "the compiled graph keeps its states")
+
+	// The map encoding has its golden file checked by TestDeterministicOutput.
+	output, err := omitted.JSON()
+	require.NoError(t, err)
+	golden := filepath.Join("testdata", "garden.omitstates.golden.json")
+	if *update {
+		require.NoError(t, os.WriteFile(golden, output, 0o644))
+	}
+	expected, err := os.ReadFile(golden)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), string(output), "output differs from %s; rerun with -update if the change is intended", golden)
+
+	fullOutput, err := full.JSON()
+	require.NoError(t, err)
+	t.Logf("JSON output: %d bytes, %d bytes with OmitStates", len(fullOutput), len(output))
+	assert.Less(t, len(output), len(fullOutput))
+
+	var doc struct {
+		FormatVersion string   `json:"formatVersion"`
+		StateNames    []string `json:"stateNames"`
+		Graph         struct {
+			Nodes map[string]json.RawMessage `json:"nodes"`
+		} `json:"graph"`
+	}
+	require.NoError(t, json.Unmarshal(output, &doc))
+	assert.Equal(t, TableFormatVersion, doc.FormatVersion, "state is null, so 1.x readers must reject the document")
+	assert.Equal(t, []string{"has_seed", "has_water", "met_gnome", "puzzle_solved", "talked_to_gnome", "unlocked_gate"}, doc.StateNames)
+	start := string(doc.Graph.Nodes[full.Graph.StartNodeID])
+	assert.Contains(t, start, `"state": null`)
+	assert.Contains(t, start, `"stateBits": "000000"`)
+
+	for _, file := range []string{"garden.golden.json", "garden.omitstates.golden.json"} {
+		data, err := os.ReadFile(filepath.Join("testdata", file))
+		require.NoError(t, err)
+		loaded, err := LoadGraph(data)
+		require.NoError(t, err, file)
+		require.Len(t, loaded.Graph, len(full.Graph.Graph), file)
+		for id, node := range loaded.Graph {
+			assert.Equal(t, full.Graph.Graph[id].State, node.State, "%s %s", file, id)
+			assert.Empty(t, node.StateBits, "%s %s", file, id)
+		}
+	}
+
+	t.Run("scene-scoped states", func(t *testing.T) {
+		result, err := CompileWithOptions(renameScript, Options{OmitStates: true, DedupContent: true})
+		require.NoError(t, err)
+		for _, format := range []OutputFormat{FormatJSON, FormatCompactJSON, FormatBinary} {
+			data, err := EncodeGraph(result.Graph, format)
+			require.NoError(t, err, format)
+			loaded, err := LoadGraph(data)
+			require.NoError(t, err, format)
+			require.Len(t, loaded.Graph, len(result.Graph.Graph), format)
+			for id, node := range loaded.Graph {
+				assert.Equal(t, result.Graph.Graph[id].State, node.State, "%s %s", format, id)
+				assert.Equal(t, result.Graph.Graph[id].Content, node.Content, "%s %s", format, id)
+			}
+		}
+		data, err := result.JSON()
+		require.NoError(t, err)
+		assert.Contains(t, string(data), `"stateBits": "00-"`, "lamp is absent outside the cellar")
+	})
+
+	broken := strings.Replace(string(output), `"stateBits": "000000"`, `"stateBits": "00x000"`, 1)
+	_, err = LoadGraph([]byte(broken))
+	var e *Error
+	require.True(t, errors.As(err, &e), "%v", err)
+	assert.Equal(t, CodeMalformedGraph, e.Code)
+}
+
+func TestAllowMissingTargets(t *testing.T) {
+	script := `// STATES: lit
+
+=== index ===
+* Light a torch. ~ lit = true -> hall
+* Go down. -> cellar
+
+=== hall ===
+- {lit == true} Torchlight.
+* Take the stairs. -> cellar
+* Climb. -> attic
+`
+	_, err := CompileWithOptions(script, Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "choice leads to non-existent knot: 'cellar'")
+
+	result, err := CompileWithOptions(script, Options{AllowMissingTargets: true})
+	require.NoError(t, err)
+
+	stub := result.Graph.Graph["cellar|"]
+	require.NotNil(t, stub)
+	assert.Equal(t, "[missing knot: cellar]", stub.Content)
+	assert.True(t, stub.Missing)
+	assert.False(t, stub.IsEnd)
+	assert.Empty(t, stub.Edges)
+	assert.Equal(t, "cellar|", result.Graph.Graph["index|lit=false"].Edges[1].TargetNodeID)
+	assert.Equal(t, "cellar|", result.Graph.Graph["hall|lit=true"].Edges[0].TargetNodeID, "every state shares one stub")
+	assert.Contains(t, result.Graph.Graph, "attic|")
+
+	assert.Equal(t, []string{
+		"state 'lit' is set to true but never back to false, so it behaves like a flag (declare it in FLAG-STATES if that is intended); set in: index",
+		"missing knot 'attic' replaced by a stub; referenced at line 10 ('Climb.' in 'hall')",
+		"missing knot 'cellar' replaced by a stub; referenced at line 9 ('Take the stairs.' in 'hall'), line 5 ('Go down.' in 'index')",
+	}, result.Warnings, "stubs are not reported as dead ends")
+
+	again, err := CompileWithOptions(script, Options{AllowMissingTargets: true, Concurrency: 1})
+	require.NoError(t, err)
+	want, err := result.JSON()
+	require.NoError(t, err)
+	got, err := again.JSON()
+	require.NoError(t, err)
+	assert.Equal(t, string(want), string(got))
+}
+
+func TestDefaultScene(t *testing.T) {
+	script := `
+// SCENES: bedroom, hallway
+// DEFAULT-SCENE: hallway
+// LOCAL-STATES: lamp_on
+
+=== index ===
+* Turn on the lamp. ~ lamp_on = true
+* {lamp_on == true} Walk on. -> corridor
+
+=== corridor ===
+// scene: hallway
+The lamp is still on.
+`
+	outputJSON, err := Compile(script)
+	require.NoError(t, err)
+
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(outputJSON, &result))
+
+	nodes := result["graph"].(map[string]interface{})["nodes"].(map[string]interface{})
+	require.Contains(t, nodes, "corridor|lamp_on=true", "Local state should survive a move within the default scene")
+	index := nodes["index|lamp_on=false"].(map[string]interface{})
+	assert.Equal(t, "hallway", index["scene"])
+}
+
+func TestUndeclaredSceneRejected(t *testing.T) {
+	script := `
+// SCENES: bedroom, hallway
+
+=== index ===
+// scene: halway
+END
+`
+	_, err := Compile(script)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 5")
+	assert.Contains(t, err.Error(), "scene 'halway' is not declared")
+}
+
+func TestKnotTags(t *testing.T) {
+	script := `
+// STATES: lit
+
+=== index === #chapter:1
+* Light a match. ~ lit = true -> cellar
+
+=== cellar === #chapter:2 #location:manor
+It is damp.
+END
+`
+	outputJSON, err := Compile(script)
+	require.NoError(t, err)
+
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(outputJSON, &result))
+
+	nodes := result["graph"].(map[string]interface{})["nodes"].(map[string]interface{})
+	cellar := nodes["cellar|lit=true"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"chapter": "2", "location": "manor"}, cellar["tags"])
+
+	_, err = Compile("=== index === #chapter:1 #chapter:2\nEND\n")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "duplicate tag key 'chapter'")
+}
+
+// writeFiles writes a set of script files into a temporary directory and returns its path.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+	return dir
+}
+
+func TestCompileFileInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.biff": `// title: Split Story
+// STATES: has_key
+// INCLUDE: chapters/two.biff
+
+=== index ===
+* Take the key. ~ has_key = true -> cellar
+`,
+		"chapters/two.biff": `// STATES: lamp_lit
+// title: Chapter Two
+
+=== cellar ===
+- {has_key == true} The cellar door opens.
+END
+`,
+	})
+
+	outputJSON, err := CompileFile(filepath.Join(dir, "main.biff"))
+	require.NoError(t, err)
+
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(outputJSON, &result))
+
+	assert.Equal(t, "Split Story", result["metadata"].(map[string]interface{})["title"])
+	nodes := result["graph"].(map[string]interface{})["nodes"].(map[string]interface{})
+	assert.Contains(t, nodes, "cellar|has_key=true,lamp_lit=false")
+
+	warnings := result["warnings"].([]interface{})
+	require.Len(t, warnings, 3)
+	assert.Contains(t, warnings[0], "two.biff:2: duplicate metadata key 'title'")
+	assert.Equal(t, "state 'lamp_lit' is declared but never read or written", warnings[1])
+	assert.Equal(t, "state 'has_key' is set to true but never back to false, so it behaves like a flag (declare it in FLAG-STATES if that is intended); set in: index", warnings[2])
+}
+
+func TestCompileFileIncludeErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.biff": "// INCLUDE: b.biff\n=== index ===\nEND\n",
+		"b.biff": "// INCLUDE: a.biff\n",
+	})
+	_, err := CompileFile(filepath.Join(dir, "a.biff"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "include cycle")
+
+	dir = writeFiles(t, map[string]string{
+		"a.biff": "// INCLUDE: b.biff\n\n=== index ===\n* Go. -> cellar\n\n=== cellar ===\nEND\n",
+		"b.biff": "=== cellar ===\n* {broken Go.\n",
+	})
+	_, err = CompileFile(filepath.Join(dir, "a.biff"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "b.biff:2: failed to parse choice")
+
+	dir = writeFiles(t, map[string]string{
+		"a.biff": "// INCLUDE: b.biff\n\n=== index ===\n* Go. -> cellar\n\n=== cellar ===\nEND\n",
+		"b.biff": "=== cellar ===\nEND\n",
+	})
+	_, err = CompileFile(filepath.Join(dir, "a.biff"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "a.biff:6: duplicate knot 'cellar'")
+	assert.Contains(t, err.Error(), "b.biff:1")
+}
+
+func TestCompileFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"story/00-header.biff":    {Data: []byte("// title: Manor\n// STATES: has_key\n")},
+		"story/index.biff":        {Data: []byte("=== index ===\n* Take the key. ~ has_key = true -> cellar\n")},
+		"story/rooms/cellar.biff": {Data: []byte("=== cellar ===\nIt is damp.\nEND\n")},
+		"story/notes.txt":         {Data: []byte("not a script")},
+	}
+
+	outputJSON, err := CompileFS(fsys, "story")
+	require.NoError(t, err)
+
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(outputJSON, &result))
+	assert.Equal(t, "Manor", result["metadata"].(map[string]interface{})["title"])
+	nodes := result["graph"].(map[string]interface{})["nodes"].(map[string]interface{})
+	assert.Contains(t, nodes, "cellar|has_key=true")
+
+	fsys["story/rooms/cellar.biff"] = &fstest.MapFile{Data: []byte("=== cellar ===\n- {has_key == true The door.\n")}
+	_, err = CompileFS(fsys, "story")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "story/rooms/cellar.biff:2: mismatched braces")
+}
+
+func TestNamespaces(t *testing.T) {
+	fsys := fstest.MapFS{
+		"act1.biff": {Data: []byte(`// NAMESPACE: act1
+=== index ===
+* Begin. -> intro
+
+=== intro ===
+* On to the second act. -> act2.intro
+
+=== outro ===
+Act one ends.
+END
+`)},
+		"act2.biff": {Data: []byte(`// NAMESPACE: act2
+=== intro ===
+* Finish. -> outro
+
+=== outro ===
+Act two ends.
+END
+`)},
+	}
+
+	outputJSON, err := CompileFS(fsys, ".")
+	require.NoError(t, err)
+
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(outputJSON, &result))
+	nodes := result["graph"].(map[string]interface{})["nodes"].(map[string]interface{})
+	assert.Contains(t, nodes, "act1.index|", "The start knot should be found inside a namespace")
+	assert.Contains(t, nodes, "act1.intro|")
+	assert.Contains(t, nodes, "act2.intro|")
+	assert.Contains(t, nodes, "act2.outro|", "Unqualified names should resolve to the file's own namespace first")
+	assert.NotContains(t, nodes, "act1.outro|")
+
+	fsys["main.biff"] = &fstest.MapFile{Data: []byte("=== index ===\n* Start. -> intro\n")}
+	_, err = CompileFS(fsys, ".")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "main.biff:2")
+	assert.Contains(t, err.Error(), "ambiguous knot reference 'intro' matches act1.intro, act2.intro")
+}
+
+func TestUnreachableKnots(t *testing.T) {
+	script := `
+=== index ===
+* Go on. -> hall
+
+=== hall ===
+END
+
+=== attic ===
+Nobody comes up here any more.
+END
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	require.Len(t, result.Warnings, 1)
+	assert.Equal(t, "line 8: ending knot 'attic' is unreachable; no choice leads to it", result.Warnings[0])
+	assert.Len(t, result.Graph.Graph, 2)
+
+	_, err = CompileWithOptions(script, Options{UnreachableKnotsAsErrors: true})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unreachable knots: attic")
+}
+
+func TestUnreachableEndings(t *testing.T) {
+	script := `// STATES: has_map
+// FLAG-STATES: bridge_out
+
+=== index ===
+* Cross the bridge. ~ bridge_out = true -> far_side
+* {has_map == true && bridge_out == true} Take the ferry. -> harbour
+
+=== far_side ===
+The bridge collapses behind you.
+* {bridge_out == false} Go back. -> index
+END
+
+=== harbour ===
+You sail home.
+END
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"state 'has_map' is read but never written, so it is always false; read in: index",
+		"line 13: ending knot 'harbour' is unreachable; choices leading to it: 'Take the ferry.' in 'index' {has_map == true && bridge_out == true}",
+	}, result.Warnings)
+
+	_, err = CompileWithOptions(script, Options{UnreachableEndingsAsErrors: true})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unreachable endings: harbour")
+}
+
+func TestStateUsageWarnings(t *testing.T) {
+	script := `// STATES: has_key, door_open, lamp_lit, spare
+// FLAG-STATES: ghost_seen
+
+=== index ===
+- {lamp_lit == true} The hall is bright.
+- The hall is dark.
+* {has_key == true} Open the door. ~ door_open = true -> cellar
+* Take the key. ~ has_key = true -> index
+
+=== cellar ===
+* {ghost_seen == true} Flee. -> index
+* Wait. ~ door_open = false -> index
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"state 'door_open' is written but never read, so it only multiplies the graph; written in: cellar, index",
+		"state 'ghost_seen' is read but never written, so it is always false; read in: cellar",
+		"state 'lamp_lit' is read but never written, so it is always false; read in: index",
+		"state 'spare' is declared but never read or written",
+		"state 'has_key' is set to true but never back to false, so it behaves like a flag (declare it in FLAG-STATES if that is intended); set in: index",
+	}, result.Warnings)
+
+	result, err = CompileWithOptions(script, Options{InitialStates: map[string]bool{"lamp_lit": true}})
+	require.NoError(t, err)
+	for _, warning := range result.Warnings {
+		assert.NotContains(t, warning, "lamp_lit", "an initial state override counts as a write")
+	}
+}
+
+func TestFlagResetWarnings(t *testing.T) {
+	script := `// FLAG-STATES: major_event
+// SCENES: hall, vault
+// LOCAL-FLAG-STATES(vault): alarm
+
+=== index ===
+// scene: hall
+- {major_event == true} Something happened.
+- Nothing happened.
+* Trigger it. ~ major_event = true -> index
+* Undo it. ~ major_event = false -> index
+
+=== vault ===
+// scene: vault
+- {alarm == true} Bells ring.
+* Silence the alarm. ~ alarm = false -> vault
+* Trip the alarm. ~ alarm = true -> vault
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	assert.Contains(t, result.Warnings, "line 10: knot 'index', choice 'Undo it.': 'major_event = false' is ignored because 'major_event' is declared in FLAG-STATES and can only become true")
+	assert.Contains(t, result.Warnings, "line 15: knot 'vault', choice 'Silence the alarm.': 'alarm = false' is ignored because 'alarm' is declared in LOCAL-FLAG-STATES and can only become true", "unreachable knots are checked too")
+}
+
+func TestStuckStateWarnings(t *testing.T) {
+	script := `// STATES: door_open, lamp
+// LOCAL-STATES: lit, noticed
+
+=== index ===
+// scene: hall
+- {lit == true} Candlelight.
+- {door_open == true} A draught.
+* {lamp == false} Take the lamp. ~ lamp = true -> index
+* {lit == false} Light a candle. ~ lit = true -> index
+* {lit == true} Blow it out. ~ lit = false -> index
+* {door_open == false} Open the door. ~ door_open = true -> index
+* {door_open == true} Close the door. ~ door_open = false -> index
+* Look around. ~ noticed = true -> index
+* {noticed == true} Peek behind the curtain. -> .curtain
+* Go to the cellar. -> cellar
+
+=== curtain ===
+// scene: stage
+- {noticed == true} You know what to look for.
+* Leave. -> cellar
+
+=== cellar ===
+// scene: cellar
+- {lit == true} The candle still burns.
+* {noticed == true} Search. -> index
+* Go up. -> index
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	assert.Contains(t, result.Warnings, "state 'lamp' is set to true but never back to false, so it behaves like a flag (declare it in FLAG-STATES if that is intended); set in: index")
+	assert.Contains(t, result.Warnings, "state 'noticed' is set to true but never back to false, so it behaves like a flag (declare it in LOCAL-FLAG-STATES if that is intended); set in: index")
+	assert.Contains(t, result.Warnings, "line 24: knot 'cellar' reads local state 'lit', which can only be true in scene(s) hall, stage, so it is always false here")
+	assert.Contains(t, result.Warnings, "line 25: knot 'cellar' reads local state 'noticed', which can only be true in scene(s) hall, stage, so it is always false here")
+	for _, warning := range result.Warnings {
+		assert.NotContains(t, warning, "'door_open' is set", "states that are reset are not flags")
+		assert.NotContains(t, warning, "knot 'curtain'", "a stitch divert carries local states into its scene")
+	}
+}
+
+func TestScenePurgeRule(t *testing.T) {
+	compile := func(script string) *StoryGraph {
+		result, err := CompileWithOptions(script, Options{})
+		require.NoError(t, err)
+		return result.Graph
+	}
+
+	t.Run("self target keeps local states", func(t *testing.T) {
+		graph := compile(`// LOCAL-STATES: lit
+
+=== index ===
+// scene: hall
+* {lit == false} Light a candle. ~ lit = true -> index
+* {lit == true} Wait. -> index
+`)
+		lit := graph.Graph["index|lit=true"]
+		require.NotNil(t, lit)
+		require.Len(t, lit.Edges, 1)
+		assert.Equal(t, "index|lit=true", lit.Edges[0].TargetNodeID)
+	})
+
+	t.Run("stitch target never purges", func(t *testing.T) {
+		graph := compile(`// LOCAL-STATES: lit
+
+=== index ===
+// scene: hall
+* {lit == false} Light a candle. ~ lit = true -> index
+* {lit == true} Peek behind the curtain. -> .curtain
+
+=== curtain ===
+// scene: stage
+By candlelight you see the stage.
+END
+`)
+		assert.Contains(t, graph.Graph, "curtain|lit=true")
+		assert.NotContains(t, graph.Graph, "curtain|lit=false")
+	})
+
+	t.Run("stitch into another scene swaps scoped states", func(t *testing.T) {
+		graph := compile(`// LOCAL-STATES(hall): lit
+// LOCAL-STATES(stage): curtain_open
+
+=== index ===
+// scene: hall
+* {lit == false} Light a candle. ~ lit = true -> index
+* {lit == true} Peek behind the curtain. -> .curtain
+
+=== curtain ===
+// scene: stage
+* {curtain_open == false} Open the curtain. ~ curtain_open = true -> backstage
+
+=== backstage ===
+// scene: stage
+END
+`)
+		assert.Contains(t, graph.Graph, "curtain|curtain_open=false")
+		assert.Contains(t, graph.Graph, "backstage|curtain_open=true")
+		for nodeID := range graph.Graph {
+			if !strings.HasPrefix(nodeID, "index|") {
+				assert.NotContains(t, nodeID, "lit=", "the hall's state must not leak into the stage")
+			}
+		}
+	})
+
+	t.Run("unscened to scened purges", func(t *testing.T) {
+		graph := compile(`// LOCAL-STATES: lit
+
+=== index ===
+* {lit == false} Light a candle. ~ lit = true -> index
+* {lit == true} Enter the hall. -> hall
+
+=== hall ===
+// scene: hall
+- {lit == true} Candlelight.
+- Darkness.
+END
+`)
+		hall := graph.Graph["hall|lit=false"]
+		require.NotNil(t, hall)
+		assert.Equal(t, "Darkness.", hall.Content)
+		assert.NotContains(t, graph.Graph, "hall|lit=true")
+	})
+}
+
+func TestDeadEndKnots(t *testing.T) {
+	script := `
+// STATES: lamp_lit
+
+=== index ===
+* Light the lamp. ~ lamp_lit = true
+* Go to the stub. -> stub
+
+=== stub ===
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	require.Len(t, result.Warnings, 2, "One stub knot should produce one warning regardless of state count")
+	assert.Equal(t, "state 'lamp_lit' is written but never read, so it only multiplies the graph; written in: index", result.Warnings[0])
+	assert.Contains(t, result.Warnings[1], "line 8: knot 'stub' is a dead end in 2 reachable state(s)")
+
+	_, err = CompileWithOptions(script, Options{DeadEndsAsErrors: true})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "dead-end knots: stub")
+}
+
+func TestKnotFences(t *testing.T) {
+	outputJSON, err := Compile("==== index ====\n* Go. -> cellar\n\n=====  cellar  ===== #depth:1\nEND\n")
+	require.NoError(t, err)
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(outputJSON, &result))
+	nodes := result["graph"].(map[string]interface{})["nodes"].(map[string]interface{})
+	assert.Contains(t, nodes, "cellar|")
+
+	for _, fence := range []string{"== cellar ===", "=== cellar ==", "==== cellar ===", "=== cellar", "== cellar =="} {
+		_, err := Compile("=== index ===\n* Go. -> cellar\n\n" + fence + "\nEND\n")
+		require.Error(t, err, fence)
+		assert.Contains(t, err.Error(), "line 4: malformed knot declaration", fence)
+	}
+}
+
+func TestRepeatedStateDeclarations(t *testing.T) {
+	script := `
+// STATES: has_key, has_torch
+// STATES: has_map
+// STATES: has_key
+
+=== index ===
+END
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	root := result.Graph.Graph["index|has_key=false,has_map=false,has_torch=false"]
+	require.NotNil(t, root, "Repeated STATES lines should merge")
+	require.Len(t, result.Warnings, 4)
+	assert.Equal(t, "line 4: state 'has_key' is already declared in STATES", result.Warnings[0])
+
+	_, err = Compile("// STATES: major_event\n// FLAG-STATES: major_event\n=== index ===\nEND\n")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 2: state 'major_event' declared as FLAG-STATES conflicts with its earlier STATES declaration")
+
+	_, err = Compile("// FLAG-STATES: major_event\n// LOCAL-STATES: major_event\n=== index ===\nEND\n")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "conflicts with its earlier FLAG-STATES declaration")
+}
+
+func TestTypedMetadata(t *testing.T) {
+	script := `
+// title: My Story
+// max_turns: 30
+// difficulty: 1.5
+// beta: true
+// genres: horror, mystery
+// tagline: A dark, stormy night
+// released: 2024-01-01
+// code: "30"
+// build: 007
+
+=== index ===
+END
+`
+	outputJSON, err := Compile(script)
+	require.NoError(t, err)
+
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(outputJSON, &result))
+	metadata := result["metadata"].(map[string]interface{})
+	assert.Equal(t, "My Story", metadata["title"])
+	assert.Equal(t, float64(30), metadata["max_turns"])
+	assert.Equal(t, 1.5, metadata["difficulty"])
+	assert.Equal(t, true, metadata["beta"])
+	assert.Equal(t, []interface{}{"horror", "mystery"}, metadata["genres"])
+	assert.Equal(t, "A dark, stormy night", metadata["tagline"])
+	assert.Equal(t, "2024-01-01", metadata["released"])
+	assert.Equal(t, "30", metadata["code"])
+	assert.Equal(t, "007", metadata["build"])
+}
+
+func TestCompileOptionsOverrides(t *testing.T) {
+	script := `
+// STATES: has_intro_seen
+// FLAG-STATES: prologue_done
+
+=== index ===
+- {has_intro_seen == false} Welcome, newcomer.
+- Welcome back.
+* Skip ahead. -> chapter1
+
+=== chapter1 ===
+Chapter one.
+END
+`
+	result, err := CompileWithOptions(script, Options{InitialStates: map[string]bool{"has_intro_seen": true, "prologue_done": true}})
+	require.NoError(t, err)
+	root := result.Graph.Graph["index|has_intro_seen=true,prologue_done=true"]
+	require.NotNil(t, root)
+	assert.Equal(t, "Welcome back.", root.Content)
+
+	result, err = CompileWithOptions(script, Options{StartKnot: "chapter1"})
+	require.NoError(t, err)
+	assert.Contains(t, result.Graph.Graph, "chapter1|has_intro_seen=false,prologue_done=false")
+	assert.Len(t, result.Graph.Graph, 1)
+
+	_, err = CompileWithOptions(script, Options{InitialStates: map[string]bool{"has_inrto_seen": true}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "undeclared state 'has_inrto_seen'")
+
+	_, err = CompileWithOptions(script, Options{StartKnot: "chapter2"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "starting knot 'chapter2' does not exist")
+}
+
+func TestUnknownDirectives(t *testing.T) {
+	script := `
+// title: Typos
+// FLAGSTATES: major_event
+// author: Someone
+
+=== index ===
+END
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	require.Len(t, result.Warnings, 1, "Lowercase metadata keys must not be reported")
+	assert.Equal(t, "line 3: unknown directive 'FLAGSTATES' (did you mean 'FLAG-STATES'?)", result.Warnings[0])
+
+	_, err = CompileWithOptions(script, Options{Strict: true})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 3: unknown directive 'FLAGSTATES' (did you mean 'FLAG-STATES'?)")
+
+	_, err = Compile("// local-state: lamp_on\n// STRICT: true\n=== index ===\nEND\n")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 1: unknown directive 'local-state' (did you mean 'LOCAL-STATES'?)")
+
+	capitals, err := CompileWithOptions("// TITLE: Shouting\n// AUTHOR: Someone\n// LANGUAGE: en\n// IFID: 0A1B2C3D-0000-4000-8000-000000000000\n// STRICT: true\n=== index ===\nEND\n", Options{Strict: true})
+	require.NoError(t, err, "metadata keys with a field of their own are not directives, whatever their case")
+	assert.Empty(t, capitals.Warnings)
+	assert.Equal(t, "Shouting", capitals.Title)
+}
+
+func TestFirstClassMetadata(t *testing.T) {
+	script := `
+// Title: The Enchanted Garden
+// AUTHOR: ChatGPT
+// language: en
+// genre: fantasy
+
+=== index ===
+END
+`
+	outputJSON, err := Compile(script)
+	require.NoError(t, err)
+
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(outputJSON, &result))
+	assert.Equal(t, "The Enchanted Garden", result["title"])
+	assert.Equal(t, "ChatGPT", result["author"])
+	assert.Equal(t, "en", result["language"])
+	assert.Equal(t, "3E598BE8-67BA-5531-AB42-2BD4B4660CA6", result["ifid"], "The IFID should be a stable UUID v5 of title and author")
+
+	metadata := result["metadata"].(map[string]interface{})
+	assert.Equal(t, "fantasy", metadata["genre"])
+	assert.Equal(t, "The Enchanted Garden", metadata["Title"])
+
+	declared, err := CompileWithOptions("// ifid: 0A1B2C3D-0000-4000-8000-000000000000\n=== index ===\nEND\n", Options{})
+	require.NoError(t, err)
+	assert.Equal(t, "0A1B2C3D-0000-4000-8000-000000000000", declared.IFID)
+
+	// Untitled, authorless stories are told apart by their knots.
+	first, err := CompileWithOptions("=== index ===\n* Go. -> cellar\n\n=== cellar ===\nEND\n", Options{})
+	require.NoError(t, err)
+	second, err := CompileWithOptions("=== index ===\n* Go. -> garden\n\n=== garden ===\nEND\n", Options{})
+	require.NoError(t, err)
+	edited, err := CompileWithOptions("=== index ===\nA new opening.\n* Go down. -> cellar\n\n=== cellar ===\nEND\n", Options{})
+	require.NoError(t, err)
+	assert.NotEqual(t, first.IFID, second.IFID)
+	assert.Equal(t, first.IFID, edited.IFID, "editing prose keeps the identity")
+	twee, err := ExportTwee(second.Graph)
+	require.NoError(t, err)
+	assert.Contains(t, string(twee), second.IFID)
+}
+
+func TestHeaderDirectiveInsideKnot(t *testing.T) {
+	script := `
+// title: Late States
+
+// A blank line and a plain comment do not end the header.
+// STATES: has_key
+
+=== index ===
+// Plain comments inside knots are fine.
+// STATES: has_rope
+END
+`
+	_, err := Compile(script)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 9: header directive 'STATES' found inside knot 'index'")
+
+	result, err := CompileWithOptions(strings.Replace(script, "// STATES: has_rope\n", "", 1), Options{})
+	require.NoError(t, err)
+	assert.Contains(t, result.Graph.Graph, "index|has_key=false")
+}
+
+func TestLocalFlagState(t *testing.T) {
+	script := `
+// LOCAL-FLAG-STATES: alarm_tripped
+
+=== index ===
+// scene: vault
+* Trip the alarm. ~ alarm_tripped = true
+* {alarm_tripped == true} Try to reset it. ~ alarm_tripped = false
+* {alarm_tripped == true} Flee. -> street
+
+=== street ===
+// scene: outside
+* Sneak back in. -> index
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+
+	tripped := result.Graph.Graph["index|alarm_tripped=true"]
+	require.NotNil(t, tripped)
+	require.Len(t, tripped.Edges, 3)
+	assert.Equal(t, "index|alarm_tripped=true", tripped.Edges[1].TargetNodeID, "A local flag cannot be reset within its scene")
+	assert.Equal(t, "street|alarm_tripped=false", tripped.Edges[2].TargetNodeID, "A local flag is reset when the scene changes")
+
+	_, err = Compile("// FLAG-STATES: alarm_tripped\n// LOCAL-STATES: alarm_tripped\n=== index ===\nEND\n")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "use LOCAL-FLAG-STATES")
+}
+
+func TestSceneScopedStates(t *testing.T) {
+	script := `
+// STATES: has_key
+// LOCAL-STATES(bedroom): drawer_open
+// LOCAL-STATES(kitchen): drawer_open
+
+=== index ===
+// scene: bedroom
+* Open the drawer. ~ drawer_open = true
+* {drawer_open == true} Take the key. ~ has_key = true
+* Go to the kitchen. -> kitchen
+
+=== kitchen ===
+// scene: kitchen
+* {drawer_open == false} Open the kitchen drawer. ~ drawer_open = true
+* Go to the hall. -> hall
+
+=== hall ===
+END
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	nodes := result.Graph.Graph
+
+	assert.Contains(t, nodes, "index|drawer_open=true,has_key=true")
+	assert.Contains(t, nodes, "kitchen|drawer_open=false,has_key=true", "The bedroom drawer must not leak into the kitchen")
+	assert.Contains(t, nodes, "kitchen|drawer_open=true,has_key=true")
+	assert.Contains(t, nodes, "hall|has_key=true", "Scoped states should be omitted outside their scene")
+
+	_, err = Compile("// STATES: drawer_open\n// LOCAL-STATES(bedroom): drawer_open\n=== index ===\nEND\n")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 2: state 'drawer_open' scoped to scene 'bedroom' conflicts with its earlier STATES declaration")
+}
+
+func TestAnalyzeDeadEnds(t *testing.T) {
+	script := `
+// STATES: has_rope
+
+=== index ===
+* Jump into the pit. -> cellar
+* Take the rope. ~ has_rope = true
+
+=== cellar ===
+It is dark down here.
+* {has_rope == true} Climb up. -> index
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+
+	analysis := Analyze(result.Graph)
+	require.Len(t, analysis.DeadEnds, 1)
+	deadEnd := analysis.DeadEnds[0]
+	assert.Equal(t, "cellar|has_rope=false", deadEnd.NodeID)
+	assert.Equal(t, "cellar", deadEnd.KnotName)
+	assert.Equal(t, map[string]bool{"has_rope": false}, deadEnd.State)
+	assert.Equal(t, []HiddenChoice{{Text: "Climb up.", Condition: "has_rope == true"}}, deadEnd.HiddenChoices)
+
+	assert.Contains(t, result.Warnings, "at cellar|has_rope=false, choice 'Climb up.' was hidden by {has_rope == true}")
+}
+
+func TestShortestPaths(t *testing.T) {
+	script := `
+// STATES: has_key
+
+=== index ===
+* Search the room. ~ has_key = true
+* {has_key == true} Unlock the door. -> hall
+* Give up. -> despair
+
+=== hall ===
+* Walk out. -> freedom
+
+=== despair ===
+END: despair
+
+=== freedom ===
+END: freedom
+
+=== secret ===
+END: secret
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, "index|has_key=false", result.Graph.StartNodeID)
+
+	analysis := Analyze(result.Graph)
+	require.Len(t, analysis.ShortestPaths, 3)
+
+	despair := analysis.ShortestPaths[0]
+	assert.Equal(t, "despair|has_key=false", despair.NodeID)
+	assert.Equal(t, 1, despair.Length)
+
+	freedom := analysis.ShortestPaths[2]
+	assert.Equal(t, "freedom|has_key=true", freedom.NodeID)
+	assert.Equal(t, "freedom", freedom.EndingName)
+	assert.Equal(t, 3, freedom.Length)
+	assert.Equal(t, []PathStep{
+		{NodeID: "index|has_key=false", Choice: "Search the room."},
+		{NodeID: "index|has_key=true", Choice: "Unlock the door."},
+		{NodeID: "hall|has_key=true", Choice: "Walk out."},
+		{NodeID: "freedom|has_key=true"},
+	}, freedom.Path)
+
+	assert.Equal(t, []string{"secret"}, analysis.UnreachableEndings)
+}
+
+func TestOneSidedConditions(t *testing.T) {
+	script := `// STATES: has_rope, lamp_lit
+
+=== index ===
+- {lamp_lit == false} It is dark.
+- The lamp is burning.
+* Light the lamp. ~ lamp_lit = true -> cellar
+* {has_rope == true} Climb down. -> cellar
+
+=== cellar ===
+- {lamp_lit == true} Shadows dance on the walls.
+- It is too dark to see.
+* {has_rope == true} Use the rope. -> index
+* {lamp_lit == true} Look around. -> attic
+
+=== attic ===
+END
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+
+	coverage := Analyze(result.Graph).OneSidedConditions
+	require.Len(t, coverage, 5)
+	messages := make([]string, len(coverage))
+	for i, c := range coverage {
+		messages[i] = c.String()
+	}
+	assert.Equal(t, []string{
+		"cellar: text block 1 condition was true in all 1 visits (condition is redundant)",
+		"cellar: choice 'Use the rope.' condition was false in all 1 visits",
+		"cellar: choice 'Look around.' condition was true in all 1 visits (condition is redundant)",
+		"index: text block 1 condition was true in all 1 visits (condition is redundant)",
+		"index: choice 'Climb down.' condition was false in all 1 visits",
+	}, messages)
+	assert.Equal(t, 12, coverage[1].Line)
+	assert.Equal(t, "has_rope == true", coverage[1].Condition)
+}
+
+func TestEnumeratePaths(t *testing.T) {
+	script := `// STATES: has_key
+
+=== index ===
+* Search the room. -> index
+* Open the door. -> hall
+
+=== hall ===
+* Go back. -> index
+* Leave. -> outside
+
+=== outside ===
+END
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	graph := result.Graph
+
+	paths := EnumeratePaths(graph, PathOptions{})
+	require.Len(t, paths, 3, "every loop must stop at its first revisit")
+	assert.Equal(t, Path{Steps: []PathStep{
+		{NodeID: "index|has_key=false", Choice: "Search the room."},
+		{NodeID: "index|has_key=false"},
+	}, Stop: PathRevisited}, paths[0])
+	assert.Equal(t, Path{Steps: []PathStep{
+		{NodeID: "index|has_key=false", Choice: "Open the door."},
+		{NodeID: "hall|has_key=false", Choice: "Leave."},
+		{NodeID: "outside|has_key=false"},
+	}, Stop: PathEnded}, paths[2])
+
+	more := EnumeratePaths(graph, PathOptions{MaxRevisits: 1})
+	assert.Greater(t, len(more), len(paths))
+	for _, path := range more {
+		counts := make(map[string]int)
+		for _, step := range path.Steps {
+			counts[step.NodeID]++
+			assert.LessOrEqual(t, counts[step.NodeID], 3)
+		}
+	}
+
+	for _, path := range EnumeratePaths(graph, PathOptions{MaxDepth: 1, MaxRevisits: 10}) {
+		assert.LessOrEqual(t, len(path.Steps), 2)
+	}
+	assert.Len(t, EnumeratePaths(graph, PathOptions{MaxRevisits: 10, MaxPaths: 7}), 7)
+
+	var streamed []Path
+	WalkPaths(graph, PathOptions{MaxRevisits: 10}, func(path Path) bool {
+		streamed = append(streamed, path)
+		return len(streamed) < 3
+	})
+	assert.Len(t, streamed, 3)
+
+	encoded, err := json.Marshal(paths[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(encoded), `"stop":"revisited"`)
+}
+
+func TestSimulate(t *testing.T) {
+	script := `=== index ===
+You wake up.
+* Go left. -> left
+* Go right. -> right
+* Wait. -> index
+
+=== left ===
+A cliff.
+END: fall
+
+=== right ===
+A road home.
+END: home
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	graph := result.Graph
+
+	first := Simulate(graph, 42, 50)
+	assert.Equal(t, first, Simulate(graph, 42, 50), "a seed must always give the same transcript")
+	assert.Equal(t, int64(42), first.Seed)
+	require.True(t, first.Ended)
+	assert.Len(t, first.Choices, len(first.NodeIDs)-1)
+	assert.True(t, strings.HasPrefix(first.Content, "You wake up."))
+
+	capped := Simulate(graph, 1, 0)
+	assert.True(t, capped.Ended)
+	for seed := int64(0); seed < 20; seed++ {
+		transcript := Simulate(graph, seed, 1)
+		assert.LessOrEqual(t, len(transcript.Choices), 1)
+	}
+
+	summary := SimulateEndings(graph, 3000, 100)
+	assert.Equal(t, 3000, summary.Runs)
+	assert.Equal(t, 0, summary.Unfinished)
+	assert.Equal(t, 3000, summary.Endings["fall"]+summary.Endings["home"])
+	assert.InDelta(t, 1500, summary.Endings["fall"], 150, "endings should be hit in roughly equal proportions")
+	assert.Equal(t, summary, SimulateEndings(graph, 3000, 100))
+}
+
+func TestSceneMetrics(t *testing.T) {
+	script := `=== index ===
+// scene: town
+* Go to the market. -> market
+* Go to the well. -> well
+
+=== market ===
+// scene: town
+* Haggle. -> stall
+* Leave town. -> road
+
+=== stall ===
+// scene: town
+* Back to the market. -> market
+* Go to the well. -> well
+
+=== well ===
+// scene: town
+* Leave town. -> road
+
+=== road ===
+// scene: wilds
+* Walk on. -> camp
+* Turn back. -> index
+
+=== camp ===
+// scene: wilds
+END
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+
+	scenes := Analyze(result.Graph).Scenes
+	require.Len(t, scenes, 2)
+
+	town := scenes[0]
+	assert.Equal(t, "town", town.Scene)
+	assert.Equal(t, 4, town.Nodes)
+	// index -> {market, stall} (one loop counted as 1 edge) -> well.
+	assert.Equal(t, 3, town.LongestPath)
+	assert.Equal(t, 1, town.MinChoices)
+	assert.Equal(t, 2, town.MaxChoices)
+	assert.InDelta(t, 7.0/4.0, town.AvgChoices, 1e-9)
+	assert.Equal(t, 1, town.EntryEdges)
+	assert.Equal(t, 2, town.ExitEdges)
+
+	wilds := scenes[1]
+	assert.Equal(t, SceneMetrics{Scene: "wilds", Nodes: 2, LongestPath: 1, MinChoices: 0, AvgChoices: 1, MaxChoices: 2, EntryEdges: 2, ExitEdges: 1}, wilds)
+}
+
+func TestSourcePositions(t *testing.T) {
+	script := `// STATES: has_key
+
+=== index ===
+- {has_key == true} The door is unlocked.
+- The door is locked.
+* {has_key == false} Take the key. ~ has_key = true -> index
+* Leave. -> outside
+
+=== outside ===
+It is raining.
+END
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+
+	locked := result.Graph.Graph["index|has_key=false"]
+	assert.Equal(t, &SourcePos{Line: 3, ContentLine: 5}, locked.Src)
+	require.Len(t, locked.Edges, 2)
+	assert.Equal(t, &SourcePos{Line: 6}, locked.Edges[0].Src)
+	assert.Equal(t, &SourcePos{Line: 7}, locked.Edges[1].Src)
+
+	unlocked := result.Graph.Graph["index|has_key=true"]
+	assert.Equal(t, &SourcePos{Line: 3, ContentLine: 4}, unlocked.Src)
+	require.Len(t, unlocked.Edges, 1)
+	assert.Equal(t, &SourcePos{Line: 7}, unlocked.Edges[0].Src, "edge lines follow the choices actually offered")
+
+	output, err := result.JSON()
+	require.NoError(t, err)
+	assert.Contains(t, string(output), `"src"`)
+
+	omitted, err := CompileWithOptions(script, Options{OmitSource: true})
+	require.NoError(t, err)
+	output, err = omitted.JSON()
+	require.NoError(t, err)
+	assert.NotContains(t, string(output), `"src"`)
+
+	// A prose edit that adds a line must shift the positions of later knots
+	// even when the Compiler reuses the explored graph.
+	c := NewCompiler()
+	_, err = c.Compile(script)
+	require.NoError(t, err)
+	edited := strings.Replace(script, "The door is locked.", "The door is locked.\nIt is very old.", 1)
+	reused, err := c.Compile(edited)
+	require.NoError(t, err)
+	assert.True(t, c.reused)
+	assert.Equal(t, &SourcePos{Line: 10, ContentLine: 11}, reused.Graph.Graph["outside|has_key=false"].Src)
+	assert.Equal(t, &SourcePos{Line: 8}, reused.Graph.Graph["index|has_key=false"].Edges[1].Src)
+
+	files := fstest.MapFS{"story/main.biff": {Data: []byte("=== index ===\nHello.\nEND\n")}}
+	fsOutput, err := CompileFS(files, "story")
+	require.NoError(t, err)
+	assert.Contains(t, string(fsOutput), `"file": "story/main.biff"`)
+}
+
+func TestWordMetrics(t *testing.T) {
+	script := `=== index ===
+Ein kleiner Weg.
+* Go left. -> left
+* Go right. -> right
+
+=== left ===
+Short.
+END
+
+=== right ===
+A much longer	ending, with many words.
+END
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, 3, result.Graph.Graph["index|"].WordCount, "Unicode spaces separate words")
+	assert.Equal(t, 7, result.Graph.Graph["right|"].WordCount)
+
+	words := Analyze(result.Graph).Words
+	assert.Equal(t, 3+1+7, words.Distinct)
+	assert.Equal(t, 4, words.MinPath)
+	assert.Equal(t, 10, words.MaxPath)
+	assert.True(t, words.MaxPathExact)
+	assert.Equal(t, 1000, words.Samples)
+	assert.Greater(t, words.AvgPath, 4.0)
+	assert.Less(t, words.AvgPath, 10.0)
+
+	looping, err := CompileWithOptions(strings.Replace(script, "* Go right. -> right", "* Go right. -> right\n* Stay. -> index", 1), Options{})
+	require.NoError(t, err)
+	words = Analyze(looping.Graph).Words
+	assert.False(t, words.MaxPathExact)
+	assert.GreaterOrEqual(t, words.MaxPath, 10)
+
+	// Sampling takes the same walks as Simulate without building transcripts.
+	for seed := int64(0); seed < 50; seed++ {
+		transcript := Simulate(looping.Graph, seed, 3)
+		want := 0
+		for _, nodeID := range transcript.NodeIDs {
+			want += looping.Graph.Graph[nodeID].WordCount
+		}
+		got, ended := sampleWords(looping.Graph, seed, 3)
+		assert.Equal(t, transcript.Ended, ended, "seed %d", seed)
+		assert.Equal(t, want, got, "seed %d", seed)
+	}
+}
+
+func TestNodeAndDepthLimits(t *testing.T) {
+	script := `
+// STATES: a, b, c, d
+
+=== index ===
+* Toggle a. ~ a = true
+* Toggle b. ~ b = true
+* Toggle c. ~ c = true
+* Toggle d. ~ d = true
+* Rest. -> camp
+
+=== camp ===
+* Go back. -> index
+`
+	result, err := CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	assert.Len(t, result.Graph.Graph, 32)
+
+	_, err = CompileWithOptions(script, Options{MaxNodes: 10})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "graph exceeds the limit of 10 nodes")
+	assert.Contains(t, err.Error(), "index (")
+
+	result, err = CompileWithOptions(script, Options{MaxDepth: 1})
+	require.NoError(t, err)
+	assert.Len(t, result.Graph.Graph, 6)
+	assert.Contains(t, result.Warnings, "graph truncated at MaxDepth 1; dead-end and unreachable-knot checks were skipped")
+}
+
+func TestDeterministicOutput(t *testing.T) {
+	script, err := os.ReadFile(filepath.Join("testdata", "garden.biff"))
+	require.NoError(t, err)
+
+	first, err := Compile(string(script))
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		output, err := Compile(string(script))
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(first, output), "compile %d produced different bytes", i)
+	}
+
+	golden := filepath.Join("testdata", "garden.golden.json")
+	if *update {
+		require.NoError(t, os.WriteFile(golden, first, 0o644))
+	}
+	expected, err := os.ReadFile(golden)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), string(first), "output differs from %s; rerun with -update if the change is intended", golden)
+}
+
+func TestCompactNodeIDs(t *testing.T) {
+	script, err := os.ReadFile(filepath.Join("testdata", "garden.biff"))
+	require.NoError(t, err)
+
+	verbose, err := CompileWithOptions(string(script), Options{})
+	require.NoError(t, err)
+	compact, err := CompileWithOptions(string(script), Options{CompactIDs: true})
+	require.NoError(t, err)
+	again, err := CompileWithOptions(string(script), Options{CompactIDs: true})
+	require.NoError(t, err)
+
+	require.Len(t, compact.Graph.Graph, len(verbose.Graph.Graph))
+	assert.Regexp(t, `^index#[0-9a-f]{16}$`, compact.Graph.StartNodeID)
+	for nodeID, node := range compact.Graph.Graph {
+		assert.Regexp(t, `^`+node.KnotName+`#[0-9a-f]{16}$`, nodeID)
+		assert.Contains(t, again.Graph.Graph, nodeID, "Compact IDs must be stable across compiles")
+		for _, edge := range node.Edges {
+			assert.Contains(t, compact.Graph.Graph, edge.TargetNodeID)
+		}
+	}
+}
+
+func TestIncomingEdges(t *testing.T) {
+	script := `
+=== index ===
+* Take the stairs. -> landing
+* Take the lift. -> landing
+
+=== landing ===
+* Go back down. -> index
+`
+	result, err := CompileWithOptions(script, Options{IncomingEdges: true})
+	require.NoError(t, err)
+
+	landing := result.Graph.Graph["landing|"]
+	assert.Equal(t, []*IncomingEdge{
+		{SourceNodeID: "index|", Text: "Take the stairs."},
+		{SourceNodeID: "index|", Text: "Take the lift."},
+	}, landing.IncomingEdges)
+	assert.Equal(t, []*IncomingEdge{{SourceNodeID: "landing|", Text: "Go back down."}}, result.Graph.Graph["index|"].IncomingEdges)
+
+	result, err = CompileWithOptions("=== index ===\n* Leave. -> outside\n\n=== outside ===\nEND\n", Options{IncomingEdges: true})
+	require.NoError(t, err)
+	assert.Empty(t, result.Graph.Graph["index|"].IncomingEdges, "The root has no predecessors")
+
+	result, err = CompileWithOptions(script, Options{})
+	require.NoError(t, err)
+	assert.Nil(t, result.Graph.Graph["landing|"].IncomingEdges, "Predecessors are only indexed on request")
+}
+
+func TestPruneUnreadStates(t *testing.T) {
+	base := `
+// STATES: has_key%s
+
+=== index ===
+* {has_key == false} Search. ~ has_key = true%s
+* {has_key == true} Leave. -> outside
+
+=== outside ===
+END
+`
+	withoutCounter, err := CompileWithOptions(fmt.Sprintf(base, "", ""), Options{PruneUnreadStates: true})
+	require.NoError(t, err)
+	withCounter, err := CompileWithOptions(fmt.Sprintf(base, ", searched_once", " ~ searched_once = true"), Options{PruneUnreadStates: true})
+	require.NoError(t, err)
+	assert.Len(t, withCounter.Graph.Graph, len(withoutCounter.Graph.Graph), "A write-only state must not add nodes")
+
+	root := withCounter.Graph.Graph["index|has_key=false"]
+	require.NotNil(t, root)
+	assert.Equal(t, []string{"searched_once = true"}, root.Edges[0].UntrackedStateChanges)
+}
+
+func TestStateVectorMatchesMapForm(t *testing.T) {
+	garden, err := os.ReadFile(filepath.Join("testdata", "garden.biff"))
+	require.NoError(t, err)
+	for _, script := range []string{largeScript(3, 6), string(garden), renameScript} {
+		graph, err := CompileWithOptions(script, Options{})
+		require.NoError(t, err)
+		layout := newStateLayout(graph.Graph.script)
+		for nodeID, node := range graph.Graph.Graph {
+			v := layout.fromMap(node.State)
+			assert.Equal(t, sprintfNodeID(node.KnotName, node.State), generateNodeID(node.KnotName, node.State))
+			assert.Equal(t, generateNodeID(node.KnotName, node.State), layout.nodeID(node.KnotName, v))
+			assert.Equal(t, nodeID, layout.nodeID(node.KnotName, v))
+			assert.Equal(t, node.State, layout.toMap(v))
+		}
+	}
+	assert.Equal(t, "index|", generateNodeID("index", nil))
+}
+
+// sprintfNodeID is how node IDs were built before generateNodeID avoided
+// fmt, kept to check that the IDs did not change.
+func sprintfNodeID(knotName string, state map[string]bool) string {
+	keys := make([]string, 0, len(state))
+	for k := range state {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var stateParts []string
+	for _, k := range keys {
+		stateParts = append(stateParts, fmt.Sprintf("%s=%t", k, state[k]))
+	}
+	return fmt.Sprintf("%s|%s", knotName, strings.Join(stateParts, ","))
+}
+
+func TestCompiledConditionsMatchStrings(t *testing.T) {
+	layout := &stateLayout{names: []string{"a", "b"}, index: map[string]int{"a": 0, "b": 1}, words: 1}
+	conditions := []string{
+		"a == true", "a != true", "a == false && b == true", "a==true&&b!=true",
+		"missing == false", "missing != false", "a == yes", "a != = true",
+		"false", "", "a == true &&", "a == true && false",
+	}
+	for _, values := range [][2]bool{{false, false}, {false, true}, {true, false}, {true, true}} {
+		state := map[string]bool{"a": values[0], "b": values[1]}
+		v := layout.fromMap(state)
+		for _, condition := range conditions {
+			want := evaluateConditionString(condition, state)
+			compiled := compileCondition(condition, layout)
+			assert.Equal(t, want, compiled.holds(state), "%q in %v", condition, state)
+			assert.Equal(t, want, compiled.holdsIn(layout, v), "%q in %v", condition, state)
+		}
+	}
+
+	ast, err := parse(`// STATES: lamp
+=== index ===
+- {lamp == true} Light.
+- Dark.
+* {lamp == true} Blow it out. ~ lamp = false -> index
+* {lamp == false} Light it. ~ lamp = true -> index
+* {lamp == true} Leave. -> done
+=== done ===
+END
+`)
+	require.NoError(t, err)
+	require.NoError(t, prepareScript(ast, Options{}))
+	index := ast.Knots["index"]
+	assert.Same(t, index.Body[0].compiled, index.Choices[0].compiled, "each distinct condition is compiled once")
+	assert.Same(t, index.Choices[0].compiled, index.Choices[2].compiled)
+	assert.NotSame(t, index.Choices[0].compiled, index.Choices[1].compiled)
+}
+
+// evaluateConditionString is how conditions were evaluated before they were
+// compiled, kept to check that compiling them changed nothing.
+func evaluateConditionString(condition string, state map[string]bool) bool {
+	for _, part := range strings.Split(condition, "&&") {
+		part = strings.TrimSpace(part)
+		var op, stateName, valueStr string
+		if strings.Contains(part, "!=") {
+			op = "!="
+			vals := strings.Split(part, "!=")
+			stateName, valueStr = strings.TrimSpace(vals[0]), strings.TrimSpace(vals[1])
+		} else if strings.Contains(part, "==") {
+			op = "=="
+			vals := strings.Split(part, "==")
+			stateName, valueStr = strings.TrimSpace(vals[0]), strings.TrimSpace(vals[1])
+		} else {
+			return false
+		}
+		if (state[stateName] == (valueStr == "true")) != (op == "==") {
+			return false
+		}
+	}
+	return true
+}
+
+func TestConcurrentBuildMatchesSequential(t *testing.T) {
+	garden, err := os.ReadFile(filepath.Join("testdata", "garden.biff"))
+	require.NoError(t, err)
+
+	scripts := map[string]string{
+		"garden": string(garden),
+		"large":  largeScript(6, 24),
+	}
+	variants := map[string]Options{
+		"default":    {},
+		"compact":    {CompactIDs: true, IncomingEdges: true},
+		"pruned":     {PruneUnreadStates: true},
+		"depth":      {MaxDepth: 5},
+		"node limit": {MaxNodes: 50},
+	}
+	for scriptName, script := range scripts {
+		for variantName, opts := range variants {
+			opts.Concurrency = 1
+			sequential, seqErr := CompileWithOptions(script, opts)
+			for _, workers := range []int{2, 4, 16} {
+				opts.Concurrency = workers
+				concurrent, err := CompileWithOptions(script, opts)
+				name := fmt.Sprintf("%s/%s/%d workers", scriptName, variantName, workers)
+				if seqErr != nil {
+					require.Error(t, err, name)
+					assert.Equal(t, seqErr.Error(), err.Error(), name)
+					continue
+				}
+				require.NoError(t, err, name)
+				want, err := sequential.JSON()
+				require.NoError(t, err)
+				got, err := concurrent.JSON()
+				require.NoError(t, err)
+				require.True(t, bytes.Equal(want, got), "%s: output differs from the sequential build", name)
+			}
+		}
+	}
+}
+
+func TestCompilerReusesGraphForProseEdits(t *testing.T) {
+	script := `// STATES: has_key
+
+=== index ===
+- {has_key == true} The door is unlocked.
+- The door is locked.
+* {has_key == false} Take the key. ~ has_key = true -> index
+* Leave. -> outside
+
+=== outside ===
+It is raining.
+END
+`
+	edited := strings.Replace(script, "It is raining.", "It is raining.\nHard.", 1)
+
+	c := NewCompiler()
+	_, err := c.Compile(script)
+	require.NoError(t, err)
+	assert.False(t, c.reused)
+
+	result, err := c.Compile(edited)
+	require.NoError(t, err)
+	assert.True(t, c.reused, "a prose edit should reuse the explored graph")
+	assertSameOutput(t, edited, Options{}, result)
+
+	again, err := c.Compile(edited)
+	require.NoError(t, err)
+	assert.Same(t, result, again)
+
+	result, err = c.Compile(strings.Replace(script, "The door is locked.", "The door is shut.", 1))
+	require.NoError(t, err)
+	assert.True(t, c.reused)
+	assert.Equal(t, "The door is shut.", result.Graph.Graph["index|has_key=false"].Content)
+	assert.Equal(t, "It is raining.", result.Graph.Graph["outside|has_key=false"].Content)
+}
+
+func TestCompilerInvalidation(t *testing.T) {
+	garden, err := os.ReadFile(filepath.Join("testdata", "garden.biff"))
+	require.NoError(t, err)
+	base := string(garden)
+
+	edits := map[string]func(string) string{
+		"condition": func(s string) string { return strings.Replace(s, "== true", "== false", 1) },
+		"new choice": func(s string) string {
+			return strings.Replace(s, "=== index ===\n", "=== index ===\n* Sit down. -> index_rest\n\n=== index_rest ===\nYou rest.\nEND\n\n=== index_again ===\n", 1)
+		},
+		"state change": func(s string) string { return strings.Replace(s, "= true", "= false", 1) },
+		"header":       func(s string) string { return "// STATES: extra_state\n" + s },
+	}
+	for name, edit := range edits {
+		t.Run(name, func(t *testing.T) {
+			edited := edit(base)
+			require.NotEqual(t, base, edited)
+
+			c := NewCompiler()
+			_, err := c.Compile(base)
+			require.NoError(t, err)
+			result, err := c.Compile(edited)
+			fresh, freshErr := CompileWithOptions(edited, Options{})
+			if freshErr != nil {
+				require.Error(t, err)
+				assert.Equal(t, freshErr.Error(), err.Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.False(t, c.reused, "a structural edit must rebuild the graph")
+			want, err := fresh.JSON()
+			require.NoError(t, err)
+			got, err := result.JSON()
+			require.NoError(t, err)
+			assert.Equal(t, string(want), string(got))
+		})
+	}
+
+	t.Run("options", func(t *testing.T) {
+		c := NewCompiler()
+		_, err := c.Compile(base)
+		require.NoError(t, err)
+		c.Options.CompactIDs = true
+		result, err := c.Compile(base)
+		require.NoError(t, err)
+		assert.False(t, c.reused)
+		assertSameOutput(t, base, c.Options, result)
+	})
+
+	t.Run("error then fix", func(t *testing.T) {
+		c := NewCompiler()
+		_, err := c.Compile(base)
+		require.NoError(t, err)
+		_, err = c.Compile(base + "\n=== index ===\nAgain.\n")
+		require.Error(t, err)
+		result, err := c.Compile(base)
+		require.NoError(t, err)
+		assertSameOutput(t, base, Options{}, result)
+	})
+
+	t.Run("maps edited in place", func(t *testing.T) {
+		script := "=== index ===\n- {ext:hard == true} Guard.\n- Clear.\n* {ext:hard == true} Fight. -> index\n* Walk on. -> gate\n\n=== gate ===\nEND\n"
+		ext := map[string]bool{"hard": true}
+		c := NewCompiler()
+		c.Options.ExternalConditions = ext
+		hard, err := c.Compile(script)
+		require.NoError(t, err)
+		assert.Equal(t, "Guard.", hard.Graph.Graph[hard.Graph.StartNodeID].Content)
+
+		ext["hard"] = false
+		easy, err := c.Compile(script)
+		require.NoError(t, err)
+		assert.False(t, c.reused)
+		assert.Equal(t, "Clear.", easy.Graph.Graph[easy.Graph.StartNodeID].Content)
+		assertSameOutput(t, script, c.Options, easy)
+	})
+}
+
+// assertSameOutput checks that result serializes exactly like a fresh compile of script.
+func assertSameOutput(t *testing.T, script string, opts Options, result *CompileResult) {
+	t.Helper()
+	fresh, err := CompileWithOptions(script, opts)
+	require.NoError(t, err)
+	want, err := fresh.JSON()
+	require.NoError(t, err)
+	got, err := result.JSON()
+	require.NoError(t, err)
+	assert.Equal(t, string(want), string(got))
+}
+
+func TestDiffGraphs(t *testing.T) {
+	script := `// STATES: has_key
+
+=== index ===
+You stand at a door.
+* {has_key == false} Take the key. ~ has_key = true -> index
+* Leave. -> outside
+
+=== outside ===
+It is raining.
+END
+`
+	compile := func(script string, opts Options) *StoryGraph {
+		result, err := CompileWithOptions(script, opts)
+		require.NoError(t, err)
+		return result.Graph
+	}
+	base := compile(script, Options{})
+
+	t.Run("identical after a JSON round trip", func(t *testing.T) {
+		output, err := Compile(script)
+		require.NoError(t, err)
+		loaded, err := LoadGraph(output)
+		require.NoError(t, err)
+		assert.Equal(t, base.StartNodeID, loaded.StartNodeID)
+		diff := DiffGraphs(base, loaded)
+		assert.True(t, diff.Empty())
+		assert.Equal(t, "graphs are identical\n", diff.String())
+	})
+
+	t.Run("content and edges", func(t *testing.T) {
+		edited := strings.Replace(script, "It is raining.", "It is snowing.", 1)
+		edited = strings.Replace(edited, "* Leave. -> outside", "* Leave. -> outside\n* Knock. -> index", 1)
+		diff := DiffGraphs(base, compile(edited, Options{}))
+		assert.Empty(t, diff.AddedNodes)
+		assert.Empty(t, diff.RemovedNodes)
+		assert.Equal(t, `~ index|has_key=false
+    + choice 'Knock.' -> index|has_key=false
+~ index|has_key=true
+    + choice 'Knock.' -> index|has_key=true
+~ outside|has_key=false
+    content: "It is raining." -> "It is snowing."
+~ outside|has_key=true
+    content: "It is raining." -> "It is snowing."
+`, diff.String())
+	})
+
+	t.Run("retargeted and removed", func(t *testing.T) {
+		edited := strings.Replace(script, "* Leave. -> outside", "* Leave. -> index", 1)
+		diff := DiffGraphs(base, compile(edited, Options{}))
+		assert.Equal(t, []string{"outside|has_key=false", "outside|has_key=true"}, diff.RemovedNodes)
+		require.Len(t, diff.ChangedNodes, 2)
+		assert.Equal(t, []EdgeRetarget{{Text: "Leave.", OldTargetNodeID: "outside|has_key=false", NewTargetNodeID: "index|has_key=false"}}, diff.ChangedNodes[0].RetargetedEdges)
+	})
+
+	t.Run("renamed IDs still match", func(t *testing.T) {
+		diff := DiffGraphs(base, compile(script, Options{CompactIDs: true}))
+		assert.Empty(t, diff.AddedNodes)
+		assert.Empty(t, diff.RemovedNodes)
+		assert.Empty(t, diff.ChangedNodes)
+		assert.Len(t, diff.RenamedNodes, 4)
+
+		withState := strings.Replace(script, "// STATES: has_key", "// STATES: has_key, rainy", 1)
+		diff = DiffGraphs(base, compile(withState, Options{}))
+		assert.Empty(t, diff.AddedNodes)
+		assert.Empty(t, diff.RemovedNodes)
+		assert.Empty(t, diff.ChangedNodes)
+		assert.Contains(t, diff.RenamedNodes, NodeRename{From: "outside|has_key=true", To: "outside|has_key=true,rainy=false"})
+	})
+
+	t.Run("rejects other JSON", func(t *testing.T) {
+		_, err := LoadGraph([]byte(`{"title": "x"}`))
+		assert.Error(t, err)
+	})
+}
+
+// largeScript generates a script whose reachable graph grows with every
+// state: each knot can toggle one state and move on to the next knot.
+func largeScript(states, knots int) string {
+	var b strings.Builder
+	names := make([]string, states)
+	for i := range names {
+		names[i] = fmt.Sprintf("s%02d", i)
+	}
+	fmt.Fprintf(&b, "// STATES: %s\n\n", strings.Join(names, ", "))
+	for k := 0; k < knots; k++ {
+		name := fmt.Sprintf("k%03d", k)
+		if k == 0 {
+			name = "index"
+		}
+		next := fmt.Sprintf("k%03d", (k+1)%knots)
+		if (k+1)%knots == 0 {
+			next = "index"
+		}
+		state := names[k%states]
+		fmt.Fprintf(&b, "=== %s ===\n", name)
+		fmt.Fprintf(&b, "- {%s == true} The lever is up.\n- The lever is down.\n", state)
+		fmt.Fprintf(&b, "* {%s == false} Pull the lever. ~ %s = true -> %s\n", state, state, next)
+		fmt.Fprintf(&b, "* Walk on. -> %s\n\n", next)
+	}
+	return b.String()
+}
+
+func BenchmarkCompileLarge(b *testing.B) {
+	script := largeScript(10, 40)
+	for i := 0; i < b.N; i++ {
+		if _, err := CompileWithOptions(script, Options{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompileLargeSequential(b *testing.B) {
+	script := largeScript(10, 40)
+	for i := 0; i < b.N; i++ {
+		if _, err := CompileWithOptions(script, Options{Concurrency: 1}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkOutputFormats(b *testing.B) {
+	result, err := CompileWithOptions(largeScript(10, 40), Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, format := range []OutputFormat{FormatJSON, FormatCompactJSON, FormatBinary} {
+		encoded, err := EncodeGraph(result.Graph, format)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run("encode-"+format.String(), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := EncodeGraph(result.Graph, format); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(encoded)), "bytes")
+		})
+		b.Run("load-"+format.String(), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := LoadGraph(encoded); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// conditionScript generates a knot with one choice per condition, each
+// reading two of the states, so expanding it evaluates every condition.
+func conditionScript(states, conditions int) string {
+	var b strings.Builder
+	names := make([]string, states)
+	for i := range names {
+		names[i] = fmt.Sprintf("s%02d", i)
+	}
+	fmt.Fprintf(&b, "// STATES: %s\n\n=== index ===\nA room full of levers.\n", strings.Join(names, ", "))
+	for i := 0; i < conditions; i++ {
+		fmt.Fprintf(&b, "* {%s == true && %s != true} Lever %d. ~ %s = true -> index\n", names[i%states], names[(i*7+3)%states], i, names[(i+1)%states])
+	}
+	return b.String()
+}
+
+// BenchmarkConditions evaluates the 50 choice conditions of a knot in
+// 100,000 node expansions, parsing each condition every time as graph
+// construction used to, and with the conditions compiled once.
+func BenchmarkConditions(b *testing.B) {
+	const expansions = 100000
+	ast, err := parse(conditionScript(16, 50))
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := prepareScript(ast, Options{}); err != nil {
+		b.Fatal(err)
+	}
+	knot, layout := ast.Knots["index"], ast.layout
+	states := make([]map[string]bool, 256)
+	vectors := make([]stateVector, len(states))
+	for i := range states {
+		states[i] = make(map[string]bool)
+		for j, name := range layout.names {
+			states[i][name] = (i*31+j*17)%3 == 0
+		}
+		vectors[i] = layout.fromMap(states[i])
+	}
+
+	b.Run("parsed", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for e := 0; e < expansions; e++ {
+				state := states[e%len(states)]
+				for _, choice := range knot.Choices {
+					evaluateConditionString(choice.Condition, state)
+				}
+			}
+		}
+	})
+	b.Run("compiled", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for e := 0; e < expansions; e++ {
+				v := vectors[e%len(vectors)]
+				for _, choice := range knot.Choices {
+					choice.compiled.holdsIn(layout, v)
+				}
+			}
+		}
+	})
+}
+
+// BenchmarkNodeID builds the ID of every node of a large graph: with fmt as
+// generateNodeID used to, from the map form as it does now, and from the
+// state vector as graph construction does.
+func BenchmarkNodeID(b *testing.B) {
+	result, err := CompileWithOptions(largeScript(10, 40), Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	layout := result.Graph.script.layout
+	nodes := make([]*StoryNode, 0, len(result.Graph.Graph))
+	vectors := make([]stateVector, 0, len(result.Graph.Graph))
+	for _, node := range result.Graph.Graph {
+		nodes = append(nodes, node)
+		vectors = append(vectors, layout.fromMap(node.State))
+	}
+
+	b.Run("sprintf", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			for _, node := range nodes {
+				sprintfNodeID(node.KnotName, node.State)
+			}
+		}
+	})
+	b.Run("map", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			for _, node := range nodes {
+				generateNodeID(node.KnotName, node.State)
+			}
+		}
+	})
+	b.Run("vector", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			for i, node := range nodes {
+				layout.nodeID(node.KnotName, vectors[i])
+			}
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package bigif
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrorCode classifies an Error for tools that react to specific problems.
+type ErrorCode string
+
+const (
+	CodeSyntax            ErrorCode = "syntax"             // A line that cannot be parsed
+	CodeInvalidName       ErrorCode = "invalid-name"       // A knot, state, tag, ending or namespace name outside the identifier grammar
+	CodeDuplicate         ErrorCode = "duplicate"          // A knot or tag defined twice
+	CodeDeclaration       ErrorCode = "declaration"        // A header directive or state declaration that conflicts or is misplaced
+	CodeUnknownDirective  ErrorCode = "unknown-directive"  // A mistyped header directive in strict mode
+	CodeInclude           ErrorCode = "include"            // An INCLUDE that cannot be followed
+	CodeRead              ErrorCode = "read"               // The script could not be read
+	CodeAmbiguousKnot     ErrorCode = "ambiguous-knot"     // A divert that matches knots in several namespaces
+	CodeMissingKnot       ErrorCode = "missing-knot"       // A divert to a knot that does not exist
+	CodeStartKnot         ErrorCode = "start-knot"         // The starting knot is missing
+	CodeInitialState      ErrorCode = "initial-state"      // An InitialStates override for an undeclared state
+	CodeNodeLimit         ErrorCode = "node-limit"         // The graph exceeded Options.MaxNodes
+	CodeDeadEnd           ErrorCode = "dead-end"           // Dead ends with Options.DeadEndsAsErrors
+	CodeUnreachable       ErrorCode = "unreachable"        // Unreachable knots or endings reported as errors
+	CodeTooManyErrors     ErrorCode = "too-many-errors"    // Collection stopped after maxErrors errors
+	CodeCanceled          ErrorCode = "canceled"           // The context passed to CompileContext was done
+	CodeDirective         ErrorCode = "directive"          // An error returned by Options.DirectiveHandler
+	CodeExternalCondition ErrorCode = "external-condition" // An "ext:" condition missing from Options.ExternalConditions
+	CodeAsset             ErrorCode = "asset"              // An asset rejected by Options.AssetValidator
+
+	CodeMalformedGraph      ErrorCode = "malformed-graph"      // Data LoadGraph cannot decode as a compiled graph
+	CodeIncompatibleVersion ErrorCode = "incompatible-version" // A loaded document with an unsupported major format version
+	CodeDanglingReference   ErrorCode = "dangling-reference"   // A loaded start node, edge target, ending or parent that names no node
+)
+
+// Error is the error returned, possibly wrapped, for every problem found in a
+// script while parsing or building its graph. Use errors.As to get at it.
+type Error struct {
+	File    string    // The script file, empty for a script passed in as a string
+	Line    int       // 1-based line, 0 when the problem has no single position
+	Column  int       // 1-based column where the offending text starts, 0 when unknown
+	Code    ErrorCode // What kind of problem this is
+	Message string    // The description, without the position
+	Err     error     // The underlying cause, if any
+}
+
+// Error formats the error as "file:line: message", "line N: message" for a
+// script string, or just the message when there is no position.
+func (e *Error) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return location(e.File, e.Line) + ": " + e.Message
+}
+
+// Unwrap returns the underlying cause.
+func (e *Error) Unwrap() error { return e.Err }
+
+// newError builds an Error from an underlying error, keeping it as the cause.
+func newError(code ErrorCode, file string, line, column int, err error) *Error {
+	return &Error{File: file, Line: line, Column: column, Code: code, Message: err.Error(), Err: err}
+}
+
+// errorAt places err at a position. An Error that has no position yet keeps
+// its code and gains this one; an Error that already has one, such as one
+// from an included file, is returned unchanged. Any other error becomes an
+// Error with the given code.
+func errorAt(err error, code ErrorCode, file string, line, column int) *Error {
+	if e, ok := err.(*Error); ok {
+		if e.Line != 0 {
+			return e
+		}
+		placed := *e
+		placed.File, placed.Line, placed.Column = file, line, column
+		return &placed
+	}
+	return newError(code, file, line, column, err)
+}
+
+// errorf builds an Error without a position, to be placed by errorAt.
+// A %w verb in format records its operand as the cause.
+func errorf(code ErrorCode, format string, args ...interface{}) *Error {
+	err := fmt.Errorf(format, args...)
+	return &Error{Code: code, Message: err.Error(), Err: errors.Unwrap(err)}
+}
+
+// codeOf returns the code of err if it is an Error, and fallback otherwise.
+func codeOf(err error, fallback ErrorCode) ErrorCode {
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return fallback
+}
+
+// maxErrors bounds how many errors one compile collects, so a badly broken
+// or binary input cannot produce an unbounded report.
+const maxErrors = 50
+
+// errTooManyErrors stops parsing once maxErrors errors have been recorded.
+var errTooManyErrors = errors.New("too many errors")
+
+// ErrorList is returned when a compile finds more than one error. The
+// errors are in the order they were found.
+type ErrorList []*Error
+
+// Error lists every error on its own line.
+func (l ErrorList) Error() string {
+	lines := make([]string, len(l))
+	for i, err := range l {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Errors returns the individual errors.
+func (l ErrorList) Errors() []*Error { return l }
+
+// Unwrap returns the individual errors, so errors.Is and errors.As look at
+// each of them.
+func (l ErrorList) Unwrap() []error {
+	errs := make([]error, len(l))
+	for i, err := range l {
+		errs[i] = err
+	}
+	return errs
+}
+
+// As lets errors.As extract the first error on Go versions whose errors
+// package does not follow Unwrap() []error.
+func (l ErrorList) As(target interface{}) bool {
+	if t, ok := target.(**Error); ok && len(l) > 0 {
+		*t = l[0]
+		return true
+	}
+	return false
+}
+
+// errorList returns the single error itself, or an ErrorList for several.
+func errorList(errs []*Error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return ErrorList(errs)
+}
@@ -0,0 +1,116 @@
+package bigif
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Explain describes how the player first arrives at a node: the knots visited
+// from the start node, the choice taken at each and the states it changed.
+// It follows the parent links recorded during compilation, or the parent
+// field of a graph loaded with LoadGraph that was compiled with
+// Options.ParentPointers.
+//
+//	start at index
+//	choose 'Enter the hall.' -> hall
+//	choose 'Take the key.' ~ key = true -> hall
+func Explain(graph *StoryGraph, nodeID string) (string, error) {
+	node, ok := graph.Graph[nodeID]
+	if !ok {
+		return "", fmt.Errorf("node '%s' does not exist", nodeID)
+	}
+
+	chain := []string{nodeID}
+	seen := map[string]bool{nodeID: true}
+	for current := node; ; {
+		link := parentOf(current)
+		if link == nil {
+			break
+		}
+		if seen[link.SourceNodeID] {
+			return "", fmt.Errorf("parent links of node '%s' form a cycle at '%s'", nodeID, link.SourceNodeID)
+		}
+		parent, ok := graph.Graph[link.SourceNodeID]
+		if !ok {
+			return "", fmt.Errorf("parent '%s' of node '%s' does not exist", link.SourceNodeID, chain[len(chain)-1])
+		}
+		seen[link.SourceNodeID] = true
+		chain = append(chain, link.SourceNodeID)
+		current = parent
+	}
+	root := chain[len(chain)-1]
+	if root != graph.StartNodeID {
+		return "", fmt.Errorf("node '%s' has no recorded path from the start node", nodeID)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "start at %s\n", graph.Graph[root].KnotName)
+	for i := len(chain) - 2; i >= 0; i-- {
+		from, to := graph.Graph[chain[i+1]], graph.Graph[chain[i]]
+		fmt.Fprintf(&b, "choose '%s'", parentOf(to).Text)
+		for _, change := range stateChanges(from.State, to.State) {
+			fmt.Fprintf(&b, " ~ %s", change)
+		}
+		fmt.Fprintf(&b, " -> %s\n", to.KnotName)
+	}
+	return b.String(), nil
+}
+
+// parentOf returns the edge that first discovered node, or nil for the start
+// node and for loaded graphs compiled without parent pointers.
+func parentOf(node *StoryNode) *IncomingEdge {
+	if node.parent != nil {
+		return node.parent
+	}
+	return node.Parent
+}
+
+// stateChanges lists, in name order, the states whose value differs between
+// two nodes, as "name = value". A state missing from a node counts as false.
+func stateChanges(from, to map[string]bool) []string {
+	names := make(map[string]bool)
+	for name := range from {
+		names[name] = true
+	}
+	for name := range to {
+		names[name] = true
+	}
+	var changes []string
+	for name := range names {
+		if from[name] != to[name] {
+			changes = append(changes, fmt.Sprintf("%s = %t", name, to[name]))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// assignParents replays breadth-first discovery from the start node, in
+// choice order, and records the first edge into every node.
+func assignParents(graph *StoryGraph) {
+	for _, node := range graph.Graph {
+		node.parent = nil
+	}
+	start, ok := graph.Graph[graph.StartNodeID]
+	if !ok {
+		return
+	}
+	seen := map[string]bool{graph.StartNodeID: true}
+	queue := []*StoryNode{start}
+	ids := []string{graph.StartNodeID}
+	for len(queue) > 0 {
+		node, nodeID := queue[0], ids[0]
+		queue, ids = queue[1:], ids[1:]
+		for _, edge := range node.Edges {
+			target, exists := graph.Graph[edge.TargetNodeID]
+			if !exists || seen[edge.TargetNodeID] {
+				continue
+			}
+			seen[edge.TargetNodeID] = true
+			target.parent = &IncomingEdge{SourceNodeID: nodeID, Text: edge.Text}
+			queue = append(queue, target)
+			ids = append(ids, edge.TargetNodeID)
+		}
+	}
+}
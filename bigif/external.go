@@ -0,0 +1,76 @@
+package bigif
+
+import (
+	"fmt"
+	"strings"
+)
+
+// externalPrefix marks a condition name resolved from Options.ExternalConditions.
+const externalPrefix = "ext:"
+
+// resolveExternalConditions replaces the external parts of every condition
+// in ast by their values, before the graph is built, so they never become
+// part of a node's state. A part that holds is dropped and a condition with
+// a part that does not becomes "false", which never holds. Every external
+// name missing from values is an error.
+func resolveExternalConditions(ast *Script, values map[string]bool) error {
+	var errs []*Error
+	resolve := func(knot *Knot, line int, condition *string) {
+		resolved, missing := resolveExternal(*condition, values)
+		for _, name := range missing {
+			errs = append(errs, &Error{File: knot.File, Line: line, Code: CodeExternalCondition, Message: fmt.Sprintf("knot '%s': external condition '%s%s' has no value in Options.ExternalConditions", knot.Name, externalPrefix, name)})
+		}
+		*condition = resolved
+	}
+	for _, name := range sortedKnotNames(ast.Knots) {
+		knot := ast.Knots[name]
+		for i := range knot.Body {
+			resolve(knot, knot.Body[i].Line, &knot.Body[i].Condition)
+		}
+		for i := range knot.Choices {
+			resolve(knot, knot.Choices[i].Line, &knot.Choices[i].Condition)
+		}
+		for i := range knot.Assets {
+			resolve(knot, knot.Assets[i].Line, &knot.Assets[i].Condition)
+		}
+	}
+	if len(errs) > 0 {
+		return errorList(errs)
+	}
+	return nil
+}
+
+// resolveExternal resolves the external parts of one condition, returning
+// it unchanged if it has none, and the external names values lacks.
+func resolveExternal(condition string, values map[string]bool) (string, []string) {
+	if !strings.Contains(condition, externalPrefix) {
+		return condition, nil
+	}
+	var kept, missing []string
+	holds := true
+	for _, part := range strings.Split(condition, "&&") {
+		part = strings.TrimSpace(part)
+		op := "=="
+		if strings.Contains(part, "!=") {
+			op = "!="
+		}
+		sides := strings.SplitN(part, op, 2)
+		name := strings.TrimSpace(sides[0])
+		if len(sides) != 2 || !strings.HasPrefix(name, externalPrefix) {
+			kept = append(kept, part)
+			continue
+		}
+		value, ok := values[strings.TrimPrefix(name, externalPrefix)]
+		if !ok {
+			missing = append(missing, strings.TrimPrefix(name, externalPrefix))
+			continue
+		}
+		if (value == (strings.TrimSpace(sides[1]) == "true")) != (op == "==") {
+			holds = false
+		}
+	}
+	if !holds {
+		return "false", missing
+	}
+	return strings.Join(kept, " && "), missing
+}
@@ -0,0 +1,209 @@
+package bigif
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// OutputFormat selects how a compiled graph is serialized.
+type OutputFormat int
+
+const (
+	FormatJSON        OutputFormat = iota // Indented JSON, as returned by Compile
+	FormatCompactJSON                     // JSON without indentation, with the short field names of the "short" struct tags
+	FormatBinary                          // encoding/gob, the smallest and fastest to load from Go
+)
+
+// String returns the name of the format.
+func (f OutputFormat) String() string {
+	switch f {
+	case FormatCompactJSON:
+		return "compact-json"
+	case FormatBinary:
+		return "binary"
+	default:
+		return "json"
+	}
+}
+
+// binaryMagic starts every FormatBinary document, so LoadGraph can tell it
+// apart from JSON.
+var binaryMagic = []byte("BIGIF\x00gob1\n")
+
+func init() {
+	// Metadata lists are decoded as []interface{} inside interface{} values,
+	// which gob only sends for registered types.
+	gob.Register([]interface{}{})
+}
+
+// Encode serializes the result in Options.Format.
+func (r *CompileResult) Encode() ([]byte, error) {
+	m, err := r.format.marshaler()
+	if err != nil {
+		return nil, err
+	}
+	return m.Marshal(r.Graph, r.metadata())
+}
+
+// EncodeGraph serializes a graph, with its title, metadata, endings and
+// warnings, in the given format. LoadGraph reads every format back.
+//
+// FormatCompactJSON has the layout of FormatJSON with every key replaced by
+// its short form: "title" t, "author" a, "language" l, "ifid" i, "metadata"
+// m, "graph" g with "startNodeId" s and "nodes" n, "endings" e, "warnings"
+// w, "contents" cs and "stateNames" sn. The short names of node, edge,
+// source and ending fields are given by the short tags on StoryNode,
+// StoryEdge, SourcePos, IncomingEdge and Ending; e.g. a node's "knotName"
+// is k and an edge's "targetNodeId" is to. Metadata keys, node IDs and
+// state names are kept as they are.
+func EncodeGraph(graph *StoryGraph, format OutputFormat) ([]byte, error) {
+	m, err := format.marshaler()
+	if err != nil {
+		return nil, err
+	}
+	return m.Marshal(graph, graphMetadata(graph))
+}
+
+// decodeDocument decodes a document in any of the formats of EncodeGraph.
+func decodeDocument(data []byte) (*graphDocument, error) {
+	doc := &graphDocument{}
+	if bytes.HasPrefix(data, binaryMagic) {
+		if err := gob.NewDecoder(bytes.NewReader(data[len(binaryMagic):])).Decode(doc); err != nil {
+			return nil, err
+		}
+		// gob leaves out empty maps and slices, which JSON writes as {} and [],
+		// and a reference to the first content, which it sends as a zero.
+		for _, node := range doc.Graph.Nodes {
+			if node == nil {
+				continue
+			}
+			if doc.Contents != nil && node.ContentRef == nil {
+				node.ContentRef = new(int)
+			}
+			if node.State == nil {
+				node.State = map[string]bool{}
+			}
+			if node.Edges == nil {
+				node.Edges = []*StoryEdge{}
+			}
+		}
+		for _, source := range doc.SourceMap {
+			if source != nil && source.Edges == nil {
+				source.Edges = []*EdgeSource{}
+			}
+		}
+		for _, ending := range doc.Endings {
+			if ending != nil && ending.State == nil {
+				ending.State = map[string]bool{}
+			}
+		}
+		return doc, nil
+	}
+
+	var probe struct {
+		Graph json.RawMessage `json:"graph"`
+		Short json.RawMessage `json:"g"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, err
+	}
+	if probe.Graph == nil && probe.Short != nil {
+		var tree interface{}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&tree); err != nil {
+			return nil, err
+		}
+		long, err := json.Marshal(renameKeys(tree, reflect.TypeOf(graphDocument{}), false))
+		if err != nil {
+			return nil, err
+		}
+		data = long
+	}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// genericJSON round-trips v through JSON into maps and slices, keeping
+// numbers exact.
+func genericJSON(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var tree interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err = decoder.Decode(&tree)
+	return tree, err
+}
+
+// renameKeys rewrites the object keys of a generic JSON value of type t from
+// the json tag names to the short tag names, or back when toShort is false.
+// Keys of map types, such as node IDs, are left alone, and so is anything
+// below an interface{} type, such as metadata values.
+func renameKeys(v interface{}, t reflect.Type, toShort bool) interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return renameKeys(v, t.Elem(), toShort)
+	case reflect.Slice, reflect.Array:
+		if list, ok := v.([]interface{}); ok {
+			for i := range list {
+				list[i] = renameKeys(list[i], t.Elem(), toShort)
+			}
+		}
+	case reflect.Map:
+		if m, ok := v.(map[string]interface{}); ok {
+			for key, value := range m {
+				m[key] = renameKeys(value, t.Elem(), toShort)
+			}
+		}
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		renamed := make(map[string]interface{}, len(m))
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			long, short := fieldNames(field)
+			if long == "" {
+				continue
+			}
+			from, to := long, short
+			if !toShort {
+				from, to = short, long
+			}
+			if value, ok := m[from]; ok {
+				renamed[to] = renameKeys(value, field.Type, toShort)
+			}
+		}
+		return renamed
+	}
+	return v
+}
+
+// fieldNames returns the JSON and short names of a struct field, or empty
+// names for a field JSON skips. A field without a short tag keeps its JSON name.
+func fieldNames(field reflect.StructField) (long, short string) {
+	if field.PkgPath != "" {
+		return "", ""
+	}
+	long = strings.Split(field.Tag.Get("json"), ",")[0]
+	if long == "-" {
+		return "", ""
+	}
+	if long == "" {
+		long = field.Name
+	}
+	short = field.Tag.Get("short")
+	if short == "" {
+		short = long
+	}
+	return long, short
+}
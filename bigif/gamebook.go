@@ -0,0 +1,143 @@
+package bigif
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultGamebookMaxNodes is the node limit of ExportGamebook when
+// GamebookOptions.MaxNodes is zero.
+const defaultGamebookMaxNodes = 1000
+
+// GamebookOptions controls ExportGamebook. The zero value numbers sections
+// in reading order and accepts graphs of up to 1000 nodes.
+type GamebookOptions struct {
+	// Shuffle numbers every section but the first at random, using Seed,
+	// so readers cannot guess where a choice leads from the numbers of
+	// the sections next to it. The same seed always gives the same book.
+	Shuffle bool
+	Seed    int64
+
+	// MaxNodes makes ExportGamebook fail for a graph with more nodes,
+	// since a book of thousands of sections cannot be printed. Zero means
+	// 1000; a negative value means no limit.
+	MaxNodes int
+}
+
+// ExportGamebook renders a graph as a numbered-section gamebook in Markdown,
+// the print format where each choice says which section to turn to. Every
+// node becomes a section: the start node is section 1 and the rest are
+// numbered in breadth-first order from it, following choices in order,
+// with any nodes it does not reach after them in node ID order. A section
+// holds the node's content and one line per choice, "If you open the door,
+// turn to 12." An END node ends with "The End" and its ending, and a node
+// without choices with "The story stops here."
+//
+// A choice is turned into the sentence by dropping its final punctuation
+// and lower-casing its first letter when the rest of the first word is lower
+// case: "Open the door." becomes "open the door", while "I run" and "NASA
+// calls" keep their capitals. A choice starting with a name, such as "Mary
+// waves", is lower-cased too; reword it if that reads badly.
+func ExportGamebook(graph *StoryGraph, opts GamebookOptions) ([]byte, error) {
+	if graph == nil {
+		return nil, fmt.Errorf("exporting gamebook: graph is nil")
+	}
+	if _, ok := graph.Graph[graph.StartNodeID]; !ok {
+		return nil, fmt.Errorf("exporting gamebook: start node '%s' does not exist", graph.StartNodeID)
+	}
+	maxNodes := opts.MaxNodes
+	if maxNodes == 0 {
+		maxNodes = defaultGamebookMaxNodes
+	}
+	if maxNodes > 0 && len(graph.Graph) > maxNodes {
+		return nil, fmt.Errorf("exporting gamebook: graph has %d nodes, more than the limit of %d", len(graph.Graph), maxNodes)
+	}
+
+	order := gamebookOrder(graph)
+	numbers := make([]int, len(order))
+	for i := range numbers {
+		numbers[i] = i + 1
+	}
+	if opts.Shuffle {
+		rng := rand.New(rand.NewSource(opts.Seed))
+		rest := numbers[1:]
+		rng.Shuffle(len(rest), func(i, j int) { rest[i], rest[j] = rest[j], rest[i] })
+	}
+	section := make(map[string]int, len(order))
+	bySection := make([]string, len(order)+1)
+	for i, id := range order {
+		section[id] = numbers[i]
+		bySection[numbers[i]] = id
+	}
+
+	var b bytes.Buffer
+	title := graph.info.title
+	if title == "" {
+		title = "Untitled Story"
+	}
+	fmt.Fprintf(&b, "# %s\n", title)
+	for number := 1; number < len(bySection); number++ {
+		node := graph.Graph[bySection[number]]
+		fmt.Fprintf(&b, "\n## %d\n\n", number)
+		if content := strings.TrimSpace(node.Content); content != "" {
+			fmt.Fprintf(&b, "%s\n\n", content)
+		}
+		switch {
+		case node.IsEnd:
+			fmt.Fprintf(&b, "**The End: %s**\n", endingLabel(node))
+		case len(node.Edges) == 0:
+			b.WriteString("**The story stops here.**\n")
+		default:
+			for _, edge := range node.Edges {
+				target, ok := section[edge.TargetNodeID]
+				if !ok {
+					return nil, fmt.Errorf("exporting gamebook: node '%s' has a choice to missing node '%s'", bySection[number], edge.TargetNodeID)
+				}
+				fmt.Fprintf(&b, "- If you %s, turn to %d.\n", gamebookChoice(edge.Text), target)
+			}
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// gamebookOrder lists the node IDs in section order: breadth-first from
+// the start node, then the unreached nodes sorted by ID.
+func gamebookOrder(graph *StoryGraph) []string {
+	order := []string{graph.StartNodeID}
+	seen := map[string]bool{graph.StartNodeID: true}
+	for i := 0; i < len(order); i++ {
+		for _, edge := range graph.Graph[order[i]].Edges {
+			if _, exists := graph.Graph[edge.TargetNodeID]; exists && !seen[edge.TargetNodeID] {
+				seen[edge.TargetNodeID] = true
+				order = append(order, edge.TargetNodeID)
+			}
+		}
+	}
+	var unreached []string
+	for id := range graph.Graph {
+		if !seen[id] {
+			unreached = append(unreached, id)
+		}
+	}
+	sort.Strings(unreached)
+	return append(order, unreached...)
+}
+
+// gamebookChoice fits choice text into "If you ..., turn to N."
+func gamebookChoice(text string) string {
+	text = strings.TrimRight(strings.TrimSpace(text), ".!?;:,")
+	first, size := utf8.DecodeRuneInString(text)
+	word := text[size:]
+	if end := strings.IndexFunc(word, unicode.IsSpace); end >= 0 {
+		word = word[:end]
+	}
+	if word != "" && word == strings.ToLower(word) && strings.ToUpper(word) != word {
+		text = string(unicode.ToLower(first)) + text[size:]
+	}
+	return text
+}
@@ -0,0 +1,141 @@
+package bigif
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// GenerateGoConstants writes a Go source file for package pkg that declares
+// the names a game needs to refer to a story, so that typos fail to compile
+// instead of failing at runtime. For each of knots, states, scenes and ending
+// labels it declares a string type (Knot, State, Scene, Ending), one constant
+// per name (KnotCellar, StateHasKey, ...) and a variable listing them all
+// (AllKnots, AllStates, ...).
+//
+// States include local states of every scene, and scenes those declared by
+// the SCENES header as well as those used by knots. Ending labels are the
+// ENDINGS header and the labels of END knots, with an unnamed ending
+// labelled by its knot name, as in Transcript.Ending.
+//
+// Names are sorted and each constant is declared on its own line, so adding
+// a knot adds lines without changing others. Identifiers are the name in
+// camel case, "act2.intro" giving KnotAct2Intro; when two names give the
+// same identifier, the later one in sorted order gets a numeric suffix. The
+// output is gofmt-formatted.
+func GenerateGoConstants(ast *Script, pkg string) ([]byte, error) {
+	if ast == nil {
+		return nil, fmt.Errorf("generating Go constants: script is nil")
+	}
+	if !token.IsIdentifier(pkg) || pkg == "_" {
+		return nil, fmt.Errorf("generating Go constants: invalid package name '%s'", pkg)
+	}
+
+	knots := make(map[string]bool)
+	states := make(map[string]bool)
+	scenes := make(map[string]bool)
+	endings := make(map[string]bool)
+	for name := range ast.States {
+		states[name] = true
+	}
+	for _, local := range ast.SceneStates {
+		for name := range local {
+			states[name] = true
+		}
+	}
+	for _, scene := range ast.Scenes {
+		scenes[scene] = true
+	}
+	if ast.DefaultScene != "" {
+		scenes[ast.DefaultScene] = true
+	}
+	for _, label := range ast.Endings {
+		endings[label] = true
+	}
+	for name, knot := range ast.Knots {
+		knots[name] = true
+		if knot.Scene != "" {
+			scenes[knot.Scene] = true
+		}
+		if knot.IsEnd {
+			if knot.EndingName != "" {
+				endings[knot.EndingName] = true
+			} else {
+				endings[name] = true
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by %s; DO NOT EDIT.\n\npackage %s\n", generator(), pkg)
+	writeGoConstants(&b, "Knot", "Knots", "a knot", knots)
+	writeGoConstants(&b, "State", "States", "a declared state", states)
+	writeGoConstants(&b, "Scene", "Scenes", "a scene", scenes)
+	writeGoConstants(&b, "Ending", "Endings", "an ending label", endings)
+	out, err := format.Source(b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("generating Go constants: %w", err)
+	}
+	return out, nil
+}
+
+// writeGoConstants writes the type, constants and list for one kind of name.
+func writeGoConstants(b *bytes.Buffer, typeName, plural, what string, names map[string]bool) {
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	fmt.Fprintf(b, "\n// %s is the name of %s in the story.\ntype %s string\n", typeName, what, typeName)
+	idents := make([]string, len(sorted))
+	used := make(map[string]bool)
+	for i, name := range sorted {
+		ident := typeName + goIdentifier(name)
+		for n := 2; used[ident]; n++ {
+			ident = fmt.Sprintf("%s%s%d", typeName, goIdentifier(name), n)
+		}
+		used[ident] = true
+		idents[i] = ident
+	}
+	// One declaration per constant, because gofmt would align a const
+	// block and a longer new name would then change every line of it.
+	if len(sorted) > 0 {
+		b.WriteString("\n")
+	}
+	for i, name := range sorted {
+		fmt.Fprintf(b, "const %s %s = %q\n", idents[i], typeName, name)
+	}
+	fmt.Fprintf(b, "\n// All%s lists every %s, sorted by name.\nvar All%s = []%s{\n", plural, strings.ToLower(typeName), plural, typeName)
+	for _, ident := range idents {
+		fmt.Fprintf(b, "%s,\n", ident)
+	}
+	b.WriteString("}\n")
+}
+
+// goIdentifier turns a name into the camel-case tail of an exported
+// identifier: each run of letters and digits starts with a capital, and
+// everything else is dropped. A name with neither becomes "Unnamed".
+func goIdentifier(name string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	if b.Len() == 0 {
+		return "Unnamed"
+	}
+	return b.String()
+}
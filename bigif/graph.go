@@ -1,190 +1,1081 @@
 package bigif
 
 import (
+	"context"
+	"crypto/sha256"
 	"fmt"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// DefaultMaxNodes is the node limit applied when Options.MaxNodes is zero.
+const DefaultMaxNodes = 100000
+
+// queuedNode is a node waiting to be expanded, with its state in vector form.
+type queuedNode struct {
+	id    string
+	node  *StoryNode
+	state stateVector
+}
+
+// expansion is one edge out of a queued node, computed without touching the
+// graph. The target node is built ahead of the merge when its key was not yet
+// visited, since it is then most likely new.
+type expansion struct {
+	choice    Choice
+	state     stateVector
+	key       string
+	nodeID    string
+	node      *StoryNode
+	err       error
+	missing   *Error // a divert to a knot that does not exist, without Options.AllowMissingTargets
+	untracked []string
+}
+
+// expanded holds the expansions of one queued node.
+type expanded struct {
+	expansions []expansion
+	trace      []string // choices skipped and assignments ignored, when tracing
+}
+
+// expander holds the read-only data needed to expand nodes, so expansion can
+// run on several goroutines at once.
+type expander struct {
+	ast          *Script
+	layout       *stateLayout
+	localStates  []int
+	sceneStates  map[string][]int
+	pruned       map[string]bool
+	prunedStates []int
+	turns        []int // The turn states, in order
+	allowMissing bool  // Options.AllowMissingTargets
+	trace        bool  // Options.Logger is set
+}
+
+// expandAll expands every node of a frontier using up to workers goroutines.
+// visited must not be modified until it returns.
+func (ex *expander) expandAll(ctx context.Context, frontier []queuedNode, visited map[string]string, workers int) []expanded {
+	results := make([]expanded, len(frontier))
+	if workers > len(frontier) {
+		workers = len(frontier)
+	}
+	if workers <= 1 {
+		for i, queued := range frontier {
+			if i%cancelCheckInterval == 0 && ctx.Err() != nil {
+				break
+			}
+			results[i] = ex.expand(queued, visited)
+		}
+		return results
+	}
+
+	next := int64(-1)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(frontier) || (i%cancelCheckInterval == 0 && ctx.Err() != nil) {
+					return
+				}
+				results[i] = ex.expand(frontier[i], visited)
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// choiceTarget returns the name of the knot a choice in knot leads to, or ""
+// for a choice that goes nowhere.
+func choiceTarget(knot *Knot, choice Choice, ast *Script) string {
+	var targetKnotName string
+	if choice.Stitch != "" {
+		// Stitches are local jumps, so the "knot" doesn't change, but we need a new node for the stitch content.
+		// This is a simplification for the POC; a full implementation might handle this differently.
+		// For now, we treat a stitch as a choice leading to a new "knot" with the stitch name.
+		targetKnotName = strings.TrimPrefix(choice.Stitch, ".")
+		if knot.Namespace != "" {
+			if _, ok := ast.Knots[knot.Namespace+"."+targetKnotName]; ok {
+				targetKnotName = knot.Namespace + "." + targetKnotName
+			}
+		}
+	} else {
+		targetKnotName = choice.TargetKnot
+	}
+
+	if targetKnotName == "" && len(choice.StateChanges) > 0 {
+		// A choice that only changes state stays in its knot.
+		targetKnotName = knot.Name
+	}
+	return targetKnotName
+}
+
+// changesScene reports whether following choice from knot from to knot to
+// leaves the current scene, which resets local states. That is the case
+// exactly when the two scene names differ: a choice back into the same knot,
+// or into any knot of the same scene, keeps local states, and moving between
+// an unscened knot and a scened one counts as a change. Stitches are jumps
+// within a knot and never change the scene. Scene-scoped states are swapped
+// on every move between scenes, stitches included, by the caller.
+func changesScene(from *Knot, choice Choice, to *Knot) bool {
+	return choice.Stitch == "" && from.Scene != to.Scene
+}
+
+// expand computes the edges offered by one node, in choice order.
+func (ex *expander) expand(queued queuedNode, visited map[string]string) expanded {
+	var result expanded
+	ast, layout := ex.ast, ex.layout
+	currentNode := queued.node
+	currentKnot := ast.Knots[currentNode.KnotName]
+	if ex.trace {
+		result.trace = skippedChoices(queued.id, currentKnot, currentNode.State, ast)
+	}
+
+	// Conditions are evaluated on the state vector, which the expander
+	// already has, rather than on the node's map.
+	offered := choicesWhere(currentKnot, ast, func(c *compiledCondition) bool { return c.holdsIn(layout, queued.state) })
+	for _, choice := range offered {
+		if ex.trace {
+			for _, reason := range ignoredAssignments(choice, ast, currentKnot.Scene) {
+				result.trace = append(result.trace, fmt.Sprintf("at node %s, choice '%s': %s", queued.id, choice.Text, reason))
+			}
+		}
+		nextState := applyStateChanges(layout, queued.state, choice, ast, currentKnot.Scene)
+		targetKnotName := choiceTarget(currentKnot, choice, ast)
+
+		targetKnot, exists := ast.Knots[targetKnotName]
+		if !exists {
+			if !ex.allowMissing {
+				// Exploration goes on, so that every missing knot is reported.
+				missing := &Error{File: currentKnot.File, Line: choice.Line, Code: CodeMissingKnot, Message: fmt.Sprintf("choice leads to non-existent knot: '%s'", targetKnotName)}
+				result.expansions = append(result.expansions, expansion{choice: choice, missing: missing})
+				continue
+			}
+			// Every choice to the same missing knot shares one stub node. The
+			// key cannot collide with a real knot's, which never starts with
+			// a zero byte.
+			e := expansion{choice: choice, key: "\x00missing\x00" + targetKnotName, nodeID: targetKnotName + "|"}
+			if _, seen := visited[e.key]; !seen {
+				e.node = missingKnotNode(targetKnotName)
+			}
+			result.expansions = append(result.expansions, e)
+			continue
+		}
+
+		if changesScene(currentKnot, choice, targetKnot) {
+			for _, i := range ex.localStates {
+				layout.set(nextState, i, false)
+			}
+		}
+		if currentKnot.Scene != targetKnot.Scene {
+			// Scene-scoped states leave the state vector with their scene,
+			// even on a stitch, since they only exist inside it.
+			for _, i := range ex.sceneStates[currentKnot.Scene] {
+				layout.remove(nextState, i)
+			}
+			for _, i := range ex.sceneStates[targetKnot.Scene] {
+				layout.set(nextState, i, false)
+			}
+		}
+
+		e := expansion{choice: choice, state: nextState}
+		if len(ex.pruned) > 0 {
+			for _, change := range choice.StateChanges {
+				if ex.pruned[strings.TrimSpace(strings.SplitN(change, "=", 2)[0])] {
+					e.untracked = append(e.untracked, change)
+				}
+			}
+			for _, i := range ex.prunedStates {
+				layout.remove(nextState, i)
+			}
+		}
+
+		// Every edge takes a turn, until the counter reaches its bound.
+		for _, i := range ex.turns {
+			if !layout.get(nextState, i) {
+				layout.set(nextState, i, true)
+				break
+			}
+		}
+
+		e.key = nextState.key(targetKnotName)
+		if _, seen := visited[e.key]; !seen {
+			e.node, e.err = createNode(targetKnotName, targetKnot, layout.toMap(nextState))
+			e.nodeID = layout.nodeID(targetKnotName, nextState)
+		}
+		result.expansions = append(result.expansions, e)
+	}
+	return result
+}
+
+// progressReporter calls Options.OnProgress at the configured interval.
+type progressReporter struct {
+	callback  func(ProgressInfo)
+	interval  int
+	period    time.Duration
+	start     time.Time
+	last      time.Time
+	sinceLast int
+	edges     int
+}
+
+// newProgressReporter returns nil when no OnProgress hook is set, so the
+// search pays nothing for progress reporting it does not use.
+func newProgressReporter(opts Options) *progressReporter {
+	if opts.OnProgress == nil {
+		return nil
+	}
+	interval := opts.ProgressInterval
+	if interval <= 0 {
+		interval = 1000
+	}
+	now := time.Now()
+	return &progressReporter{callback: opts.OnProgress, interval: interval, period: opts.ProgressPeriod, start: now, last: now}
+}
+
+// report is called after each expanded node, and once with done at the end.
+// The counts in info are completed with the edge count and elapsed time.
+func (p *progressReporter) report(info ProgressInfo, done bool) {
+	p.sinceLast++
+	if !done && p.sinceLast < p.interval && (p.period <= 0 || time.Since(p.last) < p.period) {
+		return
+	}
+	now := time.Now()
+	p.sinceLast, p.last = 0, now
+	info.EdgesCreated, info.Elapsed, info.Done = p.edges, now.Sub(p.start), done
+	p.callback(info)
+}
+
+// cancelCheckInterval is how many nodes are expanded between checks of the
+// context, so cancellation is prompt without a check on every node.
+const cancelCheckInterval = 256
+
+// canceledError reports a search stopped by its context, with how far it got.
+func canceledError(graph *StoryGraph, expanded int, err error) error {
+	return errorf(CodeCanceled, "graph analysis stopped after expanding %d nodes (%d discovered): %w", expanded, len(graph.Graph), err)
+}
+
+// nodeLimitError describes a graph that outgrew the node limit, naming the
+// knots that contributed the most nodes so the author can find the blowup.
+// With a turn counter, it also names the bound, which multiplies every
+// knot's nodes.
+func nodeLimitError(ast *Script, graph *StoryGraph, maxNodes int) error {
+	counts := make(map[string]int)
+	for _, node := range graph.Graph {
+		counts[node.KnotName]++
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > 5 {
+		names = names[:5]
+	}
+	top := make([]string, len(names))
+	for i, name := range names {
+		top[i] = fmt.Sprintf("%s (%d)", name, counts[name])
+	}
+	err := errorf(CodeNodeLimit, "graph exceeds the limit of %d nodes; knots with the most nodes: %s", maxNodes, strings.Join(top, ", "))
+	if ast.MaxTurns > 0 {
+		err.Message += fmt.Sprintf("; TURNS: max=%d multiplies the nodes of each knot by up to %d", ast.MaxTurns, ast.MaxTurns+1)
+	}
+	return err
+}
+
 // buildGraph performs the reachable state analysis to create the final graph.
-func buildGraph(ast *Script) (*StoryGraph, error) {
-	if _, ok := ast.Knots["index"]; !ok {
-		return nil, fmt.Errorf("script must contain a starting knot named 'index'")
+func buildGraph(ctx context.Context, ast *Script, opts Options) (*StoryGraph, error) {
+	graph, truncated, err := exploreGraph(ctx, ast, opts)
+	if err != nil {
+		return nil, err
 	}
+	return finishGraph(ast, graph, opts, truncated)
+}
 
-	graph := &StoryGraph{
-		Graph: make(map[string]*StoryNode),
+// exploreGraph runs the breadth-first search over reachable states. The
+// returned graph holds only nodes and edges; finishGraph adds everything else.
+// truncated reports whether MaxDepth cut the search short. The search stops
+// with a CodeCanceled error soon after ctx is done.
+func exploreGraph(ctx context.Context, ast *Script, opts Options) (graph *StoryGraph, truncated bool, err error) {
+	startKnot := opts.StartKnot
+	if startKnot == "" {
+		startKnot = "index"
 	}
-	queue := []*StoryNode{}
-	visited := make(map[string]bool)
+	startKnotName, err := resolveKnotName(ast.Knots, "", startKnot)
+	if err != nil {
+		return nil, false, errorf(CodeStartKnot, "cannot determine starting knot: %w", err)
+	}
+	if _, ok := ast.Knots[startKnotName]; !ok {
+		if opts.StartKnot != "" {
+			return nil, false, errorf(CodeStartKnot, "starting knot '%s' does not exist", opts.StartKnot)
+		}
+		return nil, false, errorf(CodeStartKnot, "script must contain a starting knot named 'index'")
+	}
+
+	graph = &StoryGraph{Graph: make(map[string]*StoryNode)}
+	visited := make(map[string]string) // state vector key -> node ID
 
 	// Create the initial state
 	initialState := make(map[string]bool)
-	for state := range ast.GlobalStates {
+	for state := range ast.States {
 		initialState[state] = false
 	}
-	for state := range ast.LocalStates {
+	for state := range ast.SceneStates[ast.Knots[startKnotName].Scene] {
 		initialState[state] = false
 	}
+	overrides := make([]string, 0, len(opts.InitialStates))
+	for state := range opts.InitialStates {
+		overrides = append(overrides, state)
+	}
+	sort.Strings(overrides)
+	for _, state := range overrides {
+		if _, declared := initialState[state]; !declared {
+			return nil, false, errorf(CodeInitialState, "initial state override for undeclared state '%s'", state)
+		}
+		initialState[state] = opts.InitialStates[state]
+	}
 
-	rootNode, err := createNode("index", ast.Knots["index"], initialState)
+	// States that no condition ever reads cannot change which choices or text
+	// a node offers, so they are left out of node identity when pruning.
+	var pruned map[string]bool
+	if opts.PruneUnreadStates {
+		pruned = unreadStates(ast)
+		for state := range pruned {
+			delete(initialState, state)
+		}
+	}
+
+	// Graph construction works on bit vectors; the map form of each state is
+	// only materialized once, when its node is created.
+	layout := ast.layout
+	ex := &expander{ast: ast, layout: layout, sceneStates: make(map[string][]int), pruned: pruned, allowMissing: opts.AllowMissingTargets, trace: opts.Logger != nil}
+	for state, kind := range ast.States {
+		if kind.IsLocal() {
+			ex.localStates = append(ex.localStates, layout.index[state])
+		}
+	}
+	for scene, states := range ast.SceneStates {
+		for state := range states {
+			ex.sceneStates[scene] = append(ex.sceneStates[scene], layout.index[state])
+		}
+	}
+	for state := range pruned {
+		ex.prunedStates = append(ex.prunedStates, layout.index[state])
+	}
+	for _, state := range ast.turnStates() {
+		ex.turns = append(ex.turns, layout.index[state])
+	}
+
+	rootNode, err := createNode(startKnotName, ast.Knots[startKnotName], initialState)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	nodeID := generateNodeID(rootNode.KnotName, rootNode.State)
+	graph.StartNodeID = nodeID
 
+	rootState := layout.fromMap(initialState)
 	graph.Graph[nodeID] = rootNode
-	queue = append(queue, rootNode)
-	visited[nodeID] = true
+	visited[rootState.key(startKnotName)] = nodeID
+	if opts.Logger != nil {
+		opts.Logger.Debugf("node %s created (start)", nodeID)
+	}
 
-	for len(queue) > 0 {
-		currentNode := queue[0]
-		queue = queue[1:]
+	maxNodes := opts.MaxNodes
+	if maxNodes == 0 {
+		maxNodes = DefaultMaxNodes
+	}
+	workers := opts.Concurrency
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	// The graph is explored one depth level at a time. Expanding a level only
+	// reads shared state, so it can be spread over workers; the results are
+	// then merged in frontier order, which is exactly the order a single FIFO
+	// queue would visit them in, so node IDs, edge order and errors do not
+	// depend on Concurrency.
+	frontier := []queuedNode{{id: nodeID, node: rootNode, state: rootState}}
+	var missing []*Error // every divert to a missing knot, reported together
+	reported := make(map[string]bool)
+	expanded := 0 // nodes whose choices have been followed, for cancellation reports
+	progress := newProgressReporter(opts)
+	for depth := 0; len(frontier) > 0; depth++ {
+		if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+			for _, queued := range frontier {
+				if len(ast.Knots[queued.node.KnotName].Choices) > 0 {
+					truncated = true
+				}
+			}
+			break
+		}
 
-		currentKnot := ast.Knots[currentNode.KnotName]
+		results := ex.expandAll(ctx, frontier, visited, workers)
+		if err := ctx.Err(); err != nil {
+			return nil, false, canceledError(graph, expanded, err)
+		}
+		var next []queuedNode
+		for i, queued := range frontier {
+			if expanded++; expanded%cancelCheckInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					return nil, false, canceledError(graph, expanded, err)
+				}
+			}
+			for _, event := range results[i].trace {
+				opts.Logger.Debugf("%s", event)
+			}
+			for _, e := range results[i].expansions {
+				if e.missing != nil {
+					if !reported[e.missing.Error()] {
+						reported[e.missing.Error()] = true
+						missing = append(missing, e.missing)
+					}
+					continue
+				}
+				nextNodeID, seen := visited[e.key]
+				if !seen {
+					if maxNodes > 0 && len(graph.Graph) >= maxNodes {
+						return nil, false, nodeLimitError(ast, graph, maxNodes)
+					}
+					if e.err != nil {
+						return nil, false, e.err
+					}
+					nextNodeID = e.nodeID
+					visited[e.key] = nextNodeID
+					e.node.parent = &IncomingEdge{SourceNodeID: queued.id, Text: e.choice.Text}
+					graph.Graph[nextNodeID] = e.node
+					if !e.node.Missing {
+						next = append(next, queuedNode{id: nextNodeID, node: e.node, state: e.state})
+					}
+					if opts.Logger != nil {
+						opts.Logger.Debugf("node %s created", nextNodeID)
+					}
+				} else if opts.Logger != nil {
+					opts.Logger.Debugf("node %s already visited", nextNodeID)
+				}
 
-		for _, choice := range currentKnot.Choices {
-			if choice.Condition != "" && !evaluateCondition(choice.Condition, currentNode.State) {
-				continue
+				edge := &StoryEdge{Text: e.choice.Text, TargetNodeID: nextNodeID, Stitch: e.choice.Stitch, UntrackedStateChanges: e.untracked}
+				if opts.IncludeSourceLogic {
+					edge.Condition = e.choice.writtenCondition
+					edge.StateChanges = append([]string(nil), e.choice.writtenStateChanges...)
+				}
+				queued.node.Edges = append(queued.node.Edges, edge)
+				if opts.Logger != nil {
+					opts.Logger.Debugf("edge added %s -> %s ('%s')", queued.id, nextNodeID, e.choice.Text)
+				}
+			}
+			if progress != nil {
+				progress.edges += len(results[i].expansions)
+				progress.report(ProgressInfo{NodesCreated: len(graph.Graph), NodesExpanded: expanded, QueueLen: len(frontier) - i - 1 + len(next), Depth: depth, CurrentKnot: queued.node.KnotName}, false)
 			}
+		}
+		frontier = next
+	}
+	if progress != nil {
+		progress.report(ProgressInfo{NodesCreated: len(graph.Graph), NodesExpanded: expanded}, true)
+	}
+	if len(missing) > 0 {
+		sort.SliceStable(missing, func(i, j int) bool {
+			if missing[i].File != missing[j].File {
+				return missing[i].File < missing[j].File
+			}
+			return missing[i].Line < missing[j].Line
+		})
+		if len(missing) > maxErrors {
+			missing = append(missing[:maxErrors], &Error{Code: CodeTooManyErrors, Message: fmt.Sprintf("too many errors; stopped after %d", maxErrors)})
+		}
+		return nil, false, errorList(missing)
+	}
+	return graph, truncated, nil
+}
 
-			nextState := applyStateChanges(currentNode.State, choice, ast)
+// finishGraph completes an explored graph: optional ID compaction and
+// incoming edges, endings, and the dead-end and unreachable-knot checks.
+func finishGraph(ast *Script, graph *StoryGraph, opts Options, truncated bool) (*StoryGraph, error) {
+	graph.Metadata = typedMetadata(ast.Metadata)
+	graph.warnings = append([]Diagnostic(nil), ast.Warnings...)
+	graph.script = ast
+	graph.dedupContent, graph.omitStates = opts.DedupContent, opts.OmitStates
 
-			var targetKnotName string
-			if choice.Stitch != "" {
-				// Stitches are local jumps, so the "knot" doesn't change, but we need a new node for the stitch content.
-				// This is a simplification for the POC; a full implementation might handle this differently.
-				// For now, we treat a stitch as a choice leading to a new "knot" with the stitch name.
-				targetKnotName = strings.TrimPrefix(choice.Stitch, ".")
-			} else {
-				targetKnotName = choice.TargetKnot
+	if opts.AllowMissingTargets {
+		graph.warnings = append(graph.warnings, missingTargetWarnings(ast)...)
+	}
+	if opts.MergeEquivalentNodes {
+		mergeEquivalentNodes(graph)
+	}
+	if opts.IncludeSourceLogic {
+		addStateDeltas(graph)
+	}
+	if !opts.OmitSource {
+		attachSources(ast, graph)
+	}
+	if opts.CompactIDs {
+		compactNodeIDs(graph)
+	}
+	if opts.IncludeSourceMap {
+		graph.SourceMap = buildSourceMap(ast, graph)
+	}
+	if opts.IncomingEdges {
+		indexIncomingEdges(graph)
+	}
+	if opts.ParentPointers {
+		for _, node := range graph.Graph {
+			node.Parent = node.parent
+		}
+	}
+
+	endings, warnings := collectEndings(ast, graph)
+	graph.Endings = endings
+	graph.warnings = append(graph.warnings, warnings...)
+
+	if truncated {
+		// Nodes cut off at the depth limit look like dead ends and leave knots
+		// unvisited, so those reports would be misleading.
+		graph.warnings = append(graph.warnings, warningAt(position{}, CodeTruncated, "graph truncated at MaxDepth %d; dead-end and unreachable-knot checks were skipped", opts.MaxDepth))
+		return graph, nil
+	}
+
+	if deadEnds := findDeadEnds(graph); len(deadEnds) > 0 {
+		counts := make(map[string]int)
+		var names []string
+		for _, deadEnd := range deadEnds {
+			if counts[deadEnd.KnotName] == 0 {
+				names = append(names, deadEnd.KnotName)
+			}
+			counts[deadEnd.KnotName]++
+		}
+		sort.Strings(names)
+		if opts.DeadEndsAsErrors {
+			return nil, errorf(CodeDeadEnd, "dead-end knots: %s", strings.Join(names, ", "))
+		}
+		for _, name := range names {
+			knot := ast.Knots[name]
+			graph.warnings = append(graph.warnings, warningAt(position{knot.File, knot.Line}, CodeDeadEnd, "knot '%s' is a dead end in %d reachable state(s): no choices are available and it is not marked END", name, counts[name]))
+		}
+		for _, deadEnd := range deadEnds {
+			for _, hidden := range deadEnd.HiddenChoices {
+				graph.warnings = append(graph.warnings, warningAt(position{}, CodeHiddenChoice, "at %s, choice '%s' was hidden by {%s}", deadEnd.NodeID, hidden.Text, hidden.Condition))
 			}
+		}
+	}
 
-			if targetKnotName == "" {
-				if len(choice.StateChanges) > 0 {
-					targetKnotName = currentNode.KnotName
-				} else {
-					continue
-				}
+	_, entries := findTraps(graph)
+	for _, entry := range entries {
+		// Dead ends and missing-knot stubs are reported on their own.
+		if target := graph.Graph[entry.TargetNodeID]; target != nil && len(target.Edges) > 0 {
+			graph.warnings = append(graph.warnings, warningAt(position{}, CodeTrap, "at %s, choice '%s' leads to %s, from which no ending can be reached", entry.SourceNodeID, entry.Choice, entry.TargetNodeID))
+		}
+	}
+
+	unreachable := unreachableKnots(ast, graph)
+	var endingNames []string
+	for _, knot := range unreachable {
+		if knot.IsEnd {
+			endingNames = append(endingNames, knot.Name)
+		}
+	}
+	if len(endingNames) > 0 && opts.UnreachableEndingsAsErrors {
+		return nil, errorf(CodeUnreachable, "unreachable endings: %s", strings.Join(endingNames, ", "))
+	}
+	if len(unreachable) > 0 {
+		if opts.UnreachableKnotsAsErrors {
+			names := make([]string, len(unreachable))
+			for i, knot := range unreachable {
+				names[i] = knot.Name
 			}
-			
-			targetKnot, exists := ast.Knots[targetKnotName]
-			if !exists {
-				return nil, fmt.Errorf("choice leads to non-existent knot: '%s'", targetKnotName)
+			return nil, errorf(CodeUnreachable, "unreachable knots: %s", strings.Join(names, ", "))
+		}
+		for _, knot := range unreachable {
+			if knot.IsEnd {
+				graph.warnings = append(graph.warnings, unreachableEndingWarning(ast, knot))
+				continue
 			}
-			
-			if currentKnot.Scene != targetKnot.Scene {
-				for state := range ast.LocalStates {
-					nextState[state] = false
-				}
+			graph.warnings = append(graph.warnings, warningAt(position{knot.File, knot.Line}, CodeUnreachable, "knot '%s' is unreachable", knot.Name))
+		}
+	}
+	return graph, nil
+}
+
+// unreachableEndingWarning reports an END knot that no reachable path arrives
+// at, naming the choices that target it so the blocking guard can be found.
+func unreachableEndingWarning(ast *Script, ending *Knot) Diagnostic {
+	var choices []string
+	for _, name := range sortedKnotNames(ast.Knots) {
+		knot := ast.Knots[name]
+		for _, choice := range knot.Choices {
+			if choiceTarget(knot, choice, ast) != ending.Name {
+				continue
+			}
+			desc := fmt.Sprintf("'%s' in '%s'", choice.Text, knot.Name)
+			if choice.Condition != "" {
+				desc += fmt.Sprintf(" {%s}", choice.Condition)
 			}
+			choices = append(choices, desc)
+		}
+	}
+	at := position{ending.File, ending.Line}
+	if len(choices) == 0 {
+		return warningAt(at, CodeUnreachable, "ending knot '%s' is unreachable; no choice leads to it", ending.Name)
+	}
+	return warningAt(at, CodeUnreachable, "ending knot '%s' is unreachable; choices leading to it: %s", ending.Name, strings.Join(choices, ", "))
+}
+
+// unreachableKnots returns, in name order, the knots that produced no node in the graph.
+func unreachableKnots(ast *Script, graph *StoryGraph) []*Knot {
+	reached := make(map[string]bool)
+	for _, node := range graph.Graph {
+		reached[node.KnotName] = true
+	}
+	var unreachable []*Knot
+	for _, name := range sortedKnotNames(ast.Knots) {
+		if !reached[name] {
+			unreachable = append(unreachable, ast.Knots[name])
+		}
+	}
+	return unreachable
+}
+
+// collectEndings lists the reachable END nodes in node ID order and reports
+// undeclared or unreachable labels against the ENDINGS header.
+func collectEndings(ast *Script, graph *StoryGraph) ([]*Ending, []Diagnostic) {
+	var warnings []Diagnostic
+	nodesByEnding := make(map[string][]string)
+	for nodeID, node := range graph.Graph {
+		if node.IsEnd && node.EndingName != "" {
+			nodesByEnding[node.EndingName] = append(nodesByEnding[node.EndingName], nodeID)
+		}
+	}
 
-			nextNode, err := createNode(targetKnotName, targetKnot, nextState)
-			if err != nil {
-				return nil, err
+	declared := make(map[string]bool)
+	for _, name := range ast.Endings {
+		declared[name] = true
+	}
+
+	if len(declared) > 0 {
+		for _, name := range sortedKnotNames(ast.Knots) {
+			knot := ast.Knots[name]
+			if knot.EndingName != "" && !declared[knot.EndingName] {
+				warnings = append(warnings, warningAt(position{knot.File, knot.Line}, CodeUndeclaredEnding, "ending '%s' in knot '%s' is not declared in the ENDINGS header", knot.EndingName, name))
 			}
-			nextNodeID := generateNodeID(nextNode.KnotName, nextNode.State)
-			
-			edge := &StoryEdge{Text: choice.Text, TargetNodeID: nextNodeID, Stitch: choice.Stitch}
-			currentNode.Edges = append(currentNode.Edges, edge)
-			
-			if !visited[nextNodeID] {
-				visited[nextNodeID] = true
-				graph.Graph[nextNodeID] = nextNode
-				queue = append(queue, nextNode)
+		}
+		for _, name := range ast.Endings {
+			if _, reached := nodesByEnding[name]; !reached {
+				warnings = append(warnings, warningAt(position{}, CodeUnreachable, "declared ending '%s' is never reached", name))
 			}
 		}
 	}
-	return graph, nil
+
+	endings := make([]*Ending, 0)
+	for _, nodeID := range sortedNodeIDs(graph) {
+		node := graph.Graph[nodeID]
+		if node.IsEnd {
+			endings = append(endings, &Ending{NodeID: nodeID, KnotName: node.KnotName, Name: node.EndingName, Scene: node.Scene, State: node.State})
+		}
+	}
+	return endings, warnings
 }
 
-// createNode generates a StoryNode for a given knot and state.
-func createNode(knotName string, knot *Knot, state map[string]bool) (*StoryNode, error) {
-	node := &StoryNode{
+// sortedKnotNames returns the knot names in lexical order, for deterministic reporting.
+func sortedKnotNames(knots map[string]*Knot) []string {
+	names := make([]string, 0, len(knots))
+	for name := range knots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// missingKnotNode is the stub that stands in for a knot that does not exist
+// under Options.AllowMissingTargets.
+func missingKnotNode(knotName string) *StoryNode {
+	return &StoryNode{
 		KnotName: knotName,
-		Scene:    knot.Scene,
-		State:    state,
-		IsEnd:    knot.IsEnd,
+		State:    map[string]bool{},
+		Content:  fmt.Sprintf("[missing knot: %s]", knotName),
 		Edges:    []*StoryEdge{},
+		Missing:  true,
 	}
-	for _, block := range knot.Body {
-		if block.Condition == "" || evaluateCondition(block.Condition, state) {
-			node.Content = block.Content
-			break
+}
+
+// missingTargetWarnings lists every choice target that names no knot, once
+// per target, with the location of every choice that refers to it.
+func missingTargetWarnings(ast *Script) []Diagnostic {
+	refs := make(map[string][]string)
+	var targets []string
+	for _, name := range sortedKnotNames(ast.Knots) {
+		knot := ast.Knots[name]
+		for _, choice := range knot.Choices {
+			target := choiceTarget(knot, choice, ast)
+			if target == "" {
+				continue
+			}
+			if _, ok := ast.Knots[target]; ok {
+				continue
+			}
+			if _, ok := refs[target]; !ok {
+				targets = append(targets, target)
+			}
+			refs[target] = append(refs[target], fmt.Sprintf("%s ('%s' in '%s')", location(knot.File, choice.Line), choice.Text, name))
 		}
 	}
+	sort.Strings(targets)
+	warnings := make([]Diagnostic, len(targets))
+	for i, target := range targets {
+		warnings[i] = warningAt(position{}, CodeMissingKnot, "missing knot '%s' replaced by a stub; referenced at %s", target, strings.Join(refs[target], ", "))
+	}
+	return warnings
+}
+
+// createNode generates a StoryNode for a given knot and state.
+func createNode(knotName string, knot *Knot, state map[string]bool) (*StoryNode, error) {
+	node := &StoryNode{
+		KnotName:   knotName,
+		Scene:      knot.Scene,
+		State:      state,
+		IsEnd:      knot.IsEnd,
+		EndingName: knot.EndingName,
+		Tags:       knot.Tags,
+		Directives: knot.Directives,
+		Assets:     knotAssets(knot, state),
+		Edges:      []*StoryEdge{},
+		Content:    knotContent(knot, state),
+	}
+	node.WordCount = countWords(node.Content)
 	return node, nil
 }
 
-// generateNodeID creates a unique, deterministic ID for a node.
+// knotContent returns the first text block of knot whose condition holds in state.
+func knotContent(knot *Knot, state map[string]bool) string {
+	if block := selectBlock(knot, state); block != nil {
+		return block.Content
+	}
+	return ""
+}
+
+// countWords counts the words in text, splitting on Unicode whitespace.
+func countWords(text string) int {
+	return len(strings.Fields(text))
+}
+
+// selectBlock returns the text block of knot shown in state, or nil if none is.
+func selectBlock(knot *Knot, state map[string]bool) *TextBlock {
+	for i := range knot.Body {
+		if block := &knot.Body[i]; block.Condition == "" || block.condition().holds(state) {
+			return block
+		}
+	}
+	return nil
+}
+
+// offeredChoices returns the choices of knot that become edges in state:
+// those whose condition holds and that lead somewhere. Edges are created in
+// this order.
+func offeredChoices(knot *Knot, state map[string]bool, ast *Script) []Choice {
+	return choicesWhere(knot, ast, func(c *compiledCondition) bool { return c.holds(state) })
+}
+
+// choicesWhere returns the choices of knot that lead somewhere and have no
+// condition or one for which holds is true, in order.
+func choicesWhere(knot *Knot, ast *Script, holds func(*compiledCondition) bool) []Choice {
+	var offered []Choice
+	for _, choice := range knot.Choices {
+		if choice.Condition != "" && !holds(choice.condition()) {
+			continue
+		}
+		if choiceTarget(knot, choice, ast) == "" {
+			continue
+		}
+		offered = append(offered, choice)
+	}
+	return offered
+}
+
+// skippedChoices explains, for tracing, each choice of knot that a node in
+// state does not offer.
+func skippedChoices(nodeID string, knot *Knot, state map[string]bool, ast *Script) []string {
+	var skipped []string
+	for _, choice := range knot.Choices {
+		switch {
+		case choice.Condition != "" && !choice.condition().holds(state):
+			skipped = append(skipped, fmt.Sprintf("at node %s, choice '%s' skipped (condition %s failed)", nodeID, choice.Text, choice.Condition))
+		case choiceTarget(knot, choice, ast) == "":
+			skipped = append(skipped, fmt.Sprintf("at node %s, choice '%s' skipped (it leads nowhere)", nodeID, choice.Text))
+		}
+	}
+	return skipped
+}
+
+// ignoredAssignments explains, for tracing, each state change of choice that
+// applyStateChanges ignores in scene.
+func ignoredAssignments(choice Choice, ast *Script, scene string) []string {
+	var ignored []string
+	for _, change := range choice.StateChanges {
+		stateName, value := splitStateChange(change)
+		kind, declared := ast.stateKind(scene, stateName)
+		switch {
+		case !declared && sceneDeclaring(ast, stateName) != "":
+			ignored = append(ignored, fmt.Sprintf("'%s' ignored ('%s' is scoped to scene '%s')", change, stateName, sceneDeclaring(ast, stateName)))
+		case kind.IsFlag() && value != "true":
+			ignored = append(ignored, fmt.Sprintf("'%s' ignored ('%s' is declared in %s and can only become true)", change, stateName, kind))
+		}
+	}
+	return ignored
+}
+
+// addStateDeltas fills in the StateDelta of every edge, once nodes have
+// been merged, so the delta is that of the node the edge really leads to.
+// States that leave the state with their scene are not listed, and edges
+// into a missing-knot stub have no delta.
+func addStateDeltas(graph *StoryGraph) {
+	for _, node := range graph.Graph {
+		for _, edge := range node.Edges {
+			target := graph.Graph[edge.TargetNodeID]
+			if target == nil || target.Missing {
+				continue
+			}
+			for state, value := range target.State {
+				if previous, ok := node.State[state]; ok && previous == value {
+					continue
+				}
+				if edge.StateDelta == nil {
+					edge.StateDelta = make(map[string]bool)
+				}
+				edge.StateDelta[state] = value
+			}
+		}
+	}
+}
+
+// attachSources records where each node and edge comes from in the script:
+// the knot declaration and the text block that supplied the node's content,
+// and the line of the choice behind each edge.
+func attachSources(ast *Script, graph *StoryGraph) {
+	for _, node := range graph.Graph {
+		source := nodeSource(ast, node)
+		if source == nil {
+			continue
+		}
+		node.Src = &SourcePos{File: source.File, Line: source.KnotLine, ContentLine: source.ContentBlockLine}
+		for i, edge := range source.Edges {
+			node.Edges[i].Src = &SourcePos{File: source.File, Line: edge.ChoiceLine}
+		}
+	}
+}
+
+// buildSourceMap maps the ID of every node that comes from a knot to its
+// source; stubs for missing knots have no entry.
+func buildSourceMap(ast *Script, graph *StoryGraph) map[string]*NodeSource {
+	sourceMap := make(map[string]*NodeSource, len(graph.Graph))
+	for id, node := range graph.Graph {
+		if source := nodeSource(ast, node); source != nil {
+			sourceMap[id] = source
+		}
+	}
+	return sourceMap
+}
+
+// nodeSource locates a node's knot, content block and choices, or returns
+// nil for a node without a knot.
+func nodeSource(ast *Script, node *StoryNode) *NodeSource {
+	knot, ok := ast.Knots[node.KnotName]
+	if !ok {
+		return nil
+	}
+	source := &NodeSource{File: knot.File, KnotLine: knot.Line, Edges: []*EdgeSource{}}
+	if block := selectBlock(knot, node.State); block != nil {
+		source.ContentBlockLine = block.Line
+	}
+	for i, choice := range offeredChoices(knot, node.State, ast) {
+		if i < len(node.Edges) {
+			source.Edges = append(source.Edges, &EdgeSource{ChoiceLine: choice.Line})
+		}
+	}
+	return source
+}
+
+// generateNodeID creates a unique, deterministic ID for a node: the knot
+// name, a '|', and the states in name order as "name=value", separated by
+// commas. Graph construction builds the same IDs from state vectors with
+// stateLayout.nodeID.
 func generateNodeID(knotName string, state map[string]bool) string {
 	keys := make([]string, 0, len(state))
+	size := len(knotName) + 1
 	for k := range state {
 		keys = append(keys, k)
+		size += len(k) + len("=false,")
 	}
 	sort.Strings(keys)
 
-	var stateParts []string
-	for _, k := range keys {
-		stateParts = append(stateParts, fmt.Sprintf("%s=%t", k, state[k]))
+	var b strings.Builder
+	b.Grow(size)
+	b.WriteString(knotName)
+	b.WriteByte('|')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		if state[k] {
+			b.WriteString("=true")
+		} else {
+			b.WriteString("=false")
+		}
 	}
-	
-	return fmt.Sprintf("%s|%s", knotName, strings.Join(stateParts, ","))
+	return b.String()
 }
 
-// evaluateCondition checks if a condition string is true for a given state.
-func evaluateCondition(condition string, state map[string]bool) bool {
-	parts := strings.Split(condition, "&&")
-	for _, part := range parts {
-		part = strings.TrimSpace(part)
-		
-		var op, stateName, valueStr string
-		if strings.Contains(part, "!=") {
-			op = "!="
-			vals := strings.Split(part, "!=")
-			stateName, valueStr = strings.TrimSpace(vals[0]), strings.TrimSpace(vals[1])
-		} else if strings.Contains(part, "==") {
-			op = "=="
-			vals := strings.Split(part, "==")
-			stateName, valueStr = strings.TrimSpace(vals[0]), strings.TrimSpace(vals[1])
-		} else {
-			return false
+// compactNodeIDs replaces every verbose node ID with the knot name plus an
+// 8-byte hash of the canonical state string. IDs are assigned in sorted order of
+// the verbose IDs, so the rare hash collision is resolved deterministically by
+// adding a numeric suffix.
+func compactNodeIDs(graph *StoryGraph) {
+	verbose := make([]string, 0, len(graph.Graph))
+	for nodeID := range graph.Graph {
+		verbose = append(verbose, nodeID)
+	}
+	sort.Strings(verbose)
+
+	compact := make(map[string]string, len(verbose))
+	taken := make(map[string]bool, len(verbose))
+	for _, nodeID := range verbose {
+		node := graph.Graph[nodeID]
+		sum := sha256.Sum256([]byte(strings.TrimPrefix(nodeID, node.KnotName+"|")))
+		id := fmt.Sprintf("%s#%x", node.KnotName, sum[:8])
+		for n := 2; taken[id]; n++ {
+			id = fmt.Sprintf("%s#%x-%d", node.KnotName, sum[:8], n)
 		}
+		taken[id] = true
+		compact[nodeID] = id
+	}
 
-		expectedValue := valueStr == "true"
-		actualValue := state[stateName]
+	nodes := make(map[string]*StoryNode, len(graph.Graph))
+	for nodeID, node := range graph.Graph {
+		for _, edge := range node.Edges {
+			edge.TargetNodeID = compact[edge.TargetNodeID]
+		}
+		if node.parent != nil {
+			node.parent = &IncomingEdge{SourceNodeID: compact[node.parent.SourceNodeID], Text: node.parent.Text}
+		}
+		nodes[compact[nodeID]] = node
+	}
+	graph.Graph = nodes
+	graph.StartNodeID = compact[graph.StartNodeID]
+}
 
-		var result bool
-		if op == "==" {
-			result = actualValue == expectedValue
-		} else {
-			result = actualValue != expectedValue
+// indexIncomingEdges records on every node the edges that lead to it. Sources
+// are visited in node ID order and edges in choice order, so the lists are
+// deterministic.
+func indexIncomingEdges(graph *StoryGraph) {
+	nodeIDs := make([]string, 0, len(graph.Graph))
+	for nodeID := range graph.Graph {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	for _, nodeID := range nodeIDs {
+		for _, edge := range graph.Graph[nodeID].Edges {
+			if target, ok := graph.Graph[edge.TargetNodeID]; ok {
+				target.IncomingEdges = append(target.IncomingEdges, &IncomingEdge{SourceNodeID: nodeID, Text: edge.Text})
+			}
 		}
-		if !result {
-			return false
+	}
+}
+
+// unreadStates returns the declared states that are never referenced by a
+// choice, text block or asset condition.
+func unreadStates(ast *Script) map[string]bool {
+	read := make(map[string]bool)
+	for _, knot := range ast.Knots {
+		for _, block := range knot.Body {
+			for _, state := range conditionStates(block.Condition) {
+				read[state] = true
+			}
+		}
+		for _, choice := range knot.Choices {
+			for _, state := range conditionStates(choice.Condition) {
+				read[state] = true
+			}
 		}
+		for _, asset := range knot.Assets {
+			for _, state := range conditionStates(asset.Condition) {
+				read[state] = true
+			}
+		}
+	}
+
+	// The turn counter reads its own states when it counts.
+	for _, state := range ast.turnStates() {
+		read[state] = true
 	}
-	return true
+
+	unread := make(map[string]bool)
+	for state := range ast.States {
+		if !read[state] {
+			unread[state] = true
+		}
+	}
+	for _, states := range ast.SceneStates {
+		for state := range states {
+			if !read[state] {
+				unread[state] = true
+			}
+		}
+	}
+	return unread
 }
 
-// applyStateChanges calculates the next state based on a choice.
-func applyStateChanges(currentState map[string]bool, choice Choice, ast *Script) map[string]bool {
-	nextState := make(map[string]bool)
-	for k, v := range currentState {
-		nextState[k] = v
+// conditionStates returns the state names referenced by a condition.
+// External names, with the "ext:" prefix, are not states and are left out.
+func conditionStates(condition string) []string {
+	if condition == "" {
+		return nil
+	}
+	var states []string
+	for _, part := range strings.Split(condition, "&&") {
+		if i := strings.IndexAny(part, "!="); i != -1 {
+			if name := strings.TrimSpace(part[:i]); !strings.HasPrefix(name, externalPrefix) {
+				states = append(states, name)
+			}
+		}
 	}
+	return states
+}
+
+// evaluateCondition checks if a condition string is true for a given state.
+// Graph construction uses the conditions compiled by compileConditions
+// instead of parsing them again on every node.
+func evaluateCondition(condition string, state map[string]bool) bool {
+	return compileCondition(condition, nil).holds(state)
+}
+
+// applyStateChanges calculates the next state based on a choice made in scene.
+// Assignments to states scoped to a different scene are ignored.
+func applyStateChanges(layout *stateLayout, currentState stateVector, choice Choice, ast *Script, scene string) stateVector {
+	nextState := currentState.clone()
 
 	for _, change := range choice.StateChanges {
 		parts := strings.Split(change, "=")
 		stateName := strings.TrimSpace(parts[0])
 		newValue := strings.TrimSpace(parts[1]) == "true"
 
-		if isFlag, ok := ast.GlobalStates[stateName]; ok && isFlag && !newValue {
+		kind, declared := ast.stateKind(scene, stateName)
+		if !declared && sceneDeclaring(ast, stateName) != "" {
+			continue
+		}
+		if kind.IsFlag() && !newValue {
 			continue
 		}
 
-		nextState[stateName] = newValue
+		layout.set(nextState, layout.index[stateName], newValue)
 	}
 	return nextState
 }
-
@@ -0,0 +1,139 @@
+package bigif
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// graphMLNamespace is the XML namespace of GraphML documents.
+const graphMLNamespace = "http://graphml.graphdrawing.org/xmlns"
+
+type graphMLDocument struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID      string `xml:"id,attr"`
+	For     string `xml:"for,attr"`
+	Name    string `xml:"attr.name,attr"`
+	Type    string `xml:"attr.type,attr"`
+	Default string `xml:"default,omitempty"`
+}
+
+type graphMLGraph struct {
+	ID          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	ID     string        `xml:"id,attr"`
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// ExportGraphML renders a graph as GraphML for tools such as Gephi and yEd.
+// Node IDs contain characters GraphML does not allow in identifiers, so
+// nodes are numbered n0, n1, ... in node ID order and carry the original ID
+// in the nodeId attribute. Nodes also carry knotName, scene, isEnd,
+// wordCount and content, plus one boolean attribute per state found in the
+// graph, named "state.<name>" and false by default. Edges carry the choice
+// text.
+func ExportGraphML(graph *StoryGraph) ([]byte, error) {
+	if graph == nil {
+		return nil, fmt.Errorf("exporting GraphML: graph is nil")
+	}
+	ids := make([]string, 0, len(graph.Graph))
+	stateSet := make(map[string]bool)
+	for id, node := range graph.Graph {
+		ids = append(ids, id)
+		for state := range node.State {
+			stateSet[state] = true
+		}
+	}
+	sort.Strings(ids)
+	states := make([]string, 0, len(stateSet))
+	for state := range stateSet {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+
+	doc := graphMLDocument{
+		XMLNS: graphMLNamespace,
+		Keys: []graphMLKey{
+			{ID: "nodeId", For: "node", Name: "nodeId", Type: "string"},
+			{ID: "knotName", For: "node", Name: "knotName", Type: "string"},
+			{ID: "scene", For: "node", Name: "scene", Type: "string"},
+			{ID: "isEnd", For: "node", Name: "isEnd", Type: "boolean", Default: "false"},
+			{ID: "wordCount", For: "node", Name: "wordCount", Type: "int", Default: "0"},
+			{ID: "content", For: "node", Name: "content", Type: "string"},
+		},
+		Graph: graphMLGraph{ID: "story", EdgeDefault: "directed"},
+	}
+	stateKeys := make(map[string]string, len(states))
+	for i, state := range states {
+		key := fmt.Sprintf("s%d", i)
+		stateKeys[state] = key
+		doc.Keys = append(doc.Keys, graphMLKey{ID: key, For: "node", Name: "state." + state, Type: "boolean", Default: "false"})
+	}
+	doc.Keys = append(doc.Keys, graphMLKey{ID: "text", For: "edge", Name: "text", Type: "string"})
+
+	numbers := make(map[string]string, len(ids))
+	for i, id := range ids {
+		numbers[id] = "n" + strconv.Itoa(i)
+	}
+	for _, id := range ids {
+		node := graph.Graph[id]
+		data := []graphMLData{
+			{Key: "nodeId", Value: id},
+			{Key: "knotName", Value: node.KnotName},
+			{Key: "scene", Value: node.Scene},
+			{Key: "isEnd", Value: strconv.FormatBool(node.IsEnd)},
+			{Key: "wordCount", Value: strconv.Itoa(node.WordCount)},
+			{Key: "content", Value: node.Content},
+		}
+		for _, state := range states {
+			if value, ok := node.State[state]; ok {
+				data = append(data, graphMLData{Key: stateKeys[state], Value: strconv.FormatBool(value)})
+			}
+		}
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{ID: numbers[id], Data: data})
+	}
+	for _, id := range ids {
+		for _, edge := range graph.Graph[id].Edges {
+			target, ok := numbers[edge.TargetNodeID]
+			if !ok {
+				return nil, fmt.Errorf("exporting GraphML: edge from '%s' leads to unknown node '%s'", id, edge.TargetNodeID)
+			}
+			doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{
+				ID:     "e" + strconv.Itoa(len(doc.Graph.Edges)),
+				Source: numbers[id],
+				Target: target,
+				Data:   []graphMLData{{Key: "text", Value: edge.Text}},
+			})
+		}
+	}
+
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("exporting GraphML: %w", err)
+	}
+	return append([]byte(xml.Header), append(out, '\n')...), nil
+}
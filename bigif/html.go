@@ -0,0 +1,77 @@
+package bigif
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"strings"
+)
+
+//go:embed player.html
+var playerTemplateSource string
+
+var playerTemplate = template.Must(template.New("player").Parse(playerTemplateSource))
+
+// HTMLOptions controls ExportHTML. The zero value gives a player titled
+// after the story, with the default style and no debug panel.
+type HTMLOptions struct {
+	// Title is the page title. Empty means the story's title, or
+	// "Untitled Story" if it has none.
+	Title string
+
+	// CSS is added after the default stylesheet, so its rules override it.
+	CSS string
+
+	// Debug adds a panel below the choices showing the current node ID and
+	// the states that are true.
+	Debug bool
+}
+
+// ExportHTML renders a graph as a single self-contained HTML page that plays
+// the story in a browser, for sharing with readers who do not have bigif.
+// The page embeds the graph as the JSON document in a
+// <script type="application/json" id="story"> element, and a small script
+// shows each node's content with one button per choice, and a restart
+// button at an END node or dead end.
+func ExportHTML(graph *StoryGraph, opts HTMLOptions) ([]byte, error) {
+	if graph == nil {
+		return nil, fmt.Errorf("exporting HTML: graph is nil")
+	}
+	if _, ok := graph.Graph[graph.StartNodeID]; !ok {
+		return nil, fmt.Errorf("exporting HTML: start node '%s' does not exist", graph.StartNodeID)
+	}
+	// json.Marshal escapes <, > and &, so the document cannot end the
+	// script element early.
+	story, err := json.Marshal(newGraphDocument(graph, graphMetadata(graph)))
+	if err != nil {
+		return nil, fmt.Errorf("exporting HTML: %w", err)
+	}
+	title := opts.Title
+	if title == "" {
+		title = graph.info.title
+	}
+	if title == "" {
+		title = "Untitled Story"
+	}
+
+	var b bytes.Buffer
+	err = playerTemplate.Execute(&b, struct {
+		Title, Language, Generator string
+		CSS                        template.CSS
+		Debug                      bool
+		Story                      template.JS
+	}{
+		Title:     title,
+		Language:  graph.info.language,
+		Generator: generator(),
+		CSS:       template.CSS(strings.ReplaceAll(opts.CSS, "</", `<\/`)),
+		Debug:     opts.Debug,
+		Story:     template.JS(story),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("exporting HTML: %w", err)
+	}
+	return b.Bytes(), nil
+}
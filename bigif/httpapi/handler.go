@@ -0,0 +1,188 @@
+// Package httpapi serves the BigIF compiler over HTTP, for web-based story
+// editors.
+//
+// The handler answers one route:
+//
+//	POST /compile[?format=json|compact-json|binary]
+//
+// The script is the request body, sent as text/plain, or the "script" field
+// of a multipart/form-data body, as a file or a plain value. A script that
+// compiles is answered with 200 and the encoded graph; one that does not is
+// answered with 422 and a JSON array of bigif.Diagnostic, one per error.
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/verkaro/bigif/bigif"
+)
+
+// DefaultMaxBytes is the request size limit of a Handler whose MaxBytes is
+// zero.
+const DefaultMaxBytes = 1 << 20
+
+// Handler is an http.Handler that compiles scripts. The zero value is ready
+// to use. Unlike bigif.Compiler, a Handler keeps no state between requests,
+// so it is safe for concurrent use.
+type Handler struct {
+	// Options apply to every compile. The format query parameter, when
+	// given, replaces Options.Format.
+	Options bigif.Options
+
+	// MaxBytes bounds the size of a request body; larger requests are
+	// answered with 413. Zero means DefaultMaxBytes.
+	MaxBytes int64
+}
+
+// NewHandler returns a Handler with default options and size limit.
+func NewHandler() *Handler {
+	return &Handler{}
+}
+
+// errTooLarge is returned by limitedBody once the limit is passed.
+var errTooLarge = errors.New("request body too large")
+
+// ServeHTTP compiles the script of a POST /compile request. The compile runs
+// with the request's context, so it stops when the client goes away.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/compile" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	opts := h.Options
+	if name := r.URL.Query().Get("format"); name != "" {
+		format, err := parseFormat(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.Format = format
+	}
+
+	maxBytes := h.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	if r.ContentLength > maxBytes {
+		http.Error(w, fmt.Sprintf("request body is larger than %d bytes", maxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	body := &limitedBody{ReadCloser: r.Body, remaining: maxBytes + 1}
+	r.Body = body
+	script, err := readScript(r, maxBytes)
+	if body.tooLarge {
+		http.Error(w, fmt.Sprintf("request body is larger than %d bytes", maxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := bigif.CompileWithOptionsContext(r.Context(), script, opts)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			http.Error(w, "compile canceled", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, http.StatusUnprocessableEntity, bigif.ErrorDiagnostics(err))
+		return
+	}
+	data, err := result.Encode()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if opts.Format == bigif.FormatBinary {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Write(data)
+}
+
+// readScript returns the script of a text/plain or multipart/form-data
+// request. Any other content type is read as plain text.
+func readScript(r *http.Request, maxBytes int64) (string, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		data, err := io.ReadAll(r.Body)
+		return string(data), err
+	}
+	if err := r.ParseMultipartForm(maxBytes); err != nil {
+		return "", fmt.Errorf("reading multipart form: %w", err)
+	}
+	defer r.MultipartForm.RemoveAll()
+	if file, _, err := r.FormFile("script"); err == nil {
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		return string(data), err
+	}
+	if values := r.MultipartForm.Value["script"]; len(values) > 0 {
+		return values[0], nil
+	}
+	return "", fmt.Errorf("multipart form has no script field")
+}
+
+// parseFormat returns the output format named as by OutputFormat.String.
+func parseFormat(name string) (bigif.OutputFormat, error) {
+	formats := []bigif.OutputFormat{bigif.FormatJSON, bigif.FormatCompactJSON, bigif.FormatBinary}
+	names := make([]string, len(formats))
+	for i, format := range formats {
+		if format.String() == name {
+			return format, nil
+		}
+		names[i] = format.String()
+	}
+	return 0, fmt.Errorf("unknown format '%s', want one of %s", name, strings.Join(names, ", "))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// limitedBody reads at most remaining bytes of a request body and records
+// when the body holds more. Unlike http.MaxBytesReader, it lets the handler
+// tell an oversized body from other read errors on Go versions without
+// http.MaxBytesError.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64 // One more than the limit, so reaching zero means too large
+	tooLarge  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		b.tooLarge = true
+		return 0, errTooLarge
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining <= 0 {
+		b.tooLarge = true
+		return n, errTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,135 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/verkaro/bigif/bigif"
+)
+
+const script = `=== index ===
+A door.
+* Open it. -> hall
+
+=== hall ===
+A hall.
+END: inside
+`
+
+func post(h http.Handler, target, contentType string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, target, body)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCompile(t *testing.T) {
+	h := NewHandler()
+	rec := post(h, "/compile", "text/plain", strings.NewReader(script))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	graph, err := bigif.LoadGraph(rec.Body.Bytes())
+	require.NoError(t, err)
+	assert.Len(t, graph.Graph, 2)
+
+	for _, format := range []string{"json", "compact-json", "binary"} {
+		rec := post(h, "/compile?format="+format, "text/plain", strings.NewReader(script))
+		require.Equal(t, http.StatusOK, rec.Code, format)
+		loaded, err := bigif.LoadGraph(rec.Body.Bytes())
+		require.NoError(t, err, format)
+		assert.Equal(t, graph.Graph, loaded.Graph, format)
+	}
+	rec = post(h, "/compile?format=compact-json", "text/plain", strings.NewReader(script))
+	assert.Contains(t, rec.Body.String(), `"g":`)
+	rec = post(h, "/compile?format=binary", "text/plain", strings.NewReader(script))
+	assert.Equal(t, "application/octet-stream", rec.Header().Get("Content-Type"))
+
+	rec = post(h, "/compile?format=yaml", "text/plain", strings.NewReader(script))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "compact-json")
+
+	t.Run("multipart", func(t *testing.T) {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		file, err := form.CreateFormFile("script", "story.biff")
+		require.NoError(t, err)
+		io.WriteString(file, script)
+		require.NoError(t, form.Close())
+		rec := post(h, "/compile", form.FormDataContentType(), &body)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		body.Reset()
+		form = multipart.NewWriter(&body)
+		require.NoError(t, form.WriteField("script", script))
+		require.NoError(t, form.Close())
+		rec = post(h, "/compile", form.FormDataContentType(), &body)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		body.Reset()
+		form = multipart.NewWriter(&body)
+		require.NoError(t, form.WriteField("story", script))
+		require.NoError(t, form.Close())
+		rec = post(h, "/compile", form.FormDataContentType(), &body)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("routing", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/compile", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+		assert.Equal(t, http.MethodPost, rec.Header().Get("Allow"))
+		rec = post(h, "/other", "text/plain", strings.NewReader(script))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
+
+func TestCompileErrors(t *testing.T) {
+	broken := strings.Replace(script, "-> hall", "-> cellar", 1) + "\n=== hall ===\nAgain.\nEND: twice\n"
+	rec := post(NewHandler(), "/compile", "text/plain", strings.NewReader(broken))
+	require.Equal(t, http.StatusUnprocessableEntity, rec.Code, rec.Body.String())
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var diagnostics []bigif.Diagnostic
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &diagnostics))
+	require.NotEmpty(t, diagnostics)
+	for _, d := range diagnostics {
+		assert.Equal(t, bigif.SeverityError, d.Severity)
+		assert.NotEmpty(t, d.Code)
+		assert.Greater(t, d.Line, 0, d.Message)
+	}
+}
+
+func TestCompileLimits(t *testing.T) {
+	h := &Handler{MaxBytes: 64}
+	rec := post(h, "/compile", "text/plain", strings.NewReader(script))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	// Without a Content-Length, the limit is found while reading.
+	req := httptest.NewRequest(http.MethodPost, "/compile", io.MultiReader(strings.NewReader(script)))
+	req.ContentLength = -1
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	h.MaxBytes = int64(len(script))
+	rec = post(h, "/compile", "text/plain", strings.NewReader(script))
+	assert.Equal(t, http.StatusOK, rec.Code, "a body of exactly MaxBytes is allowed")
+
+	t.Run("canceled request", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest(http.MethodPost, "/compile", strings.NewReader(script)).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		NewHandler().ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	})
+}
@@ -0,0 +1,258 @@
+package bigif
+
+import (
+	"sort"
+	"strings"
+)
+
+// stateUsage records, for one declared state, the knots whose conditions read
+// it and the knots whose choices write it.
+type stateUsage struct {
+	readIn    []string
+	writtenIn []string
+}
+
+// collectStateUsage records where every declared state is read and written.
+func collectStateUsage(ast *Script) map[string]*stateUsage {
+	usage := make(map[string]*stateUsage)
+	for state := range ast.States {
+		usage[state] = &stateUsage{}
+	}
+	for _, states := range ast.SceneStates {
+		for state := range states {
+			usage[state] = &stateUsage{}
+		}
+	}
+
+	addKnot := func(list []string, knot string) []string {
+		if len(list) > 0 && list[len(list)-1] == knot {
+			return list
+		}
+		return append(list, knot)
+	}
+	for _, name := range sortedKnotNames(ast.Knots) {
+		knot := ast.Knots[name]
+		var read []string
+		for _, block := range knot.Body {
+			read = append(read, conditionStates(block.Condition)...)
+		}
+		for _, asset := range knot.Assets {
+			read = append(read, conditionStates(asset.Condition)...)
+		}
+		for _, choice := range knot.Choices {
+			read = append(read, conditionStates(choice.Condition)...)
+			for _, change := range choice.StateChanges {
+				if u, ok := usage[strings.TrimSpace(strings.SplitN(change, "=", 2)[0])]; ok {
+					u.writtenIn = addKnot(u.writtenIn, name)
+				}
+			}
+		}
+		for _, state := range read {
+			if u, ok := usage[state]; ok {
+				u.readIn = addKnot(u.readIn, name)
+			}
+		}
+	}
+	return usage
+}
+
+// stateUsageWarnings reports declared states that are never used, only read
+// (so they keep their initial value) or only written (so they multiply the
+// graph without affecting it). A state overridden by opts.InitialStates counts
+// as written, since it no longer has to be false.
+func stateUsageWarnings(ast *Script, opts Options) []Diagnostic {
+	usage := collectStateUsage(ast)
+	names := make([]string, 0, len(usage))
+	for state := range usage {
+		names = append(names, state)
+	}
+	sort.Strings(names)
+
+	var warnings []Diagnostic
+	for _, state := range names {
+		if ast.isTurnState(state) {
+			continue // Written by the counter, not by choices
+		}
+		u := usage[state]
+		_, overridden := opts.InitialStates[state]
+		written := len(u.writtenIn) > 0 || overridden
+		switch {
+		case len(u.readIn) == 0 && !written:
+			warnings = append(warnings, warningAt(position{}, CodeUnusedState, "state '%s' is declared but never read or written", state))
+		case !written:
+			warnings = append(warnings, warningAt(position{}, CodeUnsetState, "state '%s' is read but never written, so it is always false; read in: %s", state, strings.Join(u.readIn, ", ")))
+		case len(u.readIn) == 0 && len(u.writtenIn) > 0:
+			warnings = append(warnings, warningAt(position{}, CodeUnusedState, "state '%s' is written but never read, so it only multiplies the graph; written in: %s", state, strings.Join(u.writtenIn, ", ")))
+		}
+	}
+	return warnings
+}
+
+// flagResetWarnings reports state changes that set a flag state to false.
+// Flags only go from false to true, so such an assignment never does
+// anything. Every choice is checked, reachable or not.
+func flagResetWarnings(ast *Script) []Diagnostic {
+	var warnings []Diagnostic
+	for _, name := range sortedKnotNames(ast.Knots) {
+		knot := ast.Knots[name]
+		for _, choice := range knot.Choices {
+			for _, change := range choice.StateChanges {
+				parts := strings.SplitN(change, "=", 2)
+				if len(parts) != 2 || strings.TrimSpace(parts[1]) != "false" {
+					continue
+				}
+				state := strings.TrimSpace(parts[0])
+				if kind, ok := ast.stateKind(knot.Scene, state); ok && kind.IsFlag() {
+					warnings = append(warnings, warningAt(position{knot.File, choice.Line}, CodeIgnoredAssignment, "knot '%s', choice '%s': '%s = false' is ignored because '%s' is declared in %s and can only become true", name, choice.Text, state, state, kind))
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+// splitStateChange splits a state change into the state name and the value it
+// assigns.
+func splitStateChange(change string) (string, string) {
+	parts := strings.SplitN(change, "=", 2)
+	if len(parts) != 2 {
+		return strings.TrimSpace(parts[0]), ""
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+}
+
+// stuckStateWarnings reports states that are read, set to true somewhere and
+// never set back to false. They behave like flags, which is either intended,
+// in which case declaring them as flags documents it, or a forgotten reset.
+func stuckStateWarnings(ast *Script) []Diagnostic {
+	type writes struct {
+		kind      StateKind
+		directive string
+		setTrue   []string
+		setFalse  bool
+	}
+	found := make(map[string]*writes)
+	for _, name := range sortedKnotNames(ast.Knots) {
+		knot := ast.Knots[name]
+		for _, choice := range knot.Choices {
+			for _, change := range choice.StateChanges {
+				state, value := splitStateChange(change)
+				kind, ok := ast.stateKind(knot.Scene, state)
+				if !ok || kind.IsFlag() {
+					continue
+				}
+				w := found[state]
+				if w == nil {
+					w = &writes{kind: kind, directive: "FLAG-STATES"}
+					if kind.IsLocal() {
+						w.directive = "LOCAL-FLAG-STATES"
+						if _, scoped := ast.SceneStates[knot.Scene][state]; scoped {
+							w.directive += "(" + knot.Scene + ")"
+						}
+					}
+					found[state] = w
+				}
+				switch value {
+				case "true":
+					if len(w.setTrue) == 0 || w.setTrue[len(w.setTrue)-1] != name {
+						w.setTrue = append(w.setTrue, name)
+					}
+				case "false":
+					w.setFalse = true
+				}
+			}
+		}
+	}
+
+	usage := collectStateUsage(ast)
+	names := make([]string, 0, len(found))
+	for state := range found {
+		names = append(names, state)
+	}
+	sort.Strings(names)
+	var warnings []Diagnostic
+	for _, state := range names {
+		w := found[state]
+		if w.setFalse || len(w.setTrue) == 0 || len(usage[state].readIn) == 0 {
+			continue
+		}
+		warnings = append(warnings, warningAt(position{}, CodeFlagLikeState, "state '%s' is set to true but never back to false, so it behaves like a flag (declare it in %s if that is intended); set in: %s", state, w.directive, strings.Join(w.setTrue, ", ")))
+	}
+	return warnings
+}
+
+// localScopeWarnings reports conditions on LOCAL-STATES in knots that the
+// state can never arrive at while true. Local states are reset when the
+// scene changes, so a state set only in other scenes always reads false
+// there. A stitch divert keeps local states, so the scenes it leads into
+// count as scenes where the state may be true.
+func localScopeWarnings(ast *Script, opts Options) []Diagnostic {
+	trueIn := make(map[string]map[string]bool) // state -> scenes where it can be true
+	for _, name := range sortedKnotNames(ast.Knots) {
+		knot := ast.Knots[name]
+		for _, choice := range knot.Choices {
+			for _, change := range choice.StateChanges {
+				state, value := splitStateChange(change)
+				if kind, ok := ast.States[state]; !ok || !kind.IsLocal() || value != "true" {
+					continue
+				}
+				if trueIn[state] == nil {
+					trueIn[state] = make(map[string]bool)
+				}
+				trueIn[state][knot.Scene] = true
+			}
+		}
+	}
+	for _, scenes := range trueIn {
+		for changed := true; changed; {
+			changed = false
+			for _, name := range sortedKnotNames(ast.Knots) {
+				knot := ast.Knots[name]
+				if !scenes[knot.Scene] {
+					continue
+				}
+				for _, choice := range knot.Choices {
+					if choice.Stitch == "" {
+						continue
+					}
+					if target, ok := ast.Knots[choiceTarget(knot, choice, ast)]; ok && !scenes[target.Scene] {
+						scenes[target.Scene] = true
+						changed = true
+					}
+				}
+			}
+		}
+	}
+
+	var warnings []Diagnostic
+	check := func(knot *Knot, line int, condition string) {
+		for _, state := range conditionStates(condition) {
+			scenes, ok := trueIn[state]
+			if !ok || scenes[knot.Scene] || opts.InitialStates[state] {
+				continue
+			}
+			names := make([]string, 0, len(scenes))
+			for scene := range scenes {
+				if scene == "" {
+					scene = "(no scene)"
+				}
+				names = append(names, scene)
+			}
+			sort.Strings(names)
+			warnings = append(warnings, warningAt(position{knot.File, line}, CodeLocalOutOfScope, "knot '%s' reads local state '%s', which can only be true in scene(s) %s, so it is always false here", knot.Name, state, strings.Join(names, ", ")))
+		}
+	}
+	for _, name := range sortedKnotNames(ast.Knots) {
+		knot := ast.Knots[name]
+		for _, block := range knot.Body {
+			check(knot, block.Line, block.Condition)
+		}
+		for _, asset := range knot.Assets {
+			check(knot, asset.Line, asset.Condition)
+		}
+		for _, choice := range knot.Choices {
+			check(knot, choice.Line, choice.Condition)
+		}
+	}
+	return warnings
+}
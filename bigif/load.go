@@ -0,0 +1,122 @@
+package bigif
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Metadata describes the document a graph was loaded from.
+type Metadata struct {
+	FormatVersion string // As written, or "1.0.0" for a document from before the field existed
+	Generator     string // Empty for legacy documents
+	Title         string
+	Author        string
+	Language      string
+	IFID          string
+	Values        map[string]interface{} // The "metadata" object, also in StoryGraph.Metadata
+	Warnings      []string
+}
+
+// LoadGraph reads the JSON produced by Compile or CompileResult.JSON back
+// into a StoryGraph, for example to diff it against a fresh compile. The
+// compact JSON and binary formats of EncodeGraph are detected and read too.
+// It is LoadGraphWithMetadata without the metadata.
+func LoadGraph(data []byte) (*StoryGraph, error) {
+	graph, _, err := LoadGraphWithMetadata(data)
+	return graph, err
+}
+
+// LoadGraphWithMetadata reads a compiled graph in any of the formats of
+// EncodeGraph, along with the document's version, generator and story
+// fields. Nodes are read from "graph"/"nodes", the one shape Compile
+// writes. The returned error wraps an *Error: CodeMalformedGraph for data
+// that does not decode or has no nodes, CodeIncompatibleVersion, also
+// matching ErrIncompatibleVersion, for another major format version, and
+// CodeDanglingReference, in an ErrorList when there are several, for a
+// start node, edge target, ending or parent that names a node the graph
+// does not have.
+func LoadGraphWithMetadata(data []byte) (*StoryGraph, *Metadata, error) {
+	doc, err := decodeDocument(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading graph: %w", newError(CodeMalformedGraph, "", 0, 0, err))
+	}
+	if err := checkFormatVersion(doc.FormatVersion); err != nil {
+		return nil, nil, fmt.Errorf("loading graph: %w", err)
+	}
+	if doc.Graph.Nodes == nil {
+		return nil, nil, fmt.Errorf("loading graph: %w", errorf(CodeMalformedGraph, "no \"graph\" object with nodes"))
+	}
+	for id, node := range doc.Graph.Nodes {
+		if node == nil {
+			return nil, nil, fmt.Errorf("loading graph: %w", errorf(CodeMalformedGraph, "node '%s' is null", id))
+		}
+	}
+	if err := doc.resolveNodes(); err != nil {
+		return nil, nil, fmt.Errorf("loading graph: %w", err)
+	}
+	graph := doc.storyGraph()
+	if errs := danglingReferences(graph); len(errs) > 0 {
+		return nil, nil, fmt.Errorf("loading graph: %w", errorList(errs))
+	}
+
+	version := doc.FormatVersion
+	if version == "" {
+		version = legacyFormatVersion
+	}
+	return graph, &Metadata{
+		FormatVersion: version,
+		Generator:     doc.Generator,
+		Title:         doc.Title,
+		Author:        doc.Author,
+		Language:      doc.Language,
+		IFID:          doc.IFID,
+		Values:        doc.Metadata,
+		Warnings:      doc.Warnings,
+	}, nil
+}
+
+// danglingReferences reports every node ID the graph refers to but does not
+// contain, in node ID order.
+func danglingReferences(graph *StoryGraph) []*Error {
+	var errs []*Error
+	if _, ok := graph.Graph[graph.StartNodeID]; !ok {
+		errs = append(errs, errorf(CodeDanglingReference, "start node '%s' does not exist", graph.StartNodeID))
+	}
+	ids := make([]string, 0, len(graph.Graph))
+	for id := range graph.Graph {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		node := graph.Graph[id]
+		for i, edge := range node.Edges {
+			if edge == nil {
+				errs = append(errs, errorf(CodeMalformedGraph, "node '%s': edge %d is null", id, i))
+			} else if _, ok := graph.Graph[edge.TargetNodeID]; !ok {
+				errs = append(errs, errorf(CodeDanglingReference, "node '%s': edge '%s' leads to unknown node '%s'", id, edge.Text, edge.TargetNodeID))
+			}
+		}
+		for _, incoming := range node.IncomingEdges {
+			if incoming == nil {
+				continue
+			}
+			if _, ok := graph.Graph[incoming.SourceNodeID]; !ok {
+				errs = append(errs, errorf(CodeDanglingReference, "node '%s': incoming edge from unknown node '%s'", id, incoming.SourceNodeID))
+			}
+		}
+		if node.Parent != nil {
+			if _, ok := graph.Graph[node.Parent.SourceNodeID]; !ok {
+				errs = append(errs, errorf(CodeDanglingReference, "node '%s': parent '%s' does not exist", id, node.Parent.SourceNodeID))
+			}
+		}
+	}
+	for _, ending := range graph.Endings {
+		if ending == nil {
+			continue
+		}
+		if _, ok := graph.Graph[ending.NodeID]; !ok {
+			errs = append(errs, errorf(CodeDanglingReference, "ending '%s' refers to unknown node '%s'", ending.Name, ending.NodeID))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,103 @@
+package bigif
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Marshaler serializes a compiled graph together with its story metadata.
+// The built-in formats are implemented as Marshalers, and CompileWith takes
+// any implementation, so a new output format can live in its own package.
+//
+// Of meta, Marshal uses Title, Author, Language, IFID, Values and Warnings;
+// the built-in formats always write the Generator of this version of bigif
+// and the FormatVersion, or TableFormatVersion, of the graph.
+type Marshaler interface {
+	Marshal(graph *StoryGraph, meta Metadata) ([]byte, error)
+}
+
+// JSONMarshaler writes the indented JSON document returned by Compile
+// (FormatJSON).
+type JSONMarshaler struct{}
+
+// Marshal implements Marshaler.
+func (JSONMarshaler) Marshal(graph *StoryGraph, meta Metadata) ([]byte, error) {
+	return json.MarshalIndent(document(graph, meta.info(), meta.Values, meta.Warnings), "", "  ")
+}
+
+// CompactJSONMarshaler writes the document without indentation and with
+// the short key names described at EncodeGraph (FormatCompactJSON).
+type CompactJSONMarshaler struct{}
+
+// Marshal implements Marshaler.
+func (CompactJSONMarshaler) Marshal(graph *StoryGraph, meta Metadata) ([]byte, error) {
+	tree, err := genericJSON(newGraphDocument(graph, meta))
+	if err != nil {
+		return nil, fmt.Errorf("encoding graph: %w", err)
+	}
+	return json.Marshal(renameKeys(tree, reflect.TypeOf(graphDocument{}), true))
+}
+
+// GobMarshaler writes the document with encoding/gob behind a header that
+// LoadGraph recognizes (FormatBinary).
+type GobMarshaler struct{}
+
+// Marshal implements Marshaler.
+func (GobMarshaler) Marshal(graph *StoryGraph, meta Metadata) ([]byte, error) {
+	var b bytes.Buffer
+	b.Write(binaryMagic)
+	if err := gob.NewEncoder(&b).Encode(newGraphDocument(graph, meta)); err != nil {
+		return nil, fmt.Errorf("encoding graph: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// marshaler returns the Marshaler that implements the format.
+func (f OutputFormat) marshaler() (Marshaler, error) {
+	switch f {
+	case FormatJSON:
+		return JSONMarshaler{}, nil
+	case FormatCompactJSON:
+		return CompactJSONMarshaler{}, nil
+	case FormatBinary:
+		return GobMarshaler{}, nil
+	default:
+		return nil, fmt.Errorf("encoding graph: unknown format %d", f)
+	}
+}
+
+// CompileWith compiles a script with default options and serializes it
+// with m. CompileWith(script, JSONMarshaler{}) returns what Compile does.
+func CompileWith(scriptContent string, m Marshaler) ([]byte, error) {
+	result, err := CompileWithOptions(scriptContent, Options{})
+	if err != nil {
+		return nil, err
+	}
+	return m.Marshal(result.Graph, result.metadata())
+}
+
+// metadata returns the story fields of the result for a Marshaler.
+func (r *CompileResult) metadata() Metadata {
+	return Metadata{
+		FormatVersion: r.Graph.formatVersion(), Generator: generator(),
+		Title: r.Title, Author: r.Author, Language: r.Language, IFID: r.IFID,
+		Values: r.Metadata, Warnings: r.Warnings,
+	}
+}
+
+// graphMetadata returns the story fields a graph carries for a Marshaler.
+func graphMetadata(g *StoryGraph) Metadata {
+	return Metadata{
+		FormatVersion: g.formatVersion(), Generator: generator(),
+		Title: g.info.title, Author: g.info.author, Language: g.info.language, IFID: g.info.ifid,
+		Values: g.Metadata, Warnings: diagnosticStrings(g.warnings),
+	}
+}
+
+// info returns the top-level story fields of the metadata.
+func (m Metadata) info() storyInfo {
+	return storyInfo{title: m.Title, author: m.Author, language: m.Language, ifid: m.IFID}
+}
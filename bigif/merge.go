@@ -0,0 +1,86 @@
+package bigif
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// mergeEquivalentNodes merges nodes that the player cannot tell apart: nodes
+// of the same knot with the same content whose choices have the same text and
+// lead to nodes that are themselves equivalent. It refines a partition of the
+// graph until it is stable, so cycles of duplicates are merged together and a
+// merge that makes two sources equivalent is picked up on the next round.
+//
+// Each class keeps the start node if it contains it, otherwise the node with
+// the smallest ID. The IDs of the nodes merged into it are recorded in
+// MergedFrom and every edge is rewritten to the survivor.
+func mergeEquivalentNodes(graph *StoryGraph) {
+	nodeIDs := sortedNodeIDs(graph)
+
+	class := make(map[string]int, len(nodeIDs))
+	count := 0
+	for {
+		signatures := make(map[string]int)
+		next := make(map[string]int, len(nodeIDs))
+		for _, nodeID := range nodeIDs {
+			signature := nodeSignature(graph.Graph[nodeID], class)
+			id, ok := signatures[signature]
+			if !ok {
+				id = len(signatures)
+				signatures[signature] = id
+			}
+			next[nodeID] = id
+		}
+		class = next
+		if len(signatures) == count {
+			break
+		}
+		count = len(signatures)
+	}
+	if count == len(nodeIDs) {
+		return
+	}
+
+	survivor := make(map[int]string, count)
+	if _, ok := graph.Graph[graph.StartNodeID]; ok {
+		survivor[class[graph.StartNodeID]] = graph.StartNodeID
+	}
+	for _, nodeID := range nodeIDs {
+		if _, ok := survivor[class[nodeID]]; !ok {
+			survivor[class[nodeID]] = nodeID
+		}
+	}
+	for _, nodeID := range nodeIDs {
+		keep := survivor[class[nodeID]]
+		if keep != nodeID {
+			graph.Graph[keep].MergedFrom = append(graph.Graph[keep].MergedFrom, nodeID)
+			delete(graph.Graph, nodeID)
+		}
+	}
+	for _, node := range graph.Graph {
+		for _, edge := range node.Edges {
+			edge.TargetNodeID = survivor[class[edge.TargetNodeID]]
+		}
+	}
+	// A survivor's parent may have been merged away, so discovery is replayed
+	// on the merged graph.
+	assignParents(graph)
+}
+
+// nodeSignature describes what the player sees at a node, with each edge
+// target replaced by its current class.
+func nodeSignature(node *StoryNode, class map[string]int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%q %q %t %t %q %q\n", node.KnotName, node.Content, node.IsEnd, node.Missing, node.EndingName, node.Stitch)
+	for _, edge := range node.Edges {
+		untracked := append([]string(nil), edge.UntrackedStateChanges...)
+		sort.Strings(untracked)
+		target := -1
+		if id, ok := class[edge.TargetNodeID]; ok {
+			target = id
+		}
+		fmt.Fprintf(&b, "%q %q %q %d\n", edge.Text, edge.Stitch, untracked, target)
+	}
+	return b.String()
+}
@@ -0,0 +1,197 @@
+package bigif
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// NamedScript is a script's source with the name it is reported under,
+// usually its file name.
+type NamedScript struct {
+	Name   string
+	Source string
+}
+
+// MergeScripts combines scripts written separately, e.g. one per author,
+// into a single script and returns its source, written by WriteScript.
+// Unlike concatenating the files, it checks that they fit together:
+//
+//   - A knot defined in two scripts is an error, unless both definitions
+//     are identical, as when two files share an included knot; the
+//     duplicate is then dropped silently.
+//   - A state declared with a different kind in two scripts, such as
+//     STATES in one and FLAG-STATES in the other, is an error. Local
+//     states are compared scene by scene.
+//   - A metadata key, DEFAULT-SCENE or TURNS given different values is a
+//     warning, and the first script's value is kept.
+//
+// Every finding is returned as a Diagnostic whose File is the name of the
+// script that brought in the conflicting definition, together with the
+// parse warnings of each script. If any finding is an error, the error is
+// an ErrorList of them and no source is returned. A script that does not
+// parse is an error too. Scenes, endings and states are the union of those
+// of all scripts, and STRICT holds if any script sets it.
+func MergeScripts(scripts ...NamedScript) (string, []Diagnostic, error) {
+	merged := newParser(nil).script
+	var diagnostics []Diagnostic
+	var conflicts []*Error
+	conflict := func(err *Error) {
+		conflicts = append(conflicts, err)
+		diagnostics = append(diagnostics, err.Diagnostic())
+	}
+	origin := make(map[string]string) // what was declared -> name of the script declaring it first
+
+	for _, script := range scripts {
+		p := newParser(nil)
+		p.parseSource(script.Name, strings.NewReader(script.Source))
+		ast, err := p.finish()
+		if err != nil {
+			return "", diagnostics, fmt.Errorf("merging scripts: %w", err)
+		}
+		diagnostics = append(diagnostics, ast.Warnings...)
+		at := position{file: script.Name}
+
+		for _, name := range sortedKnotNames(ast.Knots) {
+			knot := ast.Knots[name]
+			existing, ok := merged.Knots[name]
+			switch {
+			case !ok:
+				merged.Knots[name] = knot
+			case !sameKnot(existing, knot):
+				conflict(&Error{File: script.Name, Line: knot.Line, Code: CodeDuplicate, Message: fmt.Sprintf("knot '%s' is also defined, differently, at %s", name, location(existing.File, existing.Line))})
+			}
+		}
+
+		mergeStates := func(scope string, into, from map[string]StateKind) {
+			for _, name := range sortedStateNames(from) {
+				kind := from[name]
+				existing, ok := into[name]
+				if !ok {
+					into[name] = kind
+					origin["state "+scope+name] = script.Name
+					continue
+				}
+				if existing != kind {
+					conflict(&Error{File: script.Name, Code: CodeDeclaration, Message: fmt.Sprintf("state '%s' is declared with %s in %s, but with %s in %s", name, kind, script.Name, existing, origin["state "+scope+name])})
+				}
+			}
+		}
+		mergeStates("", merged.States, ast.States)
+		scenes := make([]string, 0, len(ast.SceneStates))
+		for scene := range ast.SceneStates {
+			scenes = append(scenes, scene)
+		}
+		sort.Strings(scenes)
+		for _, scene := range scenes {
+			states := ast.SceneStates[scene]
+			if merged.SceneStates[scene] == nil {
+				merged.SceneStates[scene] = make(map[string]StateKind)
+			}
+			mergeStates(scene+":", merged.SceneStates[scene], states)
+		}
+
+		keys := make([]string, 0, len(ast.Metadata))
+		for key := range ast.Metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := ast.Metadata[key]
+			existing, ok := merged.Metadata[key]
+			if !ok {
+				merged.Metadata[key] = value
+				origin["metadata "+key] = script.Name
+			} else if existing != value {
+				diagnostics = append(diagnostics, warningAt(at, CodeDuplicateMetadata, "metadata key '%s' is '%s' in %s, but '%s' in %s (keeping '%s')", key, value, script.Name, existing, origin["metadata "+key], existing))
+			}
+		}
+		for _, field := range []struct {
+			into  *string
+			value string
+		}{
+			{&merged.Title, ast.Title}, {&merged.Author, ast.Author}, {&merged.Language, ast.Language}, {&merged.IFID, ast.IFID},
+		} {
+			if *field.into == "" {
+				*field.into = field.value
+			}
+		}
+		if ast.DefaultScene != "" {
+			if merged.DefaultScene == "" {
+				merged.DefaultScene = ast.DefaultScene
+				origin["default scene"] = script.Name
+			} else if merged.DefaultScene != ast.DefaultScene {
+				diagnostics = append(diagnostics, warningAt(at, CodeRedeclared, "DEFAULT-SCENE is '%s' in %s, but '%s' in %s (keeping '%s')", ast.DefaultScene, script.Name, merged.DefaultScene, origin["default scene"], merged.DefaultScene))
+			}
+		}
+		for _, scene := range ast.Scenes {
+			if !containsString(merged.Scenes, scene) {
+				merged.Scenes = append(merged.Scenes, scene)
+			}
+		}
+		for _, ending := range ast.Endings {
+			if !containsString(merged.Endings, ending) {
+				merged.Endings = append(merged.Endings, ending)
+			}
+		}
+		for _, knot := range ast.TrackVisits {
+			if !containsString(merged.TrackVisits, knot) {
+				merged.TrackVisits = append(merged.TrackVisits, knot)
+			}
+		}
+		if ast.MaxTurns != 0 {
+			if merged.MaxTurns == 0 {
+				merged.MaxTurns = ast.MaxTurns
+				origin["turns"] = script.Name
+			} else if merged.MaxTurns != ast.MaxTurns {
+				diagnostics = append(diagnostics, warningAt(at, CodeRedeclared, "TURNS is max=%d in %s, but max=%d in %s (keeping max=%d)", ast.MaxTurns, script.Name, merged.MaxTurns, origin["turns"], merged.MaxTurns))
+			}
+		}
+		merged.Strict = merged.Strict || ast.Strict
+	}
+
+	if len(conflicts) > 0 {
+		return "", diagnostics, errorList(conflicts)
+	}
+	source, err := WriteScript(merged)
+	if err != nil {
+		return "", diagnostics, fmt.Errorf("merging scripts: %w", err)
+	}
+	return source, diagnostics, nil
+}
+
+// sortedStateNames returns the names of states in order.
+func sortedStateNames(states map[string]StateKind) []string {
+	names := make([]string, 0, len(states))
+	for name := range states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sameKnot reports whether two knots are defined identically, ignoring
+// where they were defined.
+func sameKnot(a, b *Knot) bool {
+	return reflect.DeepEqual(withoutPositions(a), withoutPositions(b))
+}
+
+// withoutPositions returns a copy of knot with its source positions cleared.
+func withoutPositions(knot *Knot) Knot {
+	k := *knot
+	k.File, k.Line = "", 0
+	k.Body = append([]TextBlock(nil), knot.Body...)
+	for i := range k.Body {
+		k.Body[i].Line = 0
+	}
+	k.Choices = append([]Choice(nil), knot.Choices...)
+	for i := range k.Choices {
+		k.Choices[i].Line = 0
+	}
+	k.Assets = append([]Asset(nil), knot.Assets...)
+	for i := range k.Assets {
+		k.Assets[i].Line = 0
+	}
+	return k
+}
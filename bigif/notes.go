@@ -0,0 +1,42 @@
+package bigif
+
+// Note is an author's "// TODO: ...", "// FIXME: ..." or "// NOTE: ..."
+// comment, collected so work left in a script is not lost. Notes are not
+// part of the graph output.
+type Note struct {
+	Kind string `json:"kind"`           // "TODO", "FIXME" or "NOTE"
+	Text string `json:"text"`           // The comment after the colon
+	Knot string `json:"knot,omitempty"` // The enclosing knot, empty in the header
+	File string `json:"file,omitempty"` // Empty for a script compiled from a string
+	Line int    `json:"line"`
+}
+
+// noteKinds lists the comment keys collected as notes, in the order
+// NoteCounts reports them.
+var noteKinds = []string{"TODO", "FIXME", "NOTE"}
+
+// addNote records a "// key: value" comment as a note if key is one of
+// noteKinds, and reports whether it did. knot is nil in the header.
+func (p *parser) addNote(key, value string, knot *Knot, pos position) bool {
+	if !containsString(noteKinds, key) {
+		return false
+	}
+	note := Note{Kind: key, Text: value, File: pos.file, Line: pos.line}
+	if knot != nil {
+		note.Knot = knot.Name
+	}
+	p.script.Notes = append(p.script.Notes, note)
+	return true
+}
+
+// noteCounts counts the notes of a script by kind, with every kind present.
+func noteCounts(notes []Note) map[string]int {
+	counts := make(map[string]int, len(noteKinds))
+	for _, kind := range noteKinds {
+		counts[kind] = 0
+	}
+	for _, note := range notes {
+		counts[note.Kind]++
+	}
+	return counts
+}
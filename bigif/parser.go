@@ -2,25 +2,226 @@ package bigif
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+// includeLoader resolves and reads the file named by an INCLUDE directive.
+// from is the name of the including file; the returned name identifies the
+// included file in error messages and for cycle detection.
+type includeLoader func(from, include string) (name string, content []byte, err error)
+
+// parser accumulates one Script from a root source and any files it includes.
+type parser struct {
+	script   *Script
+	errors   []*Error        // problems found so far, in the order found
+	load     includeLoader   // nil when includes are not supported
+	active   []string        // include stack, used to detect cycles
+	included map[string]bool // files already parsed, so each is included once
+
+	directives DirectiveHandler // Options.DirectiveHandler, nil if none
+}
+
+func newParser(load includeLoader) *parser {
+	return &parser{
+		script: &Script{
+			Metadata:    make(map[string]string),
+			States:      make(map[string]StateKind),
+			SceneStates: make(map[string]map[string]StateKind),
+			Knots:       make(map[string]*Knot),
+		},
+		load:     load,
+		included: make(map[string]bool),
+	}
+}
+
 // parse takes the raw script string and converts it into an AST.
 func parse(scriptContent string) (*Script, error) {
-	script := &Script{
-		Metadata:     make(map[string]string),
-		GlobalStates: make(map[string]bool),
-		LocalStates:  make(map[string]bool),
-		Knots:        make(map[string]*Knot),
+	return parseReader(strings.NewReader(scriptContent))
+}
+
+// parseWithOptions parses a script string, offering directives to
+// opts.DirectiveHandler.
+func parseWithOptions(scriptContent string, opts Options) (*Script, error) {
+	p := newParser(nil)
+	p.directives = opts.DirectiveHandler
+	p.parseSource("", strings.NewReader(scriptContent))
+	return p.finish()
+}
+
+// parseReader parses a script read line by line from r, so the source never
+// has to be held in memory as a whole.
+func parseReader(r io.Reader) (*Script, error) {
+	p := newParser(nil)
+	p.parseSource("", r)
+	return p.finish()
+}
+
+// parseFile parses the named file and, recursively, every file it includes.
+func parseFile(name string, load includeLoader) (*Script, error) {
+	p := newParser(load)
+	p.include("", 0, name)
+	return p.finish()
+}
+
+// parseFS parses every .biff file under root in fsys, in lexical path order,
+// into a single script. Files already pulled in by an INCLUDE are not parsed twice.
+func parseFS(fsys fs.FS, root string) (*Script, error) {
+	p := newParser(fsLoader(fsys))
+	err := fs.WalkDir(fsys, root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || path.Ext(name) != ".biff" {
+			return nil
+		}
+		return p.include("", 0, name)
+	})
+	if err != nil && err != errTooManyErrors {
+		return nil, newError(CodeRead, "", 0, 0, err)
+	}
+	return p.finish()
+}
+
+// fsLoader resolves includes as slash-separated paths relative to the including file within fsys.
+func fsLoader(fsys fs.FS) includeLoader {
+	return func(from, include string) (string, []byte, error) {
+		name := include
+		if from != "" {
+			name = path.Join(path.Dir(from), include)
+		}
+		content, err := fs.ReadFile(fsys, name)
+		return name, content, err
 	}
+}
+
+// location formats a source position for error and warning messages.
+func location(source string, line int) string {
+	if source == "" {
+		return fmt.Sprintf("line %d", line)
+	}
+	return fmt.Sprintf("%s:%d", source, line)
+}
+
+// add records a problem and lets parsing go on, so that one compile reports
+// as many errors as possible. Once maxErrors problems have been recorded it
+// returns errTooManyErrors, which stops parsing.
+func (p *parser) add(err *Error) error {
+	p.errors = append(p.errors, err)
+	if len(p.errors) >= maxErrors {
+		p.errors = append(p.errors, &Error{Code: CodeTooManyErrors, Message: fmt.Sprintf("too many errors; stopped after %d", maxErrors)})
+		return errTooManyErrors
+	}
+	return nil
+}
+
+// include loads a file named by an INCLUDE directive and parses it into the
+// shared script. Problems are recorded with add; the only error returned is
+// errTooManyErrors.
+func (p *parser) include(from string, line int, target string) error {
+	if p.load == nil {
+		return p.add(&Error{File: from, Line: line, Code: CodeInclude, Message: "INCLUDE is not supported when compiling a single script string; use CompileFile"})
+	}
+	name, content, err := p.load(from, target)
+	if err != nil {
+		if from == "" {
+			return p.add(newError(CodeRead, "", 0, 0, err))
+		}
+		return p.add(newError(CodeInclude, from, line, 0, err))
+	}
+	for i, active := range p.active {
+		if active == name {
+			cycle := append(append([]string{}, p.active[i:]...), name)
+			return p.add(&Error{File: from, Line: line, Code: CodeInclude, Message: "include cycle: " + strings.Join(cycle, " -> ")})
+		}
+	}
+	if p.included[name] {
+		return nil
+	}
+	p.included[name] = true
+
+	p.active = append(p.active, name)
+	defer func() { p.active = p.active[:len(p.active)-1] }()
+	return p.parseSource(name, bytes.NewReader(content))
+}
+
+// lineReader splits its input into lines like bufio.Scanner, but without a
+// limit on line length: machine-generated prose can easily exceed the
+// scanner's 64KB token size.
+type lineReader struct {
+	r    *bufio.Reader
+	line string
+	err  error
+	done bool
+}
+
+func newLineReader(r io.Reader) *lineReader {
+	return &lineReader{r: bufio.NewReader(r)}
+}
+
+// Scan reads the next line, reporting false at the end of the input or on
+// a read error.
+func (l *lineReader) Scan() bool {
+	if l.done {
+		return false
+	}
+	line, err := l.r.ReadString('\n')
+	if err != nil {
+		l.done = true
+		if err != io.EOF {
+			l.err = err
+			return false
+		}
+		if line == "" {
+			return false
+		}
+	}
+	line = strings.TrimSuffix(line, "\n")
+	l.line = strings.TrimSuffix(line, "\r")
+	return true
+}
+
+// Text returns the line read by the last call to Scan, without its line ending.
+func (l *lineReader) Text() string { return l.line }
+
+// Err returns the read error that stopped Scan, if any.
+func (l *lineReader) Err() error { return l.err }
+
+// parseSource parses one script source into the shared script. source names the
+// file for error messages and is empty for a script passed in as a string.
+// A line with an error is skipped, and so is the body of a knot whose
+// declaration has one; the only error returned is errTooManyErrors.
+func (p *parser) parseSource(source string, r io.Reader) error {
+	script := p.script
 	var currentKnot *Knot
 	var currentTextBlock *TextBlock
+	var namespace string
+	lineNum := 0
+	skipping := false // inside a knot whose declaration had an error
 
-	scanner := bufio.NewScanner(strings.NewReader(scriptContent))
+	scanner := newLineReader(r)
 	for scanner.Scan() {
+		lineNum++
 		line := scanner.Text()
 		trimmedLine := strings.TrimSpace(line)
+		pos := position{source, lineNum}
+		column := len(line) - len(strings.TrimLeft(line, " \t")) + 1
+		fail := func(code ErrorCode, err error) error {
+			return p.add(errorAt(err, code, source, lineNum, column))
+		}
+		// skipKnot discards the lines of a knot whose declaration is broken,
+		// so they are not mistaken for part of the knot before it.
+		skipKnot := func() {
+			currentKnot, currentTextBlock = nil, nil
+			skipping = true
+		}
 
 		if trimmedLine == "" {
 			if currentTextBlock != nil {
@@ -30,101 +231,676 @@ func parse(scriptContent string) (*Script, error) {
 		}
 
 		// --- Header Parsing ---
-		if currentKnot == nil && strings.HasPrefix(trimmedLine, "//") {
-			parseHeaderLine(trimmedLine, script)
+		if currentKnot == nil && !skipping && strings.HasPrefix(trimmedLine, "//") {
+			if key, value, ok := splitHeaderDirective(trimmedLine); ok {
+				if p.addNote(key, value, nil, pos) {
+					continue
+				}
+				switch strings.ToUpper(key) {
+				case "INCLUDE":
+					if err := p.include(source, lineNum, value); err != nil {
+						return err
+					}
+					continue
+				case "NAMESPACE":
+					if !isValidIdentifier(value) {
+						if err := fail(CodeInvalidName, fmt.Errorf("invalid namespace '%s': %s", value, identifierGrammar)); err != nil {
+							return err
+						}
+						continue
+					}
+					namespace = value
+					continue
+				}
+			}
+			if err := p.parseHeaderLine(trimmedLine, pos); err != nil {
+				if err := fail(CodeDeclaration, err); err != nil {
+					return err
+				}
+			}
 			continue
 		}
 
 		// --- Knot Declaration ---
-		if strings.HasPrefix(trimmedLine, "===") && strings.HasSuffix(trimmedLine, "===") {
-			knotName := strings.TrimSpace(trimmedLine[3 : len(trimmedLine)-3])
-			if knotName == "" {
-				return nil, fmt.Errorf("found knot with empty name")
+		if knotName, tagText, ok, err := splitKnotDeclaration(trimmedLine); ok {
+			knot, err := p.declareKnot(knotName, tagText, err, namespace, source, lineNum)
+			if err != nil {
+				if err := fail(CodeSyntax, err); err != nil {
+					return err
+				}
+				skipKnot()
+				continue
 			}
-			currentKnot = &Knot{Name: knotName}
-			script.Knots[knotName] = currentKnot
-			currentTextBlock = nil
+			currentKnot, currentTextBlock = knot, nil
+			skipping = false
 			continue
 		}
-
 		if currentKnot == nil {
 			continue
 		}
 
-		if strings.HasPrefix(trimmedLine, "*") || strings.HasPrefix(trimmedLine, "//") || trimmedLine == "END" {
+		if strings.HasPrefix(trimmedLine, "*") || strings.HasPrefix(trimmedLine, "//") || isEndLine(trimmedLine) {
 			currentTextBlock = nil
 		}
-		
+
 		switch {
 		case strings.HasPrefix(trimmedLine, "//"):
-			lineContent := strings.TrimSpace(trimmedLine[2:])
-			if parts := strings.SplitN(lineContent, ":", 2); len(parts) == 2 && strings.TrimSpace(parts[0]) == "scene" {
-				currentKnot.Scene = strings.TrimSpace(parts[1])
+			if asset, ok, err := parseAssetLine(trimmedLine[2:]); ok {
+				if err != nil {
+					if err := fail(CodeSyntax, err); err != nil {
+						return err
+					}
+					continue
+				}
+				asset.Line = lineNum
+				currentKnot.Assets = append(currentKnot.Assets, asset)
+				continue
+			}
+			key, value, ok := splitHeaderDirective(trimmedLine)
+			switch {
+			case !ok:
+				// A plain comment.
+			case p.addNote(key, value, currentKnot, pos):
+			case key == "scene":
+				if len(script.Scenes) > 0 && !containsString(script.Scenes, value) {
+					if err := fail(CodeDeclaration, fmt.Errorf("scene '%s' is not declared in the SCENES header", value)); err != nil {
+						return err
+					}
+					continue
+				}
+				currentKnot.Scene = value
+			case isKnownDirective(key):
+				if err := fail(CodeDeclaration, fmt.Errorf("header directive '%s' found inside knot '%s'; header directives must appear before the first knot of a file", key, currentKnot.Name)); err != nil {
+					return err
+				}
+				continue
+			default:
+				if _, err := p.handleDirective(ScopeKnot, key, value, pos, &currentKnot.Directives); err != nil {
+					if err := fail(CodeDirective, err); err != nil {
+						return err
+					}
+				}
 			}
-		case trimmedLine == "END":
+		case isEndLine(trimmedLine):
 			currentKnot.IsEnd = true
+			if label := strings.TrimSpace(strings.TrimPrefix(trimmedLine, "END")); label != "" {
+				label = strings.TrimSpace(strings.TrimPrefix(label, ":"))
+				if !isValidIdentifier(label) {
+					if err := fail(CodeInvalidName, fmt.Errorf("invalid ending name '%s': %s", label, identifierGrammar)); err != nil {
+						return err
+					}
+					continue
+				}
+				currentKnot.EndingName = label
+			}
 		case strings.HasPrefix(trimmedLine, "*"):
 			choice, err := parseChoice(trimmedLine)
 			if err != nil {
-				return nil, fmt.Errorf("failed to parse choice '%s': %w", trimmedLine, err)
+				if err := fail(CodeSyntax, fmt.Errorf("failed to parse choice '%s': %w", trimmedLine, err)); err != nil {
+					return err
+				}
+				continue
 			}
+			choice.Line = lineNum
 			currentKnot.Choices = append(currentKnot.Choices, *choice)
 		case strings.HasPrefix(trimmedLine, "-"):
 			block, err := parseTextBlock(trimmedLine)
 			if err != nil {
-				return nil, err
+				if err := fail(CodeSyntax, err); err != nil {
+					return err
+				}
+				continue
 			}
+			block.Line = lineNum
 			currentKnot.Body = append(currentKnot.Body, *block)
 			currentTextBlock = &currentKnot.Body[len(currentKnot.Body)-1]
 		default:
 			if currentTextBlock != nil {
 				currentTextBlock.Content += "\n" + trimmedLine
 			} else {
-				block := TextBlock{Content: trimmedLine}
+				block := TextBlock{Content: trimmedLine, Line: lineNum}
 				currentKnot.Body = append(currentKnot.Body, block)
 				currentTextBlock = &currentKnot.Body[len(currentKnot.Body)-1]
 			}
 		}
 	}
 	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("scanner error: %w", err)
+		return p.add(&Error{File: source, Line: lineNum + 1, Column: 1, Code: CodeRead, Message: "reading script: " + err.Error(), Err: err})
+	}
+	return nil
+}
+
+// declareKnot registers the knot declared on a line. declErr is the error
+// from splitting the declaration, if any.
+func (p *parser) declareKnot(knotName, tagText string, declErr error, namespace, source string, lineNum int) (*Knot, error) {
+	if declErr != nil {
+		return nil, errorf(CodeSyntax, "%w", declErr)
+	}
+	if knotName == "" {
+		return nil, errorf(CodeSyntax, "found knot with empty name")
+	}
+	if !isValidIdentifier(knotName) {
+		return nil, errorf(CodeInvalidName, "invalid knot name '%s': %s", knotName, identifierGrammar)
+	}
+	if namespace != "" {
+		knotName = namespace + "." + knotName
+	}
+	if existing, ok := p.script.Knots[knotName]; ok {
+		if existing.File == source {
+			return nil, errorf(CodeDuplicate, "duplicate knot '%s' (first defined on line %d)", knotName, existing.Line)
+		}
+		return nil, errorf(CodeDuplicate, "duplicate knot '%s' (first defined at %s)", knotName, location(existing.File, existing.Line))
+	}
+	tags, err := parseKnotTags(tagText)
+	if err != nil {
+		return nil, errorf(codeOf(err, CodeSyntax), "knot '%s': %w", knotName, err)
+	}
+	knot := &Knot{Name: knotName, Namespace: namespace, Tags: tags, File: source, Line: lineNum}
+	p.script.Knots[knotName] = knot
+	return knot, nil
+}
+
+// finish applies script-wide defaults once every source has been parsed and
+// returns the script, or every error found along the way.
+func (p *parser) finish() (*Script, error) {
+	p.resolve()
+	if len(p.errors) > 0 {
+		return nil, errorList(p.errors)
+	}
+	return p.script, nil
+}
+
+// resolve applies script-wide defaults and resolves divert targets, recording
+// any problems. The script is usable afterwards even if errors were found,
+// which lets Validate keep checking a broken script.
+func (p *parser) resolve() {
+	script := p.script
+	if len(p.errors) > maxErrors {
+		return
+	}
+
+	if script.DefaultScene != "" && len(script.Scenes) > 0 && !containsString(script.Scenes, script.DefaultScene) {
+		p.add(errorf(CodeDeclaration, "default scene '%s' is not declared in the SCENES header", script.DefaultScene))
 	}
 
-	for _, knot := range script.Knots {
+	for _, name := range sortedKnotNames(script.Knots) {
+		knot := script.Knots[name]
+		for i := range knot.Choices {
+			if knot.Choices[i].TargetKnot == "" {
+				continue
+			}
+			target, err := resolveKnotName(script.Knots, knot.Namespace, knot.Choices[i].TargetKnot)
+			if err != nil {
+				if p.add(&Error{File: knot.File, Line: knot.Choices[i].Line, Code: CodeAmbiguousKnot, Message: fmt.Sprintf("knot '%s': %v", name, err)}) != nil {
+					return
+				}
+				continue
+			}
+			knot.Choices[i].TargetKnot = target
+		}
+		if knot.Scene == "" {
+			knot.Scene = script.DefaultScene
+		}
 		for i := range knot.Body {
 			knot.Body[i].Content = strings.TrimSpace(knot.Body[i].Content)
 		}
 	}
+}
 
-	return script, nil
+// splitHeaderDirective splits a "// KEY: value" header line into its key and value.
+func splitHeaderDirective(line string) (key, value string, ok bool) {
+	parts := strings.SplitN(strings.TrimSpace(line[2:]), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), true
+}
+
+// resolveKnotName resolves a divert target written inside namespace to a
+// fully qualified knot name. A name in the referring knot's own namespace
+// wins, then an exact (global or already qualified) match, then a unique
+// match in any other namespace. Unknown names are returned unchanged so the
+// graph analysis can report them if they are ever reached.
+func resolveKnotName(knots map[string]*Knot, namespace, name string) (string, error) {
+	if namespace != "" {
+		if _, ok := knots[namespace+"."+name]; ok {
+			return namespace + "." + name, nil
+		}
+	}
+	if _, ok := knots[name]; ok {
+		return name, nil
+	}
+
+	var candidates []string
+	for qualified, knot := range knots {
+		if knot.Namespace != "" && qualified == knot.Namespace+"."+name {
+			candidates = append(candidates, qualified)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return name, nil
+	case 1:
+		return candidates[0], nil
+	default:
+		sort.Strings(candidates)
+		return "", fmt.Errorf("ambiguous knot reference '%s' matches %s", name, strings.Join(candidates, ", "))
+	}
 }
 
 // parseHeaderLine processes a single line from the script header.
-func parseHeaderLine(line string, script *Script) {
-	headerLine := strings.TrimSpace(line[2:])
-	parts := strings.SplitN(headerLine, ":", 2)
-	if len(parts) != 2 {
-		return // It's a simple comment, not a key-value directive.
+// pos locates the line for any warnings it records.
+func (p *parser) parseHeaderLine(line string, pos position) error {
+	script := p.script
+	key, value, ok := splitHeaderDirective(line)
+	if !ok {
+		return nil // It's a simple comment, not a key-value directive.
 	}
-	key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
 
-	switch strings.ToUpper(key) {
-	case "STATES":
-		for _, state := range strings.Split(value, ",") {
-			script.GlobalStates[strings.TrimSpace(state)] = false
+	directive, scope := splitScopedDirective(key)
+	if scope != "" {
+		switch directive {
+		case "LOCAL-STATES":
+			return p.declareSceneStates(scope, StateLocal, value, pos)
+		case "LOCAL-FLAG-STATES":
+			return p.declareSceneStates(scope, StateLocalFlag, value, pos)
 		}
-	case "FLAG-STATES":
-		for _, state := range strings.Split(value, ",") {
-			script.GlobalStates[strings.TrimSpace(state)] = true
+		if containsString(knownDirectives, directive) {
+			return fmt.Errorf("%s cannot be scoped to a scene; only LOCAL-STATES and LOCAL-FLAG-STATES can", directive)
 		}
+	}
+	switch directive {
+	case "STATES":
+		return p.declareStates(StateNormal, value, pos)
+	case "FLAG-STATES":
+		return p.declareStates(StateFlag, value, pos)
 	case "LOCAL-STATES":
-		for _, state := range strings.Split(value, ",") {
-			script.LocalStates[strings.TrimSpace(state)] = true
+		return p.declareStates(StateLocal, value, pos)
+	case "LOCAL-FLAG-STATES":
+		return p.declareStates(StateLocalFlag, value, pos)
+	case "ENDINGS":
+		for _, ending := range strings.Split(value, ",") {
+			ending = strings.TrimSpace(ending)
+			if ending == "" || containsString(script.Endings, ending) {
+				continue
+			}
+			if !isValidIdentifier(ending) {
+				return errorf(CodeInvalidName, "invalid ending name '%s': %s", ending, identifierGrammar)
+			}
+			script.Endings = append(script.Endings, ending)
+		}
+	case "TRACK-VISITS":
+		for _, knot := range strings.Split(value, ",") {
+			knot = strings.TrimSpace(knot)
+			if knot == "" || containsString(script.TrackVisits, knot) {
+				continue
+			}
+			if !isValidIdentifier(knot) {
+				return errorf(CodeInvalidName, "invalid knot name '%s' in TRACK-VISITS: %s", knot, identifierGrammar)
+			}
+			script.TrackVisits = append(script.TrackVisits, knot)
+		}
+	case "TURNS":
+		bound := strings.ReplaceAll(value, " ", "")
+		max, err := strconv.Atoi(strings.TrimPrefix(bound, "max="))
+		if !strings.HasPrefix(bound, "max=") || err != nil || max < 1 {
+			return errorf(CodeDeclaration, "TURNS needs an explicit positive bound, as in 'TURNS: max=15', not '%s'", value)
+		}
+		if script.MaxTurns != 0 && script.MaxTurns != max {
+			script.Warnings = append(script.Warnings, warningAt(pos, CodeRedeclared, "TURNS redefined from max=%d to max=%d", script.MaxTurns, max))
+		}
+		script.MaxTurns = max
+	case "SCENES":
+		for _, scene := range strings.Split(value, ",") {
+			if scene = strings.TrimSpace(scene); scene != "" && !containsString(script.Scenes, scene) {
+				script.Scenes = append(script.Scenes, scene)
+			}
 		}
+	case "STRICT":
+		script.Strict = strings.EqualFold(value, "true")
+	case "DEFAULT-SCENE":
+		if script.DefaultScene != "" && script.DefaultScene != value {
+			script.Warnings = append(script.Warnings, warningAt(pos, CodeRedeclared, "DEFAULT-SCENE redefined from '%s' to '%s'", script.DefaultScene, value))
+		}
+		script.DefaultScene = value
 	default:
+		if handled, err := p.handleDirective(ScopeHeader, key, value, pos, &script.Directives); handled || err != nil {
+			return err
+		}
+		if suggestion, suspicious := nearestDirective(key); suspicious {
+			script.UnknownDirectives = append(script.UnknownDirectives, warningAt(pos, CodeUnknownDirective, "unknown directive '%s' (did you mean '%s'?)", key, suggestion))
+		}
 		// This correctly captures any other metadata like 'title', 'author', or 'description'.
+		if previous, exists := script.Metadata[key]; exists {
+			script.Warnings = append(script.Warnings, warningAt(pos, CodeDuplicateMetadata, "duplicate metadata key '%s' (keeping '%s')", key, previous))
+			return nil
+		}
 		script.Metadata[key] = value
+
+		// The distribution fields are also recognized case-insensitively.
+		var field *string
+		switch strings.ToLower(key) {
+		case "title":
+			field = &script.Title
+		case "author":
+			field = &script.Author
+		case "language":
+			field = &script.Language
+		case "ifid":
+			field = &script.IFID
+		}
+		if field != nil {
+			if *field != "" {
+				script.Warnings = append(script.Warnings, warningAt(pos, CodeDuplicateMetadata, "duplicate metadata key '%s' (keeping '%s')", key, *field))
+			} else {
+				*field = value
+			}
+		}
+	}
+	return nil
+}
+
+// knownDirectives lists the header directives recognized by the parser.
+var knownDirectives = []string{
+	"STATES", "FLAG-STATES", "LOCAL-STATES", "LOCAL-FLAG-STATES", "ENDINGS", "SCENES", "DEFAULT-SCENE",
+	"INCLUDE", "NAMESPACE", "STRICT", "TRACK-VISITS", "TURNS",
+}
+
+// splitScopedDirective upper-cases a directive key and separates an optional
+// scene scope, so "LOCAL-STATES(bedroom)" yields "LOCAL-STATES" and "bedroom".
+func splitScopedDirective(key string) (directive, scope string) {
+	if open := strings.Index(key, "("); open != -1 && strings.HasSuffix(key, ")") {
+		return strings.ToUpper(strings.TrimSpace(key[:open])), strings.TrimSpace(key[open+1 : len(key)-1])
+	}
+	return strings.ToUpper(key), ""
+}
+
+// isKnownDirective reports whether key names a header directive, with or without a scope.
+func isKnownDirective(key string) bool {
+	directive, _ := splitScopedDirective(key)
+	return containsString(knownDirectives, directive)
+}
+
+// metadataFields lists the metadata keys with a field of their own in
+// Script, matched case-insensitively.
+var metadataFields = []string{"title", "author", "language", "ifid"}
+
+// nearestDirective returns the known directive closest to key, and whether key
+// looks like a mistyped directive: either it is written in capitals or it is
+// within an edit distance of 2 of a known directive. Ordinary lowercase
+// metadata keys such as "title" are not suspicious, and the keys in
+// metadataFields never are, whatever their case.
+func nearestDirective(key string) (string, bool) {
+	if containsString(metadataFields, strings.ToLower(key)) {
+		return "", false
+	}
+	upper := strings.ToUpper(key)
+	nearest, best := "", -1
+	for _, directive := range knownDirectives {
+		if d := editDistance(upper, directive); best == -1 || d < best {
+			nearest, best = directive, d
+		}
+	}
+	allCaps := upper == key && strings.ToLower(key) != key
+	return nearest, allCaps || best <= 2
+}
+
+// editDistance computes the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if prev[j]+1 < curr[j] {
+				curr[j] = prev[j] + 1
+			}
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// splitKnotDeclaration recognizes a knot declaration such as "=== cellar === #chapter:2",
+// returning the knot name and any trailing tag text. Fences may be longer than
+// three '=' as long as both sides match. Any other line starting with "==" is
+// reported as a malformed declaration rather than being treated as prose.
+func splitKnotDeclaration(line string) (name, tagText string, ok bool, err error) {
+	if !strings.HasPrefix(line, "==") {
+		return "", "", false, nil
+	}
+	malformed := fmt.Errorf("malformed knot declaration '%s': expected '=== name ===' with matching fences of at least three '='", line)
+
+	openLen := len(line) - len(strings.TrimLeft(line, "="))
+	rest := line[openLen:]
+	end := strings.Index(rest, "=")
+	if openLen < 3 || end == -1 {
+		return "", "", true, malformed
+	}
+	closing := rest[end:]
+	closeLen := len(closing) - len(strings.TrimLeft(closing, "="))
+	if closeLen != openLen {
+		return "", "", true, malformed
+	}
+	return strings.TrimSpace(rest[:end]), strings.TrimSpace(closing[closeLen:]), true, nil
+}
+
+// parseKnotTags parses whitespace-separated "#key:value" tokens from a knot declaration.
+func parseKnotTags(tagText string) (map[string]string, error) {
+	if tagText == "" {
+		return nil, nil
+	}
+	tags := make(map[string]string)
+	for _, token := range strings.Fields(tagText) {
+		if !strings.HasPrefix(token, "#") {
+			return nil, fmt.Errorf("unexpected text '%s' after knot name; tags must start with '#'", token)
+		}
+		key, value := token[1:], ""
+		if i := strings.Index(key, ":"); i != -1 {
+			key, value = key[:i], key[i+1:]
+		}
+		if !isValidIdentifier(key) {
+			return nil, errorf(CodeInvalidName, "invalid tag key '%s': %s", key, identifierGrammar)
+		}
+		if _, exists := tags[key]; exists {
+			return nil, errorf(CodeDuplicate, "duplicate tag key '%s'", key)
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+// isEndLine reports whether a trimmed knot line is an END marker, with or without a label.
+func isEndLine(line string) bool {
+	return line == "END" || strings.HasPrefix(line, "END:")
+}
+
+// containsString reports whether list contains s.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// declareStates records the states listed by a state declaration directive.
+// Declarations may be split across repeated lines; declaring a state with two
+// different kinds is an error, and declaring it twice with the same kind is a
+// warning.
+func (p *parser) declareStates(kind StateKind, value string, pos position) error {
+	states, err := parseStateList(value)
+	if err != nil {
+		return err
+	}
+	script := p.script
+	for _, state := range states {
+		if scene := sceneDeclaring(script, state); scene != "" {
+			return fmt.Errorf("state '%s' declared as %s conflicts with its earlier declaration scoped to scene '%s'", state, kind, scene)
+		}
+		if existing, declared := script.States[state]; declared {
+			if existing != kind {
+				hint := ""
+				if existing.IsFlag() != kind.IsFlag() && existing.IsLocal() != kind.IsLocal() {
+					hint = fmt.Sprintf("; use %s for a flag scoped to a scene", StateLocalFlag)
+				}
+				return fmt.Errorf("state '%s' declared as %s conflicts with its earlier %s declaration%s", state, kind, existing, hint)
+			}
+			script.Warnings = append(script.Warnings, warningAt(pos, CodeRedeclared, "state '%s' is already declared in %s", state, kind))
+			continue
+		}
+		script.States[state] = kind
+	}
+	return nil
+}
+
+// declareSceneStates records local states that only exist inside one scene.
+// The same name may be scoped to several scenes, but not also declared globally.
+func (p *parser) declareSceneStates(scene string, kind StateKind, value string, pos position) error {
+	script := p.script
+	if len(script.Scenes) > 0 && !containsString(script.Scenes, scene) {
+		return fmt.Errorf("scene '%s' is not declared in the SCENES header", scene)
+	}
+	states, err := parseStateList(value)
+	if err != nil {
+		return err
+	}
+	if script.SceneStates[scene] == nil {
+		script.SceneStates[scene] = make(map[string]StateKind)
+	}
+	for _, state := range states {
+		if existing, declared := script.States[state]; declared {
+			return fmt.Errorf("state '%s' scoped to scene '%s' conflicts with its earlier %s declaration", state, scene, existing)
+		}
+		if existing, declared := script.SceneStates[scene][state]; declared {
+			if existing != kind {
+				return fmt.Errorf("state '%s' declared as %s in scene '%s' conflicts with its earlier %s declaration", state, kind, scene, existing)
+			}
+			script.Warnings = append(script.Warnings, warningAt(pos, CodeRedeclared, "state '%s' is already declared in %s(%s)", state, kind, scene))
+			continue
+		}
+		script.SceneStates[scene][state] = kind
+	}
+	return nil
+}
+
+// sceneDeclaring returns the first scene, in name order, that scopes state, or "" if none does.
+func sceneDeclaring(script *Script, state string) string {
+	scenes := make([]string, 0, len(script.SceneStates))
+	for scene, states := range script.SceneStates {
+		if _, ok := states[state]; ok {
+			scenes = append(scenes, scene)
+		}
+	}
+	if len(scenes) == 0 {
+		return ""
+	}
+	sort.Strings(scenes)
+	return scenes[0]
+}
+
+// typedMetadata converts raw header metadata into JSON-friendly typed values.
+func typedMetadata(raw map[string]string) map[string]interface{} {
+	typed := make(map[string]interface{}, len(raw))
+	for key, value := range raw {
+		typed[key] = parseMetadataValue(value)
+	}
+	return typed
+}
+
+// parseMetadataValue interprets a metadata value as a bool, integer, float or
+// comma-separated list, falling back to the raw string. A double-quoted value
+// is always a string, and a list is only recognized when every item is a single
+// word, so prose such as "A dark, stormy night" stays a string.
+func parseMetadataValue(value string) interface{} {
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			return unquoted
+		}
+	}
+	if strings.Contains(value, ",") {
+		items := strings.Split(value, ",")
+		list := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			item = strings.TrimSpace(item)
+			if item == "" || strings.ContainsAny(item, " \t") {
+				return value
+			}
+			list = append(list, parseScalarValue(item))
+		}
+		return list
 	}
+	return parseScalarValue(value)
+}
+
+// parseScalarValue interprets a single metadata value as a bool, integer or float.
+// Numbers must round-trip exactly, so values like "007" or "2024-01-01" stay strings.
+func parseScalarValue(value string) interface{} {
+	switch value {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil && strconv.FormatInt(i, 10) == value {
+		return i
+	}
+	digits := strings.TrimPrefix(value, "-")
+	leadingZero := len(digits) > 1 && digits[0] == '0' && digits[1] != '.'
+	if digits != "" && digits[0] >= '0' && digits[0] <= '9' && !leadingZero {
+		if f, err := strconv.ParseFloat(value, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+			return f
+		}
+	}
+	return value
+}
+
+// parseStateList splits a comma-separated state declaration and validates each name.
+// Empty entries (e.g. from a trailing comma) are ignored.
+func parseStateList(value string) ([]string, error) {
+	var states []string
+	for _, state := range strings.Split(value, ",") {
+		state = strings.TrimSpace(state)
+		if state == "" {
+			continue
+		}
+		if !isValidIdentifier(state) {
+			return nil, errorf(CodeInvalidName, "invalid state name '%s': %s", state, identifierGrammar)
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// identifierGrammar describes the characters accepted by isValidIdentifier, for use in error messages.
+const identifierGrammar = "names may only contain letters, digits, '_' and '.'"
+
+// isValidIdentifier reports whether name is safe to use as a knot or state name.
+// The grammar excludes the delimiters used by generateNodeID ('|', ',' and '=').
+func isValidIdentifier(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
 }
 
 func parseChoice(line string) (*Choice, error) {
@@ -146,9 +922,13 @@ func parseChoice(line string) (*Choice, error) {
 		remainder = strings.TrimSpace(parts[0])
 		for _, change := range parts[1:] {
 			trimmedChange := strings.TrimSpace(change)
-			if trimmedChange != "" {
-				c.StateChanges = append(c.StateChanges, trimmedChange)
+			if trimmedChange == "" {
+				continue
+			}
+			if state, value := splitStateChange(trimmedChange); !isValidIdentifier(state) || (value != "true" && value != "false") {
+				return nil, fmt.Errorf("malformed state change '%s': expected 'state = true|false'", trimmedChange)
 			}
+			c.StateChanges = append(c.StateChanges, trimmedChange)
 		}
 	}
 
@@ -166,14 +946,24 @@ func parseChoice(line string) (*Choice, error) {
 	if c.Text == "" && c.TargetKnot == "" && len(c.StateChanges) == 0 && c.Stitch == "" {
 		return nil, fmt.Errorf("choice appears to be empty")
 	}
+	c.writtenCondition, c.writtenStateChanges = c.Condition, c.StateChanges
 
 	return c, nil
 }
 
 func parseTextBlock(line string) (*TextBlock, error) {
 	b := &TextBlock{}
-	remainder := strings.TrimSpace(line[1:])
-	
+	remainder := line[1:]
+	for _, visit := range []BlockVisit{FirstVisit, Revisit} {
+		marker := visit.marker()
+		if strings.HasPrefix(remainder, marker) && (len(remainder) == 1 || strings.ContainsAny(remainder[1:2], " \t{")) {
+			b.Visit = visit
+			remainder = remainder[len(marker):]
+			break
+		}
+	}
+	remainder = strings.TrimSpace(remainder)
+
 	if start := strings.Index(remainder, "{"); start != -1 {
 		end := strings.Index(remainder, "}")
 		if end == -1 || end < start {
@@ -182,8 +972,7 @@ func parseTextBlock(line string) (*TextBlock, error) {
 		b.Condition = strings.TrimSpace(remainder[start+1 : end])
 		remainder = remainder[:start] + remainder[end+1:]
 	}
-	
+
 	b.Content = strings.TrimSpace(remainder)
 	return b, nil
 }
-
@@ -0,0 +1,126 @@
+package bigif
+
+// PathOptions bounds the playthroughs produced by EnumeratePaths and WalkPaths.
+type PathOptions struct {
+	// MaxDepth is the most choices a path may take. Zero means no limit;
+	// paths are then bounded by MaxRevisits alone.
+	MaxDepth int
+
+	// MaxRevisits is how many times a node may appear again on one path after
+	// its first visit. Zero stops a path as soon as it returns to a node.
+	MaxRevisits int
+
+	// MaxPaths stops the enumeration after this many paths. Zero means no limit.
+	MaxPaths int
+}
+
+// PathStop says why a path ended.
+type PathStop int
+
+const (
+	PathEnded      PathStop = iota // Reached a node with no edges, such as an ending
+	PathRevisited                  // Stepped onto a node more often than MaxRevisits allows
+	PathDepthLimit                 // Took MaxDepth choices
+)
+
+// String returns a short description of the stop reason.
+func (s PathStop) String() string {
+	switch s {
+	case PathRevisited:
+		return "revisited"
+	case PathDepthLimit:
+		return "depth limit"
+	default:
+		return "ended"
+	}
+}
+
+// MarshalText encodes the stop reason as its String form in JSON.
+func (s PathStop) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Path is one playthrough from the start node. Each step names the node and
+// the choice taken to leave it; the final step has an empty Choice.
+type Path struct {
+	Steps []PathStep `json:"steps"`
+	Stop  PathStop   `json:"stop"`
+}
+
+// EnumeratePaths returns every distinct playthrough from the start node within
+// the bounds of opts, in depth-first order with edges followed in choice
+// order. Use WalkPaths to stream paths from large graphs instead.
+func EnumeratePaths(graph *StoryGraph, opts PathOptions) []Path {
+	var paths []Path
+	WalkPaths(graph, opts, func(path Path) bool {
+		paths = append(paths, path)
+		return true
+	})
+	return paths
+}
+
+// WalkPaths calls fn with each playthrough EnumeratePaths would return, in
+// the same order, and stops early when fn returns false. Each Path passed to
+// fn is its own copy and may be retained.
+func WalkPaths(graph *StoryGraph, opts PathOptions, fn func(Path) bool) {
+	if _, ok := graph.Graph[graph.StartNodeID]; !ok {
+		return
+	}
+	w := &pathWalker{graph: graph, opts: opts, fn: fn, visits: make(map[string]int)}
+	w.walk(graph.StartNodeID)
+}
+
+// pathWalker holds the state of one depth-first path enumeration.
+type pathWalker struct {
+	graph   *StoryGraph
+	opts    PathOptions
+	fn      func(Path) bool
+	steps   []PathStep
+	visits  map[string]int // visits of each node on the current path
+	emitted int
+	stopped bool
+}
+
+// walk extends the current path with nodeID and explores its edges.
+func (w *pathWalker) walk(nodeID string) {
+	node := w.graph.Graph[nodeID]
+	w.steps = append(w.steps, PathStep{NodeID: nodeID})
+	w.visits[nodeID]++
+	defer func() {
+		w.steps = w.steps[:len(w.steps)-1]
+		w.visits[nodeID]--
+	}()
+
+	switch {
+	case w.visits[nodeID] > w.opts.MaxRevisits+1:
+		w.emit(PathRevisited)
+		return
+	case node == nil || len(node.Edges) == 0:
+		w.emit(PathEnded)
+		return
+	case w.opts.MaxDepth > 0 && len(w.steps)-1 >= w.opts.MaxDepth:
+		w.emit(PathDepthLimit)
+		return
+	}
+
+	for _, edge := range node.Edges {
+		if w.stopped {
+			return
+		}
+		w.steps[len(w.steps)-1].Choice = edge.Text
+		w.walk(edge.TargetNodeID)
+	}
+}
+
+// emit hands a copy of the current path to the callback.
+func (w *pathWalker) emit(stop PathStop) {
+	if w.stopped {
+		return
+	}
+	steps := make([]PathStep, len(w.steps))
+	copy(steps, w.steps)
+	w.emitted++
+	if !w.fn(Path{Steps: steps, Stop: stop}) || (w.opts.MaxPaths > 0 && w.emitted >= w.opts.MaxPaths) {
+		w.stopped = true
+	}
+}
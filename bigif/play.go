@@ -0,0 +1,148 @@
+package bigif
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NodeForKnot returns the node a player would enter knotName in with every
+// state false, for starting a session in the middle of a story. It fails if
+// the knot has no such node, because that state cannot be reached there.
+// When several nodes qualify, as when they differ in scene-scoped states,
+// the one with the smallest ID is returned.
+func NodeForKnot(graph *StoryGraph, knotName string) (string, error) {
+	var candidates []string
+	for id, node := range graph.Graph {
+		if node.KnotName == knotName {
+			candidates = append(candidates, id)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("knot '%s' has no reachable node", knotName)
+	}
+	sort.Strings(candidates)
+	for _, id := range candidates {
+		allFalse := true
+		for _, value := range graph.Graph[id].State {
+			allFalse = allFalse && !value
+		}
+		if allFalse {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("knot '%s' is never reached with every state false; reachable nodes: %s", knotName, strings.Join(candidates, ", "))
+}
+
+// Play runs session as an interactive game on a terminal: it writes the
+// current node's content and numbered choices to out, reads the player's
+// choice from in, one number per line, and repeats until the story is done.
+// "back" takes back the last choice and "quit" stops early. Input that is
+// not a valid choice is asked for again.
+//
+// Play returns the transcript of the run, without the choices taken back.
+// The end of in stops the game without an error; when ctx is done, Play
+// stops at once and returns the transcript so far with ctx.Err().
+func Play(ctx context.Context, session *Session, in io.Reader, out io.Writer) (Transcript, error) {
+	finish := func() Transcript {
+		transcript := Transcript{Seed: session.Seed(), NodeIDs: session.Visited()}
+		var content []string
+		for _, id := range transcript.NodeIDs {
+			if node := session.Graph().Graph[id]; node != nil && node.Content != "" {
+				content = append(content, node.Content)
+			}
+		}
+		for _, step := range session.History() {
+			transcript.Choices = append(transcript.Choices, step.Text)
+		}
+		transcript.Content = strings.Join(content, "\n\n")
+		transcript.Tags = session.CollectedTags()
+		if node := session.Current(); node != nil && node.IsEnd {
+			transcript.Ended = true
+			transcript.Ending = endingLabel(node)
+		}
+		return transcript
+	}
+
+	// Lines are read on their own goroutine so that a done ctx can stop
+	// Play while it waits for input.
+	lines := make(chan string)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			select {
+			case lines <- strings.TrimSpace(scanner.Text()):
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for {
+		node := session.Current()
+		if node == nil {
+			return finish(), fmt.Errorf("playing: node '%s' does not exist", session.NodeID())
+		}
+		if node.Content != "" {
+			fmt.Fprintf(out, "%s\n\n", node.Content)
+		}
+		if session.Done() {
+			if node.IsEnd {
+				fmt.Fprintf(out, "*** The End: %s ***\n", endingLabel(node))
+			} else {
+				fmt.Fprintln(out, "*** The story stops here. ***")
+			}
+			return finish(), nil
+		}
+
+		choices := session.Choices()
+		for i, edge := range choices {
+			fmt.Fprintf(out, "  %d. %s\n", i+1, edge.Text)
+		}
+		for moved := false; !moved; {
+			fmt.Fprint(out, "> ")
+			var line string
+			var ok bool
+			select {
+			case line, ok = <-lines:
+			case <-ctx.Done():
+				fmt.Fprintln(out)
+				return finish(), ctx.Err()
+			}
+			if !ok {
+				fmt.Fprintln(out)
+				return finish(), nil
+			}
+			switch line {
+			case "quit":
+				return finish(), nil
+			case "back":
+				if err := session.Back(); errors.Is(err, ErrAtStart) {
+					fmt.Fprintln(out, "You are at the start.")
+					continue
+				}
+				fmt.Fprintln(out)
+				moved = true
+				continue
+			}
+			n, err := strconv.Atoi(line)
+			if err != nil || n < 1 || n > len(choices) {
+				fmt.Fprintf(out, "Choose a number from 1 to %d, back or quit.\n", len(choices))
+				continue
+			}
+			if err := session.Choose(n - 1); err != nil {
+				return finish(), fmt.Errorf("playing: %w", err)
+			}
+			fmt.Fprintln(out)
+			moved = true
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package bigif
+
+// CanReach reports whether the player can get from one node to another. A
+// node always reaches itself.
+func (g *StoryGraph) CanReach(fromID, toID string) bool {
+	_, ok := g.WitnessPath(fromID, toID)
+	return ok
+}
+
+// WitnessPath returns a shortest path from one node to another, ending with a
+// step for the target node. Edges are followed in choice order, so the same
+// graph always yields the same witness. It returns false when either node
+// does not exist or the target cannot be reached.
+func (g *StoryGraph) WitnessPath(fromID, toID string) ([]PathStep, bool) {
+	return g.witness(fromID, func(nodeID string, node *StoryNode) bool {
+		return nodeID == toID
+	})
+}
+
+// WitnessPathWithState returns a shortest path from a node to any node of
+// knotName where stateName has the given value on arrival. Because a node ID
+// already fixes its state, this is how to ask "can the player reach this
+// knot having done that?". Ties are broken as in WitnessPath.
+func (g *StoryGraph) WitnessPathWithState(fromID, knotName, stateName string, value bool) ([]PathStep, bool) {
+	return g.witness(fromID, func(nodeID string, node *StoryNode) bool {
+		return node.KnotName == knotName && node.State[stateName] == value
+	})
+}
+
+// witness runs a breadth-first search from fromID and returns the path to
+// the first node accepted.
+func (g *StoryGraph) witness(fromID string, accept func(string, *StoryNode) bool) ([]PathStep, bool) {
+	if _, ok := g.Graph[fromID]; !ok {
+		return nil, false
+	}
+	type parentLink struct {
+		nodeID string
+		choice string
+	}
+	parents := map[string]parentLink{fromID: {}}
+	queue := []string{fromID}
+	for len(queue) > 0 {
+		nodeID := queue[0]
+		queue = queue[1:]
+		if accept(nodeID, g.Graph[nodeID]) {
+			path := []PathStep{{NodeID: nodeID}}
+			for current := nodeID; current != fromID; {
+				link := parents[current]
+				path = append(path, PathStep{NodeID: link.nodeID, Choice: link.choice})
+				current = link.nodeID
+			}
+			for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+				path[i], path[j] = path[j], path[i]
+			}
+			return path, true
+		}
+		for _, edge := range g.Graph[nodeID].Edges {
+			if _, seen := parents[edge.TargetNodeID]; seen {
+				continue
+			}
+			if _, exists := g.Graph[edge.TargetNodeID]; !exists {
+				continue
+			}
+			parents[edge.TargetNodeID] = parentLink{nodeID: nodeID, choice: edge.Text}
+			queue = append(queue, edge.TargetNodeID)
+		}
+	}
+	return nil, false
+}
+
+// shortestChoices returns the choice indexes of a shortest path a session
+// can take from fromID to toID. Among shortest paths it takes the one whose
+// node IDs come first lexically, step by step, so the result does not depend
+// on choice order. END nodes are not passed through, since a session stops
+// there. It returns false when either node does not exist or the target
+// cannot be reached.
+func (g *StoryGraph) shortestChoices(fromID, toID string) ([]int, bool) {
+	if _, ok := g.Graph[fromID]; !ok {
+		return nil, false
+	}
+	if _, ok := g.Graph[toID]; !ok {
+		return nil, false
+	}
+
+	// Distances to toID, from a breadth-first search over reversed edges.
+	reverse := make(map[string][]string)
+	for id, node := range g.Graph {
+		if node.IsEnd {
+			continue
+		}
+		for _, edge := range node.Edges {
+			if _, exists := g.Graph[edge.TargetNodeID]; exists {
+				reverse[edge.TargetNodeID] = append(reverse[edge.TargetNodeID], id)
+			}
+		}
+	}
+	distance := map[string]int{toID: 0}
+	queue := []string{toID}
+	for len(queue) > 0 {
+		nodeID := queue[0]
+		queue = queue[1:]
+		for _, source := range reverse[nodeID] {
+			if _, seen := distance[source]; !seen {
+				distance[source] = distance[nodeID] + 1
+				queue = append(queue, source)
+			}
+		}
+	}
+	if _, ok := distance[fromID]; !ok {
+		return nil, false
+	}
+
+	var choices []int
+	for nodeID := fromID; nodeID != toID; {
+		edges := g.Graph[nodeID].Edges
+		best := -1
+		for i, edge := range edges {
+			d, ok := distance[edge.TargetNodeID]
+			if ok && d == distance[nodeID]-1 && (best < 0 || edge.TargetNodeID < edges[best].TargetNodeID) {
+				best = i
+			}
+		}
+		choices = append(choices, best)
+		nodeID = edges[best].TargetNodeID
+	}
+	return choices, true
+}
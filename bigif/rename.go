@@ -0,0 +1,346 @@
+package bigif
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RenameKnot renames the knot old to new in a script's source and returns
+// the edited source. It rewrites the knot's declaration and every divert to
+// it, including stitch diverts ("-> .old"), and nothing else: comments,
+// prose, choice text and formatting are left byte for byte as they were.
+//
+// The knot's entry in the TRACK-VISITS header and its visit state,
+// visited_<old>, in conditions and state changes are renamed with it.
+//
+// old and new are fully qualified names, as in Script.Knots. A divert
+// written without its namespace stays without it. A knot cannot be moved to
+// another namespace by renaming it. It is an error if old does not exist,
+// new is not a valid name or already names a knot, or the script does not
+// parse. Files pulled in with INCLUDE are not edited.
+func RenameKnot(script string, old, new string) (string, error) {
+	ast, err := parse(script)
+	if err != nil {
+		return "", fmt.Errorf("renaming knot: %w", err)
+	}
+	if _, ok := ast.Knots[old]; !ok {
+		return "", fmt.Errorf("renaming knot: no knot named '%s'", old)
+	}
+	if !isValidIdentifier(new) {
+		return "", fmt.Errorf("renaming knot: invalid knot name '%s': %s", new, identifierGrammar)
+	}
+	if _, ok := ast.Knots[new]; ok {
+		return "", fmt.Errorf("renaming knot: knot '%s' already exists", new)
+	}
+	if ns := ast.Knots[old].Namespace; ns != "" && !strings.HasPrefix(new, ns+".") {
+		return "", fmt.Errorf("renaming knot: '%s' is in namespace '%s', so its new name must start with '%s.'", old, ns, ns)
+	}
+
+	// shorten writes new as briefly as old was written, so a name written
+	// without its namespace stays without it.
+	shorten := func(written string) string {
+		if prefix := strings.TrimSuffix(old, written); strings.HasPrefix(new, prefix) {
+			return new[len(prefix):]
+		}
+		return new
+	}
+	oldVisited, newVisited := visitedState(old), visitedState(new)
+	return rewriteSource(script, old, new, func(line string, l sourceLine) string {
+		switch l.kind {
+		case lineHeader:
+			key, _, ok := splitHeaderDirective(strings.TrimSpace(line))
+			if !ok || !strings.EqualFold(key, "TRACK-VISITS") {
+				break
+			}
+			colon := strings.Index(line, ":")
+			return line[:colon+1] + replaceIdentifierFunc(line[colon+1:], func(written string) string {
+				if resolved, _ := resolveKnotName(ast.Knots, "", written); resolved == old {
+					return shorten(written)
+				}
+				return written
+			})
+		case lineKnot:
+			name, start, ok := knotNameSpan(line)
+			if ok && qualify(l.namespace, name) == old {
+				return splice(line, start, start+len(name), strings.TrimPrefix(new, l.namespace+"."))
+			}
+		case lineChoice:
+			spans := splitChoiceLine(line)
+			if spans.target[0] != spans.target[1] {
+				written := line[spans.target[0]:spans.target[1]]
+				var resolved string
+				if strings.HasPrefix(written, ".") {
+					knot := ast.Knots[l.knot]
+					resolved = choiceTarget(knot, Choice{Stitch: written}, ast)
+				} else {
+					resolved, _ = resolveKnotName(ast.Knots, l.namespace, written)
+				}
+				if resolved == old {
+					replacement := shorten(strings.TrimPrefix(written, "."))
+					if strings.HasPrefix(written, ".") {
+						replacement = "." + replacement
+					}
+					line = splice(line, spans.target[0], spans.target[1], replacement)
+				}
+			}
+			line = splice(line, spans.changes[0], spans.changes[1], replaceIdentifier(line[spans.changes[0]:spans.changes[1]], oldVisited, newVisited))
+			return splice(line, spans.condition[0], spans.condition[1], replaceIdentifier(line[spans.condition[0]:spans.condition[1]], oldVisited, newVisited))
+		case lineTextBlock:
+			start, end := conditionSpan(line, strings.Index(line, "-")+1, len(line))
+			return splice(line, start, end, replaceIdentifier(line[start:end], oldVisited, newVisited))
+		case lineAsset:
+			start, end := conditionSpan(line, strings.Index(line, "//")+2, len(line))
+			return splice(line, start, end, replaceIdentifier(line[start:end], oldVisited, newVisited))
+		}
+		return line
+	})
+}
+
+// RenameState renames the state old to new in a script's source and returns
+// the edited source. It rewrites the state's declaration in the header
+// (including scene-scoped LOCAL-STATES) and every use in choice, text
+// block and asset conditions and in state changes, and nothing else: comments, prose,
+// choice text and formatting are left byte for byte as they were.
+//
+// It is an error if old is not declared, new is not a valid name or is
+// already declared, or the script does not parse. Files pulled in with
+// INCLUDE are not edited.
+func RenameState(script string, old, new string) (string, error) {
+	ast, err := parse(script)
+	if err != nil {
+		return "", fmt.Errorf("renaming state: %w", err)
+	}
+	if !ast.declaresState(old) {
+		return "", fmt.Errorf("renaming state: no state named '%s'", old)
+	}
+	if !isValidIdentifier(new) {
+		return "", fmt.Errorf("renaming state: invalid state name '%s': %s", new, identifierGrammar)
+	}
+	if ast.declaresState(new) {
+		return "", fmt.Errorf("renaming state: state '%s' already exists", new)
+	}
+
+	return rewriteSource(script, old, new, func(line string, l sourceLine) string {
+		switch l.kind {
+		case lineHeader:
+			key, _, ok := splitHeaderDirective(strings.TrimSpace(line))
+			if !ok {
+				break
+			}
+			switch directive, _ := splitScopedDirective(key); directive {
+			case "STATES", "FLAG-STATES", "LOCAL-STATES", "LOCAL-FLAG-STATES":
+				colon := strings.Index(line, ":")
+				return line[:colon+1] + replaceIdentifier(line[colon+1:], old, new)
+			}
+		case lineChoice:
+			spans := splitChoiceLine(line)
+			line = splice(line, spans.changes[0], spans.changes[1], replaceIdentifier(line[spans.changes[0]:spans.changes[1]], old, new))
+			return splice(line, spans.condition[0], spans.condition[1], replaceIdentifier(line[spans.condition[0]:spans.condition[1]], old, new))
+		case lineTextBlock:
+			start, end := conditionSpan(line, strings.Index(line, "-")+1, len(line))
+			return splice(line, start, end, replaceIdentifier(line[start:end], old, new))
+		case lineAsset:
+			start, end := conditionSpan(line, strings.Index(line, "//")+2, len(line))
+			return splice(line, start, end, replaceIdentifier(line[start:end], old, new))
+		}
+		return line
+	})
+}
+
+// declaresState reports whether name is declared, globally or in any scene.
+func (s *Script) declaresState(name string) bool {
+	if _, ok := s.States[name]; ok {
+		return true
+	}
+	return sceneDeclaring(s, name) != ""
+}
+
+// lineKind classifies a source line the way parseSource reads it.
+type lineKind int
+
+const (
+	lineOther     lineKind = iota
+	lineHeader             // A "//" line before the file's first knot
+	lineKnot               // A knot declaration
+	lineChoice             // A "*" choice inside a knot
+	lineTextBlock          // A "-" text block inside a knot
+	lineAsset              // A "// image:" or "// audio:" line inside a knot
+)
+
+// sourceLine is what rewriteSource knows about a line when it passes it on.
+type sourceLine struct {
+	kind      lineKind
+	namespace string // Namespace of the file so far
+	knot      string // Qualified name of the enclosing knot, for choices
+}
+
+// rewriteSource passes each line of script to edit, with its kind as the
+// parser sees it, and joins the results. Line endings are kept, since edit
+// only ever sees and replaces text inside a line. As a guard against an
+// edit the parser reads differently, the result must still parse, must
+// compile if script did, and must not have more Validate errors.
+func rewriteSource(script, old, new string, edit func(line string, l sourceLine) string) (string, error) {
+	lines := strings.Split(script, "\n")
+	var namespace, knot string
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		l := sourceLine{namespace: namespace, knot: knot}
+		switch {
+		case trimmed == "":
+			continue
+		case knot == "" && strings.HasPrefix(trimmed, "//"):
+			if key, value, ok := splitHeaderDirective(trimmed); ok && strings.EqualFold(key, "NAMESPACE") {
+				namespace = value
+			}
+			l.kind = lineHeader
+		case strings.HasPrefix(trimmed, "=="):
+			if name, _, ok := knotNameSpan(line); ok {
+				knot = qualify(namespace, name)
+			}
+			l.kind = lineKnot
+		case knot == "":
+		case strings.HasPrefix(trimmed, "//"):
+			if _, ok, _ := parseAssetLine(trimmed[2:]); ok {
+				l.kind = lineAsset
+			}
+		case strings.HasPrefix(trimmed, "*"):
+			l.kind = lineChoice
+		case strings.HasPrefix(trimmed, "-"):
+			l.kind = lineTextBlock
+		}
+		lines[i] = edit(line, l)
+	}
+
+	renamed := strings.Join(lines, "\n")
+	if _, err := parse(renamed); err != nil {
+		return "", fmt.Errorf("renaming '%s' to '%s' broke the script: %w", old, new, err)
+	}
+	if _, err := CompileWithOptions(script, Options{}); err == nil {
+		if _, err := CompileWithOptions(renamed, Options{}); err != nil {
+			return "", fmt.Errorf("renaming '%s' to '%s' broke the script: %w", old, new, err)
+		}
+	}
+	if before, after := validationErrors(script), validationErrors(renamed); len(after) > len(before) {
+		return "", fmt.Errorf("renaming '%s' to '%s' broke the script: %s", old, new, after[0])
+	}
+	return renamed, nil
+}
+
+// validationErrors returns the errors Validate finds in script.
+func validationErrors(script string) []Diagnostic {
+	var errs []Diagnostic
+	for _, d := range Validate(script) {
+		if d.Severity == SeverityError {
+			errs = append(errs, d)
+		}
+	}
+	return errs
+}
+
+// qualify returns the full name of a knot declared as name in namespace.
+func qualify(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// knotNameSpan returns the name in a knot declaration line and its offset
+// in the line, as splitKnotDeclaration reads it.
+func knotNameSpan(line string) (name string, start int, ok bool) {
+	name, _, ok, err := splitKnotDeclaration(strings.TrimSpace(line))
+	if !ok || err != nil || name == "" {
+		return "", 0, false
+	}
+	fence := strings.Index(line, "=")
+	open := fence + len(line[fence:]) - len(strings.TrimLeft(line[fence:], "="))
+	return name, strings.Index(line[open:], name) + open, true
+}
+
+// choiceSpans holds the [start, end) offsets of the parts of a choice line,
+// each empty when the choice has no such part.
+type choiceSpans struct {
+	condition [2]int // Inside the braces
+	changes   [2]int // From the first '~' to the divert
+	target    [2]int // The divert target, without surrounding space
+}
+
+// splitChoiceLine finds the parts of a choice line as parseChoice reads
+// them: the divert is everything after the first "->", state changes start
+// at the first '~' before it, and the condition is between the first '{'
+// and the first '}' before those.
+func splitChoiceLine(line string) choiceSpans {
+	var spans choiceSpans
+	rest := strings.Index(line, "*") + 1
+	end := len(line)
+	if arrow := strings.Index(line[rest:], "->"); arrow != -1 {
+		end = rest + arrow
+		target := strings.TrimSpace(line[end+2:])
+		start := end + 2 + strings.Index(line[end+2:], target)
+		spans.target = [2]int{start, start + len(target)}
+	}
+	if tilde := strings.Index(line[rest:end], "~"); tilde != -1 {
+		spans.changes = [2]int{rest + tilde, end}
+		end = rest + tilde
+	}
+	start, stop := conditionSpan(line, rest, end)
+	spans.condition = [2]int{start, stop}
+	return spans
+}
+
+// conditionSpan returns the offsets of the text between the first '{' and
+// the first '}' of line[from:to], or an empty span if there is none.
+func conditionSpan(line string, from, to int) (int, int) {
+	open := strings.Index(line[from:to], "{")
+	closing := strings.Index(line[from:to], "}")
+	if open == -1 || closing < open {
+		return from, from
+	}
+	return from + open + 1, from + closing
+}
+
+// replaceIdentifier replaces each whole identifier old in text with new.
+// Identifiers are maximal runs of the characters isValidIdentifier allows,
+// so renaming "key" leaves "has_key" alone.
+func replaceIdentifier(text, old, new string) string {
+	return replaceIdentifierFunc(text, func(id string) string {
+		if id == old {
+			return new
+		}
+		return id
+	})
+}
+
+// replaceIdentifierFunc replaces each whole identifier in text with what
+// replace returns for it. External condition names, as in "ext:hard", are
+// not states or knots and are kept, prefix and all.
+func replaceIdentifierFunc(text string, replace func(string) string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		if !isIdentifierByte(text[i]) {
+			b.WriteByte(text[i])
+			i++
+			continue
+		}
+		j := i
+		for j < len(text) && isIdentifierByte(text[j]) {
+			j++
+		}
+		if strings.HasPrefix(text[i:], externalPrefix) || strings.HasSuffix(text[:i], externalPrefix) {
+			b.WriteString(text[i:j])
+		} else {
+			b.WriteString(replace(text[i:j]))
+		}
+		i = j
+	}
+	return b.String()
+}
+
+func isIdentifierByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.'
+}
+
+// splice replaces line[start:end] with s.
+func splice(line string, start, end int, s string) string {
+	return line[:start] + s + line[end:]
+}
@@ -0,0 +1,113 @@
+package bigif
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rule is a style check run by Lint. Rules see the parsed script and report
+// each violation as a Diagnostic placed at the knot or choice it concerns.
+// A rule may leave Severity and Code empty; Lint fills them in as a warning
+// carrying the rule's name.
+type Rule interface {
+	// Name identifies the rule, e.g. "require-scene".
+	Name() string
+	// Check returns the violations found in script.
+	Check(script *Script) []Diagnostic
+}
+
+// DefaultRules returns the built-in rules Lint runs when given none.
+func DefaultRules() []Rule {
+	return []Rule{RequireScene{}, ChoicePunctuation{}, MaxChoices{Limit: 6}}
+}
+
+// Lint parses a script and runs rules over it, DefaultRules if none are
+// given, returning the violations in rule order. A script that cannot be
+// parsed is an error.
+func Lint(scriptContent string, rules ...Rule) ([]Diagnostic, error) {
+	ast, err := Parse(scriptContent)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		rules = DefaultRules()
+	}
+	var diagnostics []Diagnostic
+	for _, rule := range rules {
+		for _, d := range rule.Check(ast) {
+			if d.Severity == "" {
+				d.Severity = SeverityWarning
+			}
+			if d.Code == "" {
+				d.Code = ErrorCode(rule.Name())
+			}
+			diagnostics = append(diagnostics, d)
+		}
+	}
+	return diagnostics, nil
+}
+
+// RequireScene reports knots that do not belong to a scene, either through
+// a "// scene:" line or the DEFAULT-SCENE header.
+type RequireScene struct{}
+
+// Name returns "require-scene".
+func (RequireScene) Name() string { return "require-scene" }
+
+// Check reports every knot without a scene.
+func (r RequireScene) Check(script *Script) []Diagnostic {
+	var diagnostics []Diagnostic
+	for _, name := range sortedKnotNames(script.Knots) {
+		knot := script.Knots[name]
+		if knot.Scene == "" {
+			diagnostics = append(diagnostics, warningAt(position{knot.File, knot.Line}, ErrorCode(r.Name()), "knot '%s' does not declare a scene", name))
+		}
+	}
+	return diagnostics
+}
+
+// ChoicePunctuation reports choice text that does not end with punctuation,
+// such as a full stop, question mark or closing quote. Choices without text,
+// which only divert, are not checked.
+type ChoicePunctuation struct{}
+
+// Name returns "choice-punctuation".
+func (ChoicePunctuation) Name() string { return "choice-punctuation" }
+
+// Check reports every choice whose text ends without punctuation.
+func (r ChoicePunctuation) Check(script *Script) []Diagnostic {
+	var diagnostics []Diagnostic
+	for _, name := range sortedKnotNames(script.Knots) {
+		knot := script.Knots[name]
+		for _, choice := range knot.Choices {
+			if choice.Text == "" {
+				continue
+			}
+			last, _ := utf8.DecodeLastRuneInString(choice.Text)
+			if !unicode.IsPunct(last) {
+				diagnostics = append(diagnostics, warningAt(position{knot.File, choice.Line}, ErrorCode(r.Name()), "knot '%s', choice '%s' does not end with punctuation", name, choice.Text))
+			}
+		}
+	}
+	return diagnostics
+}
+
+// MaxChoices reports knots offering more than Limit choices.
+type MaxChoices struct {
+	Limit int
+}
+
+// Name returns "max-choices".
+func (r MaxChoices) Name() string { return "max-choices" }
+
+// Check reports every knot with more than Limit choices.
+func (r MaxChoices) Check(script *Script) []Diagnostic {
+	var diagnostics []Diagnostic
+	for _, name := range sortedKnotNames(script.Knots) {
+		knot := script.Knots[name]
+		if len(knot.Choices) > r.Limit {
+			diagnostics = append(diagnostics, warningAt(position{knot.File, knot.Line}, ErrorCode(r.Name()), "knot '%s' has %d choices, more than the limit of %d", name, len(knot.Choices), r.Limit))
+		}
+	}
+	return diagnostics
+}
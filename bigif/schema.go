@@ -0,0 +1,224 @@
+package bigif
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+//go:embed output.schema.json
+var outputSchema []byte
+
+// maxSchemaProblems caps the problems listed in a ValidateOutput error.
+const maxSchemaProblems = 10
+
+// OutputSchema returns the JSON Schema (draft 2020-12) of the document
+// produced by Compile and CompileResult.JSON. Each property also carries an
+// "x-shortName" annotation giving its key in FormatCompactJSON. The schema is
+// the file output.schema.json in this package.
+func OutputSchema() []byte {
+	return append([]byte(nil), outputSchema...)
+}
+
+// jsonSchema is the subset of JSON Schema that OutputSchema uses.
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 schemaTypes            `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *schemaOrBool          `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Minimum              *float64               `json:"minimum"`
+	Defs                 map[string]*jsonSchema `json:"$defs"`
+	ShortName            string                 `json:"x-shortName"`
+}
+
+// schemaTypes is the "type" keyword, a single name or a list.
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*t = list
+	return nil
+}
+
+// schemaOrBool is the "additionalProperties" keyword: false forbids other
+// properties, a schema constrains them.
+type schemaOrBool struct {
+	forbidden bool
+	schema    *jsonSchema
+}
+
+func (s *schemaOrBool) UnmarshalJSON(data []byte) error {
+	var allowed bool
+	if err := json.Unmarshal(data, &allowed); err == nil {
+		s.forbidden = !allowed
+		return nil
+	}
+	return json.Unmarshal(data, &s.schema)
+}
+
+// ValidateOutput checks a JSON document against OutputSchema, reporting up
+// to ten problems, each with the JSON pointer of the offending value. A
+// document in the compact format of EncodeGraph, recognized by its "g" key,
+// is checked with the short property names.
+func ValidateOutput(jsonBytes []byte) error {
+	var root jsonSchema
+	if err := json.Unmarshal(outputSchema, &root); err != nil {
+		return fmt.Errorf("reading output schema: %w", err)
+	}
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(jsonBytes))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return fmt.Errorf("invalid output: %w", err)
+	}
+	if decoder.More() {
+		return fmt.Errorf("invalid output: data after the document")
+	}
+
+	v := &schemaValidator{defs: root.Defs}
+	if m, ok := doc.(map[string]interface{}); ok {
+		_, long := m["graph"]
+		_, short := m["g"]
+		v.short = short && !long
+	}
+	v.validate(&root, doc, "")
+	if len(v.problems) == 0 {
+		return nil
+	}
+	problems := v.problems
+	if len(problems) > maxSchemaProblems {
+		problems = append(problems[:maxSchemaProblems:maxSchemaProblems], fmt.Sprintf("and %d more", len(v.problems)-maxSchemaProblems))
+	}
+	return fmt.Errorf("invalid output: %s", strings.Join(problems, "; "))
+}
+
+// schemaValidator collects the problems found in one document.
+type schemaValidator struct {
+	defs     map[string]*jsonSchema
+	short    bool // match properties by their x-shortName
+	problems []string
+}
+
+func (v *schemaValidator) fail(path, format string, args ...interface{}) {
+	if path == "" {
+		path = "/"
+	}
+	v.problems = append(v.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *schemaValidator) validate(s *jsonSchema, value interface{}, path string) {
+	if s.Ref != "" {
+		def, ok := v.defs[strings.TrimPrefix(s.Ref, "#/$defs/")]
+		if !ok {
+			v.fail(path, "unknown schema reference '%s'", s.Ref)
+			return
+		}
+		s = def
+	}
+	if len(s.Type) > 0 && !hasSchemaType(s.Type, value) {
+		v.fail(path, "expected %s, got %s", strings.Join(s.Type, " or "), jsonTypeName(value))
+		return
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		keys := make(map[string]*jsonSchema, len(s.Properties))
+		for name, property := range s.Properties {
+			if v.short && property.ShortName != "" {
+				name = property.ShortName
+			}
+			keys[name] = property
+		}
+		for _, name := range s.Required {
+			if property := s.Properties[name]; v.short && property != nil && property.ShortName != "" {
+				name = property.ShortName
+			}
+			if _, ok := value[name]; !ok {
+				v.fail(path, "missing required property '%s'", name)
+			}
+		}
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			childPath := path + "/" + escapePointer(name)
+			if property, ok := keys[name]; ok {
+				v.validate(property, value[name], childPath)
+			} else if s.AdditionalProperties != nil && s.AdditionalProperties.forbidden {
+				v.fail(childPath, "unexpected property")
+			} else if s.AdditionalProperties != nil && s.AdditionalProperties.schema != nil {
+				v.validate(s.AdditionalProperties.schema, value[name], childPath)
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range value {
+				v.validate(s.Items, item, fmt.Sprintf("%s/%d", path, i))
+			}
+		}
+	case json.Number:
+		if f, err := value.Float64(); err == nil && s.Minimum != nil && f < *s.Minimum {
+			v.fail(path, "%s is less than the minimum %v", value, *s.Minimum)
+		}
+	}
+}
+
+// hasSchemaType reports whether value is one of the JSON Schema types.
+func hasSchemaType(types []string, value interface{}) bool {
+	for _, t := range types {
+		switch t {
+		case "integer":
+			if n, ok := value.(json.Number); ok {
+				if f, err := n.Float64(); err == nil && f == math.Trunc(f) {
+					return true
+				}
+			}
+		case jsonTypeName(value):
+			return true
+		case "number":
+			if _, ok := value.(json.Number); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jsonTypeName names the JSON Schema type of a decoded value.
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// escapePointer escapes a key for use in a JSON pointer.
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
@@ -0,0 +1,529 @@
+package bigif
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrChoiceOutOfRange is wrapped by Choose for an index outside Choices.
+	ErrChoiceOutOfRange = errors.New("choice out of range")
+	// ErrStoryEnded is wrapped by Choose once the session is Done.
+	ErrStoryEnded = errors.New("story has ended")
+	// ErrAtStart is wrapped by Back when there is no choice to take back.
+	ErrAtStart = errors.New("already at the start")
+	// ErrGraphMismatch is wrapped by RestoreSession when a save was made
+	// with a different graph, such as a compile of an edited script.
+	ErrGraphMismatch = errors.New("save does not match the graph")
+	// ErrHookPanic is wrapped by Choose when a hook registered with
+	// OnChoice, OnEnterNode or OnEnd panics.
+	ErrHookPanic = errors.New("hook panicked")
+	// ErrUnreachable is wrapped by GotoNode when no path leads to the node.
+	ErrUnreachable = errors.New("node is unreachable")
+)
+
+// saveVersion is the version of the payload written by Session.Save.
+// Version 1 saves, which listed visited node IDs, are still read.
+const saveVersion = 2
+
+// Step is one move of a session: the choice taken at a node.
+type Step struct {
+	NodeID       string `json:"nodeId"`       // The node the choice was made at
+	Choice       int    `json:"choice"`       // Index of the choice in that node's Choices
+	Text         string `json:"text"`         // Text of the choice
+	TargetNodeID string `json:"targetNodeId"` // The node it led to
+}
+
+// Session plays a compiled graph one choice at a time, the way a game
+// would: show Current, offer Choices, and Choose one until Done. It follows
+// the graph's edges and nothing else, so the same choices always lead to
+// the same nodes. Randomness, as in ChooseRandom, comes from a generator
+// seeded when the session is created, so a session replays exactly from its
+// Seed. A Session is not safe for concurrent use.
+type Session struct {
+	graph   *StoryGraph
+	seed    int64
+	rng     *rand.Rand
+	start   string // The node the session began at
+	nodeID  string
+	history []Step         // Moves from start to nodeID, popped by Back
+	moved   bool           // Whether Choose has ever succeeded
+	carried map[string]int // Node visits from before a forced restore
+
+	onEnterNode []func(*StoryNode)
+	onChoice    []func(*StoryEdge)
+	onEnd       []func(*StoryNode)
+}
+
+// NewSession starts a session at the graph's start node, with a seed read
+// from crypto/rand.
+func NewSession(graph *StoryGraph) *Session {
+	return newSession(graph, graph.StartNodeID, randomSeed())
+}
+
+// NewSessionSeeded starts a session at the graph's start node with the
+// given seed, so that its random choices can be replayed.
+func NewSessionSeeded(graph *StoryGraph, seed int64) *Session {
+	return newSession(graph, graph.StartNodeID, seed)
+}
+
+// NewSessionAt starts a session at the node with the given ID, as if the
+// story began there, with a seed read from crypto/rand.
+func NewSessionAt(graph *StoryGraph, nodeID string) (*Session, error) {
+	if _, ok := graph.Graph[nodeID]; !ok {
+		return nil, fmt.Errorf("starting session: node '%s' does not exist", nodeID)
+	}
+	return newSession(graph, nodeID, randomSeed()), nil
+}
+
+func newSession(graph *StoryGraph, start string, seed int64) *Session {
+	return &Session{graph: graph, seed: seed, rng: rand.New(rand.NewSource(seed)), start: start, nodeID: start}
+}
+
+// randomSeed returns a seed from crypto/rand, or from the clock in the
+// unlikely case that crypto/rand fails.
+func randomSeed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+// Seed returns the seed of the session's random generator.
+func (s *Session) Seed() int64 { return s.seed }
+
+// Graph returns the graph being played.
+func (s *Session) Graph() *StoryGraph { return s.graph }
+
+// NodeID returns the ID of the current node.
+func (s *Session) NodeID() string { return s.nodeID }
+
+// Current returns the current node, or nil if the graph has no node with
+// the current ID.
+func (s *Session) Current() *StoryNode { return s.graph.Graph[s.nodeID] }
+
+// Choices returns the edges the player can take from the current node, in
+// order. It is empty once the session is Done.
+func (s *Session) Choices() []*StoryEdge {
+	node := s.Current()
+	if node == nil || node.IsEnd {
+		return nil
+	}
+	return node.Edges
+}
+
+// OnEnterNode registers a hook that Choose calls with each node it moves
+// to. Because a session is entered when it is created, a hook registered
+// before the first choice is also called at once with the current node, so
+// it sees the start node exactly once. Hooks are called in the order they
+// were registered.
+func (s *Session) OnEnterNode(hook func(*StoryNode)) {
+	s.onEnterNode = append(s.onEnterNode, hook)
+	if node := s.Current(); node != nil && !s.moved {
+		hook(node)
+	}
+}
+
+// OnChoice registers a hook that Choose calls with the edge taken, before
+// the session moves and before the target's OnEnterNode hooks.
+func (s *Session) OnChoice(hook func(*StoryEdge)) {
+	s.onChoice = append(s.onChoice, hook)
+}
+
+// OnEnd registers a hook that Choose calls with an END node after the
+// OnEnterNode hooks for it. Like OnEnterNode, a hook registered before the
+// first choice is called at once if the session starts at an END node.
+func (s *Session) OnEnd(hook func(*StoryNode)) {
+	s.onEnd = append(s.onEnd, hook)
+	if node := s.Current(); node != nil && node.IsEnd && !s.moved {
+		hook(node)
+	}
+}
+
+// Choose takes the choice at index in Choices and moves to its target.
+// It fails, leaving the session where it was, when the session is Done,
+// when index is out of range, or when the edge leads to a node the graph
+// does not have.
+//
+// Hooks run synchronously: OnChoice, then the move, then OnEnterNode and,
+// at an END node, OnEnd. If a hook panics, the hooks after it are skipped
+// and Choose returns an error wrapping ErrHookPanic; the session is where
+// it was if an OnChoice hook panicked, and at the target otherwise. Back
+// and RestoreSession do not call hooks.
+func (s *Session) Choose(index int) error {
+	return s.choose(index, true)
+}
+
+// choose is Choose, calling the hooks only if hooks is true.
+func (s *Session) choose(index int, hooks bool) (err error) {
+	if s.Done() {
+		return fmt.Errorf("choosing at node '%s': %w", s.nodeID, ErrStoryEnded)
+	}
+	choices := s.Choices()
+	if index < 0 || index >= len(choices) {
+		return fmt.Errorf("choosing %d at node '%s' with %d choices: %w", index, s.nodeID, len(choices), ErrChoiceOutOfRange)
+	}
+	edge := choices[index]
+	if _, ok := s.graph.Graph[edge.TargetNodeID]; !ok {
+		return fmt.Errorf("choosing %d at node '%s': target node '%s' does not exist", index, s.nodeID, edge.TargetNodeID)
+	}
+	from := s.nodeID
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("choosing %d at node '%s': %w: %v", index, from, ErrHookPanic, r)
+		}
+	}()
+	onChoice, onEnterNode, onEnd := s.onChoice, s.onEnterNode, s.onEnd
+	if !hooks {
+		onChoice, onEnterNode, onEnd = nil, nil, nil
+	}
+	for _, hook := range onChoice {
+		hook(edge)
+	}
+	s.history = append(s.history, Step{NodeID: s.nodeID, Choice: index, Text: edge.Text, TargetNodeID: edge.TargetNodeID})
+	s.nodeID = edge.TargetNodeID
+	s.moved = true
+	target := s.Current()
+	for _, hook := range onEnterNode {
+		hook(target)
+	}
+	if target.IsEnd {
+		for _, hook := range onEnd {
+			hook(target)
+		}
+	}
+	return nil
+}
+
+// ChooseRandom takes a uniformly random choice with the session's generator
+// and returns its index. From the start node, a session seeded with seed
+// follows the same path as Simulate with that seed. It fails like Choose.
+//
+// The compiler does not produce weighted edges or shuffled text yet; when
+// it does, they will be resolved with the same generator.
+func (s *Session) ChooseRandom() (int, error) {
+	if s.Done() {
+		return -1, fmt.Errorf("choosing at node '%s': %w", s.nodeID, ErrStoryEnded)
+	}
+	index := s.rng.Intn(len(s.Choices()))
+	return index, s.Choose(index)
+}
+
+// GotoOptions controls GotoNodeWithOptions. The zero value gives the
+// behaviour of GotoNode.
+type GotoOptions struct {
+	// SkipHooks replays the path without calling any hooks, which is
+	// faster when nothing is listening for the steps on the way.
+	SkipHooks bool
+}
+
+// GotoNode plays the session to the node with the given ID, for jumping to
+// a spot a tester reported. It takes a shortest path from the current node,
+// or, if there is none, goes back to the start node and takes a shortest
+// path from there. Ties between paths are broken by node ID, so the same
+// graph always gives the same path. The steps are taken with Choose, hooks
+// included, and end up in History.
+//
+// GotoNode fails with an error wrapping ErrUnreachable, leaving the session
+// where it was, when neither node leads to the target. If a hook panics on
+// the way, the session stays where the panic happened.
+func (s *Session) GotoNode(nodeID string) error {
+	return s.GotoNodeWithOptions(nodeID, GotoOptions{})
+}
+
+// GotoNodeWithOptions is GotoNode with options.
+func (s *Session) GotoNodeWithOptions(nodeID string, opts GotoOptions) error {
+	if _, ok := s.graph.Graph[nodeID]; !ok {
+		return fmt.Errorf("going to node '%s': node does not exist", nodeID)
+	}
+	choices, ok := s.graph.shortestChoices(s.nodeID, nodeID)
+	if !ok {
+		if choices, ok = s.graph.shortestChoices(s.start, nodeID); !ok {
+			return fmt.Errorf("going to node '%s' from node '%s' or the start node '%s': %w", nodeID, s.nodeID, s.start, ErrUnreachable)
+		}
+		s.history = nil
+		s.nodeID = s.start
+	}
+	for _, index := range choices {
+		if err := s.choose(index, !opts.SkipHooks); err != nil {
+			return fmt.Errorf("going to node '%s': %w", nodeID, err)
+		}
+	}
+	return nil
+}
+
+// Back takes back the last choice, returning to the node it was made at.
+// It works after the story has ended too, and fails with an error wrapping
+// ErrAtStart when no choice has been made.
+func (s *Session) Back() error {
+	if len(s.history) == 0 {
+		return fmt.Errorf("going back from node '%s': %w", s.nodeID, ErrAtStart)
+	}
+	last := s.history[len(s.history)-1]
+	s.history = s.history[:len(s.history)-1]
+	s.nodeID = last.NodeID
+	return nil
+}
+
+// History returns the choices made so far, oldest first.
+func (s *Session) History() []Step {
+	return append([]Step(nil), s.history...)
+}
+
+// Done reports whether the story is over: the current node is an END node,
+// has no choices, or does not exist.
+func (s *Session) Done() bool {
+	node := s.Current()
+	return node == nil || node.IsEnd || len(node.Edges) == 0
+}
+
+// Visited returns the IDs of the nodes visited so far, from the start node
+// to the current node.
+func (s *Session) Visited() []string {
+	visited := []string{s.start}
+	for _, step := range s.history {
+		visited = append(visited, step.TargetNodeID)
+	}
+	return visited
+}
+
+// VisitedNodes returns the IDs of the nodes the session has entered.
+func (s *Session) VisitedNodes() map[string]bool {
+	visited := make(map[string]bool)
+	for id := range s.visits() {
+		visited[id] = true
+	}
+	return visited
+}
+
+// VisitCount returns how many times the session has entered a node of
+// knotName, counting the start node and every return through a loop.
+func (s *Session) VisitCount(knotName string) int {
+	count := 0
+	for id, n := range s.visits() {
+		if node := s.graph.Graph[id]; node != nil && node.KnotName == knotName {
+			count += n
+		}
+	}
+	return count
+}
+
+// CollectedTags returns the tags of the nodes the session has entered as a
+// multiset: each "key:value" is counted once per visit to a node that has
+// it, or nil if there is none. Edges carry no tags in the compiled output,
+// so choices add none.
+func (s *Session) CollectedTags() map[string]int {
+	return tagCounts(s.graph, s.visits())
+}
+
+// visits counts the times each node has been entered: the nodes carried
+// over by a forced restore, the start node and every step's target. Back
+// takes the visit of the step it undoes away again.
+func (s *Session) visits() map[string]int {
+	visits := make(map[string]int, len(s.carried)+len(s.history)+1)
+	for id, n := range s.carried {
+		visits[id] += n
+	}
+	for _, id := range s.Visited() {
+		visits[id]++
+	}
+	return visits
+}
+
+// tagCounts counts the "key:value" tags of the visited nodes, once per
+// visit, and returns nil when there are none. Nodes missing from graph
+// contribute nothing.
+func tagCounts(graph *StoryGraph, visits map[string]int) map[string]int {
+	var tags map[string]int
+	for id, n := range visits {
+		if node := graph.Graph[id]; node != nil {
+			for key, value := range node.Tags {
+				if tags == nil {
+					tags = make(map[string]int)
+				}
+				tags[key+":"+value] += n
+			}
+		}
+	}
+	return tags
+}
+
+// savedSession is the payload of Session.Save. Visits and CollectedTags
+// follow from the history, but are saved for readers of the payload and for
+// forced restores, which drop the history.
+type savedSession struct {
+	Version       int            `json:"version"`
+	GraphHash     string         `json:"graphHash"`
+	StartNodeID   string         `json:"startNodeId"`
+	NodeID        string         `json:"nodeId"`
+	History       []Step         `json:"history"`
+	Visits        map[string]int `json:"visits,omitempty"`        // Times each node was entered
+	CollectedTags map[string]int `json:"collectedTags,omitempty"` // As returned by CollectedTags
+}
+
+// savedSessionV1 is the version 1 payload, whose history lists the visited
+// node IDs, from the start node to NodeID.
+type savedSessionV1 struct {
+	GraphHash string   `json:"graphHash"`
+	NodeID    string   `json:"nodeId"`
+	History   []string `json:"history"`
+}
+
+// Save returns the session's progress as versioned JSON: the start and
+// current node IDs, the history Back uses, the visit counts and collected
+// tags, and a hash of the graph, so RestoreSession can tell when the graph
+// has changed since.
+func (s *Session) Save() ([]byte, error) {
+	data, err := json.Marshal(savedSession{
+		Version:       saveVersion,
+		GraphHash:     GraphHash(s.graph),
+		StartNodeID:   s.start,
+		NodeID:        s.nodeID,
+		History:       s.History(),
+		Visits:        s.visits(),
+		CollectedTags: s.CollectedTags(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("saving session: %w", err)
+	}
+	return data, nil
+}
+
+// RestoreOptions controls RestoreSessionWithOptions. The zero value gives
+// the behaviour of RestoreSession.
+type RestoreOptions struct {
+	// Force restores a save made with a different graph, as long as the
+	// saved current node still exists. The history is dropped, so the
+	// session continues from that node as if it had started there, but
+	// the saved visits are kept for VisitCount and CollectedTags.
+	Force bool
+}
+
+// RestoreSession continues a session saved with Save, history included, with
+// a new seed, because the state of the random generator is not saved. It
+// fails with an error wrapping ErrGraphMismatch if the save was made with a
+// different graph, and for a payload it cannot read.
+func RestoreSession(graph *StoryGraph, data []byte) (*Session, error) {
+	return RestoreSessionWithOptions(graph, data, RestoreOptions{})
+}
+
+// RestoreSessionWithOptions is RestoreSession with options.
+func RestoreSessionWithOptions(graph *StoryGraph, data []byte, opts RestoreOptions) (*Session, error) {
+	saved, err := readSave(graph, data)
+	if err != nil {
+		return nil, fmt.Errorf("restoring session: %w", err)
+	}
+	if _, ok := graph.Graph[saved.NodeID]; !ok {
+		if saved.GraphHash != GraphHash(graph) {
+			return nil, fmt.Errorf("restoring session: node '%s' does not exist: %w", saved.NodeID, ErrGraphMismatch)
+		}
+		return nil, fmt.Errorf("restoring session: node '%s' does not exist", saved.NodeID)
+	}
+	if saved.GraphHash != GraphHash(graph) {
+		if !opts.Force {
+			return nil, fmt.Errorf("restoring session at node '%s': %w", saved.NodeID, ErrGraphMismatch)
+		}
+		session := newSession(graph, saved.NodeID, randomSeed())
+		if len(saved.Visits) > 0 {
+			// The saved node is counted again as the new start node.
+			session.carried = saved.Visits
+			session.carried[saved.NodeID]--
+		}
+		return session, nil
+	}
+
+	// Replay the history, so a tampered save cannot put the session
+	// somewhere its moves do not lead.
+	session := newSession(graph, saved.StartNodeID, randomSeed())
+	if _, ok := graph.Graph[saved.StartNodeID]; !ok {
+		return nil, fmt.Errorf("restoring session: start node '%s' does not exist", saved.StartNodeID)
+	}
+	for i, step := range saved.History {
+		if step.NodeID != session.nodeID {
+			return nil, fmt.Errorf("restoring session: history step %d is at node '%s', not '%s'", i, step.NodeID, session.nodeID)
+		}
+		if err := session.Choose(step.Choice); err != nil {
+			return nil, fmt.Errorf("restoring session: history step %d: %w", i, err)
+		}
+		if session.nodeID != step.TargetNodeID {
+			return nil, fmt.Errorf("restoring session: history step %d leads to '%s', not '%s'", i, session.nodeID, step.TargetNodeID)
+		}
+	}
+	if session.nodeID != saved.NodeID {
+		return nil, fmt.Errorf("restoring session: history does not end at node '%s'", saved.NodeID)
+	}
+	return session, nil
+}
+
+// readSave decodes a save of any version into the current payload. The
+// node IDs of a version 1 history become steps taking the first choice of
+// graph that leads from each node to the next, or choice -1 if none does.
+func readSave(graph *StoryGraph, data []byte) (*savedSession, error) {
+	var version struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &version); err != nil {
+		return nil, err
+	}
+	switch version.Version {
+	case saveVersion:
+		var saved savedSession
+		err := json.Unmarshal(data, &saved)
+		return &saved, err
+	case 1:
+		var old savedSessionV1
+		if err := json.Unmarshal(data, &old); err != nil {
+			return nil, err
+		}
+		if len(old.History) == 0 {
+			return nil, fmt.Errorf("version 1 save has no history")
+		}
+		saved := &savedSession{Version: saveVersion, GraphHash: old.GraphHash, StartNodeID: old.History[0], NodeID: old.NodeID}
+		for i := 1; i < len(old.History); i++ {
+			step := Step{NodeID: old.History[i-1], Choice: -1, TargetNodeID: old.History[i]}
+			if node, ok := graph.Graph[step.NodeID]; ok {
+				for j, edge := range node.Edges {
+					if edge.TargetNodeID == step.TargetNodeID {
+						step.Choice, step.Text = j, edge.Text
+						break
+					}
+				}
+			}
+			saved.History = append(saved.History, step)
+		}
+		return saved, nil
+	default:
+		return nil, fmt.Errorf("unsupported save version %d", version.Version)
+	}
+}
+
+// GraphHash returns a hex SHA-256 of the shape of the graph: the start node
+// and every node's ID, END flag and edge targets in order. Text is left out,
+// so a save restores under another translation or after a typo fix, and so
+// are source positions, metadata and warnings.
+func GraphHash(graph *StoryGraph) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "start %q\n", graph.StartNodeID)
+	ids := make([]string, 0, len(graph.Graph))
+	for id := range graph.Graph {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		node := graph.Graph[id]
+		fmt.Fprintf(h, "node %q %t\n", id, node.IsEnd)
+		for _, edge := range node.Edges {
+			fmt.Fprintf(h, "edge %q\n", edge.TargetNodeID)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
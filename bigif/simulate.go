@@ -0,0 +1,95 @@
+package bigif
+
+import (
+	"math/rand"
+	"strings"
+)
+
+// Transcript records one playthrough, simulated or played with Play.
+type Transcript struct {
+	Seed    int64    `json:"seed"`    // The Simulate seed, or the session's Seed for a played run
+	NodeIDs []string `json:"nodeIds"` // Visited nodes, starting with the start node
+	Choices []string `json:"choices"` // Text of the edge taken at each node but the last
+	Content string   `json:"content"` // Content of the visited nodes, separated by blank lines
+	Ended   bool     `json:"ended"`   // Whether the run stopped on an END node
+	Ending  string   `json:"ending,omitempty"`
+
+	Tags map[string]int `json:"tags,omitempty"` // Tags of the visited nodes, counted as in Session.CollectedTags
+}
+
+// Simulate plays through graph from the start node, picking a uniformly
+// random edge at every node. It stops at an END node, at a node without
+// edges, or after maxSteps choices (zero means no cap, which may not
+// terminate on a graph with loops). The same seed always gives the same
+// transcript.
+func Simulate(graph *StoryGraph, seed int64, maxSteps int) Transcript {
+	rng := rand.New(rand.NewSource(seed))
+	transcript := Transcript{Seed: seed}
+	var content []string
+
+	nodeID := graph.StartNodeID
+	for {
+		node, ok := graph.Graph[nodeID]
+		if !ok {
+			break
+		}
+		transcript.NodeIDs = append(transcript.NodeIDs, nodeID)
+		if node.Content != "" {
+			content = append(content, node.Content)
+		}
+		if node.IsEnd {
+			transcript.Ended = true
+			transcript.Ending = endingLabel(node)
+			break
+		}
+		if len(node.Edges) == 0 || (maxSteps > 0 && len(transcript.Choices) >= maxSteps) {
+			break
+		}
+		edge := node.Edges[rng.Intn(len(node.Edges))]
+		transcript.Choices = append(transcript.Choices, edge.Text)
+		nodeID = edge.TargetNodeID
+	}
+	transcript.Content = strings.Join(content, "\n\n")
+	transcript.Tags = tagCounts(graph, countVisits(transcript.NodeIDs))
+	return transcript
+}
+
+// countVisits counts the times each node ID appears in nodeIDs.
+func countVisits(nodeIDs []string) map[string]int {
+	visits := make(map[string]int, len(nodeIDs))
+	for _, id := range nodeIDs {
+		visits[id]++
+	}
+	return visits
+}
+
+// SimulationSummary aggregates many simulated playthroughs.
+type SimulationSummary struct {
+	Runs       int            `json:"runs"`
+	Endings    map[string]int `json:"endings"`    // Runs finishing at each ending, keyed as in Transcript.Ending
+	Unfinished int            `json:"unfinished"` // Runs that hit the step cap or a dead end
+}
+
+// SimulateEndings runs Simulate with seeds 0 to runs-1 and counts how often
+// each ending is reached.
+func SimulateEndings(graph *StoryGraph, runs, maxSteps int) SimulationSummary {
+	summary := SimulationSummary{Runs: runs, Endings: make(map[string]int)}
+	for seed := 0; seed < runs; seed++ {
+		transcript := Simulate(graph, int64(seed), maxSteps)
+		if transcript.Ended {
+			summary.Endings[transcript.Ending]++
+		} else {
+			summary.Unfinished++
+		}
+	}
+	return summary
+}
+
+// endingLabel names the ending an END node realizes: its ending name, or its
+// knot name for an unnamed ending.
+func endingLabel(node *StoryNode) string {
+	if node.EndingName != "" {
+		return node.EndingName
+	}
+	return node.KnotName
+}
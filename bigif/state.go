@@ -0,0 +1,156 @@
+package bigif
+
+import (
+	"encoding/binary"
+	"sort"
+	"strings"
+)
+
+// stateLayout assigns every state name that can appear in a node a fixed bit
+// position, so graph construction can work on compact bit vectors instead of
+// copying maps. Names are sorted, so walking the bits in order visits states
+// in the same order generateNodeID uses.
+type stateLayout struct {
+	names []string
+	index map[string]int
+	words int // uint64 words per half of a stateVector
+
+	idParts [][2]string // "name=false" and "name=true" for each state, as node IDs spell them
+	idLen   int         // Length of the state part of a node ID holding every state
+}
+
+// newStateLayout collects every declared state, every scene-scoped state and
+// every state assigned by a choice (undeclared states are tracked once set).
+func newStateLayout(ast *Script) *stateLayout {
+	seen := make(map[string]bool)
+	for state := range ast.States {
+		seen[state] = true
+	}
+	for _, states := range ast.SceneStates {
+		for state := range states {
+			seen[state] = true
+		}
+	}
+	for _, knot := range ast.Knots {
+		for _, choice := range knot.Choices {
+			for _, change := range choice.StateChanges {
+				seen[strings.TrimSpace(strings.SplitN(change, "=", 2)[0])] = true
+			}
+		}
+	}
+
+	layout := &stateLayout{index: make(map[string]int, len(seen))}
+	for state := range seen {
+		layout.names = append(layout.names, state)
+	}
+	sort.Strings(layout.names)
+	layout.idParts = make([][2]string, len(layout.names))
+	for i, state := range layout.names {
+		layout.index[state] = i
+		layout.idParts[i] = [2]string{state + "=false", state + "=true"}
+		layout.idLen += len(layout.idParts[i][0]) + 1
+	}
+	layout.words = (len(layout.names) + 63) / 64
+	return layout
+}
+
+// stateVector is the state of one node. The first half records which states
+// are present (scene-scoped and undeclared states come and go); the second
+// half holds their values.
+type stateVector []uint64
+
+func (l *stateLayout) newVector() stateVector {
+	return make(stateVector, 2*l.words)
+}
+
+func (v stateVector) clone() stateVector {
+	c := make(stateVector, len(v))
+	copy(c, v)
+	return c
+}
+
+// set marks the state at index i present with the given value.
+func (l *stateLayout) set(v stateVector, i int, value bool) {
+	word, bit := i/64, uint64(1)<<(uint(i)%64)
+	v[word] |= bit
+	if value {
+		v[l.words+word] |= bit
+	} else {
+		v[l.words+word] &^= bit
+	}
+}
+
+// get returns the value of the state at index i, false when it is absent.
+func (l *stateLayout) get(v stateVector, i int) bool {
+	word, bit := i/64, uint64(1)<<(uint(i)%64)
+	return v[l.words+word]&bit != 0
+}
+
+// remove drops the state at index i from the vector.
+func (l *stateLayout) remove(v stateVector, i int) {
+	word, bit := i/64, uint64(1)<<(uint(i)%64)
+	v[word] &^= bit
+	v[l.words+word] &^= bit
+}
+
+func (l *stateLayout) fromMap(state map[string]bool) stateVector {
+	v := l.newVector()
+	for name, value := range state {
+		if i, ok := l.index[name]; ok {
+			l.set(v, i, value)
+		}
+	}
+	return v
+}
+
+// toMap materializes the vector as the map stored on a StoryNode.
+func (l *stateLayout) toMap(v stateVector) map[string]bool {
+	state := make(map[string]bool)
+	for i, name := range l.names {
+		word, bit := i/64, uint64(1)<<(uint(i)%64)
+		if v[word]&bit != 0 {
+			state[name] = v[l.words+word]&bit != 0
+		}
+	}
+	return state
+}
+
+// key returns a compact string identifying a knot in this state, for use as a
+// map key during graph construction. It is not a node ID.
+func (v stateVector) key(knotName string) string {
+	b := make([]byte, len(knotName)+1+8*len(v))
+	n := copy(b, knotName)
+	n++ // zero separator
+	for _, word := range v {
+		binary.LittleEndian.PutUint64(b[n:], word)
+		n += 8
+	}
+	return string(b)
+}
+
+// nodeID returns the same ID generateNodeID builds from the map form of v,
+// without materializing the map or sorting its names again. The ID is built
+// in a single allocation from the parts precomputed by newStateLayout.
+func (l *stateLayout) nodeID(knotName string, v stateVector) string {
+	var b strings.Builder
+	b.Grow(len(knotName) + 1 + l.idLen)
+	b.WriteString(knotName)
+	b.WriteByte('|')
+	first := true
+	for i, parts := range l.idParts {
+		word, bit := i/64, uint64(1)<<(uint(i)%64)
+		if v[word]&bit == 0 {
+			continue
+		}
+		if !first {
+			b.WriteByte(',')
+		}
+		first = false
+		if v[l.words+word]&bit != 0 {
+			b.WriteString(parts[1])
+		} else {
+			b.WriteString(parts[0])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,144 @@
+package bigif
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// StripReport lists what StripUnreachable removed, in source order.
+type StripReport struct {
+	Removed []StrippedSection `json:"removed"`
+}
+
+// StrippedSection is one removed part of a script: a whole knot that
+// produced no node, a text block whose condition never held, or a choice
+// leading to a removed knot.
+type StrippedSection struct {
+	KnotName  string `json:"knotName"`
+	Block     int    `json:"block,omitempty"`     // 1-based text block number, zero for a whole knot
+	Choice    int    `json:"choice,omitempty"`    // 1-based choice number, zero unless a choice was removed
+	Target    string `json:"target,omitempty"`    // The removed knot the choice led to
+	Condition string `json:"condition,omitempty"` // The block's or choice's condition
+	StartLine int    `json:"startLine"`
+	EndLine   int    `json:"endLine"` // Last removed line, inclusive
+}
+
+// String describes the section, e.g. "lines 40-52: unreachable knot 'attic'".
+func (s StrippedSection) String() string {
+	lines := fmt.Sprintf("line %d", s.StartLine)
+	if s.EndLine > s.StartLine {
+		lines = fmt.Sprintf("lines %d-%d", s.StartLine, s.EndLine)
+	}
+	switch {
+	case s.Choice > 0:
+		return fmt.Sprintf("%s: %s choice %d, leads to unreachable knot '%s'", lines, s.KnotName, s.Choice, s.Target)
+	case s.Block == 0:
+		return fmt.Sprintf("%s: unreachable knot '%s'", lines, s.KnotName)
+	}
+	return fmt.Sprintf("%s: %s text block %d, condition '%s' is never true", lines, s.KnotName, s.Block, s.Condition)
+}
+
+// StripUnreachable compiles a script and returns its source with the dead
+// content removed: knots that produce no node, and text blocks whose
+// condition was false on every reachable node where it was evaluated, as
+// found by the condition coverage of Analyze. Everything else, comments and
+// blank lines included, is kept byte for byte.
+//
+// A knot is removed from its declaration to its last non-blank line before
+// the next knot, and a text block from its first line to its last non-blank
+// line, so the blank lines between sections stay. Choices leading to a
+// removed knot are removed too: they were never offered, or the knot would
+// have produced a node. The result is compiled and validated again, and an
+// error is returned if it no longer compiles or Validate finds an error the
+// script did not have.
+func StripUnreachable(script string) (string, StripReport, error) {
+	result, err := CompileWithOptions(script, Options{})
+	if err != nil {
+		return "", StripReport{}, err
+	}
+	graph := result.Graph
+	lines := strings.Split(script, "\n")
+
+	var report StripReport
+	unreachable := make(map[string]bool)
+	for _, knot := range unreachableKnots(graph.script, graph) {
+		if knot.File != "" {
+			continue
+		}
+		unreachable[knot.Name] = true
+		end := knot.Line
+		for i := knot.Line; i < len(lines); i++ {
+			trimmed := strings.TrimSpace(lines[i])
+			if _, _, ok, _ := splitKnotDeclaration(trimmed); ok {
+				break
+			}
+			if trimmed != "" {
+				end = i + 1
+			}
+		}
+		report.Removed = append(report.Removed, StrippedSection{KnotName: knot.Name, StartLine: knot.Line, EndLine: end})
+	}
+	for _, name := range sortedKnotNames(graph.script.Knots) {
+		knot := graph.script.Knots[name]
+		if unreachable[name] || knot.File != "" {
+			continue
+		}
+		for i, choice := range knot.Choices {
+			if target := choiceTarget(knot, choice, graph.script); unreachable[target] {
+				report.Removed = append(report.Removed, StrippedSection{KnotName: name, Choice: i + 1, Target: target, Condition: choice.Condition, StartLine: choice.Line, EndLine: choice.Line})
+			}
+		}
+	}
+	for _, c := range oneSidedConditions(graph) {
+		knot := graph.script.Knots[c.KnotName]
+		if c.Block == 0 || c.Outcome || knot.File != "" {
+			continue
+		}
+		end := c.Line
+		for i := c.Line; i < len(lines); i++ {
+			trimmed := strings.TrimSpace(lines[i])
+			if strings.HasPrefix(trimmed, "*") || strings.HasPrefix(trimmed, "//") || strings.HasPrefix(trimmed, "-") || strings.HasPrefix(trimmed, "==") || isEndLine(trimmed) {
+				break
+			}
+			if trimmed != "" {
+				end = i + 1
+			}
+		}
+		report.Removed = append(report.Removed, StrippedSection{KnotName: c.KnotName, Block: c.Block, Condition: c.Condition, StartLine: c.Line, EndLine: end})
+	}
+	sort.Slice(report.Removed, func(i, j int) bool { return report.Removed[i].StartLine < report.Removed[j].StartLine })
+
+	removed := make([]bool, len(lines))
+	for _, section := range report.Removed {
+		for line := section.StartLine; line <= section.EndLine; line++ {
+			removed[line-1] = true
+		}
+	}
+	kept := make([]string, 0, len(lines))
+	for i, line := range lines {
+		if !removed[i] {
+			kept = append(kept, line)
+		}
+	}
+	stripped := strings.Join(kept, "\n")
+	if _, err := CompileWithOptions(stripped, Options{}); err != nil {
+		return "", report, fmt.Errorf("stripping dead content broke the script: %w", err)
+	}
+	had := make(map[string]bool)
+	for _, d := range Validate(script) {
+		had[validationKey(d)] = true
+	}
+	for _, d := range Validate(stripped) {
+		if d.Severity == SeverityError && !had[validationKey(d)] {
+			return "", report, fmt.Errorf("stripping dead content broke the script: %s", d)
+		}
+	}
+	return stripped, report, nil
+}
+
+// validationKey identifies a finding of Validate regardless of its line,
+// which stripping shifts.
+func validationKey(d Diagnostic) string {
+	return string(d.Code) + " " + d.Message
+}
@@ -0,0 +1,89 @@
+package bigif
+
+import "fmt"
+
+// visitedState returns the name of the flag state that tracks visits to knot.
+func visitedState(knot string) string {
+	return "visited_" + knot
+}
+
+// trackVisits synthesizes the visit states of the knots named by the
+// TRACK-VISITS header and of the knots with "-1" or "-+" text blocks. Each
+// tracked knot gets a flag state visited_<knot>, set by every choice that
+// leaves the knot, so inside the knot it is false on the first arrival and
+// true on every later one, and elsewhere it tells whether the knot has been
+// visited. Only tracked knots get a state, which keeps the growth of the
+// graph to what the script asks for.
+//
+// The visit marker of a block then becomes part of its condition, so the
+// graph splits the knot's nodes into first arrivals and revisits.
+func trackVisits(ast *Script) error {
+	var errs []*Error
+	tracked := make(map[string]bool)
+	for _, name := range ast.TrackVisits {
+		qualified, err := resolveKnotName(ast.Knots, "", name)
+		if err != nil {
+			errs = append(errs, errorf(CodeAmbiguousKnot, "TRACK-VISITS: %v", err))
+			continue
+		}
+		if _, ok := ast.Knots[qualified]; !ok {
+			errs = append(errs, errorf(CodeMissingKnot, "TRACK-VISITS names knot '%s', which does not exist", name))
+			continue
+		}
+		tracked[qualified] = true
+	}
+	for _, name := range sortedKnotNames(ast.Knots) {
+		for _, block := range ast.Knots[name].Body {
+			if block.Visit != AnyVisit {
+				tracked[name] = true
+			}
+		}
+	}
+
+	for _, name := range sortedKnotNames(ast.Knots) {
+		if !tracked[name] {
+			continue
+		}
+		if err := addVisitState(ast, ast.Knots[name]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errorList(errs)
+	}
+	return nil
+}
+
+// addVisitState declares the visit state of knot, sets it on every choice
+// that leaves the knot and adds it to the conditions of the knot's "-1" and
+// "-+" blocks.
+func addVisitState(ast *Script, knot *Knot) *Error {
+	state := visitedState(knot.Name)
+	if ast.declaresState(state) {
+		return &Error{File: knot.File, Line: knot.Line, Code: CodeDeclaration, Message: fmt.Sprintf("cannot track visits to knot '%s': state '%s' is already declared", knot.Name, state)}
+	}
+	ast.States[state] = StateFlag
+	for i, choice := range knot.Choices {
+		if choiceTarget(knot, choice, ast) == "" {
+			continue // Not an edge, and must not become one
+		}
+		knot.Choices[i].StateChanges = append(knot.Choices[i].StateChanges, state+" = true")
+	}
+	for i, block := range knot.Body {
+		var visit string
+		switch block.Visit {
+		case FirstVisit:
+			visit = state + " == false"
+		case Revisit:
+			visit = state + " == true"
+		default:
+			continue
+		}
+		if block.Condition == "" {
+			knot.Body[i].Condition = visit
+		} else {
+			knot.Body[i].Condition = visit + " && " + block.Condition
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package bigif
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// turnsName is the name conditions use for the turn counter.
+const turnsName = "turns"
+
+// turnStates returns the states that hold the turn counter of a script with
+// a TURNS header, in order: the n-th is true once n turns have been taken.
+// Their numbers are zero-padded so that node IDs list them in order.
+func (s *Script) turnStates() []string {
+	states := make([]string, s.MaxTurns)
+	width := len(strconv.Itoa(s.MaxTurns))
+	for i := range states {
+		states[i] = fmt.Sprintf("%s_%0*d", turnsName, width, i+1)
+	}
+	return states
+}
+
+// isTurnState reports whether state holds part of the turn counter.
+func (s *Script) isTurnState(state string) bool {
+	return s.MaxTurns > 0 && containsString(s.turnStates(), state)
+}
+
+// countTurns synthesizes the turn counter of a script with a TURNS header.
+// The counter is kept as one flag state per turn, so it is part of node
+// identity like any other state, and buildGraph sets the next one on every
+// edge until all are set: the counter saturates at the bound instead of
+// growing the graph further. Comparisons of turns with a number are
+// rewritten into conditions on these states.
+func countTurns(ast *Script) error {
+	if ast.MaxTurns == 0 {
+		return nil
+	}
+	var errs []*Error
+	for _, state := range ast.turnStates() {
+		if ast.declaresState(state) {
+			errs = append(errs, errorf(CodeDeclaration, "cannot count turns: state '%s' is already declared", state))
+		}
+		ast.States[state] = StateFlag
+	}
+	if ast.declaresState(turnsName) {
+		errs = append(errs, errorf(CodeDeclaration, "cannot count turns: state '%s' is already declared", turnsName))
+	}
+	if len(errs) > 0 {
+		return errorList(errs)
+	}
+
+	rewrite := func(knot *Knot, line int, condition *string) {
+		rewritten, err := rewriteTurns(*condition, ast)
+		if err != nil {
+			errs = append(errs, &Error{File: knot.File, Line: line, Code: CodeSyntax, Message: fmt.Sprintf("knot '%s': %v", knot.Name, err)})
+		}
+		*condition = rewritten
+	}
+	for _, name := range sortedKnotNames(ast.Knots) {
+		knot := ast.Knots[name]
+		for i := range knot.Body {
+			rewrite(knot, knot.Body[i].Line, &knot.Body[i].Condition)
+		}
+		for i := range knot.Choices {
+			rewrite(knot, knot.Choices[i].Line, &knot.Choices[i].Condition)
+		}
+		for i := range knot.Assets {
+			rewrite(knot, knot.Assets[i].Line, &knot.Assets[i].Condition)
+		}
+	}
+	if len(errs) > 0 {
+		return errorList(errs)
+	}
+	return nil
+}
+
+// turnOperators are the comparisons allowed on turns, longest first so that
+// ">=" is not read as ">".
+var turnOperators = []string{">=", "<=", "==", "!=", ">", "<"}
+
+// rewriteTurns rewrites the comparisons of turns in one condition into
+// conditions on the turn states, returning it unchanged if it has none. A
+// comparison that always holds is dropped, and a condition with one that
+// never does becomes "false", which never holds.
+func rewriteTurns(condition string, ast *Script) (string, error) {
+	if !strings.Contains(condition, turnsName) {
+		return condition, nil
+	}
+	states := ast.turnStates()
+	// atLeast and below give the condition for turns >= n and turns < n.
+	atLeast := func(n int) string {
+		switch {
+		case n <= 0:
+			return ""
+		case n > len(states):
+			return "false"
+		}
+		return states[n-1] + " == true"
+	}
+	below := func(n int) string {
+		switch {
+		case n <= 0:
+			return "false"
+		case n > len(states):
+			return ""
+		}
+		return states[n-1] + " == false"
+	}
+
+	var kept []string
+	for _, part := range strings.Split(condition, "&&") {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, turnsName) || len(part) > len(turnsName) && isIdentifierByte(part[len(turnsName)]) {
+			kept = append(kept, part)
+			continue
+		}
+		rest := strings.TrimSpace(part[len(turnsName):])
+		op := ""
+		for _, candidate := range turnOperators {
+			if strings.HasPrefix(rest, candidate) {
+				op = candidate
+				break
+			}
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(rest, op)))
+		if op == "" || err != nil {
+			return condition, fmt.Errorf("malformed turn condition '%s': expected 'turns' compared with a number, as in 'turns >= 10'", part)
+		}
+		switch op {
+		case ">=":
+			kept = append(kept, atLeast(n))
+		case ">":
+			kept = append(kept, atLeast(n+1))
+		case "<":
+			kept = append(kept, below(n))
+		case "<=":
+			kept = append(kept, below(n+1))
+		case "==":
+			kept = append(kept, atLeast(n), below(n+1))
+		case "!=":
+			switch {
+			case n < 0 || n > len(states):
+			case n == 0:
+				kept = append(kept, atLeast(1))
+			case n == len(states):
+				kept = append(kept, below(n))
+			default:
+				return condition, fmt.Errorf("turn condition '%s' cannot be expressed; use 'turns < %d' or 'turns > %d'", part, n, n)
+			}
+		}
+	}
+
+	var parts []string
+	for _, part := range kept {
+		switch part {
+		case "":
+		case "false":
+			return "false", nil
+		default:
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, " && "), nil
+}
@@ -0,0 +1,136 @@
+package bigif
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ExportTwee renders a graph as a Twee 3 source file for Twine. Each node
+// becomes a passage holding its content followed by one
+// "[[choice text->passage]]" link per edge, tagged "scene:<scene>" and, for
+// END nodes, "end". StoryTitle and StoryData passages name the story, its
+// IFID and the start passage.
+//
+// Passage names are derived from node IDs: Twine reads '|' in a link as a
+// separator, so "cellar|has_key=true,lit=false" becomes
+// "cellar (has_key=true, lit=false)". Compact IDs are used unchanged. Link
+// text is adjusted where it would end the link early or be read as a
+// divider: "[[" and "]]" are spaced apart and "|" and "<-" are replaced.
+func ExportTwee(graph *StoryGraph) ([]byte, error) {
+	if graph == nil {
+		return nil, fmt.Errorf("exporting Twee: graph is nil")
+	}
+	if _, ok := graph.Graph[graph.StartNodeID]; !ok {
+		return nil, fmt.Errorf("exporting Twee: start node '%s' does not exist", graph.StartNodeID)
+	}
+
+	ids := make([]string, 0, len(graph.Graph))
+	names := make(map[string]string, len(graph.Graph))
+	for id := range graph.Graph {
+		ids = append(ids, id)
+		names[id] = tweePassageName(id)
+	}
+	// The start passage comes first, the rest in node ID order.
+	sort.Slice(ids, func(i, j int) bool {
+		if (ids[i] == graph.StartNodeID) != (ids[j] == graph.StartNodeID) {
+			return ids[i] == graph.StartNodeID
+		}
+		return ids[i] < ids[j]
+	})
+
+	title := graph.info.title
+	if title == "" {
+		title = "Untitled Story"
+	}
+	ifid := graph.info.ifid
+	if ifid == "" {
+		ifid = generateIFID(graph.info.title, graph.info.author, graph)
+	}
+	storyData, err := json.MarshalIndent(map[string]string{"ifid": ifid, "start": names[graph.StartNodeID]}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("exporting Twee: %w", err)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, ":: StoryTitle\n%s\n\n:: StoryData\n%s\n", tweeEscapeContent(title), storyData)
+	for _, id := range ids {
+		node := graph.Graph[id]
+		var tags []string
+		if node.Scene != "" {
+			tags = append(tags, "scene:"+strings.Join(strings.Fields(node.Scene), "_"))
+		}
+		if node.IsEnd {
+			tags = append(tags, "end")
+		}
+		fmt.Fprintf(&b, "\n:: %s", tweeEscapeName(names[id]))
+		if len(tags) > 0 {
+			fmt.Fprintf(&b, " [%s]", tweeEscapeName(strings.Join(tags, " ")))
+		}
+		b.WriteString("\n")
+		if node.Content != "" {
+			b.WriteString(tweeEscapeContent(node.Content) + "\n")
+		}
+		if node.Content != "" && len(node.Edges) > 0 {
+			b.WriteString("\n")
+		}
+		for _, edge := range node.Edges {
+			target, ok := names[edge.TargetNodeID]
+			if !ok {
+				return nil, fmt.Errorf("exporting Twee: edge from '%s' leads to unknown node '%s'", id, edge.TargetNodeID)
+			}
+			if text := tweeLinkText(edge.Text); text != "" {
+				fmt.Fprintf(&b, "[[%s->%s]]\n", text, target)
+			} else {
+				fmt.Fprintf(&b, "[[%s]]\n", target)
+			}
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// tweePassageName turns a node ID into a passage name without '|'.
+func tweePassageName(id string) string {
+	i := strings.Index(id, "|")
+	if i == -1 {
+		return id
+	}
+	knot, state := id[:i], id[i+1:]
+	if state == "" {
+		return knot
+	}
+	return knot + " (" + strings.Replace(state, ",", ", ", -1) + ")"
+}
+
+// tweeEscapeName escapes the characters Twee 3 reserves in passage headers.
+func tweeEscapeName(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\\', '[', ']', '{', '}':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// tweeEscapeContent escapes content lines that would otherwise start a new
+// passage.
+func tweeEscapeContent(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "::") {
+			lines[i] = `\` + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// tweeLinkText keeps choice text from breaking out of a link.
+func tweeLinkText(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	return strings.NewReplacer("[[", "[ [", "]]", "] ]", "|", "/", "<-", "< -").Replace(text)
+}
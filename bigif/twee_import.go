@@ -0,0 +1,262 @@
+package bigif
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// tweeLinkPattern matches a Twine link, including a SugarCube setter suffix.
+	tweeLinkPattern = regexp.MustCompile(`\[\[((?:[^\]]|\][^\]])*?)\](?:\[[^\]]*\])?\]`)
+	// tweeMacroPattern matches Harlowe "(name: ...)" and SugarCube "<<name ...>>" macros.
+	tweeMacroPattern = regexp.MustCompile(`<<[^>]*>>|\([A-Za-z][\w-]*:[^)]*\)`)
+)
+
+// tweePassage is one passage of a Twee 3 file.
+type tweePassage struct {
+	name string
+	tags []string
+	line int
+	body []string
+}
+
+// ImportTwee converts a Twee 3 story into a script, one knot per passage.
+// Links become choices: "[[target]]" gets the target as its text, while
+// "[[text->target]]", "[[target<-text]]" and "[[text|target]]" keep their
+// text. A "scene:<name>" tag, or else the first tag, sets the knot's scene,
+// and passages tagged "end" or without links are endings.
+//
+// Passage names are turned into knot names by replacing characters outside
+// the identifier grammar with '_', and the start passage, from StoryData or
+// else the passage named "Start", becomes the "index" knot. Renamed
+// passages, macros, which are removed from the text, and script and
+// stylesheet passages, which are skipped, are reported in Script.Warnings.
+// The script compiles like a parsed one; WriteScript turns it into .biff.
+func ImportTwee(tweeSource string) (*Script, error) {
+	passages, err := parseTweePassages(tweeSource)
+	if err != nil {
+		return nil, fmt.Errorf("importing Twee: %w", err)
+	}
+	script := newParser(nil).script
+
+	start := ""
+	var story []*tweePassage
+	for _, passage := range passages {
+		switch {
+		case passage.name == "StoryTitle":
+			script.Title = strings.TrimSpace(strings.Join(passage.body, "\n"))
+			script.Metadata["title"] = script.Title
+		case passage.name == "StoryData":
+			var data struct {
+				IFID  string `json:"ifid"`
+				Start string `json:"start"`
+			}
+			if err := json.Unmarshal([]byte(strings.Join(passage.body, "\n")), &data); err != nil {
+				return nil, fmt.Errorf("importing Twee: %w", &Error{Line: passage.line, Code: CodeSyntax, Message: "invalid StoryData: " + err.Error(), Err: err})
+			}
+			script.IFID, start = data.IFID, data.Start
+			if data.IFID != "" {
+				script.Metadata["ifid"] = data.IFID
+			}
+		case containsString(passage.tags, "script") || containsString(passage.tags, "stylesheet"):
+			script.Warnings = append(script.Warnings, warningAt(position{"", passage.line}, CodeUnsupportedMacro, "passage '%s' is a script or stylesheet and was skipped", passage.name))
+		default:
+			story = append(story, passage)
+		}
+	}
+	if start == "" {
+		start = "Start"
+	}
+	names := make(map[string]string, len(story))
+	for _, passage := range story {
+		if passage.name == start {
+			names[passage.name] = "index"
+		}
+	}
+	if names[start] == "" {
+		return nil, fmt.Errorf("importing Twee: %w", errorf(CodeStartKnot, "start passage '%s' does not exist", start))
+	}
+	taken := map[string]bool{"index": true}
+	for _, passage := range story {
+		if passage.name == start {
+			continue
+		}
+		base := tweeKnotName(passage.name)
+		name := base
+		for n := 2; taken[name]; n++ {
+			name = base + "_" + strconv.Itoa(n)
+		}
+		taken[name] = true
+		names[passage.name] = name
+	}
+
+	for _, passage := range story {
+		name := names[passage.name]
+		if name != passage.name {
+			script.Warnings = append(script.Warnings, warningAt(position{"", passage.line}, CodeRenamedPassage, "passage '%s' imported as knot '%s'", passage.name, name))
+		}
+		knot := &Knot{Name: name, Line: passage.line}
+		for _, tag := range passage.tags {
+			switch {
+			case tag == "end":
+				knot.IsEnd = true
+			case strings.HasPrefix(tag, "scene:"):
+				knot.Scene = strings.TrimPrefix(tag, "scene:")
+			case knot.Scene == "":
+				knot.Scene = tag
+			}
+		}
+
+		var text []string
+		for i, line := range passage.body {
+			lineNum := passage.line + 1 + i
+			for _, macro := range tweeMacroPattern.FindAllString(line, -1) {
+				script.Warnings = append(script.Warnings, warningAt(position{"", lineNum}, CodeUnsupportedMacro, "passage '%s': unsupported macro '%s' ignored", passage.name, macro))
+			}
+			line = tweeMacroPattern.ReplaceAllString(line, "")
+			line = tweeLinkPattern.ReplaceAllStringFunc(line, func(link string) string {
+				choiceText, target := splitTweeLink(tweeLinkPattern.FindStringSubmatch(link)[1])
+				targetKnot, ok := names[target]
+				if !ok {
+					targetKnot = tweeKnotName(target)
+				}
+				knot.Choices = append(knot.Choices, Choice{Text: choiceText, TargetKnot: targetKnot, Line: lineNum})
+				return choiceText
+			})
+			if strings.HasPrefix(line, `\::`) {
+				line = line[1:]
+			}
+			text = append(text, strings.TrimSpace(line))
+		}
+		if len(knot.Choices) == 0 {
+			knot.IsEnd = true
+		}
+		if content := strings.TrimSpace(strings.Join(text, "\n")); content != "" {
+			knot.Body = []TextBlock{{Content: content, Line: passage.line + 1}}
+		}
+		script.Knots[name] = knot
+	}
+	return script, nil
+}
+
+// parseTweePassages splits a Twee 3 source into passages.
+func parseTweePassages(source string) ([]*tweePassage, error) {
+	var passages []*tweePassage
+	seen := make(map[string]int)
+	var current *tweePassage
+	for i, line := range strings.Split(strings.Replace(source, "\r\n", "\n", -1), "\n") {
+		lineNum := i + 1
+		if !strings.HasPrefix(line, "::") {
+			if current != nil {
+				current.body = append(current.body, line)
+			}
+			continue
+		}
+		name, tags, err := parseTweeHeader(strings.TrimSpace(line[2:]))
+		if err != nil {
+			return nil, &Error{Line: lineNum, Code: CodeSyntax, Message: err.Error(), Err: err}
+		}
+		if first, dup := seen[name]; dup {
+			return nil, &Error{Line: lineNum, Code: CodeDuplicate, Message: fmt.Sprintf("duplicate passage '%s' (first defined on line %d)", name, first)}
+		}
+		seen[name] = lineNum
+		current = &tweePassage{name: name, tags: tags, line: lineNum}
+		passages = append(passages, current)
+	}
+	if len(passages) == 0 {
+		return nil, errorf(CodeSyntax, "no passages found")
+	}
+	for _, passage := range passages {
+		for len(passage.body) > 0 && strings.TrimSpace(passage.body[len(passage.body)-1]) == "" {
+			passage.body = passage.body[:len(passage.body)-1]
+		}
+	}
+	return passages, nil
+}
+
+// parseTweeHeader parses "Name [tag tag] {metadata}", undoing the backslash
+// escapes of reserved characters in the name and tags.
+func parseTweeHeader(header string) (name string, tags []string, err error) {
+	var b strings.Builder
+	i := 0
+	for ; i < len(header); i++ {
+		c := header[i]
+		if c == '\\' && i+1 < len(header) {
+			i++
+			b.WriteByte(header[i])
+			continue
+		}
+		if c == '[' || c == '{' {
+			break
+		}
+		if c == ']' || c == '}' {
+			return "", nil, fmt.Errorf("malformed passage header '%s': unescaped '%c'", header, c)
+		}
+		b.WriteByte(c)
+	}
+	name = strings.TrimSpace(b.String())
+	if name == "" {
+		return "", nil, fmt.Errorf("malformed passage header '%s': empty name", header)
+	}
+	rest := strings.TrimSpace(header[i:])
+	if strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "]")
+		for end > 0 && rest[end-1] == '\\' {
+			next := strings.Index(rest[end+1:], "]")
+			if next == -1 {
+				end = -1
+				break
+			}
+			end += next + 1
+		}
+		if end == -1 {
+			return "", nil, fmt.Errorf("malformed passage header '%s': unclosed tag list", header)
+		}
+		for _, tag := range strings.Fields(rest[1:end]) {
+			tags = append(tags, strings.NewReplacer(`\[`, "[", `\]`, "]", `\\`, `\`).Replace(tag))
+		}
+		rest = strings.TrimSpace(rest[end+1:])
+	}
+	if rest != "" && !strings.HasPrefix(rest, "{") {
+		return "", nil, fmt.Errorf("malformed passage header '%s': unexpected '%s'", header, rest)
+	}
+	return name, tags, nil
+}
+
+// splitTweeLink returns the text and target of a link's inner markup.
+func splitTweeLink(link string) (text, target string) {
+	if i := strings.LastIndex(link, "->"); i != -1 {
+		return strings.TrimSpace(link[:i]), strings.TrimSpace(link[i+2:])
+	}
+	if i := strings.Index(link, "<-"); i != -1 {
+		return strings.TrimSpace(link[i+2:]), strings.TrimSpace(link[:i])
+	}
+	if i := strings.Index(link, "|"); i != -1 {
+		return strings.TrimSpace(link[:i]), strings.TrimSpace(link[i+1:])
+	}
+	link = strings.TrimSpace(link)
+	return link, link
+}
+
+// tweeKnotName turns a passage name into a valid knot name.
+func tweeKnotName(passage string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range passage {
+		if r < 128 && isValidIdentifier(string(r)) {
+			b.WriteRune(r)
+			underscore = false
+		} else if !underscore {
+			b.WriteByte('_')
+			underscore = true
+		}
+	}
+	name := strings.Trim(b.String(), "_")
+	if name == "" {
+		return "passage"
+	}
+	return name
+}
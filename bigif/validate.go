@@ -0,0 +1,137 @@
+package bigif
+
+import (
+	"strings"
+)
+
+// Validate checks a script without building its graph. It parses the script,
+// resolves every divert, checks the syntax of conditions and state changes and
+// the states they name, and runs the lint checks Compile runs before the
+// search. Every knot is checked, reachable or not, and the work grows linearly
+// with the script, so Validate suits editors that check on every keystroke.
+//
+// Validate never fails: problems Compile would report as errors come back as
+// diagnostics with error severity, and a script that cannot be parsed at all
+// still yields whatever could be found. A script with no error diagnostics
+// may still fail to compile on problems that need the graph, such as
+// Options.MaxNodes or dead ends with Options.DeadEndsAsErrors.
+func Validate(scriptContent string) []Diagnostic {
+	p := newParser(nil)
+	p.parseSource("", strings.NewReader(scriptContent))
+	p.resolve()
+
+	var diagnostics []Diagnostic
+	for _, err := range p.errors {
+		diagnostics = append(diagnostics, err.Diagnostic())
+	}
+	if len(p.errors) > maxErrors {
+		return diagnostics
+	}
+
+	ast := p.script
+	diagnostics = append(diagnostics, ast.Warnings...)
+	// The synthesized states are declared, and turn conditions rewritten, as
+	// Compile does before its checks.
+	diagnostics = append(diagnostics, ErrorDiagnostics(trackVisits(ast))...)
+	diagnostics = append(diagnostics, ErrorDiagnostics(countTurns(ast))...)
+	if _, ok := ast.Knots["index"]; !ok {
+		diagnostics = append(diagnostics, errorf(CodeStartKnot, "script must contain a starting knot named 'index'").Diagnostic())
+	}
+	for _, name := range sortedKnotNames(ast.Knots) {
+		diagnostics = append(diagnostics, validateKnot(ast, ast.Knots[name])...)
+	}
+
+	for _, d := range ast.UnknownDirectives {
+		if ast.Strict {
+			d.Severity = SeverityError
+		}
+		diagnostics = append(diagnostics, d)
+	}
+	diagnostics = append(diagnostics, stateUsageWarnings(ast, Options{})...)
+	diagnostics = append(diagnostics, flagResetWarnings(ast)...)
+	diagnostics = append(diagnostics, stuckStateWarnings(ast)...)
+	diagnostics = append(diagnostics, localScopeWarnings(ast, Options{})...)
+	return diagnostics
+}
+
+// validateKnot checks the diverts, state changes and the conditions of the
+// text blocks, assets and choices of one knot.
+func validateKnot(ast *Script, knot *Knot) []Diagnostic {
+	var diagnostics []Diagnostic
+	fail := func(line int, code ErrorCode, format string, args ...interface{}) {
+		err := errorf(code, format, args...)
+		err.File, err.Line = knot.File, line
+		diagnostics = append(diagnostics, err.Diagnostic())
+	}
+	checkState := func(line int, state string) {
+		if _, ok := ast.stateKind(knot.Scene, state); !ok && sceneDeclaring(ast, state) == "" {
+			diagnostics = append(diagnostics, warningAt(position{knot.File, line}, CodeUndeclaredState, "knot '%s' uses undeclared state '%s', which is always false", knot.Name, state))
+		}
+	}
+	checkCondition := func(line int, condition string) {
+		if condition == "false" {
+			return // A turn condition that can never hold, rewritten
+		}
+		for _, part := range strings.Split(condition, "&&") {
+			// External names are not states; their values come from
+			// Options.ExternalConditions when compiling.
+			external := strings.HasPrefix(strings.TrimSpace(part), externalPrefix)
+			state, ok := splitComparison(strings.Replace(part, externalPrefix, "", 1))
+			if !ok {
+				fail(line, CodeSyntax, "malformed condition '%s': expected 'state == true|false' or 'state != true|false'", strings.TrimSpace(part))
+				continue
+			}
+			if !external {
+				checkState(line, state)
+			}
+		}
+	}
+
+	for _, block := range knot.Body {
+		if block.Condition != "" {
+			checkCondition(block.Line, block.Condition)
+		}
+	}
+	for _, asset := range knot.Assets {
+		if asset.Condition != "" {
+			checkCondition(asset.Line, asset.Condition)
+		}
+	}
+	for _, choice := range knot.Choices {
+		if choice.Condition != "" {
+			checkCondition(choice.Line, choice.Condition)
+		}
+		for _, change := range choice.StateChanges {
+			state, value := splitStateChange(change)
+			if !isValidIdentifier(state) || (value != "true" && value != "false") {
+				fail(choice.Line, CodeSyntax, "malformed state change '%s': expected 'state = true|false'", change)
+				continue
+			}
+			checkState(choice.Line, state)
+		}
+		if target := choiceTarget(knot, choice, ast); target != "" {
+			if _, ok := ast.Knots[target]; !ok {
+				fail(choice.Line, CodeMissingKnot, "choice leads to non-existent knot: '%s'", target)
+			}
+		}
+	}
+	return diagnostics
+}
+
+// splitComparison splits one "state == value" or "state != value" part of a
+// condition, reporting whether it is well formed.
+func splitComparison(part string) (state string, ok bool) {
+	op := strings.Index(part, "!=")
+	if op == -1 {
+		op = strings.Index(part, "==")
+	}
+	if op == -1 {
+		return "", false
+	}
+	state = strings.TrimSpace(part[:op])
+	value := strings.TrimSpace(part[op+2:])
+	if !isValidIdentifier(state) || (value != "true" && value != "false") {
+		return "", false
+	}
+	return state, true
+}
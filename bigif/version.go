@@ -0,0 +1,74 @@
+package bigif
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Version is the version of the BigIF engine, written to the "generator"
+// field of the output as "bigif <Version>".
+const Version = "1.0.0"
+
+// FormatVersion is the semantic version of the output document, written to
+// its "formatVersion" field. The minor version goes up when fields are
+// added, the major version when fields are removed, renamed or change
+// meaning, so a reader of major version N can read any N.x document.
+const FormatVersion = "1.3.0"
+
+// TableFormatVersion is written instead of FormatVersion by documents whose
+// nodes refer to top-level tables, as with Options.DedupContent and
+// Options.OmitStates. A node's "content" or "state" means something else
+// there, so a reader of FormatVersion documents must not take them for its
+// own; LoadGraph reads both majors.
+const TableFormatVersion = "2.0.0"
+
+// legacyFormatVersion is assumed for documents written before the
+// "formatVersion" field existed.
+const legacyFormatVersion = "1.0.0"
+
+// ErrIncompatibleVersion is wrapped by the error LoadGraph returns for a
+// document whose major format version this package cannot read.
+var ErrIncompatibleVersion = errors.New("incompatible format version")
+
+// generator is the value of the "generator" field.
+func generator() string {
+	return "bigif " + Version
+}
+
+// formatVersion returns the format version of the documents written for g.
+func (g *StoryGraph) formatVersion() string {
+	if g.dedupContent || g.omitStates {
+		return TableFormatVersion
+	}
+	return FormatVersion
+}
+
+// checkFormatVersion accepts the versions with the major version of
+// FormatVersion or TableFormatVersion. An empty version is a legacy
+// document, read as 1.0.
+func checkFormatVersion(version string) error {
+	if version == "" {
+		version = legacyFormatVersion
+	}
+	major, err := majorVersion(version)
+	if err != nil {
+		return err
+	}
+	supported, _ := majorVersion(FormatVersion)
+	tables, _ := majorVersion(TableFormatVersion)
+	if major != supported && major != tables {
+		return errorf(CodeIncompatibleVersion, "format version %s, this version of bigif reads %d.x and %d.x: %w", version, supported, tables, ErrIncompatibleVersion)
+	}
+	return nil
+}
+
+// majorVersion returns the major part of a "major.minor.patch" version.
+func majorVersion(version string) (int, error) {
+	parts := strings.Split(version, ".")
+	major, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) > 3 || major < 0 {
+		return 0, errorf(CodeMalformedGraph, "invalid format version '%s'", version)
+	}
+	return major, nil
+}
@@ -0,0 +1,102 @@
+package bigif
+
+import "sort"
+
+// WalkAction tells Walk how to go on after a Visitor method returns.
+type WalkAction int
+
+const (
+	Continue     WalkAction = iota // Go on with the node's children, then its siblings
+	SkipChildren                   // Skip the node's children; the same as Continue for leaves
+	Stop                           // End the walk
+)
+
+// Visitor is called by Walk for each node of a script. The nodes are the
+// script's own, so a visitor may change them, but not add or remove any.
+type Visitor interface {
+	VisitKnot(knot *Knot) WalkAction
+	VisitTextBlock(block *TextBlock) WalkAction
+	VisitChoice(choice *Choice) WalkAction
+}
+
+// Walk traverses a script depth first, like go/ast.Walk: each knot, then its
+// text blocks and choices. Knots come in source order (by file, then line,
+// with knots that have no position sorted by name after the others), and
+// the blocks and choices of a knot in line order, blocks first when they
+// share a line. Every node has its line in its Line field, and a knot its
+// file in File.
+func Walk(ast *Script, v Visitor) {
+	for _, knot := range knotsInSourceOrder(ast) {
+		switch v.VisitKnot(knot) {
+		case Stop:
+			return
+		case SkipChildren:
+			continue
+		}
+		blocks, choices := 0, 0
+		for blocks < len(knot.Body) || choices < len(knot.Choices) {
+			var action WalkAction
+			if choices == len(knot.Choices) || blocks < len(knot.Body) && knot.Body[blocks].Line <= knot.Choices[choices].Line {
+				action = v.VisitTextBlock(&knot.Body[blocks])
+				blocks++
+			} else {
+				action = v.VisitChoice(&knot.Choices[choices])
+				choices++
+			}
+			if action == Stop {
+				return
+			}
+		}
+	}
+}
+
+// Inspect traverses a script in the order of Walk, calling f with each
+// *Knot, *TextBlock and *Choice, like go/ast.Inspect. If f returns false
+// for a knot, its blocks and choices are skipped. Unlike go/ast.Inspect, f
+// is not called with nil after a node's children.
+func Inspect(ast *Script, f func(node interface{}) bool) {
+	Walk(ast, inspector(f))
+}
+
+type inspector func(node interface{}) bool
+
+func (f inspector) VisitKnot(knot *Knot) WalkAction {
+	if !f(knot) {
+		return SkipChildren
+	}
+	return Continue
+}
+
+func (f inspector) VisitTextBlock(block *TextBlock) WalkAction {
+	f(block)
+	return Continue
+}
+
+func (f inspector) VisitChoice(choice *Choice) WalkAction {
+	f(choice)
+	return Continue
+}
+
+// knotsInSourceOrder returns the knots of s ordered by file and line, with
+// knots that have no line, such as those built in code, sorted by name after
+// the others.
+func knotsInSourceOrder(s *Script) []*Knot {
+	knots := make([]*Knot, 0, len(s.Knots))
+	for _, knot := range s.Knots {
+		knots = append(knots, knot)
+	}
+	sort.Slice(knots, func(i, j int) bool {
+		a, b := knots[i], knots[j]
+		if (a.Line == 0) != (b.Line == 0) {
+			return b.Line == 0
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Name < b.Name
+	})
+	return knots
+}
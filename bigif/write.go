@@ -0,0 +1,253 @@
+package bigif
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// WriteScript serializes a script AST as .biff source in canonical syntax,
+// so that parsing the result yields an equivalent script. It is meant for
+// scripts built in code that are then edited by hand.
+//
+// The header lists metadata in key order, then SCENES, DEFAULT-SCENE, the
+// state declarations grouped by kind, ENDINGS, TRACK-VISITS, TURNS and
+// STRICT. Knots follow in source order (file, then line), with knots that
+// have no line sorted by name after them. Comments, INCLUDE directives and
+// source positions are not kept, and knots from several namespaces are
+// written under their qualified names. Text that cannot be expressed in
+// .biff syntax, such as a choice whose text contains "->", is an error.
+func WriteScript(s *Script) (string, error) {
+	var b strings.Builder
+	var headerErr error
+	header := func(key, value string) {
+		if strings.ContainsAny(value, "\n\r") && headerErr == nil {
+			headerErr = fmt.Errorf("header '%s': value cannot span several lines", key)
+		}
+		fmt.Fprintf(&b, "// %s: %s\n", key, value)
+	}
+
+	keys := make([]string, 0, len(s.Metadata))
+	for key := range s.Metadata {
+		if key == "" || strings.ContainsAny(key, ":\n\r") || isKnownDirective(key) {
+			return "", fmt.Errorf("metadata key '%s' cannot be written as a header", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		header(key, s.Metadata[key])
+	}
+	for _, field := range []struct{ key, value string }{
+		{"title", s.Title}, {"author", s.Author}, {"language", s.Language}, {"ifid", s.IFID},
+	} {
+		if field.value == "" || hasKeyFold(s.Metadata, field.key) {
+			continue
+		}
+		header(field.key, field.value)
+	}
+
+	if len(s.Scenes) > 0 {
+		header("SCENES", strings.Join(s.Scenes, ", "))
+	}
+	if s.DefaultScene != "" {
+		header("DEFAULT-SCENE", s.DefaultScene)
+	}
+	for _, kind := range []StateKind{StateNormal, StateFlag, StateLocal, StateLocalFlag} {
+		if states := statesOfKind(s.States, kind); len(states) > 0 {
+			header(kind.String(), strings.Join(states, ", "))
+		}
+	}
+	scenes := make([]string, 0, len(s.SceneStates))
+	for scene := range s.SceneStates {
+		scenes = append(scenes, scene)
+	}
+	sort.Strings(scenes)
+	for _, scene := range scenes {
+		for _, kind := range []StateKind{StateLocal, StateLocalFlag} {
+			if states := statesOfKind(s.SceneStates[scene], kind); len(states) > 0 {
+				header(fmt.Sprintf("%s(%s)", kind, scene), strings.Join(states, ", "))
+			}
+		}
+	}
+	if len(s.Endings) > 0 {
+		header("ENDINGS", strings.Join(s.Endings, ", "))
+	}
+	if len(s.TrackVisits) > 0 {
+		header("TRACK-VISITS", strings.Join(s.TrackVisits, ", "))
+	}
+	if s.MaxTurns > 0 {
+		header("TURNS", fmt.Sprintf("max=%d", s.MaxTurns))
+	}
+	if s.Strict {
+		header("STRICT", "true")
+	}
+
+	knots := knotsInSourceOrder(s)
+
+	namespace := ""
+	if len(knots) > 0 {
+		namespace = knots[0].Namespace
+		for _, knot := range knots {
+			if knot.Namespace != namespace {
+				namespace = ""
+				break
+			}
+		}
+	}
+	if namespace != "" {
+		header("NAMESPACE", namespace)
+	}
+	if headerErr != nil {
+		return "", headerErr
+	}
+
+	for _, knot := range knots {
+		name := knot.Name
+		if namespace != "" {
+			name = strings.TrimPrefix(name, namespace+".")
+		}
+		if err := writeKnot(&b, s, knot, name); err != nil {
+			return "", fmt.Errorf("knot '%s': %w", knot.Name, err)
+		}
+	}
+	return b.String(), nil
+}
+
+// writeKnot writes one knot under the given name: its declaration and tags,
+// its scene, its assets, its body, its choices and its END marker.
+func writeKnot(b *strings.Builder, s *Script, knot *Knot, name string) error {
+	fmt.Fprintf(b, "\n=== %s ===", name)
+	tags := make([]string, 0, len(knot.Tags))
+	for key := range knot.Tags {
+		tags = append(tags, key)
+	}
+	sort.Strings(tags)
+	for _, key := range tags {
+		value := knot.Tags[key]
+		if strings.ContainsAny(value, " \t\n\r") {
+			return fmt.Errorf("tag '%s': value '%s' cannot contain whitespace", key, value)
+		}
+		if value == "" {
+			fmt.Fprintf(b, " #%s", key)
+		} else {
+			fmt.Fprintf(b, " #%s:%s", key, value)
+		}
+	}
+	b.WriteString("\n")
+	if knot.Scene != "" && knot.Scene != s.DefaultScene {
+		fmt.Fprintf(b, "// scene: %s\n", knot.Scene)
+	}
+	for _, asset := range knot.Assets {
+		if asset.Condition != "" {
+			fmt.Fprintf(b, "// %s {%s}: %s\n", asset.Kind, asset.Condition, asset.Path)
+		} else {
+			fmt.Fprintf(b, "// %s: %s\n", asset.Kind, asset.Path)
+		}
+	}
+
+	for i, block := range knot.Body {
+		lines := strings.Split(block.Content, "\n")
+		for j, line := range lines {
+			line = strings.TrimSpace(line)
+			if line != "" && j > 0 && startsSpecialLine(line) {
+				return fmt.Errorf("text line '%s' would be read as script syntax", line)
+			}
+			lines[j] = line
+		}
+		// The first block can start as plain prose; later ones, and any with a
+		// condition, need a "-" line so they are not merged into the one before.
+		if i == 0 && block.Condition == "" && block.Visit == AnyVisit && lines[0] != "" && !startsSpecialLine(lines[0]) {
+			b.WriteString(lines[0])
+		} else {
+			if strings.ContainsAny(lines[0], "{}") || strings.ContainsAny(block.Condition, "{}") {
+				return fmt.Errorf("text block '%s' cannot contain braces on its first line", lines[0])
+			}
+			b.WriteString("-" + block.Visit.marker())
+			if block.Condition != "" {
+				fmt.Fprintf(b, " {%s}", block.Condition)
+			}
+			if lines[0] != "" {
+				b.WriteString(" " + lines[0])
+			}
+		}
+		b.WriteString("\n")
+		for _, line := range lines[1:] {
+			b.WriteString(line + "\n")
+		}
+	}
+
+	for _, choice := range knot.Choices {
+		line, err := choiceLine(choice)
+		if err != nil {
+			return err
+		}
+		b.WriteString(line + "\n")
+	}
+	if knot.IsEnd {
+		if knot.EndingName != "" {
+			fmt.Fprintf(b, "END: %s\n", knot.EndingName)
+		} else {
+			b.WriteString("END\n")
+		}
+	}
+	return nil
+}
+
+// choiceLine formats a choice as "* {condition} Text ~ change -> target".
+func choiceLine(choice Choice) (string, error) {
+	for _, part := range append([]string{choice.Text, choice.Condition}, choice.StateChanges...) {
+		if strings.Contains(part, "->") || strings.ContainsAny(part, "~{}\n\r") {
+			return "", fmt.Errorf("'%s' cannot be written in a choice line: it contains '->', '~', braces or a line break", part)
+		}
+	}
+	parts := []string{"*"}
+	if choice.Condition != "" {
+		parts = append(parts, "{"+choice.Condition+"}")
+	}
+	if choice.Text != "" {
+		parts = append(parts, choice.Text)
+	}
+	for _, change := range choice.StateChanges {
+		parts = append(parts, "~ "+change)
+	}
+	switch {
+	case choice.Stitch != "":
+		parts = append(parts, "-> "+choice.Stitch)
+	case choice.TargetKnot != "":
+		parts = append(parts, "-> "+choice.TargetKnot)
+	}
+	if len(parts) == 1 {
+		return "", fmt.Errorf("a choice needs text, a state change or a target")
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// startsSpecialLine reports whether a trimmed line inside a knot would be
+// read as something other than prose.
+func startsSpecialLine(line string) bool {
+	return strings.HasPrefix(line, "*") || strings.HasPrefix(line, "-") || strings.HasPrefix(line, "//") ||
+		strings.HasPrefix(line, "==") || isEndLine(line)
+}
+
+// statesOfKind returns, in name order, the states of the given kind.
+func statesOfKind(states map[string]StateKind, kind StateKind) []string {
+	var names []string
+	for name, k := range states {
+		if k == kind {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hasKeyFold reports whether m has a key equal to key under case folding.
+func hasKeyFold(m map[string]string, key string) bool {
+	for k := range m {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package main
+
+import "github.com/verkaro/bigif/bigif"
+
+// compileError is one error of a failed compile, as the editor shows it.
+type compileError struct {
+	Line    int    `json:"line"`   // 1-based, 0 when the error has no single position
+	Column  int    `json:"column"` // 1-based, 0 when unknown
+	Message string `json:"message"`
+}
+
+// compileResult is what bigifCompile returns: the compiled JSON, or the
+// errors that stopped the compile.
+type compileResult struct {
+	JSON   string         `json:"json"`
+	Errors []compileError `json:"errors"`
+}
+
+// compile compiles a script for the editor. It is kept free of syscall/js
+// so it builds and can be tested on every platform.
+func compile(script string) compileResult {
+	output, err := bigif.Compile(script)
+	if err != nil {
+		result := compileResult{Errors: []compileError{}}
+		for _, d := range bigif.ErrorDiagnostics(err) {
+			result.Errors = append(result.Errors, compileError{Line: d.Line, Column: d.Column, Message: d.Message})
+		}
+		return result
+	}
+	return compileResult{JSON: string(output), Errors: []compileError{}}
+}
+
+// object converts the result into the plain values js.ValueOf accepts.
+func (r compileResult) object() map[string]interface{} {
+	errs := make([]interface{}, len(r.Errors))
+	for i, e := range r.Errors {
+		errs[i] = map[string]interface{}{"line": e.Line, "column": e.Column, "message": e.Message}
+	}
+	return map[string]interface{}{"json": r.JSON, "errors": errs}
+}
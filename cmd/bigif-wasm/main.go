@@ -0,0 +1,28 @@
+//go:build js && wasm
+
+// Command bigif-wasm exposes the BigIF compiler to JavaScript, so a web
+// editor can compile in the browser. Build it with
+//
+//	GOOS=js GOARCH=wasm go build -o bigif.wasm ./cmd/bigif-wasm
+//
+// and load it with the wasm_exec.js that ships with Go. It defines one
+// global function:
+//
+//	bigifCompile(script) -> {json, errors: [{line, column, message}]}
+//
+// json is the compiled story, empty when the script has errors; errors is
+// empty when it compiled.
+package main
+
+import "syscall/js"
+
+func main() {
+	js.Global().Set("bigifCompile", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) != 1 || args[0].Type() != js.TypeString {
+			return js.ValueOf(compileResult{Errors: []compileError{{Message: "bigifCompile takes one script string"}}}.object())
+		}
+		return js.ValueOf(compile(args[0].String()).object())
+	}))
+	// The function must outlive main, so main never returns.
+	select {}
+}
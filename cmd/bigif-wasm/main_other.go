@@ -0,0 +1,15 @@
+//go:build !(js && wasm)
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// main explains how to build the command on platforms other than js/wasm,
+// where it has nothing to do.
+func main() {
+	fmt.Fprintln(os.Stderr, "bigif-wasm: build with GOOS=js GOARCH=wasm and load it in a browser or Node")
+	os.Exit(2)
+}
@@ -0,0 +1,21 @@
+// Runs bigif.wasm under Node and compiles the scripts given as a JSON array
+// on stdin, printing the results as a JSON array.
+//
+//	node harness.js wasm_exec.js bigif.wasm < scripts.json
+"use strict";
+
+const fs = require("fs");
+require(process.argv[2]);
+
+const scripts = JSON.parse(fs.readFileSync(0, "utf8"));
+const go = new Go();
+WebAssembly.instantiate(fs.readFileSync(process.argv[3]), go.importObject).then(({ instance }) => {
+  go.run(instance);
+  const results = scripts.map((script) => globalThis.bigifCompile(script));
+  results.push(globalThis.bigifCompile(42));
+  process.stdout.write(JSON.stringify(results));
+  process.exit(0);
+}).catch((err) => {
+  console.error(err);
+  process.exit(1);
+});
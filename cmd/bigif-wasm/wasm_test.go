@@ -0,0 +1,89 @@
+//go:build !js
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/verkaro/bigif/bigif"
+)
+
+const goodScript = `=== index ===
+A door.
+* Open it. -> hall
+
+=== hall ===
+END
+`
+
+const badScript = `=== index ===
+A door.
+* Open it. -> nowhere
+`
+
+func TestCompile(t *testing.T) {
+	result := compile(goodScript)
+	assert.Empty(t, result.Errors)
+	_, err := bigif.LoadGraph([]byte(result.JSON))
+	require.NoError(t, err)
+
+	result = compile(badScript)
+	assert.Empty(t, result.JSON)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, 3, result.Errors[0].Line)
+	assert.Contains(t, result.Errors[0].Message, "nowhere")
+}
+
+// TestWasm builds the command for js/wasm and runs it under Node, the way a
+// browser would load it.
+func TestWasm(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds for js/wasm")
+	}
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	goroot, err := exec.Command("go", "env", "GOROOT").Output()
+	require.NoError(t, err)
+	var wasmExec string
+	for _, dir := range []string{"lib/wasm", "misc/wasm"} {
+		path := filepath.Join(strings.TrimSpace(string(goroot)), dir, "wasm_exec.js")
+		if _, err := os.Stat(path); err == nil {
+			wasmExec = path
+			break
+		}
+	}
+	if wasmExec == "" {
+		t.Skip("wasm_exec.js not found in GOROOT")
+	}
+
+	wasm := filepath.Join(t.TempDir(), "bigif.wasm")
+	build := exec.Command("go", "build", "-o", wasm, ".")
+	build.Env = append(os.Environ(), "GOOS=js", "GOARCH=wasm")
+	out, err := build.CombinedOutput()
+	require.NoError(t, err, "%s", out)
+
+	scripts, err := json.Marshal([]string{goodScript, badScript})
+	require.NoError(t, err)
+	run := exec.Command(node, filepath.Join("testdata", "harness.js"), wasmExec, wasm)
+	run.Stdin = strings.NewReader(string(scripts))
+	run.Stderr = os.Stderr
+	out, err = run.Output()
+	require.NoError(t, err)
+
+	var results []compileResult
+	require.NoError(t, json.Unmarshal(out, &results))
+	require.Len(t, results, 3)
+	assert.Equal(t, compile(goodScript), results[0])
+	assert.Equal(t, compile(badScript), results[1])
+	require.Len(t, results[2].Errors, 1, "a non-string argument is an error")
+	assert.Empty(t, results[2].JSON)
+}
@@ -0,0 +1,327 @@
+// Command bigif compiles and plays BigIF scripts.
+//
+//	bigif compile story.biff
+//	bigif play [--start-node knot] [--transcript out.json] story.biff
+//	bigif export --html [--css style.css] [--debug] story.biff
+//	bigif export --gamebook [--shuffle] [--seed n] story.biff
+//	bigif gen-go [--package name] story.biff
+//	bigif rename knot|state [-w] old new story.biff
+//	bigif strip [--dry-run] story.biff
+//	bigif merge part1.biff part2.biff...
+//	bigif todos [--fail-on FIXME,TODO] story.biff
+//
+// compile prints the story graph as JSON. play runs the story in the
+// terminal: type the number of a choice, back to take one back, or quit.
+// export --html prints a self-contained web page that plays the story, and
+// export --gamebook a numbered-section gamebook in Markdown. gen-go prints a
+// Go file of constants for the story's knots, states, scenes and endings.
+// rename renames a knot or state everywhere it is referenced and prints the
+// edited script, or with -w writes it back to the file. strip prints the
+// script without its unreachable knots and never-shown text blocks, and lists
+// what it removed on standard error; --dry-run prints only the list. merge
+// prints the scripts combined into one, reporting conflicting knots, states
+// and metadata on standard error. todos lists the script's TODO, FIXME and
+// NOTE comments and, with --fail-on, fails if any of the given kinds is left.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/verkaro/bigif/bigif"
+)
+
+const usage = `usage:
+  bigif compile story.biff
+  bigif play [--start-node knot] [--transcript out.json] story.biff
+  bigif export --html [--css style.css] [--debug] story.biff
+  bigif export --gamebook [--shuffle] [--seed n] story.biff
+  bigif gen-go [--package name] story.biff
+  bigif rename knot|state [-w] old new story.biff
+  bigif strip [--dry-run] story.biff
+  bigif merge part1.biff part2.biff...
+  bigif todos [--fail-on FIXME,TODO] story.biff
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "compile":
+		err = compile(os.Args[2:])
+	case "play":
+		err = play(os.Args[2:])
+	case "export":
+		err = export(os.Args[2:])
+	case "gen-go":
+		err = genGo(os.Args[2:])
+	case "rename":
+		err = rename(os.Args[2:])
+	case "strip":
+		err = strip(os.Args[2:])
+	case "merge":
+		err = merge(os.Args[2:])
+	case "todos":
+		err = todos(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if errors.Is(err, context.Canceled) {
+		os.Exit(130)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bigif:", err)
+		os.Exit(1)
+	}
+}
+
+func compile(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("compile takes one script file")
+	}
+	output, err := bigif.CompileFile(args[0])
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(string(output))
+	return err
+}
+
+func play(args []string) error {
+	flags := flag.NewFlagSet("play", flag.ExitOnError)
+	startKnot := flags.String("start-node", "", "start at this knot, with every state false")
+	transcriptPath := flags.String("transcript", "", "write a JSON transcript of the run to this file")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("play takes one script file")
+	}
+
+	output, err := bigif.CompileFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	graph, err := bigif.LoadGraph(output)
+	if err != nil {
+		return err
+	}
+	session := bigif.NewSession(graph)
+	if *startKnot != "" {
+		nodeID, err := bigif.NodeForKnot(graph, *startKnot)
+		if err != nil {
+			return err
+		}
+		if session, err = bigif.NewSessionAt(graph, nodeID); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	transcript, playErr := bigif.Play(ctx, session, os.Stdin, os.Stdout)
+	if *transcriptPath != "" {
+		data, err := json.MarshalIndent(transcript, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(*transcriptPath, append(data, '\n'), 0o644); err != nil {
+			return err
+		}
+	}
+	return playErr
+}
+
+func export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	html := flags.Bool("html", false, "export a self-contained HTML player")
+	cssPath := flags.String("css", "", "add the stylesheet in this file to the HTML player")
+	debug := flags.Bool("debug", false, "show the current node ID and state in the HTML player")
+	gamebook := flags.Bool("gamebook", false, "export a numbered-section gamebook in Markdown")
+	shuffle := flags.Bool("shuffle", false, "number gamebook sections at random")
+	seed := flags.Int64("seed", 0, "seed for --shuffle")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("export takes one script file")
+	}
+	if *html == *gamebook {
+		return fmt.Errorf("export needs one format: --html or --gamebook")
+	}
+
+	output, err := bigif.CompileFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	graph, err := bigif.LoadGraph(output)
+	if err != nil {
+		return err
+	}
+	var exported []byte
+	if *gamebook {
+		exported, err = bigif.ExportGamebook(graph, bigif.GamebookOptions{Shuffle: *shuffle, Seed: *seed})
+	} else {
+		opts := bigif.HTMLOptions{Debug: *debug}
+		if *cssPath != "" {
+			css, err := os.ReadFile(*cssPath)
+			if err != nil {
+				return err
+			}
+			opts.CSS = string(css)
+		}
+		exported, err = bigif.ExportHTML(graph, opts)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(exported)
+	return err
+}
+
+func genGo(args []string) error {
+	flags := flag.NewFlagSet("gen-go", flag.ExitOnError)
+	pkg := flags.String("package", "story", "package name of the generated file")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("gen-go takes one script file")
+	}
+	ast, err := bigif.ParseFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	source, err := bigif.GenerateGoConstants(ast, *pkg)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(source)
+	return err
+}
+
+func rename(args []string) error {
+	if len(args) == 0 || args[0] != "knot" && args[0] != "state" {
+		return fmt.Errorf("rename takes knot or state")
+	}
+	kind := args[0]
+	flags := flag.NewFlagSet("rename "+kind, flag.ExitOnError)
+	write := flags.Bool("w", false, "write the result back to the script file instead of printing it")
+	flags.Parse(args[1:])
+	if flags.NArg() != 3 {
+		return fmt.Errorf("rename %s takes the old name, the new name and one script file", kind)
+	}
+	old, new, path := flags.Arg(0), flags.Arg(1), flags.Arg(2)
+	script, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var renamed string
+	if kind == "knot" {
+		renamed, err = bigif.RenameKnot(string(script), old, new)
+	} else {
+		renamed, err = bigif.RenameState(string(script), old, new)
+	}
+	if err != nil {
+		return err
+	}
+	if *write {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, []byte(renamed), info.Mode().Perm())
+	}
+	_, err = fmt.Print(renamed)
+	return err
+}
+
+func strip(args []string) error {
+	flags := flag.NewFlagSet("strip", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only list what would be removed")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("strip takes one script file")
+	}
+	script, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	stripped, report, err := bigif.StripUnreachable(string(script))
+	if err != nil {
+		return err
+	}
+	out := os.Stderr
+	if *dryRun {
+		out = os.Stdout
+	}
+	for _, section := range report.Removed {
+		fmt.Fprintln(out, section)
+	}
+	if *dryRun {
+		return nil
+	}
+	_, err = fmt.Print(stripped)
+	return err
+}
+
+func merge(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("merge takes one or more script files")
+	}
+	scripts := make([]bigif.NamedScript, len(args))
+	for i, path := range args {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		scripts[i] = bigif.NamedScript{Name: path, Source: string(source)}
+	}
+	merged, diagnostics, err := bigif.MergeScripts(scripts...)
+	for _, d := range diagnostics {
+		fmt.Fprintln(os.Stderr, d)
+	}
+	if err != nil {
+		return fmt.Errorf("%d scripts could not be merged", len(args))
+	}
+	_, err = fmt.Print(merged)
+	return err
+}
+
+func todos(args []string) error {
+	flags := flag.NewFlagSet("todos", flag.ExitOnError)
+	failOn := flags.String("fail-on", "", "comma-separated note kinds that make the command fail, e.g. FIXME")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("todos takes one script file")
+	}
+	ast, err := bigif.ParseFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	failing := make(map[string]bool)
+	for _, kind := range strings.Split(*failOn, ",") {
+		if kind = strings.TrimSpace(kind); kind != "" {
+			failing[strings.ToUpper(kind)] = true
+		}
+	}
+	found := 0
+	for _, note := range ast.Notes {
+		where := fmt.Sprintf("%s:%d", note.File, note.Line)
+		if note.Knot != "" {
+			where += " (" + note.Knot + ")"
+		}
+		fmt.Printf("%s: %s: %s\n", where, note.Kind, note.Text)
+		if failing[note.Kind] {
+			found++
+		}
+	}
+	if found > 0 {
+		return fmt.Errorf("%d notes left of kinds %s", found, *failOn)
+	}
+	return nil
+}